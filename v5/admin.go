@@ -0,0 +1,80 @@
+package dohProxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+)
+
+// NewAdminHandler returns the http handler of the admin api:
+//
+//	GET /cache                   dump the cache entries as json
+//	DELETE /cache                flush the cache
+//	DELETE /cache?name=NAME      purge the entries of NAME
+//	GET /healthz                 200 if the process is alive
+//	GET /readyz                  200 if upstream answered once and the recent
+//	                             success rate isn't below the threshold
+//	GET /stats                   counters of queries, cache hits and upstream
+//	                             queries as json
+//	GET /upstreams               state of the upstream endpoints as json
+func NewAdminHandler(handler *Handler) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		minSuccessRate := handler.options.ReadyMinSuccessRate
+		if ready, reason := upstreamHealth.Ready(minSuccessRate); !ready {
+			http.Error(w, reason, http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		writeAdminJSON(w, queryStats.Snapshot())
+	})
+	mux.HandleFunc("/upstreams", func(w http.ResponseWriter, r *http.Request) {
+		ref := handler.provider.Load().(*providerRef)
+		p, ok := ref.Provider.(UpstreamStatuser)
+		if !ok {
+			http.Error(w, "upstream state is not available", http.StatusNotFound)
+			return
+		}
+		writeAdminJSON(w, p.UpstreamStatuses())
+	})
+	mux.HandleFunc("/cache", func(w http.ResponseWriter, r *http.Request) {
+		if handler.cache == nil {
+			http.Error(w, "cache is disabled", http.StatusNotFound)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			entries := handler.cache.Entries()
+			sort.Slice(entries, func(i, j int) bool {
+				if entries[i].Name != entries[j].Name {
+					return entries[i].Name < entries[j].Name
+				}
+				return entries[i].Type < entries[j].Type
+			})
+			writeAdminJSON(w, entries)
+		case http.MethodDelete:
+			if name := r.URL.Query().Get("name"); name != "" {
+				writeAdminJSON(w, map[string]int{"purged": handler.cache.Purge(name)})
+				return
+			}
+			handler.cache.Flush()
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.Header().Set("Allow", "GET, DELETE")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	return mux
+}
+
+func writeAdminJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		Log.Errorf("write admin response error: %v", err)
+	}
+}
@@ -0,0 +1,190 @@
+package dohProxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func newAdminTestHandler() *Handler {
+	handler := NewHandler(&testProvider{name: "upstream"}, &HandlerOptions{Cache: true})
+	handler.cache.realInsert(newTestAnswer("a.example.com", dns.TypeA, 300, "93.184.216.34"))
+	handler.cache.realInsert(newTestAnswer("a.example.com", dns.TypeAAAA, 300, "2606:2800:220:1::1"))
+	handler.cache.realInsert(newTestAnswer("b.example.com", dns.TypeA, 60, "93.184.216.35"))
+	return handler
+}
+
+func adminRequest(handler *Handler, method string, target string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, nil)
+	rec := httptest.NewRecorder()
+	NewAdminHandler(handler).ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAdmin_GetCache(t *testing.T) {
+	handler := newAdminTestHandler()
+	rec := adminRequest(handler, http.MethodGet, "/cache")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status: %v", rec.Code)
+	}
+	var entries []CacheEntryInfo
+	if err := json.Unmarshal(rec.Body.Bytes(), &entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 entries, got: %v", entries)
+	}
+	if e := entries[2]; e.Name != "b.example.com." || e.Type != "A" || e.Rcode != "NOERROR" ||
+		e.TTL <= 0 || e.TTL > 60 {
+		t.Errorf("unexpected entry: %+v", e)
+	}
+}
+
+func TestAdmin_FlushCache(t *testing.T) {
+	handler := newAdminTestHandler()
+	rec := adminRequest(handler, http.MethodDelete, "/cache")
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("unexpected status: %v", rec.Code)
+	}
+	if entries := handler.cache.Entries(); len(entries) != 0 {
+		t.Errorf("cache should be flushed, got: %v", entries)
+	}
+}
+
+func TestAdmin_PurgeCache(t *testing.T) {
+	handler := newAdminTestHandler()
+	rec := adminRequest(handler, http.MethodDelete, "/cache?name=A.example.com")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status: %v", rec.Code)
+	}
+	var result map[string]int
+	if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	if result["purged"] != 2 {
+		t.Errorf("expected 2 entries purged, got: %v", result)
+	}
+	entries := handler.cache.Entries()
+	if len(entries) != 1 || entries[0].Name != "b.example.com." {
+		t.Errorf("only b.example.com. should be left, got: %v", entries)
+	}
+}
+
+func TestAdmin_MethodNotAllowed(t *testing.T) {
+	handler := newAdminTestHandler()
+	if rec := adminRequest(handler, http.MethodPost, "/cache"); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("unexpected status: %v", rec.Code)
+	}
+}
+
+func TestAdmin_CacheDisabled(t *testing.T) {
+	handler := NewHandler(&testProvider{name: "upstream"}, &HandlerOptions{})
+	if rec := adminRequest(handler, http.MethodGet, "/cache"); rec.Code != http.StatusNotFound {
+		t.Errorf("unexpected status: %v", rec.Code)
+	}
+}
+
+func TestAdmin_Stats(t *testing.T) {
+	saved := queryStats
+	defer func() { queryStats = saved }()
+	queryStats = newStats()
+
+	stub := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		rr, _ := dns.NewRR(r.Question[0].Name + " 300 IN A 93.184.216.34")
+		m.Answer = append(m.Answer, rr)
+		_ = w.WriteMsg(m)
+	})
+	provider, err := NewPlainProvider([]string{startPlainTestServer(t, stub)}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := NewHandler(provider, &HandlerOptions{Cache: true})
+	msg := new(dns.Msg)
+	msg.SetQuestion("stats.example.com.", dns.TypeA)
+	handler.Handle(newTestResponseWriter("127.0.0.1:5353"), msg)
+	// the answer is inserted into cache asynchronously.
+	for deadline := time.Now().Add(time.Second); handler.cache.Get(msg) == nil; {
+		if time.Now().After(deadline) {
+			t.Fatalf("answer should be cached")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	writer := newTestResponseWriter("127.0.0.1:5353")
+	handler.Handle(writer, msg)
+	writer.waitMsg(t, time.Second)
+
+	rec := adminRequest(handler, http.MethodGet, "/stats")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status: %v", rec.Code)
+	}
+	var stats map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &stats); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]float64{"queries": 2, "cache_hits": 1, "cache_hit_ratio": 0.5,
+		"upstream_queries": 1, "upstream_errors": 0}
+	for key, value := range expected {
+		if stats[key] != value {
+			t.Errorf("expected %v of %v, got: %v", key, value, stats[key])
+		}
+	}
+	for _, key := range []string{"avg_upstream_latency_ms", "uptime_seconds"} {
+		if v, ok := stats[key].(float64); !ok || v <= 0 {
+			t.Errorf("expected positive %v, got: %v", key, stats[key])
+		}
+	}
+}
+
+func TestAdmin_Upstreams(t *testing.T) {
+	var hitsBad, hitsGood int32
+	tsBad := newDoHTestServer(t, http.StatusInternalServerError, dns.RcodeSuccess, &hitsBad)
+	defer tsBad.Close()
+	tsGood := newDoHTestServer(t, http.StatusOK, dns.RcodeSuccess, &hitsGood)
+	defer tsGood.Close()
+
+	provider, err := NewDMProvider([]string{tsBad.URL, tsGood.URL}, &DMProviderOptions{
+		EDNSSubnet:       "no",
+		BreakerThreshold: maxConsecutiveFailures,
+		BreakerCooldown:  time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < maxConsecutiveFailures; i++ {
+		msg := new(dns.Msg)
+		msg.SetQuestion("upstreams.example.com.", dns.TypeA)
+		if _, err := provider.Query(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rec := adminRequest(NewHandler(provider, &HandlerOptions{}), http.MethodGet, "/upstreams")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status: %v", rec.Code)
+	}
+	var statuses []UpstreamStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &statuses); err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) != 2 {
+		t.Fatalf("expected 2 endpoints, got: %v", statuses)
+	}
+	if s := statuses[0]; s.Endpoint != tsBad.URL || s.Healthy || s.ConsecutiveFailures != maxConsecutiveFailures ||
+		s.Breaker != "open" || s.LastSuccess != nil {
+		t.Errorf("first endpoint should be unhealthy, got: %+v", s)
+	}
+	if s := statuses[1]; s.Endpoint != tsGood.URL || !s.Healthy || s.ConsecutiveFailures != 0 ||
+		s.Breaker != "closed" || s.LastSuccess == nil || s.LatencyMs <= 0 {
+		t.Errorf("second endpoint should be healthy, got: %+v", s)
+	}
+
+	if rec := adminRequest(newAdminTestHandler(), http.MethodGet, "/upstreams"); rec.Code != http.StatusNotFound {
+		t.Errorf("provider without upstream state should be 404, got: %v", rec.Code)
+	}
+}
@@ -0,0 +1,195 @@
+package dohProxy
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// BlocklistResponseNXDomain answers blocked names with NXDOMAIN, the
+	// default; otherwise blocked names are answered with a sinkhole ip.
+	BlocklistResponseNXDomain = "nxdomain"
+
+	// ttl of the answers to blocked names.
+	blockedTTL = 60
+)
+
+// names in hosts-format blocklists which shouldn't be blocked.
+var blocklistIgnoredNames = map[string]bool{
+	"localhost.":             true,
+	"localhost.localdomain.": true,
+	"local.":                 true,
+	"broadcasthost.":         true,
+	"ip6-localhost.":         true,
+	"ip6-loopback.":          true,
+	"0.0.0.0.":               true,
+}
+
+// Blocklist holds the blocked names, lookups are done label by label in maps
+// so the cost doesn't grow with the size of the list.
+type Blocklist struct {
+	// exact names, in canonical form.
+	names map[string]bool
+	// names of "*.example.com" entries, subdomains of them are blocked.
+	suffixes map[string]bool
+}
+
+// LoadBlocklist reads a blocklist file, either in hosts format
+// ("0.0.0.0 ads.example.com") or one name per line; names like
+// "*.example.com" block all subdomains of example.com.
+func LoadBlocklist(path string) (*Blocklist, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open blocklist %v error: %v", path, err)
+	}
+	defer func() { _ = f.Close() }()
+
+	blocklist := &Blocklist{names: make(map[string]bool), suffixes: make(map[string]bool)}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			// Discard comments.
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if net.ParseIP(fields[0]) != nil {
+			fields = fields[1:]
+		}
+		for _, name := range fields {
+			blocklist.add(name)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read blocklist %v error: %v", path, err)
+	}
+	return blocklist, nil
+}
+
+func (b *Blocklist) add(name string) {
+	wildcard := strings.HasPrefix(name, "*.")
+	name = dns.CanonicalName(strings.TrimPrefix(name, "*."))
+	if blocklistIgnoredNames[name] {
+		return
+	}
+	if _, ok := dns.IsDomainName(name); !ok {
+		Log.Debugf("ignore invalid name in blocklist: %v", name)
+		return
+	}
+	if wildcard {
+		b.suffixes[name] = true
+	} else {
+		b.names[name] = true
+	}
+}
+
+// Len returns the number of entries.
+func (b *Blocklist) Len() int {
+	return len(b.names) + len(b.suffixes)
+}
+
+// diff returns the number of entries added and removed comparing to old.
+func (b *Blocklist) diff(old *Blocklist) (added int, removed int) {
+	if old == nil {
+		return b.Len(), 0
+	}
+	count := func(from, to map[string]bool) (n int) {
+		for name := range from {
+			if !to[name] {
+				n++
+			}
+		}
+		return
+	}
+	added = count(b.names, old.names) + count(b.suffixes, old.suffixes)
+	removed = count(old.names, b.names) + count(old.suffixes, b.suffixes)
+	return
+}
+
+// Match reports whether name is blocked.
+func (b *Blocklist) Match(name string) bool {
+	name = dns.CanonicalName(name)
+	if b.names[name] {
+		return true
+	}
+	// parent domains of name, excluding name itself.
+	for off, end := dns.NextLabel(name, 0); !end; off, end = dns.NextLabel(name, off) {
+		if b.suffixes[name[off:]] {
+			return true
+		}
+	}
+	return false
+}
+
+// blockedReply builds the answer to the blocked msg, sinkhole is nil for
+// NXDOMAIN answers.
+func blockedReply(msg *dns.Msg, sinkhole net.IP) *dns.Msg {
+	rMsg := new(dns.Msg)
+	if sinkhole == nil {
+		rMsg.SetRcode(msg, dns.RcodeNameError)
+		return rMsg
+	}
+	rMsg.SetReply(msg)
+
+	q := msg.Question[0]
+	ip := sinkholeIP(q.Qtype, sinkhole)
+	if ip == nil {
+		// no data for other types.
+		return rMsg
+	}
+	rr := genAnswerFromIP(q.Qtype, q.Name, ip)
+	rr.Header().Ttl = blockedTTL
+	rMsg.Answer = append(rMsg.Answer, rr)
+	return rMsg
+}
+
+// blockedCNAMEReply answers the blocked A and AAAA queries of msg with a
+// CNAME to the sinkhole host cname and its address record, the sinkhole ip or
+// the unspecified address if nil; other queries are answered by blockedReply.
+func blockedCNAMEReply(msg *dns.Msg, sinkhole net.IP, cname string) *dns.Msg {
+	q := msg.Question[0]
+	if q.Qtype != dns.TypeA && q.Qtype != dns.TypeAAAA {
+		return blockedReply(msg, sinkhole)
+	}
+	if sinkhole == nil {
+		sinkhole = net.IPv4zero
+		if q.Qtype == dns.TypeAAAA {
+			sinkhole = net.IPv6zero
+		}
+	}
+	rMsg := new(dns.Msg)
+	rMsg.SetReply(msg)
+	cname = dns.Fqdn(cname)
+	rr := genAnswerFromIP(q.Qtype, cname, sinkholeIP(q.Qtype, sinkhole))
+	rr.Header().Ttl = blockedTTL
+	rMsg.Answer = append(rMsg.Answer, &dns.CNAME{
+		Hdr:    dns.RR_Header{Name: q.Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: blockedTTL},
+		Target: cname,
+	}, rr)
+	return rMsg
+}
+
+// sinkholeIP returns the address answered to blocked queries of qtype, the
+// unspecified address if sinkhole is of the other family; nil for types other
+// than A and AAAA.
+func sinkholeIP(qtype uint16, sinkhole net.IP) net.IP {
+	switch {
+	case qtype == dns.TypeA && sinkhole.To4() != nil:
+		return sinkhole.To4()
+	case qtype == dns.TypeA:
+		return net.IPv4zero
+	case qtype == dns.TypeAAAA && sinkhole.To4() == nil:
+		return sinkhole
+	case qtype == dns.TypeAAAA:
+		return net.IPv6zero
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package dohProxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const sampleBlocklist = `# hosts format
+127.0.0.1 localhost
+0.0.0.0 ads.example.com tracker.example.com
+0.0.0.0 Mixed.Example.ORG   # comment
+*.doubleclick.net
+plain.example.net
+`
+
+func TestBlocklist_Match(t *testing.T) {
+	blocklist, err := LoadBlocklist(writeTestConfig(t, sampleBlocklist))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blocklist.Len() != 5 {
+		t.Errorf("expected 5 entries, got: %v", blocklist.Len())
+	}
+	cases := map[string]bool{
+		"ads.example.com.":         true,
+		"tracker.example.com":      true,
+		"mixed.example.org.":       true,
+		"ad.g.doubleclick.net.":    true,
+		"doubleclick.net.":         false,
+		"plain.example.net.":       true,
+		"sub.plain.example.net.":   false,
+		"example.com.":             false,
+		"localhost.":               false,
+		"notdoubleclick.net.":      false,
+		"ads.example.com.evil.io.": false,
+	}
+	for name, blocked := range cases {
+		if blocklist.Match(name) != blocked {
+			t.Errorf("match %v: expected %v", name, blocked)
+		}
+	}
+}
+
+func TestBlockedReply(t *testing.T) {
+	msg := new(dns.Msg)
+	msg.SetQuestion("ads.example.com.", dns.TypeA)
+	if rMsg := blockedReply(msg, nil); rMsg.Rcode != dns.RcodeNameError {
+		t.Errorf("expected NXDOMAIN, got: %v", rMsg)
+	}
+
+	rMsg := blockedReply(msg, net.ParseIP("0.0.0.0"))
+	if a, ok := rMsg.Answer[0].(*dns.A); !ok || !a.A.Equal(net.IPv4zero) {
+		t.Errorf("expected sinkhole answer, got: %v", rMsg)
+	}
+	msg.SetQuestion("ads.example.com.", dns.TypeAAAA)
+	rMsg = blockedReply(msg, net.ParseIP("0.0.0.0"))
+	if aaaa, ok := rMsg.Answer[0].(*dns.AAAA); !ok || !aaaa.AAAA.Equal(net.IPv6zero) {
+		t.Errorf("expected sinkhole answer, got: %v", rMsg)
+	}
+	msg.SetQuestion("ads.example.com.", dns.TypeMX)
+	if rMsg = blockedReply(msg, net.ParseIP("0.0.0.0")); rMsg.Rcode != dns.RcodeSuccess || len(rMsg.Answer) != 0 {
+		t.Errorf("expected no data answer, got: %v", rMsg)
+	}
+}
+
+func BenchmarkBlocklist_Match(b *testing.B) {
+	blocklist := &Blocklist{names: make(map[string]bool), suffixes: make(map[string]bool)}
+	for i := 0; i < 1000000; i++ {
+		blocklist.add(fmt.Sprintf("ads%d.example.com", i))
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		blocklist.Match("www.not-blocked.example.org.")
+	}
+}
+
+func TestBlocklistWatcher(t *testing.T) {
+	path := writeTestConfig(t, "0.0.0.0 old.example.com\n")
+	blocklist, err := LoadBlocklist(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := NewHandler(&testProvider{name: "upstream"}, &HandlerOptions{Blocklist: blocklist})
+	watcher, err := NewBlocklistWatcher(path, handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = watcher.Close() }()
+
+	if err := ioutil.WriteFile(path, []byte("0.0.0.0 old.example.com new.example.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for !handler.currentBlocklist().Match("new.example.com.") {
+		if time.Now().After(deadline) {
+			t.Fatal("newly added name should be blocked within a second")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// unreadable file keeps the old list.
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * blocklistReloadDelay)
+	if !handler.currentBlocklist().Match("new.example.com.") {
+		t.Errorf("old blocklist should stay active if the file is unreadable")
+	}
+}
@@ -0,0 +1,91 @@
+package dohProxy
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// the file is reloaded after no more changes in this duration, scripts
+// rewriting the file may trigger several events.
+const blocklistReloadDelay = 200 * time.Millisecond
+
+// BlocklistWatcher watches the blocklist file and swaps the reloaded list into
+// the handler, the old list is kept if the new file can't be loaded.
+type BlocklistWatcher struct {
+	path    string
+	handler *Handler
+	watcher *fsnotify.Watcher
+	done    chan bool
+}
+
+// NewBlocklistWatcher starts watching the blocklist file at path.
+func NewBlocklistWatcher(path string, handler *Handler) (*BlocklistWatcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	// watch the directory, files replaced by renaming aren't tracked otherwise.
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		_ = watcher.Close()
+		return nil, err
+	}
+	w := &BlocklistWatcher{
+		path:    filepath.Clean(path),
+		handler: handler,
+		watcher: watcher,
+		done:    make(chan bool),
+	}
+	go w.run()
+	return w, nil
+}
+
+// Close stops watching.
+func (w *BlocklistWatcher) Close() error {
+	close(w.done)
+	return w.watcher.Close()
+}
+
+func (w *BlocklistWatcher) run() {
+	var reload <-chan time.Time
+	for {
+		select {
+		case <-w.done:
+			return
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			if filepath.Clean(event.Name) != w.path || event.Op == fsnotify.Chmod {
+				continue
+			}
+			Log.Debugf("blocklist file changed: %v", event)
+			reload = time.After(blocklistReloadDelay)
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			Log.Errorf("watch blocklist error: %v", err)
+		case <-reload:
+			reload = nil
+			w.reload()
+		}
+	}
+}
+
+func (w *BlocklistWatcher) reload() {
+	blocklist, err := LoadBlocklist(w.path)
+	if err != nil {
+		Log.Errorf("reload blocklist failed, keep using the old one: %v", err)
+		return
+	}
+	old := w.handler.currentBlocklist()
+	if blocklist.Len() == 0 && old != nil && old.Len() > 0 {
+		Log.Errorf("reloaded blocklist %v is empty, keep using the old one", w.path)
+		return
+	}
+	added, removed := blocklist.diff(old)
+	w.handler.SwapBlocklist(blocklist)
+	Log.Infof("blocklist reloaded, %v entries, %v added, %v removed", blocklist.Len(), added, removed)
+}
@@ -0,0 +1,47 @@
+package dohProxy
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+var (
+	// errCACertNotFound is returned if the CA certificate file doesn't exist.
+	errCACertNotFound = errors.New("CA certificate file not found")
+	// errCACertInvalidPEM is returned if the file has no PEM block.
+	errCACertInvalidPEM = errors.New("CA certificate file is not a valid PEM")
+	// errCACertNoCertificates is returned if no certificate could be parsed
+	// from the PEM blocks of the file.
+	errCACertNoCertificates = errors.New("no certificates parsed from CA certificate file")
+)
+
+// loadCACertPool returns the pool of the certificates in the PEM file at path,
+// appended to the system pool if appendSystem.
+func loadCACertPool(path string, appendSystem bool) (*x509.CertPool, error) {
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: %v", errCACertNotFound, path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read CA certificate file %v error: %v", path, err)
+	}
+	if block, _ := pem.Decode(content); block == nil {
+		return nil, fmt.Errorf("%w: %v", errCACertInvalidPEM, path)
+	}
+
+	pool := x509.NewCertPool()
+	if appendSystem {
+		if pool, err = x509.SystemCertPool(); err != nil {
+			upstreamLog.Warnf("load system certificates error, using %v only: %v", path, err)
+			pool = x509.NewCertPool()
+		}
+	}
+	if !pool.AppendCertsFromPEM(content) {
+		return nil, fmt.Errorf("%w: %v", errCACertNoCertificates, path)
+	}
+	return pool, nil
+}
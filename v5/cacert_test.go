@@ -0,0 +1,50 @@
+package dohProxy
+
+import (
+	"crypto/x509"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewDMProvider_CACert(t *testing.T) {
+	_, caFile := newTestCert(t, "doh.test")
+	for _, c := range []struct {
+		path string
+		err  error
+	}{
+		{filepath.Join(filepath.Dir(caFile), "missing.pem"), errCACertNotFound},
+		{writeTestConfig(t, "not a certificate\n"), errCACertInvalidPEM},
+		{writeTestConfig(t, "-----BEGIN CERTIFICATE-----\nbm90IGEgY2VydGlmaWNhdGU=\n-----END CERTIFICATE-----\n"),
+			errCACertNoCertificates},
+		{caFile, nil},
+	} {
+		_, err := NewDMProvider([]string{"https://doh.test/dns-query"},
+			&DMProviderOptions{CACertFilePath: c.path, EDNSSubnet: "no"})
+		if !errors.Is(err, c.err) {
+			t.Errorf("%v: expected error %v, got: %v", c.path, c.err, err)
+		}
+	}
+}
+
+func TestLoadCACertPool_AppendSystem(t *testing.T) {
+	_, caFile := newTestCert(t, "doh.test")
+	system, err := x509.SystemCertPool()
+	if err != nil {
+		t.Skipf("no system certificates: %v", err)
+	}
+	pool, err := loadCACertPool(caFile, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pool.Subjects()) != len(system.Subjects())+1 {
+		t.Errorf("expected %v system certificates and the custom one, got: %v",
+			len(system.Subjects()), len(pool.Subjects()))
+	}
+	if pool, err = loadCACertPool(caFile, false); err != nil {
+		t.Fatal(err)
+	}
+	if len(pool.Subjects()) != 1 {
+		t.Errorf("expected the custom certificate only, got: %v", len(pool.Subjects()))
+	}
+}
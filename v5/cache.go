@@ -1,10 +1,15 @@
 package dohProxy
 
 import (
+	"container/list"
 	"fmt"
 	rbt "github.com/emirpasic/gods/trees/redblacktree"
 	"github.com/miekg/dns"
+	"math/rand"
+	"net"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -23,35 +28,119 @@ const (
 	// Name   string
 	// Qtype  uint16
 	// Qclass uint16
-	queryFormatString string = "[OPCODE:%v][TC:%v][RD:%v][Z:%v][CD:%v][QName:%v]" +
-		"[QType:%v][QClass:%v][EDNS0Subnet:%v]"
+	queryFormatString string = "[OPCODE:%v][TC:%v][RD:%v][Z:%v][CD:%v]%v" +
+		"[EDNS0Subnet:%v][DO:%v][Group:%v]"
+	questionFormatString string = "[QName:%v][QType:%v][QClass:%v]"
+
+	// entries are prefetched in the last 1/prefetchTTLDivisor of their ttl.
+	prefetchTTLDivisor = 10
+
+	// ttl of stale answers, RFC 8767 section 4.
+	staleAnswerTTL = 30
+
+	// DefaultCacheMaxEntries is the max number of cache entries if not
+	// specified.
+	DefaultCacheMaxEntries = 100000
+
+	// the recorded scopes of edns0-client-subnet are reset beyond this many,
+	// they are recorded again on inserting.
+	maxECSScopes = 100000
 )
 
+// CacheOptions specifies options of the cache.
+type CacheOptions struct {
+	// ttl of cache entry is clamped to [MinTTL, MaxTTL], 0 means no clamping.
+	MinTTL uint32
+	MaxTTL uint32
+	// ttl of NXDOMAIN and NODATA answers is clamped to [MinTTL, NegativeMaxTTL],
+	// MaxTTL is used if 0.
+	NegativeMaxTTL uint32
+	// ttl of AAAA records is clamped to at most AAAAMaxTTL if ClampAAAA, after
+	// MinTTL and MaxTTL; answers with AAAA records aren't cached if it's 0.
+	ClampAAAA  bool
+	AAAAMaxTTL uint32
+	// entries hit more than PrefetchThreshold times are reported by Lookup to
+	// be prefetched when they are about to expire.
+	Prefetch          bool
+	PrefetchThreshold uint32
+	// expired positive answers are kept ServeStaleTTL seconds more for GetStale,
+	// 0 disables serving stale answers.
+	ServeStaleTTL uint32
+	// A and AAAA records of entries are rotated on each hit.
+	RotateAnswers bool
+	// the least recently used entries are evicted beyond MaxEntries, 0 means
+	// no limit.
+	MaxEntries int
+	// edns0-client-subnet in keys is truncated to at most ECSv4Prefix or
+	// ECSv6Prefix bits by family, so clients of nearby subnets share entries;
+	// 0 keeps the prefix length of the query or the scope.
+	ECSv4Prefix uint8
+	ECSv6Prefix uint8
+	// the expiry of entries is brought forward by a random fraction of their
+	// ttl of up to TTLJitter, in [0, 1), so entries stored together don't
+	// expire together; the ttl is never increased.
+	TTLJitter float64
+}
+
 // Use map to store cache, red-black tree to index cache.
 // red-black tree also used to implement the cache expire mechanism.
 type Cache struct {
-	nextExpireTime int64
-	cacheStore     map[string]*cacheItem
-	cacheReg       *RedBlackTreeExtended
-	lock           sync.RWMutex
+	opts       *CacheOptions
+	cacheStore map[string]*cacheItem
+	cacheReg   *RedBlackTreeExtended
+	lock       sync.RWMutex
+	// keys by recency of use, the most recent at front; moved under read lock
+	// of lock with lruLock.
+	lru     *list.List
+	lruLock sync.Mutex
+	// scope prefix lengths of edns0-client-subnet answered by upstream, by the
+	// key of the query without subnet.
+	ecsScopes map[string]uint8
+	// of TTLJitter, used under write lock of lock.
+	rand *rand.Rand
+	// now is replaceable for testing.
+	now func() time.Time
 }
 
 type cacheItem struct {
 	TimeArrival int64
-	MsgBytes    []byte
+	TimeExpire  int64
+	// dropped from cache on TimeDrop, later than TimeExpire if serving stale.
+	TimeDrop int64
+	MsgBytes []byte
+	// updated atomically under read lock.
+	Hits        int32
+	Prefetching int32
+	// advanced on each hit if rotating answers.
+	Rotation uint32
+	// set once served with ttl 0, later lookups miss until refreshed.
+	ServedExpiring int32
+	// the exact time of TimeArrival, ttl is decremented by the whole seconds
+	// elapsed since.
+	arrival time.Time
+	// in lru, value is the key.
+	element *list.Element
 }
 
 type cacheEntry struct {
-	// key for cacheStore
-	Key        string
+	// keys for cacheStore dropping at the same time
+	Keys       map[string]bool
 	TimeExpire int64
 }
 
-func NewCache() *Cache {
+func NewCache(opts *CacheOptions) *Cache {
+	return newCache(opts, time.Now)
+}
+
+// newCache creates the cache reading the time from now, it's set before the
+// expiring goroutine starts.
+func newCache(opts *CacheOptions, now func() time.Time) *Cache {
+	if opts == nil {
+		opts = &CacheOptions{}
+	}
 	cache := &Cache{
-		// init a max int64, to let any other expire time rewrite it.
-		nextExpireTime: int64(^uint64(0) >> 1),
-		cacheStore:     make(map[string]*cacheItem),
+		opts:       opts,
+		cacheStore: make(map[string]*cacheItem),
 		cacheReg: &RedBlackTreeExtended{rbt.NewWith(
 			func(a, b interface{}) int {
 				if a == b {
@@ -68,6 +157,10 @@ func NewCache() *Cache {
 				}
 			},
 		)},
+		lru:       list.New(),
+		ecsScopes: make(map[string]uint8),
+		rand:      rand.New(rand.NewSource(time.Now().UnixNano())),
+		now:       now,
 	}
 	go cache.expire()
 	return cache
@@ -76,39 +169,33 @@ func NewCache() *Cache {
 func (c *Cache) expire() {
 	// infinite loop
 	for c.cacheReg != nil {
-		Log.Debugf("will drop cache on: %v, current cache size: %v", c.nextExpireTime, c.cacheReg.Size())
-		if time.Now().Unix() > c.nextExpireTime && c.cacheReg.Size() > 0{
-			c.doExpire()
-			Log.Debugf("cache expire scheduled, current cache size: %v", c.cacheReg.Size())
-		}
+		c.doExpire()
 		time.Sleep(2 * time.Second)
 	}
 }
 
-func (c *Cache) doExpire(/*notify chan bool*/) {
-	now := time.Now().Unix()
-	for hang, found := c.cacheReg.GetMin()
-		found && now > hang.(cacheEntry).TimeExpire && c.cacheReg.Size() > 0; {
-
-		hangEntry := hang.(cacheEntry)
-		c.expireAction(hangEntry)
+// doExpire drops all entries expired.
+func (c *Cache) doExpire() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
 
-		hang, found = c.cacheReg.GetMin()
-		if found {
-			c.nextExpireTime = hang.(cacheEntry).TimeExpire
+	now := c.now().Unix()
+	dropped := 0
+	for hang, found := c.cacheReg.GetMin(); found && now >= hang.(*cacheEntry).TimeExpire; hang, found = c.cacheReg.GetMin() {
+		hangEntry := hang.(*cacheEntry)
+		cacheLog.Debugf("cache dropping : %v", hangEntry)
+		c.cacheReg.Remove(hangEntry.TimeExpire)
+		for key := range hangEntry.Keys {
+			// the key may be inserted again with another expire time.
+			if item, ok := c.cacheStore[key]; ok && item.TimeDrop == hangEntry.TimeExpire {
+				c.removeLocked(key, item)
+				dropped++
+			}
 		}
-		Log.Debugf("set next expire time %v, current cache size: %v",c.nextExpireTime, c.cacheReg.Size())
 	}
-	Log.Infof("current cache size: %v", c.cacheReg.Size())
-}
-
-func (c *Cache) expireAction(entry cacheEntry) {
-	c.lock.Lock()
-	defer c.lock.Unlock()
-	Log.Debugf("cache dropping : %v", entry)
-	c.cacheReg.Remove(entry.TimeExpire)
-	delete(c.cacheStore, entry.Key)
-	Log.Debugf("cache dropped once, cache size: %v", c.cacheReg.Size())
+	if dropped > 0 {
+		cacheLog.Infof("cache dropped %v entries, current cache size: %v", dropped, len(c.cacheStore))
+	}
 }
 
 func (c *Cache) Insert(msgCh <-chan *dns.Msg) {
@@ -117,68 +204,371 @@ func (c *Cache) Insert(msgCh <-chan *dns.Msg) {
 }
 
 func (c *Cache) realInsert(msg *dns.Msg) {
+	// only successful answers and name errors are worth caching.
+	if msg.Rcode != dns.RcodeSuccess && msg.Rcode != dns.RcodeNameError {
+		return
+	}
 	qStr := getQueryStringForCache(msg)
-	Log.Debugf("start insert cache: \n%v \n <= \n %v", qStr, msg)
-	now := time.Now().Unix()
+	cacheLog.Debugf("start insert cache: \n%v \n <= \n %v", qStr, msg)
+	arrival := c.now()
+	now := arrival.Unix()
+
+	// negative answers are cached with the ttl from SOA record, RFC 2308.
+	negative := isNegativeAnswer(msg)
+	var negativeTTL uint32
+	if negative {
+		soaTTL, ok := getNegativeTTLFromDnsMsg(msg)
+		if !ok {
+			// e.g. fake answers of NoAAAA, cached as before.
+			soaTTL = GetMinTTLFromDnsMsg(msg)
+		}
+		maxTTL := c.opts.NegativeMaxTTL
+		if maxTTL == 0 {
+			maxTTL = c.opts.MaxTTL
+		}
+		negativeTTL = clampTTL(soaTTL, c.opts.MinTTL, maxTTL)
+	}
+
+	// clamp on a copy, the message may be writing to client at the same time.
+	msg = msg.Copy()
+	hasAAAA := false
+	for _, rs := range [][]dns.RR{msg.Answer, msg.Ns} {
+		for _, r := range rs {
+			if negative && r.Header().Rrtype == dns.TypeSOA {
+				r.Header().Ttl = negativeTTL
+				continue
+			}
+			r.Header().Ttl = clampTTL(r.Header().Ttl, c.opts.MinTTL, c.opts.MaxTTL)
+			if c.opts.ClampAAAA && r.Header().Rrtype == dns.TypeAAAA {
+				hasAAAA = true
+				if r.Header().Ttl > c.opts.AAAAMaxTTL {
+					r.Header().Ttl = c.opts.AAAAMaxTTL
+				}
+			}
+		}
+	}
+	// use minimal ttl in dns-message to expire early.
 	minTTL := GetMinTTLFromDnsMsg(msg)
+	if !negative {
+		minTTL = clampTTL(minTTL, c.opts.MinTTL, c.opts.MaxTTL)
+	}
+	if hasAAAA && minTTL > c.opts.AAAAMaxTTL {
+		minTTL = c.opts.AAAAMaxTTL
+	}
+	if minTTL == 0 {
+		return
+	}
 	bytesMsg, err := msg.Pack()
 	if err != nil {
-		Log.Errorf("can't pack dns-message: %v", err)
+		cacheLog.Errorf("can't pack dns-message: %v", err)
 		return
 	}
 
 	c.lock.Lock()
 	defer c.lock.Unlock()
-	c.cacheStore[qStr] = &cacheItem{TimeArrival: now, MsgBytes: bytesMsg}
-	// use minimal ttl in dns-message to expire early.
+	qStr = c.insertKeyLocked(msg)
+	minTTL = c.jitterTTLLocked(minTTL)
 	expireTime := now + int64(minTTL)
-	c.cacheReg.Put(expireTime,
-		cacheEntry{
-			Key: qStr, TimeExpire: expireTime,
-		})
-	if c.cacheReg.Size() < 100 {
-		Log.Debugf("cache registry: %v", c.cacheReg)
+	// kept a second more, so it's served once with ttl 0.
+	dropTime := expireTime + 1
+	if !negative {
+		// only answers resolved successfully are served stale.
+		dropTime += int64(c.opts.ServeStaleTTL)
 	}
-	if expireTime < c.nextExpireTime {
-		c.nextExpireTime = expireTime
-		Log.Debugf("next cache entry expire on: %v <= %vs",
-			c.nextExpireTime, time.Now().Unix()-c.nextExpireTime)
+	item := &cacheItem{TimeArrival: now, TimeExpire: expireTime, TimeDrop: dropTime, MsgBytes: bytesMsg,
+		arrival: arrival}
+	if old, ok := c.cacheStore[qStr]; ok {
+		item.element = old.element
+		c.lru.MoveToFront(item.element)
+	} else {
+		item.element = c.lru.PushFront(qStr)
 	}
+	c.cacheStore[qStr] = item
+	c.evictLocked()
+	if hang, found := c.cacheReg.Get(dropTime); found {
+		hang.(*cacheEntry).Keys[qStr] = true
+	} else {
+		c.cacheReg.Put(dropTime,
+			&cacheEntry{
+				Keys: map[string]bool{qStr: true}, TimeExpire: dropTime,
+			})
+	}
+	cacheLog.Debugf("cache entry expire on: %v <= %vs", expireTime, minTTL)
+}
+
+// jitterTTLLocked returns ttl less a random fraction of it up to TTLJitter,
+// at least 1 if ttl isn't 0.
+func (c *Cache) jitterTTLLocked(ttl uint32) uint32 {
+	if c.opts.TTLJitter <= 0 || c.opts.TTLJitter >= 1 {
+		return ttl
+	}
+	return ttl - uint32(c.rand.Float64()*c.opts.TTLJitter*float64(ttl))
 }
 
 func (c *Cache) Get(msgQ *dns.Msg) (rMsg *dns.Msg) {
-	qStr := getQueryStringForCache(msgQ)
+	rMsg, _ = c.Lookup(msgQ)
+	return
+}
 
+// Lookup is like Get, and reports whether the entry should be refreshed now,
+// it's reported once for each entry.
+func (c *Cache) Lookup(msgQ *dns.Msg) (rMsg *dns.Msg, prefetch bool) {
 	c.lock.RLock()
 	defer c.lock.RUnlock()
 
+	qStr := c.lookupKeyLocked(msgQ)
+
 	cacheRet := c.cacheStore[qStr]
 	if cacheRet == nil || cacheRet.MsgBytes == nil {
-		return nil
+		return nil, false
 	}
 	cacheArrivalTime := cacheRet.TimeArrival
+	now := c.now()
+	elapsed, ttl := cacheRet.elapsed(now), cacheRet.TimeExpire-cacheRet.TimeArrival
+	// at ttl 0 it's served once, then refreshed, RFC 2308 section 5.
+	expiring := elapsed == ttl
+	if elapsed > ttl || (expiring && !atomic.CompareAndSwapInt32(&cacheRet.ServedExpiring, 0, 1)) {
+		return nil, false
+	}
+	c.touch(cacheRet)
 	msgRet := new(dns.Msg)
 	err := msgRet.Unpack(cacheRet.MsgBytes)
 	if err != nil {
-		Log.Errorf("can't unpack dns-message: %v", err)
-		return nil
+		cacheLog.Errorf("can't unpack dns-message: %v", err)
+		return nil, false
 	}
-	Log.Debugf("cache query result: \n%v \n => cacheArrivalTime: %v\n %v", qStr, cacheArrivalTime, msgRet)
+	cacheLog.Debugf("cache query result: \n%v \n => cacheArrivalTime: %v\n %v", qStr, cacheArrivalTime, msgRet)
+	// the question is echoed in the case of the query, e.g. for 0x20 encoding.
+	msgRet.Question = append([]dns.Question(nil), msgQ.Question...)
 	// recalculate ttl.
 	for _, rs :=
 	range [][]dns.RR{msgRet.Answer, msgRet.Ns} {
 		for _, r := range rs {
 			rh := r.Header()
-			ttlNew := cacheArrivalTime + int64(rh.Ttl) - time.Now().Unix()
-			if ttlNew <= 0 {
-				return nil
+			ttlNew := int64(rh.Ttl) - elapsed
+			if ttlNew < 0 {
+				ttlNew = 0
 			}
 			rh.Ttl = uint32(ttlNew)
 		}
 	}
+	if c.opts.RotateAnswers {
+		rotateAddressRecords(msgRet, atomic.AddUint32(&cacheRet.Rotation, 1))
+	}
+	return msgRet, expiring || c.shouldPrefetch(cacheRet, now.Unix())
+}
+
+// elapsed returns the whole seconds elapsed since item arrived, from the exact
+// arrival time so it's never a second more.
+func (item *cacheItem) elapsed(now time.Time) int64 {
+	arrival := item.arrival
+	if arrival.IsZero() {
+		// loaded from file.
+		arrival = time.Unix(item.TimeArrival, 0)
+	}
+	if now.Before(arrival) {
+		return 0
+	}
+	return int64(now.Sub(arrival) / time.Second)
+}
+
+func (c *Cache) shouldPrefetch(item *cacheItem, now int64) bool {
+	if !c.opts.Prefetch {
+		return false
+	}
+	hits := atomic.AddInt32(&item.Hits, 1)
+	if uint32(hits) <= c.opts.PrefetchThreshold {
+		return false
+	}
+	if (item.TimeExpire-now)*prefetchTTLDivisor > item.TimeExpire-item.TimeArrival {
+		return false
+	}
+	return atomic.CompareAndSwapInt32(&item.Prefetching, 0, 1)
+}
+
+// GetStale returns the expired answer of msgQ kept for serving stale, with ttl
+// of staleAnswerTTL; nil if there's none or it's not expired yet.
+func (c *Cache) GetStale(msgQ *dns.Msg) *dns.Msg {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	qStr := c.lookupKeyLocked(msgQ)
+
+	cacheRet := c.cacheStore[qStr]
+	if cacheRet == nil || cacheRet.MsgBytes == nil {
+		return nil
+	}
+	now := c.now().Unix()
+	if now < cacheRet.TimeExpire || now >= cacheRet.TimeDrop {
+		return nil
+	}
+	msgRet := new(dns.Msg)
+	if err := msgRet.Unpack(cacheRet.MsgBytes); err != nil {
+		cacheLog.Errorf("can't unpack dns-message: %v", err)
+		return nil
+	}
+	for _, rs := range [][]dns.RR{msgRet.Answer, msgRet.Ns} {
+		for _, r := range rs {
+			r.Header().Ttl = staleAnswerTTL
+		}
+	}
+	msgRet.Question = append([]dns.Question(nil), msgQ.Question...)
 	return msgRet
 }
 
+// CacheEntryInfo describes a cache entry, TTL is the remaining seconds, negative
+// if the entry is expired and kept for serving stale.
+type CacheEntryInfo struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Rcode string `json:"rcode"`
+	TTL   int64  `json:"ttl"`
+}
+
+// Entries returns all entries in cache.
+func (c *Cache) Entries() []CacheEntryInfo {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	now := c.now().Unix()
+	entries := make([]CacheEntryInfo, 0, len(c.cacheStore))
+	for _, item := range c.cacheStore {
+		msg := new(dns.Msg)
+		if err := msg.Unpack(item.MsgBytes); err != nil || len(msg.Question) == 0 {
+			continue
+		}
+		entries = append(entries, CacheEntryInfo{
+			Name:  msg.Question[0].Name,
+			Type:  dns.TypeToString[msg.Question[0].Qtype],
+			Rcode: dns.RcodeToString[msg.Rcode],
+			TTL:   item.TimeExpire - now,
+		})
+	}
+	return entries
+}
+
+// Flush drops all entries.
+func (c *Cache) Flush() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.cacheStore = make(map[string]*cacheItem)
+	c.ecsScopes = make(map[string]uint8)
+	c.cacheReg.Clear()
+	c.lru.Init()
+	metricCacheEntries.Set(0)
+	cacheLog.Infof("cache flushed")
+}
+
+// Purge drops the entries of name of all types, returns the number of entries
+// dropped.
+func (c *Cache) Purge(name string) int {
+	name = dns.CanonicalName(name)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	purged := 0
+	for key, item := range c.cacheStore {
+		msg := new(dns.Msg)
+		if err := msg.Unpack(item.MsgBytes); err != nil || len(msg.Question) == 0 {
+			continue
+		}
+		if dns.CanonicalName(msg.Question[0].Name) == name {
+			// the key stays in cacheReg, it's skipped on expiring.
+			c.removeLocked(key, item)
+			purged++
+		}
+	}
+	cacheLog.Infof("cache purged %v entries of %v", purged, name)
+	return purged
+}
+
+// touch marks item as the most recently used, under read lock.
+func (c *Cache) touch(item *cacheItem) {
+	c.lruLock.Lock()
+	c.lru.MoveToFront(item.element)
+	c.lruLock.Unlock()
+}
+
+// removeLocked drops the entry of key, under write lock.
+func (c *Cache) removeLocked(key string, item *cacheItem) {
+	delete(c.cacheStore, key)
+	c.lru.Remove(item.element)
+	metricCacheEntries.Set(float64(len(c.cacheStore)))
+}
+
+// evictLocked drops the least recently used entries beyond MaxEntries, under
+// write lock; their keys stay in cacheReg, skipped on expiring.
+func (c *Cache) evictLocked() {
+	for c.opts.MaxEntries > 0 && len(c.cacheStore) > c.opts.MaxEntries {
+		key := c.lru.Back().Value.(string)
+		c.removeLocked(key, c.cacheStore[key])
+		metricCacheEvictions.Inc()
+		cacheLog.Debugf("cache evicted: %v", key)
+	}
+	metricCacheEntries.Set(float64(len(c.cacheStore)))
+}
+
+// insertKeyLocked returns the key of the answer msg in cache, its
+// edns0-client-subnet is truncated to the scope prefix length, which is
+// recorded so clients in other subnets of the scope share the entry, RFC 7871
+// section 7.3.1.
+func (c *Cache) insertKeyLocked(msg *dns.Msg) string {
+	subnet := ObtainEDN0Subnet(msg)
+	if subnet.Address == nil {
+		return getQueryStringForCache(msg)
+	}
+	if len(c.ecsScopes) >= maxECSScopes {
+		c.ecsScopes = make(map[string]uint8)
+	}
+	c.ecsScopes[msgCacheKey(msg, fmt.Sprintf("family %v", subnet.Family))] = subnet.SourceScope
+	return msgCacheKey(msg, ecsSubnetKey(subnet, c.ecsKeyPrefix(subnet, subnet.SourceScope)))
+}
+
+// lookupKeyLocked returns the key of the query msgQ in cache, its
+// edns0-client-subnet is truncated to the scope prefix length recorded for
+// the query, or the source prefix length if unknown.
+func (c *Cache) lookupKeyLocked(msgQ *dns.Msg) string {
+	subnet := ObtainEDN0Subnet(msgQ)
+	if subnet.Address == nil {
+		return getQueryStringForCache(msgQ)
+	}
+	scope, ok := c.ecsScopes[msgCacheKey(msgQ, fmt.Sprintf("family %v", subnet.Family))]
+	if !ok {
+		scope = subnet.SourceNetmask
+	}
+	return msgCacheKey(msgQ, ecsSubnetKey(subnet, c.ecsKeyPrefix(subnet, scope)))
+}
+
+// ecsKeyPrefix returns prefix clamped to the prefix length of keys of the
+// family of subnet, ECSv4Prefix or ECSv6Prefix.
+func (c *Cache) ecsKeyPrefix(subnet dns.EDNS0_SUBNET, prefix uint8) uint8 {
+	max := c.opts.ECSv4Prefix
+	if subnet.Family == 2 {
+		max = c.opts.ECSv6Prefix
+	}
+	if max > 0 && prefix > max {
+		return max
+	}
+	return prefix
+}
+
+// ecsSubnetKey returns the address of subnet truncated to prefix bits with the
+// length, the source prefix length if prefix is longer.
+func ecsSubnetKey(subnet dns.EDNS0_SUBNET, prefix uint8) string {
+	if prefix > subnet.SourceNetmask {
+		prefix = subnet.SourceNetmask
+	}
+	bits := 8 * net.IPv4len
+	if subnet.Family == 2 {
+		bits = 8 * net.IPv6len
+	}
+	return fmt.Sprintf("%v/%v", subnet.Address.Mask(net.CIDRMask(int(prefix), bits)), prefix)
+}
+
+// getQueryStringForCache returns the key of the query msg, with its
+// edns0-client-subnet truncated to the source prefix length.
 func getQueryStringForCache(msg *dns.Msg) (q string) {
 	if msg.Question == nil || len(msg.Question) == 0 {
 		return ""
@@ -186,13 +576,95 @@ func getQueryStringForCache(msg *dns.Msg) (q string) {
 	edns0Subnet := ""
 	subnet := ObtainEDN0Subnet(msg)
 	if subnet.Address != nil {
-		edns0Subnet = subnet.String()
+		edns0Subnet = ecsSubnetKey(subnet, subnet.SourceNetmask)
 	}
+	return msgCacheKey(msg, edns0Subnet)
+}
+
+// cacheKey returns the key of question q, the name is canonicalized to lower
+// case fqdn, so e.g. "Example.COM." and "example.com" share the entry.
+func cacheKey(q dns.Question) string {
+	return fmt.Sprintf(questionFormatString, dns.CanonicalName(q.Name), q.Qtype, q.Qclass)
+}
 
+// msgCacheKey returns the key of msg with edns0Subnet.
+func msgCacheKey(msg *dns.Msg, edns0Subnet string) string {
 	queryStr := fmt.Sprintf(queryFormatString,
 		msg.Opcode, msg.Truncated, msg.RecursionDesired, msg.Zero, msg.CheckingDisabled,
-		dns.CanonicalName(msg.Question[0].Name), msg.Question[0].Qtype, msg.Question[0].Qclass,
-		edns0Subnet)
-	Log.Debugf("cache query string: %v", queryStr)
+		cacheKey(msg.Question[0]), edns0Subnet, dnssecOK(msg), upstreamGroupTag(msg))
+	cacheLog.Debugf("cache query string: %v", queryStr)
 	return queryStr
 }
+
+// ParseQTypes parses the comma separated qtype names, e.g. "TXT,ANY".
+func ParseQTypes(s string) (map[uint16]bool, error) {
+	qtypes := make(map[uint16]bool)
+	for _, name := range strings.Split(s, ",") {
+		name = strings.ToUpper(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		qtype, ok := dns.StringToType[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown qtype: %v", name)
+		}
+		qtypes[qtype] = true
+	}
+	return qtypes, nil
+}
+
+// isNegativeAnswer reports whether msg is a NXDOMAIN or NODATA answer.
+func isNegativeAnswer(msg *dns.Msg) bool {
+	if msg.Rcode == dns.RcodeNameError {
+		return true
+	}
+	if msg.Rcode != dns.RcodeSuccess || len(msg.Question) == 0 {
+		return false
+	}
+	for _, r := range msg.Answer {
+		if r.Header().Rrtype == msg.Question[0].Qtype {
+			return false
+		}
+	}
+	return true
+}
+
+// getNegativeTTLFromDnsMsg returns the ttl of negative answer, the minimum of
+// SOA ttl and SOA MINIMUM field, RFC 2308 section 5.
+func getNegativeTTLFromDnsMsg(msg *dns.Msg) (uint32, bool) {
+	for _, r := range msg.Ns {
+		if soa, ok := r.(*dns.SOA); ok {
+			if soa.Minttl < soa.Hdr.Ttl {
+				return soa.Minttl, true
+			}
+			return soa.Hdr.Ttl, true
+		}
+	}
+	return 0, false
+}
+
+func clampTTL(ttl uint32, min uint32, max uint32) uint32 {
+	if min > 0 && ttl < min {
+		ttl = min
+	}
+	if max > 0 && ttl > max {
+		ttl = max
+	}
+	return ttl
+}
+
+// clampMsgTTL clamps the ttl of records in all sections of msg, 0 means no
+// clamping; OPT records are skipped, their ttl field holds the flags.
+func clampMsgTTL(msg *dns.Msg, min uint32, max uint32) {
+	if min == 0 && max == 0 {
+		return
+	}
+	for _, rs := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, r := range rs {
+			if r.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			r.Header().Ttl = clampTTL(r.Header().Ttl, min, max)
+		}
+	}
+}
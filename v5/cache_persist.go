@@ -0,0 +1,160 @@
+package dohProxy
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/miekg/dns"
+)
+
+// version of the persisted cache format, files of other versions are ignored.
+const cachePersistVersion = 1
+
+type persistedCache struct {
+	Version int
+	// the most recently used first.
+	Entries []persistedCacheEntry
+}
+
+// persistedCacheEntry is a cache entry with the absolute timestamps in unix
+// seconds, the key is derived from the message on loading.
+type persistedCacheEntry struct {
+	TimeArrival int64
+	TimeExpire  int64
+	TimeDrop    int64
+	MsgBytes    []byte
+}
+
+// Save writes the entries not dropped yet to w.
+func (c *Cache) Save(w io.Writer) error {
+	c.lock.RLock()
+	now := c.now().Unix()
+	data := persistedCache{Version: cachePersistVersion}
+	c.lruLock.Lock()
+	for e := c.lru.Front(); e != nil; e = e.Next() {
+		item := c.cacheStore[e.Value.(string)]
+		if item == nil || now >= item.TimeDrop {
+			continue
+		}
+		data.Entries = append(data.Entries, persistedCacheEntry{
+			TimeArrival: item.TimeArrival,
+			TimeExpire:  item.TimeExpire,
+			TimeDrop:    item.TimeDrop,
+			MsgBytes:    item.MsgBytes,
+		})
+	}
+	c.lruLock.Unlock()
+	c.lock.RUnlock()
+	return gob.NewEncoder(w).Encode(&data)
+}
+
+// Load adds the entries saved by Save from r, the dropped ones are discarded.
+// It returns the number of entries loaded.
+func (c *Cache) Load(r io.Reader) (int, error) {
+	var data persistedCache
+	if err := gob.NewDecoder(r).Decode(&data); err != nil {
+		return 0, fmt.Errorf("decode cache error: %v", err)
+	}
+	if data.Version != cachePersistVersion {
+		return 0, fmt.Errorf("unsupported cache version: %v", data.Version)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	now := c.now().Unix()
+	loaded := 0
+	for _, entry := range data.Entries {
+		if now >= entry.TimeDrop {
+			continue
+		}
+		msg := new(dns.Msg)
+		if err := msg.Unpack(entry.MsgBytes); err != nil {
+			cacheLog.Debugf("discard malformed cache entry: %v", err)
+			continue
+		}
+		if len(msg.Question) == 0 {
+			continue
+		}
+		key := c.insertKeyLocked(msg)
+		if key == "" {
+			continue
+		}
+		if _, ok := c.cacheStore[key]; ok {
+			// inserted since starting, newer than the saved one.
+			continue
+		}
+		// in order of recency, the saved most recent is the front.
+		c.cacheStore[key] = &cacheItem{
+			TimeArrival: entry.TimeArrival,
+			TimeExpire:  entry.TimeExpire,
+			TimeDrop:    entry.TimeDrop,
+			MsgBytes:    entry.MsgBytes,
+			element:     c.lru.PushBack(key),
+		}
+		if hang, found := c.cacheReg.Get(entry.TimeDrop); found {
+			hang.(*cacheEntry).Keys[key] = true
+		} else {
+			c.cacheReg.Put(entry.TimeDrop, &cacheEntry{Keys: map[string]bool{key: true}, TimeExpire: entry.TimeDrop})
+		}
+		loaded++
+	}
+	c.evictLocked()
+	return loaded, nil
+}
+
+// SaveFile saves the cache to path, replacing it atomically.
+func (c *Cache) SaveFile(path string) error {
+	file, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("save cache error: %v", err)
+	}
+	if err := c.Save(file); err != nil {
+		_ = file.Close()
+		_ = os.Remove(file.Name())
+		return fmt.Errorf("save cache error: %v", err)
+	}
+	if err := file.Close(); err != nil {
+		_ = os.Remove(file.Name())
+		return fmt.Errorf("save cache error: %v", err)
+	}
+	return os.Rename(file.Name(), path)
+}
+
+// LoadFile loads the cache saved to path, it's not an error if path doesn't
+// exist.
+func (c *Cache) LoadFile(path string) (int, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("load cache error: %v", err)
+	}
+	defer func() { _ = file.Close() }()
+	return c.Load(file)
+}
+
+// SaveCache saves the cache to path, if caching.
+func (h *Handler) SaveCache(path string) error {
+	if h.cache == nil {
+		return nil
+	}
+	return h.cache.SaveFile(path)
+}
+
+// LoadCache loads the cache saved to path by SaveCache, if caching.
+func (h *Handler) LoadCache(path string) error {
+	if h.cache == nil {
+		return nil
+	}
+	n, err := h.cache.LoadFile(path)
+	if err != nil {
+		return err
+	}
+	Log.Infof("loaded %v cache entries from %v", n, path)
+	return nil
+}
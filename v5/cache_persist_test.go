@@ -0,0 +1,48 @@
+package dohProxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestCache_SaveLoad(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1600000000, 0)}
+	cache := newCache(nil, clock.now)
+	cache.realInsert(newTestAnswer("valid.example.com", dns.TypeA, 300, "192.0.2.1"))
+	cache.realInsert(newTestAnswer("expiring.example.com", dns.TypeA, 30, "192.0.2.2"))
+
+	path := writeTestConfig(t, "")
+	if err := cache.SaveFile(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// restarted 100s later.
+	clock.advance(100 * time.Second)
+	loaded := newCache(nil, clock.now)
+	n, err := loaded.LoadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("expired entry should be discarded, loaded %v entries", n)
+	}
+	msg := new(dns.Msg)
+	msg.SetQuestion("valid.example.com.", dns.TypeA)
+	rMsg := loaded.Get(msg)
+	if rMsg == nil || len(rMsg.Answer) != 1 {
+		t.Fatalf("valid entry should survive, got: %v", rMsg)
+	}
+	if ttl := rMsg.Answer[0].Header().Ttl; ttl != 200 {
+		t.Errorf("expected remaining ttl 200, got: %v", ttl)
+	}
+	msg.SetQuestion("expiring.example.com.", dns.TypeA)
+	if rMsg := loaded.Get(msg); rMsg != nil {
+		t.Errorf("expired entry should not be loaded, got: %v", rMsg)
+	}
+
+	if n, err := loaded.LoadFile(path + ".missing"); err != nil || n != 0 {
+		t.Errorf("missing file should be ignored, got: %v %v", n, err)
+	}
+}
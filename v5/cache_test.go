@@ -3,6 +3,10 @@ package dohProxy
 import (
 	"fmt"
 	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"net"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -32,8 +36,10 @@ func TestCache_Get(t *testing.T) {
 
 	msgR := new(dns.Msg)
 	msgR.SetReply(msg)
+	// the DO bit is echoed in answers.
+	msgR.SetEdns0(dns.DefaultMsgSize, true)
 
-	cache := NewCache()
+	cache := NewCache(nil)
 	cache.realInsert(msgR)
 	t.Logf("message response: \n%v", msgR)
 	msgC := cache.Get(msg)
@@ -57,7 +63,7 @@ func BenchmarkCache_Insert(b *testing.B) {
 	msgR := new(dns.Msg)
 	msgR.SetReply(msg)
 
-	cache := NewCache()
+	cache := NewCache(nil)
 	for i := 0; i < b.N; i++ {
 		msgR.SetQuestion(dns.CanonicalName(fmt.Sprintf("google%v.com", time.Now().UnixNano())), dns.TypeAAAA)
 		cache.realInsert(msgR)
@@ -74,7 +80,7 @@ func BenchmarkCache_Get(b *testing.B) {
 
 	msgR := new(dns.Msg)
 
-	cache := NewCache()
+	cache := NewCache(nil)
 	for i := 0; i < b.N; i++ {
 		nonce := time.Now().UnixNano()
 		msg.SetQuestion(dns.CanonicalName(fmt.Sprintf("google%v.com", nonce)), dns.TypeAAAA)
@@ -86,3 +92,470 @@ func BenchmarkCache_Get(b *testing.B) {
 		}
 	}
 }
+
+type fakeClock struct {
+	lock sync.Mutex
+	t    time.Time
+}
+
+func (f *fakeClock) now() time.Time {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.t
+}
+
+func (f *fakeClock) advance(d time.Duration) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.t = f.t.Add(d)
+}
+
+func newTestAnswer(name string, qtype uint16, ttl uint32, rrs ...string) *dns.Msg {
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.CanonicalName(name), qtype)
+	msgR := new(dns.Msg)
+	msgR.SetReply(msg)
+	for _, r := range rrs {
+		rr, _ := dns.NewRR(fmt.Sprintf("%v %v IN %v %v", msg.Question[0].Name, ttl, dns.TypeToString[qtype], r))
+		msgR.Answer = append(msgR.Answer, rr)
+	}
+	return msgR
+}
+
+func TestCache_Expire(t *testing.T) {
+	clock := &fakeClock{t: time.Now()}
+	cache := newCache(nil, clock.now)
+
+	msgR := newTestAnswer("expire.example.com", dns.TypeA, 30, "93.184.216.34")
+	cache.realInsert(msgR)
+
+	clock.advance(10 * time.Second)
+	msgC := cache.Get(msgR)
+	if msgC == nil {
+		t.Fatalf("entry should be cached")
+	}
+	if ttl := msgC.Answer[0].Header().Ttl; ttl != 20 {
+		t.Errorf("ttl should be decremented to 20, got %v", ttl)
+	}
+
+	clock.advance(21 * time.Second)
+	if msgC = cache.Get(msgR); msgC != nil {
+		t.Errorf("entry should be expired: %v", msgC)
+	}
+	cache.doExpire()
+	if len(cache.cacheStore) != 0 {
+		t.Errorf("expired entry should be evicted, cache size: %v", len(cache.cacheStore))
+	}
+}
+
+func TestCache_ExpireSameTime(t *testing.T) {
+	clock := &fakeClock{t: time.Now()}
+	cache := newCache(nil, clock.now)
+
+	cache.realInsert(newTestAnswer("a.example.com", dns.TypeA, 30, "93.184.216.34"))
+	cache.realInsert(newTestAnswer("b.example.com", dns.TypeA, 30, "93.184.216.35"))
+	clock.advance(31 * time.Second)
+	cache.doExpire()
+	if len(cache.cacheStore) != 0 {
+		t.Errorf("entries expiring at the same time should all be evicted, cache size: %v",
+			len(cache.cacheStore))
+	}
+}
+
+func TestCache_ClampTTL(t *testing.T) {
+	clock := &fakeClock{t: time.Now()}
+	cache := newCache(&CacheOptions{MinTTL: 60, MaxTTL: 600}, clock.now)
+
+	short := newTestAnswer("short.example.com", dns.TypeA, 5, "93.184.216.34")
+	long := newTestAnswer("long.example.com", dns.TypeA, 86400, "93.184.216.35")
+	cache.realInsert(short)
+	cache.realInsert(long)
+
+	clock.advance(30 * time.Second)
+	if msgC := cache.Get(short); msgC == nil || msgC.Answer[0].Header().Ttl != 30 {
+		t.Errorf("short ttl should be raised to min ttl: %v", msgC)
+	}
+	if msgC := cache.Get(long); msgC == nil || msgC.Answer[0].Header().Ttl != 570 {
+		t.Errorf("long ttl should be lowered to max ttl: %v", msgC)
+	}
+	if short.Answer[0].Header().Ttl != 5 {
+		t.Errorf("inserted message should not be modified")
+	}
+}
+
+func newTestNegativeAnswer(name string, qtype uint16, rcode int, soaTTL uint32, minTTL uint32) *dns.Msg {
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.CanonicalName(name), qtype)
+	msgR := new(dns.Msg)
+	msgR.SetRcode(msg, rcode)
+	soa, _ := dns.NewRR(fmt.Sprintf("example.com. %v IN SOA ns.example.com. admin.example.com. 1 7200 900 1209600 %v",
+		soaTTL, minTTL))
+	msgR.Ns = append(msgR.Ns, soa)
+	return msgR
+}
+
+func TestCache_NegativeTTL(t *testing.T) {
+	clock := &fakeClock{t: time.Now()}
+	cache := newCache(&CacheOptions{MaxTTL: 3600, NegativeMaxTTL: 120}, clock.now)
+
+	// ttl is the minimum of SOA ttl and SOA MINIMUM.
+	nxDomain := newTestNegativeAnswer("nx.example.com", dns.TypeA, dns.RcodeNameError, 300, 60)
+	// NODATA, clamped to NegativeMaxTTL.
+	noData := newTestNegativeAnswer("nodata.example.com", dns.TypeAAAA, dns.RcodeSuccess, 3600, 900)
+	cache.realInsert(nxDomain)
+	cache.realInsert(noData)
+
+	clock.advance(10 * time.Second)
+	if msgC := cache.Get(nxDomain); msgC == nil || msgC.Rcode != dns.RcodeNameError ||
+		msgC.Ns[0].Header().Ttl != 50 {
+		t.Errorf("NXDOMAIN should be cached with SOA minimum ttl: %v", msgC)
+	}
+	if msgC := cache.Get(noData); msgC == nil || msgC.Ns[0].Header().Ttl != 110 {
+		t.Errorf("NODATA should be cached with negative max ttl: %v", msgC)
+	}
+
+	clock.advance(51 * time.Second)
+	if msgC := cache.Get(nxDomain); msgC != nil {
+		t.Errorf("NXDOMAIN should be expired: %v", msgC)
+	}
+	if msgC := cache.Get(noData); msgC == nil {
+		t.Errorf("NODATA should still be cached")
+	}
+}
+
+func TestCache_NotCacheServerFailure(t *testing.T) {
+	cache := NewCache(nil)
+	msgR := newTestNegativeAnswer("fail.example.com", dns.TypeA, dns.RcodeServerFailure, 300, 60)
+	cache.realInsert(msgR)
+	if msgC := cache.Get(msgR); msgC != nil {
+		t.Errorf("SERVFAIL should not be cached: %v", msgC)
+	}
+}
+
+func TestCache_LookupPrefetch(t *testing.T) {
+	clock := &fakeClock{t: time.Now()}
+	cache := newCache(&CacheOptions{Prefetch: true, PrefetchThreshold: 2}, clock.now)
+
+	msgR := newTestAnswer("prefetch.example.com", dns.TypeA, 100, "93.184.216.34")
+	cache.realInsert(msgR)
+	for i := 0; i < 3; i++ {
+		if _, prefetch := cache.Lookup(msgR); prefetch {
+			t.Fatalf("entry shouldn't be prefetched before the last 10%% of ttl")
+		}
+	}
+	clock.advance(90 * time.Second)
+	if _, prefetch := cache.Lookup(msgR); !prefetch {
+		t.Errorf("popular entry about to expire should be prefetched")
+	}
+	if _, prefetch := cache.Lookup(msgR); prefetch {
+		t.Errorf("entry should be prefetched only once")
+	}
+
+	unpopular := newTestAnswer("unpopular.example.com", dns.TypeA, 10, "93.184.216.35")
+	cache.realInsert(unpopular)
+	clock.advance(9 * time.Second)
+	if _, prefetch := cache.Lookup(unpopular); prefetch {
+		t.Errorf("entry hit less than threshold shouldn't be prefetched")
+	}
+}
+
+func TestCache_GetStale(t *testing.T) {
+	clock := &fakeClock{t: time.Now()}
+	cache := newCache(&CacheOptions{ServeStaleTTL: 100}, clock.now)
+
+	msgR := newTestAnswer("stale.example.com", dns.TypeA, 30, "93.184.216.34")
+	nxDomain := newTestNegativeAnswer("nx.example.com", dns.TypeA, dns.RcodeNameError, 30, 30)
+	cache.realInsert(msgR)
+	cache.realInsert(nxDomain)
+	if msgC := cache.GetStale(msgR); msgC != nil {
+		t.Errorf("fresh entry shouldn't be served stale: %v", msgC)
+	}
+
+	clock.advance(60 * time.Second)
+	if msgC := cache.Get(msgR); msgC != nil {
+		t.Errorf("entry should be expired: %v", msgC)
+	}
+	if msgC := cache.GetStale(msgR); msgC == nil || msgC.Answer[0].Header().Ttl != staleAnswerTTL {
+		t.Errorf("expired entry should be served stale: %v", msgC)
+	}
+	if msgC := cache.GetStale(nxDomain); msgC != nil {
+		t.Errorf("negative answer shouldn't be served stale: %v", msgC)
+	}
+
+	clock.advance(71 * time.Second)
+	if msgC := cache.GetStale(msgR); msgC != nil {
+		t.Errorf("entry should be dropped after serve stale ttl: %v", msgC)
+	}
+	cache.doExpire()
+	if len(cache.cacheStore) != 0 {
+		t.Errorf("stale entry should be evicted, cache size: %v", len(cache.cacheStore))
+	}
+}
+
+func TestCache_MaxEntries(t *testing.T) {
+	cache := NewCache(&CacheOptions{MaxEntries: 3})
+	evicted := testutil.ToFloat64(metricCacheEvictions)
+	names := []string{"a.example.com", "b.example.com", "c.example.com", "d.example.com"}
+	for _, name := range names {
+		cache.realInsert(newTestAnswer(name, dns.TypeA, 300, "192.0.2.1"))
+	}
+	if n := len(cache.Entries()); n != 3 {
+		t.Fatalf("expected 3 entries, got: %v", n)
+	}
+	lookup := func(name string) *dns.Msg {
+		msg := new(dns.Msg)
+		msg.SetQuestion(dns.Fqdn(name), dns.TypeA)
+		return cache.Get(msg)
+	}
+	if lookup("a.example.com") != nil {
+		t.Error("the oldest entry should be evicted")
+	}
+	if diff := testutil.ToFloat64(metricCacheEvictions) - evicted; diff != 1 {
+		t.Errorf("expected 1 eviction, got: %v", diff)
+	}
+
+	// b is the least recently used after looking up.
+	if lookup("b.example.com") == nil || lookup("c.example.com") == nil {
+		t.Fatal("entries should be cached")
+	}
+	cache.realInsert(newTestAnswer("e.example.com", dns.TypeA, 300, "192.0.2.1"))
+	if lookup("d.example.com") != nil || lookup("b.example.com") == nil {
+		t.Error("the least recently used entry should be evicted")
+	}
+}
+
+// ecsProvider answers with the address of the edns0-client-subnet of queries,
+// the scope prefix length is 16 for "scoped.example.com." and 24 for others.
+type ecsProvider struct {
+	queries int32
+}
+
+func (p *ecsProvider) Query(msg *dns.Msg) (*dns.Msg, error) {
+	atomic.AddInt32(&p.queries, 1)
+	subnet := ObtainEDN0Subnet(msg)
+	rMsg := new(dns.Msg)
+	rMsg.SetReply(msg)
+	rr, _ := dns.NewRR(fmt.Sprintf("%v 300 IN A %v", msg.Question[0].Name, subnet.Address))
+	rMsg.Answer = append(rMsg.Answer, rr)
+	subnet.SourceScope = 24
+	if msg.Question[0].Name == "scoped.example.com." {
+		subnet.SourceScope = 16
+	}
+	rMsg.SetEdns0(dns.DefaultMsgSize, false)
+	ReplaceEDNS0Subnet(rMsg, &subnet)
+	return rMsg, nil
+}
+
+func TestCache_EDNSSubnetScope(t *testing.T) {
+	provider := &ecsProvider{}
+	handler := NewHandler(provider, &HandlerOptions{Cache: true})
+	query := func(name string, subnet string) *dns.Msg {
+		writer := newTestResponseWriter("127.0.0.1:5353")
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, dns.TypeA)
+		msg.SetEdns0(dns.DefaultMsgSize, false)
+		ReplaceEDNS0Subnet(msg, &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24,
+			Address: net.ParseIP(subnet).To4()})
+		handler.Handle(writer, msg)
+		rMsg := writer.waitMsg(t, time.Second)
+		// inserted into cache asynchronously.
+		time.Sleep(20 * time.Millisecond)
+		return rMsg
+	}
+	addressOf := func(rMsg *dns.Msg) string {
+		if len(rMsg.Answer) != 1 {
+			return ""
+		}
+		return rMsg.Answer[0].(*dns.A).A.String()
+	}
+
+	for i, c := range []struct {
+		name    string
+		subnet  string
+		address string
+		queries int32
+	}{
+		{"example.com.", "198.51.100.0", "198.51.100.0", 1},
+		// identical ones share the entry.
+		{"example.com.", "198.51.100.0", "198.51.100.0", 1},
+		// other subnets don't.
+		{"example.com.", "203.0.113.0", "203.0.113.0", 2},
+		{"scoped.example.com.", "198.51.100.0", "198.51.100.0", 3},
+		// in the /16 scope answered by upstream.
+		{"scoped.example.com.", "198.51.7.0", "198.51.100.0", 3},
+		{"scoped.example.com.", "203.0.113.0", "203.0.113.0", 4},
+	} {
+		rMsg := query(c.name, c.subnet)
+		if address := addressOf(rMsg); address != c.address {
+			t.Errorf("%v: expected answer %v, got: %v", i, c.address, rMsg)
+		}
+		if subnet := ObtainEDN0Subnet(rMsg); !subnet.Address.Equal(net.ParseIP(c.subnet)) {
+			t.Errorf("%v: subnet of client should be answered, got: %v", i, subnet.String())
+		}
+		if queries := atomic.LoadInt32(&provider.queries); queries != c.queries {
+			t.Errorf("%v: expected %v upstream queries, got: %v", i, c.queries, queries)
+		}
+	}
+}
+
+func TestCache_ECSPrefix(t *testing.T) {
+	withSubnet := func(msg *dns.Msg, subnet string, scope uint8) *dns.Msg {
+		msg.SetEdns0(dns.DefaultMsgSize, false)
+		ReplaceEDNS0Subnet(msg, &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24,
+			SourceScope: scope, Address: net.ParseIP(subnet).To4()})
+		return msg
+	}
+	query := func(subnet string) *dns.Msg {
+		msg := new(dns.Msg)
+		msg.SetQuestion("ecs.example.com.", dns.TypeA)
+		return withSubnet(msg, subnet, 0)
+	}
+
+	for _, c := range []struct {
+		opts   *CacheOptions
+		shared bool
+	}{
+		{&CacheOptions{}, false},
+		{&CacheOptions{ECSv4Prefix: 16}, true},
+	} {
+		cache := NewCache(c.opts)
+		cache.realInsert(withSubnet(newTestAnswer("ecs.example.com", dns.TypeA, 60, "93.184.216.34"), "198.51.100.0", 24))
+		if cache.Get(query("198.51.100.0")) == nil {
+			t.Errorf("%+v: query of the same /24 should hit", c.opts)
+		}
+		// another /24 in the same /16.
+		if hit := cache.Get(query("198.51.7.0")) != nil; hit != c.shared {
+			t.Errorf("%+v: query of another /24 should share the entry: %v, got: %v", c.opts, c.shared, hit)
+		}
+		if cache.Get(query("203.0.113.0")) != nil {
+			t.Errorf("%+v: query of another /16 should miss", c.opts)
+		}
+	}
+}
+
+func TestCache_TTLJitter(t *testing.T) {
+	cache := NewCache(&CacheOptions{TTLJitter: 0.1})
+	ttls := make(map[int64]bool)
+	for i := 0; i < 200; i++ {
+		cache.realInsert(newTestAnswer(fmt.Sprintf("jitter%v.example.com", i), dns.TypeA, 100, "93.184.216.34"))
+	}
+	for _, item := range cache.cacheStore {
+		ttl := item.TimeExpire - item.TimeArrival
+		if ttl < 90 || ttl > 100 {
+			t.Errorf("jittered ttl should be in [90, 100], got: %v", ttl)
+		}
+		ttls[ttl] = true
+	}
+	if len(ttls) < 2 {
+		t.Errorf("ttls should be spread, got: %v", ttls)
+	}
+
+	// short ttls are never jittered to 0.
+	cache.realInsert(newTestAnswer("short.example.com", dns.TypeA, 1, "93.184.216.34"))
+	if cache.Get(newTestAnswer("short.example.com", dns.TypeA, 1)) == nil {
+		t.Errorf("entry of ttl 1 should be cached")
+	}
+}
+
+func TestCache_DecrementTTL(t *testing.T) {
+	// inserted in the middle of a second, elapsed time is counted from there.
+	arrival := time.Unix(1000, int64(900*time.Millisecond))
+	for _, tc := range []struct {
+		elapsed time.Duration
+		ttl     uint32
+		cached  bool
+	}{
+		{0, 30, true},
+		{100 * time.Millisecond, 30, true},
+		{time.Second, 29, true},
+		{1500 * time.Millisecond, 29, true},
+		{29900 * time.Millisecond, 1, true},
+		{30 * time.Second, 0, true},
+		{30500 * time.Millisecond, 0, true},
+		{31 * time.Second, 0, false},
+	} {
+		clock := &fakeClock{t: arrival}
+		cache := newCache(nil, clock.now)
+		msgR := newTestAnswer("ttl.example.com", dns.TypeA, 30, "93.184.216.34")
+		cache.realInsert(msgR)
+
+		clock.advance(tc.elapsed)
+		msgC, prefetch := cache.Lookup(msgR)
+		if (msgC != nil) != tc.cached {
+			t.Errorf("after %v, cached should be %v, got: %v", tc.elapsed, tc.cached, msgC)
+			continue
+		}
+		if msgC == nil {
+			continue
+		}
+		if ttl := msgC.Answer[0].Header().Ttl; ttl != tc.ttl {
+			t.Errorf("after %v, ttl should be %v, got: %v", tc.elapsed, tc.ttl, ttl)
+		}
+		if tc.ttl == 0 {
+			if !prefetch {
+				t.Errorf("after %v, entry at ttl 0 should be refreshed", tc.elapsed)
+			}
+			if msgC, _ = cache.Lookup(msgR); msgC != nil {
+				t.Errorf("after %v, entry at ttl 0 should be served once, got: %v", tc.elapsed, msgC)
+			}
+		}
+	}
+}
+
+func TestCache_AAAAMaxTTL(t *testing.T) {
+	clock := &fakeClock{t: time.Now()}
+	cache := newCache(&CacheOptions{MinTTL: 60, ClampAAAA: true, AAAAMaxTTL: 30}, clock.now)
+
+	a := newTestAnswer("example.com", dns.TypeA, 300, "93.184.216.34")
+	aaaa := newTestAnswer("example.com", dns.TypeAAAA, 300, "2606:2800:220:1:248:1893:25c8:1946")
+	cache.realInsert(a)
+	cache.realInsert(aaaa)
+
+	clock.advance(10 * time.Second)
+	if msgC := cache.Get(a); msgC == nil || msgC.Answer[0].Header().Ttl != 290 {
+		t.Errorf("A ttl should not be clamped by AAAA max ttl: %v", msgC)
+	}
+	if msgC := cache.Get(aaaa); msgC == nil || msgC.Answer[0].Header().Ttl != 20 {
+		t.Errorf("AAAA ttl should be clamped to AAAA max ttl: %v", msgC)
+	}
+
+	clock.advance(21 * time.Second)
+	if msgC := cache.Get(aaaa); msgC != nil {
+		t.Errorf("AAAA should be expired: %v", msgC)
+	}
+
+	cache = NewCache(&CacheOptions{ClampAAAA: true})
+	cache.realInsert(a)
+	cache.realInsert(aaaa)
+	if msgC := cache.Get(aaaa); msgC != nil {
+		t.Errorf("AAAA should not be cached with AAAA max ttl 0: %v", msgC)
+	}
+	if msgC := cache.Get(a); msgC == nil {
+		t.Errorf("A should still be cached with AAAA max ttl 0")
+	}
+}
+
+func TestCache_KeyCaseAndTrailingDot(t *testing.T) {
+	cache := NewCache(nil)
+	msgR := newTestAnswer("Example.COM.", dns.TypeA, 300, "93.184.216.34")
+	cache.realInsert(msgR)
+
+	for _, name := range []string{"example.com.", "EXAMPLE.com", "eXaMpLe.CoM."} {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, dns.TypeA)
+		if key, expected := getQueryStringForCache(msg), getQueryStringForCache(msgR); key != expected {
+			t.Errorf("key of %v should be %v, got %v", name, expected, key)
+		}
+		msgC := cache.Get(msg)
+		if msgC == nil {
+			t.Errorf("%v should hit the cached entry", name)
+			continue
+		}
+		if msgC.Question[0].Name != name {
+			t.Errorf("question should be echoed as %v, got %v", name, msgC.Question[0].Name)
+		}
+	}
+	if n := len(cache.cacheStore); n != 1 {
+		t.Errorf("variants should share one entry, got %v", n)
+	}
+}
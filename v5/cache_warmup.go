@@ -0,0 +1,99 @@
+package dohProxy
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// names are warmed by this many workers at most.
+const cacheWarmupWorkers = 8
+
+// LoadWarmupNames loads the questions from path, one "name [qtype]" per line,
+// qtype defaults to A; "#" starts a comment.
+func LoadWarmupNames(path string) ([]dns.Question, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open warmup names %v error: %v", path, err)
+	}
+	defer func() { _ = f.Close() }()
+
+	var questions []dns.Question
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) > 2 {
+			return nil, fmt.Errorf("%v:%v: expected name and optional qtype", path, lineNo)
+		}
+		name := dns.CanonicalName(fields[0])
+		if _, ok := dns.IsDomainName(name); !ok {
+			return nil, fmt.Errorf("%v:%v: invalid name: %v", path, lineNo, fields[0])
+		}
+		qtype := dns.TypeA
+		if len(fields) == 2 {
+			var ok bool
+			if qtype, ok = dns.StringToType[strings.ToUpper(fields[1])]; !ok {
+				return nil, fmt.Errorf("%v:%v: unknown qtype: %v", path, lineNo, fields[1])
+			}
+		}
+		questions = append(questions, dns.Question{Name: name, Qtype: qtype, Qclass: dns.ClassINET})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read warmup names %v error: %v", path, err)
+	}
+	return questions, nil
+}
+
+// WarmupCache resolves the questions upstream into cache, if caching; names
+// failed are logged and skipped. It returns the number of names warmed.
+func (h *Handler) WarmupCache(questions []dns.Question) int {
+	if h.cache == nil || len(questions) == 0 {
+		return 0
+	}
+	startTime := time.Now()
+	var warmed int32
+	var wg sync.WaitGroup
+	queue := make(chan dns.Question)
+	for i := 0; i < cacheWarmupWorkers && i < len(questions); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for q := range queue {
+				msg := new(dns.Msg)
+				msg.SetQuestion(q.Name, q.Qtype)
+				if !h.cacheable(msg) {
+					continue
+				}
+				resp, err := h.refresh(msg)
+				if err == nil && resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+					err = fmt.Errorf("answered %v", dns.RcodeToString[resp.Rcode])
+				}
+				if err != nil {
+					Log.Warnf("warm up %v %v failed: %v", q.Name, dns.TypeToString[q.Qtype], err)
+					continue
+				}
+				atomic.AddInt32(&warmed, 1)
+			}
+		}()
+	}
+	for _, q := range questions {
+		queue <- q
+	}
+	close(queue)
+	wg.Wait()
+	Log.Infof("cache warmed up with %v of %v names, cost time: %v", warmed, len(questions), time.Since(startTime))
+	return int(warmed)
+}
@@ -0,0 +1,68 @@
+package dohProxy
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestHandler_WarmupCache(t *testing.T) {
+	path := writeTestConfig(t, `# critical names
+www.example.com
+api.example.com. AAAA
+txt.example.com txt
+fail.example.com
+`)
+	questions, err := LoadWarmupNames(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(questions) != 4 || questions[1].Name != "api.example.com." || questions[1].Qtype != dns.TypeAAAA {
+		t.Fatalf("unexpected questions: %v", questions)
+	}
+
+	stub := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		q := r.Question[0]
+		if q.Name == "fail.example.com." {
+			m.SetRcode(r, dns.RcodeServerFailure)
+			_ = w.WriteMsg(m)
+			return
+		}
+		m.SetReply(r)
+		rr, _ := dns.NewRR(map[uint16]string{
+			dns.TypeA:    q.Name + " 300 IN A 192.0.2.1",
+			dns.TypeAAAA: q.Name + " 300 IN AAAA 2001:db8::1",
+			dns.TypeTXT:  q.Name + ` 300 IN TXT "warm"`,
+		}[q.Qtype])
+		m.Answer = append(m.Answer, rr)
+		_ = w.WriteMsg(m)
+	})
+	provider, err := NewPlainProvider([]string{startPlainTestServer(t, stub)}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := NewHandler(provider, &HandlerOptions{Cache: true})
+	// the failed one is skipped.
+	if warmed := handler.WarmupCache(questions); warmed != 3 {
+		t.Errorf("expected 3 names warmed, got: %v", warmed)
+	}
+	for _, q := range questions[:3] {
+		msg := new(dns.Msg)
+		msg.SetQuestion(q.Name, q.Qtype)
+		if rMsg := handler.cache.Get(msg); rMsg == nil || len(rMsg.Answer) != 1 {
+			t.Errorf("%v %v should be cached, got: %v", q.Name, dns.TypeToString[q.Qtype], rMsg)
+		}
+	}
+	msg := new(dns.Msg)
+	msg.SetQuestion("fail.example.com.", dns.TypeA)
+	if rMsg := handler.cache.Get(msg); rMsg != nil {
+		t.Errorf("failed answer should not be cached, got: %v", rMsg)
+	}
+
+	for _, content := range []string{"www.example.com BOGUS\n", "www.example.com A extra\n"} {
+		if _, err := LoadWarmupNames(writeTestConfig(t, content)); err == nil {
+			t.Errorf("%q should be rejected", content)
+		}
+	}
+}
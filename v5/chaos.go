@@ -0,0 +1,56 @@
+package dohProxy
+
+import (
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// Version is the version of doh-proxy.
+	Version = "v5.0.1"
+
+	// DefaultVersionString is answered to version.bind queries if not
+	// specified.
+	DefaultVersionString = "doh-proxy " + Version
+
+	// VersionStringHidden answers the CHAOS queries with REFUSED.
+	VersionStringHidden = "hidden"
+)
+
+// chaosReply answers the CH TXT queries of version.bind and hostname.bind,
+// with their aliases version.server and id.server, RFC 4892; nil for other
+// queries. version is DefaultVersionString if empty, the queries are refused
+// if it's VersionStringHidden.
+func chaosReply(msg *dns.Msg, version string) *dns.Msg {
+	q := msg.Question[0]
+	if q.Qclass != dns.ClassCHAOS || (q.Qtype != dns.TypeTXT && q.Qtype != dns.TypeANY) {
+		return nil
+	}
+	var txt string
+	switch strings.ToLower(dns.Fqdn(q.Name)) {
+	case "version.bind.", "version.server.":
+		txt = version
+		if txt == "" {
+			txt = DefaultVersionString
+		}
+	case "hostname.bind.", "id.server.":
+		txt, _ = os.Hostname()
+	default:
+		return nil
+	}
+
+	rMsg := new(dns.Msg)
+	if version == VersionStringHidden {
+		rMsg.SetRcode(msg, dns.RcodeRefused)
+		return rMsg
+	}
+	rMsg.SetReply(msg)
+	rMsg.Authoritative = true
+	rMsg.Answer = []dns.RR{&dns.TXT{
+		Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS},
+		Txt: []string{txt},
+	}}
+	return rMsg
+}
@@ -0,0 +1,49 @@
+package dohProxy
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestHandler_VersionBind(t *testing.T) {
+	query := func(handler *Handler, name string, qclass uint16) *dns.Msg {
+		writer := newTestResponseWriter("127.0.0.1:5353")
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, dns.TypeTXT)
+		msg.Question[0].Qclass = qclass
+		handler.Handle(writer, msg)
+		return writer.waitMsg(t, time.Second)
+	}
+
+	provider := &testProvider{name: "upstream"}
+	handler := NewHandler(provider, &HandlerOptions{VersionString: "test 1.0"})
+	rMsg := query(handler, "VERSION.BIND.", dns.ClassCHAOS)
+	if len(rMsg.Answer) != 1 || rMsg.Answer[0].(*dns.TXT).Txt[0] != "test 1.0" ||
+		rMsg.Answer[0].Header().Class != dns.ClassCHAOS {
+		t.Errorf("version.bind should be answered with the version string, got: %v", rMsg)
+	}
+	if rMsg = query(handler, "hostname.bind.", dns.ClassCHAOS); len(rMsg.Answer) != 1 {
+		t.Errorf("hostname.bind should be answered, got: %v", rMsg)
+	}
+	if n := atomic.LoadInt32(&provider.queries); n != 0 {
+		t.Errorf("CH queries should not be sent upstream, sent %v", n)
+	}
+	if rMsg = query(handler, "version.bind.", dns.ClassINET); rMsg.Answer[0].(*dns.TXT).Txt[0] != "upstream" {
+		t.Errorf("IN queries should be answered by upstream, got: %v", rMsg)
+	}
+
+	handler = NewHandler(provider, &HandlerOptions{})
+	if rMsg = query(handler, "version.bind.", dns.ClassCHAOS); rMsg.Answer[0].(*dns.TXT).Txt[0] != DefaultVersionString {
+		t.Errorf("version.bind should be answered with the default version, got: %v", rMsg)
+	}
+
+	handler = NewHandler(provider, &HandlerOptions{VersionString: VersionStringHidden})
+	for _, name := range []string{"version.bind.", "hostname.bind."} {
+		if rMsg = query(handler, name, dns.ClassCHAOS); rMsg.Rcode != dns.RcodeRefused {
+			t.Errorf("%v should be refused if hidden, got: %v", name, rMsg)
+		}
+	}
+}
@@ -1,226 +1,1303 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	proxy "github.com/tinkernels/doh-proxy/v5"
+	"io"
 	"math/rand"
 	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
 )
 
-const (
-	gdnsEndpoint = "https://dns.google/dns-query"
-)
-
 // Create a new instance of the logger. You can have any number of instances.
 var log = proxy.Log
 
-var (
-	listenAddressFlag = flag.String(
-		"listen", ":53", "listen address, as `[host]:port`",
+// cmdOptions holds the parsed command line, flags of the resolver are bound
+// to the fields of config.
+type cmdOptions struct {
+	config      *proxy.Config
+	configFile  string
+	version     bool
+	validate    bool
+	printConfig bool
+	testQuery   string
+}
+
+// resettable is implemented by multi-value flags, they are reset before
+// flags on command line overriding the config file.
+type resettable interface {
+	Reset()
+}
+
+func newFlagSet(opts *cmdOptions, output io.Writer) *flag.FlagSet {
+	cfg := opts.config
+	fs := flag.NewFlagSet("doh-proxy", flag.ContinueOnError)
+	fs.SetOutput(output)
+
+	fs.StringVar(&opts.configFile, "config", "",
+		`YAML config file, keys are the same as the flag names, e.g. "endpoint: https://dns.google/dns-query";
+flags on command line override the values in config file; reloaded on SIGHUP`,
+	)
+	fs.Var(&cfg.Listen,
+		"listen",
+		`listen address, as [host]:port, default "`+proxy.DefaultListen+`"; comma separated or specify
+multiple for listening on several addresses, e.g. -listen 0.0.0.0:53 -listen [::]:53`,
+	)
+	fs.StringVar(&cfg.ListenInterface,
+		"listen-interface",
+		cfg.ListenInterface,
+		`Bind the dns and admin listeners to the network interface, e.g. "eth1", by SO_BINDTODEVICE;
+they only get packets through it, on each "listen" address, e.g. ":53"; linux only`,
 	)
 
-	logLevelFlag = flag.String(
+	fs.StringVar(&cfg.LogLevel,
 		"loglevel",
-		"info",
+		cfg.LogLevel,
 		"Log level, one of: debug, info, warn, error, fatal, panic",
 	)
-	googleFlag = flag.Bool(
+	fs.StringVar(&cfg.LogLevelComponent,
+		"loglevel-component",
+		cfg.LogLevelComponent,
+		`Log level overrides of components, as component=level, comma separated, e.g.
+"cache=debug,upstream=warn"; components: cache, upstream`,
+	)
+	fs.BoolVar(&cfg.Google,
 		"google",
-		false,
+		cfg.Google,
 		fmt.Sprintf(`Alternative google url scheme like dns.google/resolve.`),
 	)
-	jsonFlag = flag.Bool(
+	fs.BoolVar(&cfg.JSON,
 		"json",
-		false,
+		cfg.JSON,
 		fmt.Sprintf(`JSON API for DoH like dns.google/resolve.`),
 	)
 	// resolution of the Google DNS endpoint; the interaction of these values is
 	// somewhat complex, and is further explained in the help message.
-	endpointFlag = flag.String(
+	fs.Var(&cfg.Endpoint,
 		"endpoint",
-		gdnsEndpoint,
-		"DNS-over-HTTPS endpoint url",
+		`DNS-over-HTTPS endpoint url, default "`+proxy.DefaultEndpoint+`"; specify multiple
+for failover, endpoints are tried in order:
+    -endpoint https://dns.google/dns-query -endpoint https://cloudflare-dns.com/dns-query`,
 	)
-	endpointIPsFlag = flag.String(
+	fs.StringVar(&cfg.EndpointIPs,
 		"endpoint-ips",
-		"",
+		cfg.EndpointIPs,
 		`IPs of the DNS-over-HTTPS endpoint; if provided, endpoint lookup is
 skipped, the TLS establishment will direct hit the "endpoint-ips". Comma
-separated with no spaces; e.g. "74.125.28.139,74.125.28.102". One server is
-randomly chosen for each request, failed requests are not retried.`,
+separated with no spaces; e.g. "74.125.28.139,74.125.28.102". Connections are
+raced over the ips, ipv6 first, the attempts staggered by 250ms (Happy Eyeballs).`,
 	)
-	ednsSubnetFlag = flag.String(
+	fs.StringVar(&cfg.EDNSSubnet,
 		"edns-subnet",
-		"auto",
+		cfg.EDNSSubnet,
 		`Specify a subnet to be sent in the edns0-client-subnet option;
 take your own risk of privacy to use this option;
-no: will not use edns_subnet;
-auto: will use your current external IP address;
+no: will not use edns_subnet, the subnet of clients is removed from queries and answers;
+auto: will use the subnet of your current external IP address of the family of the client,
+by "ecs-v4-prefix" and "ecs-v6-prefix", the other family if it has none;
 net/mask: will use specified subnet, e.g. 66.66.66.66/24.
        `,
 	)
+	fs.UintVar(&cfg.ECSv4Prefix,
+		"ecs-v4-prefix",
+		cfg.ECSv4Prefix,
+		`Source prefix length of the ipv4 subnet sent with "edns-subnet auto", for clients over ipv4`,
+	)
+	fs.UintVar(&cfg.ECSv6Prefix,
+		"ecs-v6-prefix",
+		cfg.ECSv6Prefix,
+		`Source prefix length of the ipv6 subnet sent with "edns-subnet auto", for clients over ipv6`,
+	)
+	fs.StringVar(&cfg.ECSCachePrefix,
+		"ecs-cache-prefix",
+		cfg.ECSCachePrefix,
+		`Prefix lengths the subnets of clients are truncated to in cache keys, as v4 or v4,v6, e.g. "16,48";
+clients of nearby subnets share entries, trading accuracy for hit rate; exact subnets if empty`,
+	)
+	fs.StringVar(&cfg.ECSPolicyFile,
+		"ecs-policy-file",
+		cfg.ECSPolicyFile,
+		`File of edns0-client-subnet policies by domain, one "domain send|strip" per line, e.g.
+"cdn.example send"; overrides "edns-subnet-mode" for the domain and its subdomains, the longest
+matched domain wins; "send" sends "edns-subnet", auto if it's no`,
+	)
+	fs.UintVar(&cfg.EDNSPadding,
+		"edns-padding",
+		cfg.EDNSPadding,
+		"Pad wire format queries to a multiple of this many bytes with the edns0 padding option, RFC 8467; 0 disables padding",
+	)
+	fs.BoolVar(&cfg.RequestNSID,
+		"request-nsid",
+		cfg.RequestNSID,
+		"Request the NSID of upstream name servers, RFC 5001, logged at debug; answered to clients requesting it only",
+	)
+	fs.StringVar(&cfg.EDNSSubnetMode,
+		"edns-subnet-mode",
+		cfg.EDNSSubnetMode,
+		`How the edns0-client-subnet option is set, one of: global, passthrough, strip;
+global: send the subnet of "edns-subnet" in every query;
+passthrough: forward the subnet of client unchanged, "edns-subnet" is sent if
+the client has none; cached answers are shared within the scope answered by upstream;
+strip: remove the subnet from every query`,
+	)
+	fs.UintVar(&cfg.MinTTL,
+		"min-ttl",
+		cfg.MinTTL,
+		"Minimum ttl in seconds of records in answers, clamped before caching and serving; 0 means no clamping",
+	)
+	fs.UintVar(&cfg.MaxTTL,
+		"max-ttl",
+		cfg.MaxTTL,
+		"Maximum ttl in seconds of records in answers, clamped before caching and serving; 0 means no clamping",
+	)
 
-	cacheFlag = flag.Bool("cache", true, "Cache the dns answers")
+	fs.BoolVar(&cfg.Cache, "cache", cfg.Cache, "Cache the dns answers")
+	fs.UintVar(&cfg.CacheMinTTL,
+		"cache-min-ttl",
+		cfg.CacheMinTTL,
+		"Minimum ttl in seconds of cached answers, 0 means no clamping",
+	)
+	fs.StringVar(&cfg.CacheExcludeQType,
+		"cache-exclude-qtype",
+		cfg.CacheExcludeQType,
+		`Comma separated qtypes never cached, e.g. "TXT,ANY"`,
+	)
+	fs.StringVar(&cfg.BlockQType,
+		"block-qtype",
+		cfg.BlockQType,
+		`Comma separated qtypes refused without querying upstream, e.g. "ANY,AXFR,IXFR"`,
+	)
+	fs.StringVar(&cfg.CacheWarmup,
+		"cache-warmup",
+		cfg.CacheWarmup,
+		`File of names resolved into cache on starting, one "name [qtype]" per line, qtype defaults
+to A; resolved in background, disabled if empty`,
+	)
+	fs.UintVar(&cfg.CacheMaxEntries,
+		"cache-max-entries",
+		cfg.CacheMaxEntries,
+		"Maximum number of cache entries, the least recently used are evicted beyond; 0 means no limit",
+	)
+	fs.StringVar(&cfg.CachePersist,
+		"cache-persist",
+		cfg.CachePersist,
+		`File the cache is saved to on exiting and loaded from on starting, e.g.
+"/var/cache/doh-proxy.gob"; expired entries are discarded on loading; disabled if empty`,
+	)
+	fs.UintVar(&cfg.CacheMaxTTL,
+		"cache-max-ttl",
+		cfg.CacheMaxTTL,
+		"Maximum ttl in seconds of cached answers, 0 means no clamping",
+	)
+	fs.UintVar(&cfg.CacheNegativeMaxTTL,
+		"cache-negative-max-ttl",
+		cfg.CacheNegativeMaxTTL,
+		"Maximum ttl in seconds of cached NXDOMAIN and NODATA answers, cache-max-ttl is used if 0",
+	)
+	fs.IntVar(&cfg.AAAACacheTTL,
+		"aaaa-cache-ttl",
+		cfg.AAAACacheTTL,
+		"Maximum ttl in seconds of cached AAAA records, A records are not affected; 0 means AAAA answers are not cached, negative means no separate clamping",
+	)
+	fs.BoolVar(&cfg.CachePrefetch,
+		"cache-prefetch",
+		cfg.CachePrefetch,
+		"Refresh popular cache entries in background before they expire",
+	)
+	fs.UintVar(&cfg.CachePrefetchThreshold,
+		"cache-prefetch-threshold",
+		cfg.CachePrefetchThreshold,
+		"Minimum hits of a cache entry within its ttl to be prefetched",
+	)
+	fs.UintVar(&cfg.CacheServeStaleTTL,
+		"cache-serve-stale-ttl",
+		cfg.CacheServeStaleTTL,
+		"Seconds to keep expired answers, served when querying upstream failed; 0 disables serving stale answers",
+	)
+	fs.StringVar(&cfg.CacheTTLJitter,
+		"cache-ttl-jitter",
+		cfg.CacheTTLJitter,
+		`Cache entries expire early by a random share of their ttl up to this percentage, e.g. "10%";
+entries stored together expire apart, smoothing the refreshes upstream; disabled if empty`,
+	)
+	fs.BoolVar(&cfg.RotateAnswers,
+		"rotate-answers",
+		cfg.RotateAnswers,
+		"Rotate the order of A and AAAA records on each answer, cached answers rotate on each hit",
+	)
+	fs.BoolVar(&cfg.FlattenCNAME,
+		"flatten-cname",
+		cfg.FlattenCNAME,
+		"Answer A and AAAA queries with the address records at the end of CNAME chains, owned by the queried name",
+	)
+	fs.BoolVar(&cfg.SortAnswersByRTT,
+		"sort-answers-by-rtt",
+		cfg.SortAnswersByRTT,
+		`Sort A and AAAA records by the rtt to the ips, measured by tcp connecting to port 443
+in background, the fastest first; off by default since it adds probing traffic`,
+	)
+	fs.Var(&cfg.Rewrite,
+		"rewrite",
+		`Rewrite the addresses of A and AAAA answers, as cidr=ip, e.g. -rewrite 203.0.113.0/24=10.0.0.5;
+specify multiple for several rules, the first matched wins`,
+	)
+	fs.BoolVar(&cfg.StripDNSSEC,
+		"strip-dnssec",
+		cfg.StripDNSSEC,
+		"Clear the DO bit of queries and remove RRSIG and NSEC records from answers, they are passed through by default",
+	)
+	fs.BoolVar(&cfg.StripAdditional,
+		"strip-additional",
+		cfg.StripAdditional,
+		"Remove the additional section from answers except the EDNS OPT record, shrinking answers over UDP",
+	)
+	fs.BoolVar(&cfg.StripAuthority,
+		"strip-authority",
+		cfg.StripAuthority,
+		"Remove the authority section from answers except the SOA of negative answers, shrinking answers over UDP",
+	)
+	fs.BoolVar(&cfg.MinimizeAnswers,
+		"minimize-answers",
+		cfg.MinimizeAnswers,
+		"Remove the records of the answer section not of the question type, except the CNAME chain to the answer",
+	)
 
-	enableTCPFlag = flag.Bool("tcp", true, "Listen on TCP")
-	enableUDPFlag = flag.Bool("udp", true, "Listen on UDP")
+	fs.StringVar(&cfg.FallbackResolver,
+		"fallback-resolver",
+		cfg.FallbackResolver,
+		`Plain dns resolver queried when all endpoints are unreachable, e.g.
+"1.1.1.1:53"; off by default, queries are sent unencrypted when falling back`,
+	)
+	fs.BoolVar(&cfg.QnameMinimize,
+		"qname-minimize",
+		cfg.QnameMinimize,
+		`Resolve iteratively with plain dns servers, i.e. "fallback-resolver" and plain dns routes,
+taken as the root servers; only the next label of names is sent to each authority (RFC 7816)`,
+	)
+	fs.BoolVar(&cfg.Recursive,
+		"recursive",
+		cfg.Recursive,
+		`Resolve iteratively from the root servers with plain dns instead of querying endpoints, the
+root servers are primed from "dns-resolver" if specified; names are minimized (RFC 7816)`,
+	)
+	fs.BoolVar(&cfg.QnameRandomize,
+		"qname-randomize",
+		cfg.QnameRandomize,
+		`Randomize the letter case of query names sent to plain dns servers, i.e. "fallback-resolver"
+and plain dns routes; answers not echoing the same case are treated as failures`,
+	)
+	fs.BoolVar(&cfg.DNSCookies,
+		"dns-cookies",
+		cfg.DNSCookies,
+		`Send DNS cookies (RFC 7873) to plain dns servers, i.e. "fallback-resolver" and plain
+dns routes; answers with bad cookies are retried once`,
+	)
 
-	// variables set in main body
-	headersFlag     = make(proxy.KeyValue)
-	queryParameters = make(proxy.KeyValue)
+	fs.BoolVar(&cfg.DNSSECValidate,
+		"dnssec-validate",
+		cfg.DNSSECValidate,
+		"Validate DNSSEC signatures of upstream answers, bogus answers are replaced with SERVFAIL",
+	)
+	fs.StringVar(&cfg.DNSSECTrustAnchors,
+		"dnssec-trust-anchors",
+		cfg.DNSSECTrustAnchors,
+		"DS or DNSKEY records of trust anchors in zone file format, the root KSK is used if empty",
+	)
 
-	http2Flag = flag.Bool(
+	fs.BoolVar(&cfg.TCP, "tcp", cfg.TCP, "Listen on TCP")
+	fs.BoolVar(&cfg.UDP, "udp", cfg.UDP, "Listen on UDP")
+	fs.BoolVar(&cfg.Compress,
+		"compress",
+		cfg.Compress,
+		"Compress names in answers, so large answers fit in udp; turn off for clients mishandling compression",
+	)
+	fs.BoolVar(&cfg.ReusePort,
+		"reuseport",
+		cfg.ReusePort,
+		"Set SO_REUSEPORT on the dns listeners, so a new instance can bind while the old one drains; linux only",
+	)
+	fs.DurationVar(&cfg.ShutdownTimeout,
+		"shutdown-timeout",
+		cfg.ShutdownTimeout,
+		`How long in-flight queries are waited for on SIGINT and SIGTERM, e.g. "10s"; queries are still
+accepted until none is in flight, the listeners are closed at the deadline regardless`,
+	)
+	fs.BoolVar(&cfg.Systemd,
+		"systemd",
+		cfg.Systemd,
+		"Serve on the sockets passed by systemd socket activation instead of listen, tcp and udp; also on if LISTEN_FDS is set for this process",
+	)
+	fs.BoolVar(&cfg.TCPFastOpen,
+		"tcp-fastopen",
+		cfg.TCPFastOpen,
+		"Enable TCP Fast Open on the tcp listeners; linux only",
+	)
+	fs.UintVar(&cfg.UDPRcvBuf,
+		"udp-rcvbuf",
+		cfg.UDPRcvBuf,
+		"Receive buffer size in bytes of the udp listeners, SO_RCVBUF; raise it if packets drop under load, capped by net.core.rmem_max on linux; 0 keeps the system default",
+	)
+	fs.UintVar(&cfg.UDPWorkers,
+		"udp-workers",
+		cfg.UDPWorkers,
+		"Maximum udp queries handled concurrently on each udp listener, further packets wait in the receive buffer; 0 is unlimited",
+	)
+
+	// non-standard flag vars
+	fs.Var(
+		cfg.Headers,
+		"headers",
+		`Additional headers to be sent with http requests, as Key=Value; specify
+multiple as:
+    -header Key-1=Value-1-1 -header Key-1=Value1-2 -header Key-2=Value-2
+values are expanded per query as templates of: .ClientIP, .QName, .QNameHash, .QType;
+e.g. -header "X-Client={{.ClientIP}}"`,
+	)
+	fs.Var(
+		cfg.Params,
+		"param",
+		`Additional query parameters to be sent with http requests, as key=value;
+specify multiple as:
+    -param key1=value1-1 -param key1=value1-2 -param key2=value2`,
+	)
+
+	fs.BoolVar(&cfg.HTTP2,
 		"http2",
-		false,
+		cfg.HTTP2,
 		"Using http2 for query connection",
 	)
+	fs.BoolVar(&cfg.HTTP3,
+		"http3",
+		cfg.HTTP3,
+		"Using http3 for query connection, falling back to http2 or http1.1 if the endpoint can't be reached over QUIC; requires building with -tags http3",
+	)
 
-	cacertFlag = flag.String(
+	fs.StringVar(&cfg.CACert,
 		"cacert",
-		"",
-		"CA certificate for TLS establishment",
+		cfg.CACert,
+		"CA certificate for TLS establishment, a PEM file replacing the system certificates",
+	)
+	fs.BoolVar(&cfg.CACertSystem,
+		"cacert-system",
+		cfg.CACertSystem,
+		`Append the certificates of "cacert" to the system certificates rather than replacing them`,
+	)
+	fs.StringVar(&cfg.TLSServerName,
+		"tls-servername",
+		cfg.TLSServerName,
+		"Server name sent in TLS SNI and verified against the certificate of endpoints, rather than the host of the endpoint url",
 	)
 
-	noAAAAFlag = flag.Bool(
+	fs.BoolVar(&cfg.NoIPv6,
 		"no-ipv6",
-		false,
+		cfg.NoIPv6,
 		`Reply all AAAA questions with a fake answer`,
 	)
-	dnsResolverFlag = flag.String(
+	fs.StringVar(&cfg.NoIPv6Mode,
+		"no-ipv6-mode",
+		cfg.NoIPv6Mode,
+		`How AAAA questions are answered with "no-ipv6", one of: fake, nodata, refused;
+fake: an empty answer; nodata: an empty answer with SOA, so clients cache it;
+refused: REFUSED`,
+	)
+	fs.StringVar(&cfg.DNS64Prefix,
+		"dns64-prefix",
+		cfg.DNS64Prefix,
+		`Synthesize AAAA records from A records with the DNS64 prefix, e.g. "64:ff9b::/96",
+for names without AAAA records; disabled if empty`,
+	)
+	fs.StringVar(&cfg.UpstreamProtocol,
+		"upstream-protocol",
+		cfg.UpstreamProtocol,
+		`Upstream protocol, one of: doh, dot, doq; with dot, the endpoint is like
+"tls://dns.google[:853]" or "dns.google[:853]", port 853 is used if omitted;
+doq is like dot with "quic://", requires building with -tags http3`,
+	)
+	fs.StringVar(&cfg.DoHMethod,
+		"doh-method",
+		cfg.DoHMethod,
+		`HTTP method of the DoH queries to endpoint, get or post; post sends the query in the body,
+not limited by the url length, e.g. for large DNSSEC queries; json endpoints always use get`,
+	)
+	fs.StringVar(&cfg.UpstreamStrategy,
+		"upstream-strategy",
+		cfg.UpstreamStrategy,
+		`How multiple endpoints are queried, one of: first, race, round-robin, ip-hash;
+first: try in order, falling over to the next on failure;
+race: query all simultaneously, the first answer wins;
+round-robin: start from the next endpoint for each query, by endpoint-weight, with failover;
+ip-hash: start from the endpoint chosen by the client ip, by endpoint-weight, with failover`,
+	)
+	fs.Var(
+		cfg.EndpointWeights,
+		"endpoint-weight",
+		`Weight of an endpoint for round-robin and ip-hash strategy, as url=weight, 1 if not
+specified; specify multiple as:
+    -endpoint-weight https://dns.google/dns-query=3 -endpoint-weight https://cloudflare-dns.com/dns-query=1`,
+	)
+	fs.DurationVar(&cfg.UpstreamTimeout,
+		"upstream-timeout",
+		cfg.UpstreamTimeout,
+		`Deadline of each query to an endpoint, e.g. "5s"; failing over to the next endpoint
+or "fallback-resolver" on timeout, answered with "upstream-failure-rcode" otherwise`,
+	)
+	fs.StringVar(&cfg.UpstreamFailureRcode,
+		"upstream-failure-rcode",
+		cfg.UpstreamFailureRcode,
+		`Rcode answered when no endpoint or "fallback-resolver" answered, "servfail" or "refused"`,
+	)
+	fs.UintVar(&cfg.UpstreamRetries,
+		"upstream-retries",
+		cfg.UpstreamRetries,
+		`Times to retry an endpoint answering http 429 or 503, with exponential backoff honoring
+"Retry-After" up to 2s, within "upstream-timeout"; 0 disables retrying`,
+	)
+	fs.UintVar(&cfg.UpstreamBreakerThreshold,
+		"upstream-breaker-threshold",
+		cfg.UpstreamBreakerThreshold,
+		`Consecutive failures opening the circuit breaker of an endpoint, which is skipped for
+"upstream-breaker-cooldown" then probed by one query; 0 disables the breakers`,
+	)
+	fs.DurationVar(&cfg.UpstreamBreakerCooldown,
+		"upstream-breaker-cooldown",
+		cfg.UpstreamBreakerCooldown,
+		`How long an endpoint with open circuit breaker is skipped, e.g. "30s"`,
+	)
+	fs.UintVar(&cfg.UpstreamMaxInflight,
+		"upstream-max-inflight",
+		cfg.UpstreamMaxInflight,
+		`Maximum queries sent upstream concurrently, more queries wait for at most "upstream-timeout";
+identical queries in flight share one; 0 is unlimited`,
+	)
+	fs.UintVar(&cfg.UpstreamMaxConns,
+		"upstream-max-conns",
+		cfg.UpstreamMaxConns,
+		`Maximum http connections to each endpoint, also the idle http and DoT connections kept for reuse`,
+	)
+	fs.DurationVar(&cfg.UpstreamIdleTimeout,
+		"upstream-idle-timeout",
+		cfg.UpstreamIdleTimeout,
+		`Close http and DoT connections to endpoints idle for this duration`,
+	)
+	fs.BoolVar(&cfg.UpstreamDisableKeepAlive,
+		"upstream-disable-keepalive",
+		cfg.UpstreamDisableKeepAlive,
+		`Open a new http or DoT connection to the endpoint for each query`,
+	)
+	fs.StringVar(&cfg.DNSResolver,
 		"dns-resolver",
-		"",
-		`DNS resolver for retrieve ip of DoH enpoint host, e.g. "8.8.8.8:53";`,
-		)
-	versionFlag = flag.Bool(
+		cfg.DNSResolver,
+		`DNS resolver for retrieve ip of DoH enpoint host, e.g. "8.8.8.8:53"; the hosts are resolved
+on startup and the ips pinned until their ttl expires, the system resolver is used if it fails;
+ignored if "endpoint-ips" provided`,
+	)
+	fs.StringVar(&cfg.Blocklist,
+		"blocklist",
+		cfg.Blocklist,
+		`Blocklist file in hosts format or one name per line, names like
+"*.example.com" block all subdomains; blocked names are answered without querying;
+the file is reloaded on changes`,
+	)
+	fs.StringVar(&cfg.BlocklistResponse,
+		"blocklist-response",
+		cfg.BlocklistResponse,
+		`Answer to blocked names, "nxdomain" or a sinkhole ip, e.g. "0.0.0.0"`,
+	)
+	fs.StringVar(&cfg.BlocklistCNAME,
+		"blocklist-cname",
+		cfg.BlocklistCNAME,
+		`Answer blocked A and AAAA queries with a CNAME to this sinkhole host and its address record,
+the "blocklist-response" ip or the unspecified address, e.g. "sinkhole.example.net"`,
+	)
+	fs.StringVar(&cfg.Hosts,
+		"hosts",
+		cfg.Hosts,
+		`Static hosts file in hosts format, e.g. "/etc/proxy-hosts"; A and AAAA queries
+of names in it are answered with the ips, round-robin if multiple, before the cache
+and upstream, PTR queries of the ips with all their names; the file is re-read on changes;
+lines like "printer.home 10.0.0.9#3 10.0.0.10#1" answer one ip chosen by weight, 1 if omitted`,
+	)
+	fs.UintVar(&cfg.HostsTTL,
+		"hosts-ttl",
+		cfg.HostsTTL,
+		"TTL in seconds of the answers from static hosts file",
+	)
+	fs.StringVar(&cfg.Proxy,
+		"proxy",
+		cfg.Proxy,
+		`SOCKS5 proxy for connecting to endpoints, as "socks5://[user:pass@]host:port";
+the proxy connects to "endpoint-ips" if provided, endpoint hosts are resolved
+by the proxy unless "dns-resolver" specified`,
+	)
+	fs.StringVar(&cfg.Routes,
+		"routes",
+		cfg.Routes,
+		`Routing file mapping domains to upstreams, one route per line, e.g.
+"corp.local 10.0.0.53:53" or "vpn.corp.local tcp://10.1.0.53"; upstreams are
+DoH urls, "tls://" DoT or "quic://" DoQ endpoints, or plain dns servers; the longest matched
+domain wins, other names are queried by endpoint; reloaded on SIGHUP`,
+	)
+	fs.StringVar(&cfg.RPZ,
+		"rpz",
+		cfg.RPZ,
+		`Response policy zone file, e.g. "/etc/rpz.txt"; queries of qname triggers and answers
+of rpz-ip triggers are answered by the NXDOMAIN, NODATA, PASSTHRU or local data action of the rule`,
+	)
+	fs.StringVar(&cfg.VersionString,
+		"version-string",
+		cfg.VersionString,
+		`Version answered to CH TXT queries of version.bind, "hidden" refuses them along with hostname.bind`,
+	)
+	fs.StringVar(&cfg.RootNSResponse,
+		"root-ns-response",
+		cfg.RootNSResponse,
+		`How NS queries of the root are answered, one of: upstream, local, refused;
+local: answer with the root hints without querying upstream;
+refused: answer with REFUSED, e.g. for scanning traffic`,
+	)
+	fs.StringVar(&cfg.SpecialUseDomains,
+		"special-use-domains",
+		cfg.SpecialUseDomains,
+		`How queries of special-use domains are answered without querying upstream, one of: off, localhost, all;
+localhost: answer localhost and its subdomains with the loopback addresses, and their reverse with localhost;
+all: also answer invalid and the private reverse zones with NXDOMAIN, RFC 6761 and RFC 6303`,
+	)
+	fs.Var(&cfg.UpstreamGroup,
+		"upstream-group",
+		`Upstream group queries can be tagged with by the EDNS0 local option 65001, as name=url1,url2,
+e.g. -upstream-group gaming=https://dns.example.com/dns-query; specify multiple for several groups;
+upstreams are like those of "routes", untagged queries and unknown tags are queried by endpoint`,
+	)
+	fs.StringVar(&cfg.QueryLog,
+		"query-log",
+		cfg.QueryLog,
+		`File to append a line per answered query, e.g. "/var/log/dns-queries.log";
+fields are time, client ip, qname, qtype, rcode, cache hit and upstream latency`,
+	)
+	fs.StringVar(&cfg.QueryLogFormat,
+		"query-log-format",
+		cfg.QueryLogFormat,
+		`Format of query log lines, "text" for key=value pairs or "json" for json lines`,
+	)
+	fs.UintVar(&cfg.QueryLogMaxSize,
+		"query-log-max-size",
+		cfg.QueryLogMaxSize,
+		`Max size in megabytes of the query log, rotated to "<file>.1" when exceeded; 0 means no rotation`,
+	)
+	fs.StringVar(&cfg.MetricsListen,
+		"metrics-listen",
+		cfg.MetricsListen,
+		"Listen address for exposing prometheus metrics on /metrics, as `[host]:port`; disabled if empty",
+	)
+	fs.StringVar(&cfg.OTelEndpoint,
+		"otel-endpoint",
+		cfg.OTelEndpoint,
+		`OpenTelemetry collector the traces of queries are exported to by OTLP/HTTP, e.g.
+"http://localhost:4318"; the traceparent header is sent to DoH upstreams; disabled if empty`,
+	)
+	fs.StringVar(&cfg.AllowFrom,
+		"allow-from",
+		cfg.AllowFrom,
+		`Comma separated CIDRs or ips of clients allowed to query, e.g.
+"10.0.0.0/8,192.168.0.0/16"; others are refused, all clients are allowed if empty`,
+	)
+
+	fs.UintVar(&cfg.RateLimit,
+		"rate-limit",
+		cfg.RateLimit,
+		"Maximum queries per second of each client ip, 0 means no limit",
+	)
+	fs.UintVar(&cfg.RateLimitBurst,
+		"rate-limit-burst",
+		cfg.RateLimitBurst,
+		"Maximum burst of queries of each client ip, rate-limit is used if 0",
+	)
+	fs.StringVar(&cfg.RateLimitAction,
+		"rate-limit-action",
+		cfg.RateLimitAction,
+		`Action on queries over the rate limit, "refuse" to answer with REFUSED or "drop"`,
+	)
+
+	fs.StringVar(&cfg.AdminListen,
+		"admin-listen",
+		cfg.AdminListen,
+		"Listen address for the admin api to inspect and flush the cache on /cache, and health checks on /healthz and /readyz, counters on /stats, upstream state on /upstreams, as `[host]:port`, host defaults to 127.0.0.1; disabled if empty",
+	)
+	fs.Float64Var(&cfg.ReadyMinSuccessRate,
+		"ready-min-success-rate",
+		cfg.ReadyMinSuccessRate,
+		"/readyz of the admin api fails if the success rate of recent upstream queries is below it",
+	)
+
+	fs.StringVar(&cfg.DoHListen,
+		"doh-listen",
+		cfg.DoHListen,
+		`Listen address for serving DNS-over-HTTPS to clients, e.g. ":443"; queries are answered
+like the dns service; disabled if empty`,
+	)
+	fs.StringVar(&cfg.DoHPath,
+		"doh-path",
+		cfg.DoHPath,
+		`Path of the DNS-over-HTTPS service`,
+	)
+	fs.StringVar(&cfg.DoHCert,
+		"doh-cert",
+		cfg.DoHCert,
+		`TLS certificate file of the DNS-over-HTTPS service, served over plain http if empty,
+e.g. behind a reverse proxy`,
+	)
+	fs.StringVar(&cfg.DoHKey,
+		"doh-key",
+		cfg.DoHKey,
+		`TLS key file of the DNS-over-HTTPS service`,
+	)
+
+	fs.BoolVar(&opts.version,
 		"version",
 		false,
 		"Print version info",
 	)
-)
+	fs.BoolVar(&opts.validate,
+		"validate",
+		false,
+		`Check the config, build the upstream provider and send a test query, then exit with
+non-zero status on failure; dns ports aren't bound`,
+	)
 
-func printVersion(){
-	fmt.Println("v5.0.1")
+	fs.BoolVar(&opts.printConfig,
+		"print-config",
+		false,
+		`Print the effective config in yaml, after merging the config file and flags, with
+credentials in headers and proxy redacted, then exit`,
+	)
+	fs.StringVar(&opts.testQuery,
+		"test-query",
+		"",
+		`Resolve a single query through the whole pipeline as name[:qtype], e.g. "example.com:AAAA",
+print the answer and exit with its rcode, e.g. 3 of NXDOMAIN, or 1 if not answered; dns ports aren't bound`,
+	)
+
+	fs.Usage = func() {
+		_, exe := filepath.Split(os.Args[0])
+		_, _ = fmt.Fprint(fs.Output(), "A DNS-protocol proxy for DNS-over-HTTPS service.\n\n")
+		_, _ = fmt.Fprintf(fs.Output(), "Usage:\n\n  %s [options]\n\nOptions:\n\n", exe)
+		fs.PrintDefaults()
+	}
+	return fs
 }
 
-func serve(net <- chan string) {
-	listenNet := <- net
-	log.Infof("starting %s service on %s", listenNet, *listenAddressFlag)
+// parseCmdOptions parses the command line arguments, the config file
+// specified by -config is loaded, then overridden by flags on command line.
+func parseCmdOptions(args []string, output io.Writer) (*cmdOptions, error) {
+	opts := &cmdOptions{config: proxy.NewConfig()}
+	fs := newFlagSet(opts, output)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if opts.configFile == "" {
+		return opts, nil
+	}
+
+	if err := opts.config.LoadFile(opts.configFile); err != nil {
+		return nil, err
+	}
+	fs.Visit(func(f *flag.Flag) {
+		if r, ok := f.Value.(resettable); ok {
+			r.Reset()
+		}
+	})
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	return opts, nil
+}
+
+func printVersion() {
+	fmt.Println(proxy.Version)
+}
 
-	server := &dns.Server{Addr: *listenAddressFlag, Net: listenNet, TsigSecret: nil}
+// dnsServers tracks the running dns servers for shutting down.
+type dnsServers struct {
+	// queries being handled, first for 64-bit alignment of atomic access.
+	inflight int64
+	servers  []*dns.Server
+	wg       sync.WaitGroup
+}
 
-	if err := server.ListenAndServe(); err != nil {
-		log.Fatalf("Failed to setup the %s server: %s\n", listenNet, err.Error())
+// the in-flight queries are checked this often in draining.
+const drainPollInterval = 10 * time.Millisecond
+
+// startServers starts a dns server on each of addrs for each of protocols, it
+// returns after all servers started listening; listenOpts may be nil.
+func startServers(addrs []string, protocols []string, handler dns.Handler,
+	listenOpts *proxy.ListenOptions) (*dnsServers, error) {
+	s := &dnsServers{}
+	for _, addr := range addrs {
+		for _, p := range protocols {
+			if err := s.serve(addr, p, handler, listenOpts); err != nil {
+				s.Shutdown(proxy.DefaultShutdownTimeout)
+				return nil, err
+			}
+		}
 	}
+	return s, nil
+}
 
-	log.Infof("shutting down %s on interrupt\n", listenNet)
-	if err := server.Shutdown(); err != nil {
-		log.Errorf("got unexpected error %s", err.Error())
+// startSystemdServers starts a dns server on each of the sockets passed by
+// systemd socket activation, the socket options of listenOpts are not applied
+// but the udp workers.
+func startSystemdServers(handler dns.Handler, listenOpts *proxy.ListenOptions) (*dnsServers, error) {
+	listeners, packetConns, err := proxy.SystemdSockets()
+	if err != nil {
+		return nil, err
+	}
+	if len(listeners) == 0 && len(packetConns) == 0 {
+		return nil, fmt.Errorf("no sockets passed by systemd")
+	}
+	s := &dnsServers{}
+	for _, l := range listeners {
+		server := &dns.Server{Addr: l.Addr().String(), Net: "tcp", Handler: handler, Listener: l}
+		if err := s.activate(server, listenOpts); err != nil {
+			s.Shutdown(proxy.DefaultShutdownTimeout)
+			return nil, err
+		}
 	}
+	for _, pc := range packetConns {
+		server := &dns.Server{Addr: pc.LocalAddr().String(), Net: "udp", Handler: handler, PacketConn: pc}
+		if err := s.activate(server, listenOpts); err != nil {
+			s.Shutdown(proxy.DefaultShutdownTimeout)
+			return nil, err
+		}
+	}
+	return s, nil
 }
 
-func main() {
-	// non-standard flag vars
-	flag.Var(
-		headersFlag,
-		"headers",
-		`Additional headers to be sent with http requests, as Key=Value; specify
-multiple as:
-    -header Key-1=Value-1-1 -header Key-1=Value1-2 -header Key-2=Value-2`,
-	)
-	flag.Var(
-		queryParameters,
-		"param",
-		`Additional query parameters to be sent with http requests, as key=value;
-specify multiple as:
-    -param key1=value1-1 -param key1=value1-2 -param key2=value2`,
-	)
-	flag.Usage = func() {
-		_, exe := filepath.Split(os.Args[0])
-		_, _ = fmt.Fprint(os.Stderr, "A DNS-protocol proxy for DNS-over-HTTPS service.\n\n")
-		_, _ = fmt.Fprintf(os.Stderr, "Usage:\n\n  %s [options]\n\nOptions:\n\n", exe)
-		flag.PrintDefaults()
+// serve starts a dns server on addr with network, it returns after the server
+// started listening.
+func (s *dnsServers) serve(addr string, network string, handler dns.Handler, listenOpts *proxy.ListenOptions) error {
+	server := &dns.Server{Addr: addr, Net: network, Handler: handler, TsigSecret: nil}
+	// listeners are built here for the socket options.
+	var err error
+	if network == "tcp" {
+		server.Listener, err = proxy.ListenTCP(addr, listenOpts)
+	} else {
+		server.PacketConn, err = proxy.ListenUDP(addr, listenOpts)
 	}
-	flag.Parse()
+	if err != nil {
+		return fmt.Errorf("failed to setup the %s server on %s: %v", network, addr, err)
+	}
+	return s.activate(server, listenOpts)
+}
+
+// activate starts server on its listener or packet conn, it returns after the
+// server started.
+func (s *dnsServers) activate(server *dns.Server, listenOpts *proxy.ListenOptions) error {
+	network, addr := server.Net, server.Addr
+	log.Infof("starting %s service on %s", network, addr)
+	started := make(chan bool)
+	failed := make(chan error, 1)
+	server.NotifyStartedFunc = func() { close(started) }
+	handler := server.Handler
+	server.Handler = dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		atomic.AddInt64(&s.inflight, 1)
+		defer atomic.AddInt64(&s.inflight, -1)
+		handler.ServeDNS(w, r)
+	})
+	if server.PacketConn != nil && listenOpts != nil && listenOpts.UDPWorkers > 0 {
+		proxy.NewUDPWorkers(listenOpts.UDPWorkers).Attach(server)
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		if err := server.ActivateAndServe(); err != nil {
+			failed <- err
+		}
+	}()
+	select {
+	case <-started:
+		s.servers = append(s.servers, server)
+		return nil
+	case err := <-failed:
+		return fmt.Errorf("failed to setup the %s server on %s: %v", network, addr, err)
+	}
+}
+
+// Shutdown drains the servers, queries are accepted until none is in flight,
+// then shuts them down waiting for the queries left; all within timeout, the
+// queries still in flight on the deadline are abandoned.
+func (s *dnsServers) Shutdown(timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	s.drain(ctx)
+	for _, server := range s.servers {
+		log.Infof("shutting down %s service on %s", server.Net, server.Addr)
+		if err := server.ShutdownContext(ctx); err != nil {
+			log.Errorf("shut down %s service on %s error: %v", server.Net, server.Addr, err)
+		}
+	}
+	// the servers return after their queries are handled.
+	stopped := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		log.Errorf("%v queries still in flight after %v, abandoned", atomic.LoadInt64(&s.inflight), timeout)
+	}
+}
+
+// drain waits until no query is in flight or ctx is done, the servers keep
+// accepting queries meanwhile.
+func (s *dnsServers) drain(ctx context.Context) {
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for atomic.LoadInt64(&s.inflight) > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// waitSignals handles the signals until SIGINT or SIGTERM received, reload is
+// called on SIGHUP.
+func waitSignals(sig <-chan os.Signal, reload func()) {
+	for s := range sig {
+		if s != syscall.SIGHUP {
+			log.Infof("received %v, stopping", s)
+			return
+		}
+		reload()
+	}
+}
 
-	if *versionFlag {
+func serveMetrics(addr string) {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(prometheus.NewGoCollector())
+	if err := proxy.RegisterMetrics(registry); err != nil {
+		log.Fatalf("register metrics failed: %v", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+
+	log.Infof("starting metrics service on %s", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Fatalf("Failed to setup the metrics server: %s\n", err.Error())
+	}
+}
+
+func serveDoH(cfg *proxy.Config, handler *proxy.Handler) {
+	server := &http.Server{Addr: cfg.DoHListen, Handler: proxy.NewDoHHandler(handler, cfg.DoHPath)}
+	var err error
+	if cfg.DoHCert != "" {
+		log.Infof("starting DoH service on https://%s%s", cfg.DoHListen, cfg.DoHPath)
+		err = server.ListenAndServeTLS(cfg.DoHCert, cfg.DoHKey)
+	} else {
+		log.Infof("starting DoH service on http://%s%s", cfg.DoHListen, cfg.DoHPath)
+		err = server.ListenAndServe()
+	}
+	if err != nil {
+		log.Fatalf("Failed to setup the DoH server: %s\n", err.Error())
+	}
+}
+
+func serveAdmin(addr string, handler *proxy.Handler, listenOpts *proxy.ListenOptions) {
+	log.Infof("starting admin service on %s", addr)
+	l, err := proxy.ListenTCP(addr, listenOpts)
+	if err == nil {
+		err = http.Serve(l, proxy.NewAdminHandler(handler))
+	}
+	if err != nil {
+		log.Fatalf("Failed to setup the admin server: %s\n", err.Error())
+	}
+}
+
+// newProvider builds the upstream provider from config, it's called on
+// startup and on reloading.
+func newProvider(cfg *proxy.Config) (proxy.Provider, error) {
+	opts, err := cfg.DMProviderOptions()
+	if err != nil {
+		return nil, err
+	}
+	var provider proxy.Provider
+	if cfg.Recursive {
+		provider, err = proxy.NewRecursiveProvider(cfg.RecursiveProviderOptions())
+	} else {
+		provider, err = proxy.NewDMProvider(cfg.Endpoints(), opts)
+	}
+	if err != nil {
+		return nil, err
+	}
+	groups, err := cfg.UpstreamGroups()
+	if err != nil {
+		return nil, err
+	}
+	if len(groups) > 0 {
+		if provider, err = proxy.NewGroupProvider(provider, groups, opts); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Routes != "" {
+		routes, err := proxy.LoadRoutes(cfg.Routes)
+		if err != nil {
+			return nil, err
+		}
+		if provider, err = proxy.NewRouteProvider(provider, routes, opts); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.DNSSECValidate {
+		var anchors []dns.RR
+		if cfg.DNSSECTrustAnchors != "" {
+			if anchors, err = proxy.LoadTrustAnchors(cfg.DNSSECTrustAnchors); err != nil {
+				return nil, err
+			}
+		}
+		if provider, err = proxy.NewDNSSECProvider(provider, anchors); err != nil {
+			return nil, err
+		}
+	}
+	return provider, nil
+}
+
+// validate checks cfg as on starting and queries upstream once, a summary of
+// the effective config is written to output.
+func validate(cfg *proxy.Config, output io.Writer) error {
+	if _, err := logrus.ParseLevel(cfg.LogLevel); err != nil {
+		return fmt.Errorf("invalid log level: %v", err)
+	}
+	if _, err := proxy.ParseComponentLevels(cfg.LogLevelComponent); err != nil {
+		return fmt.Errorf("invalid loglevel-component: %v", err)
+	}
+	handlerOpts, err := cfg.HandlerOptions()
+	if err != nil {
+		return err
+	}
+	if handlerOpts.QueryLog != nil {
+		_ = handlerOpts.QueryLog.Close()
+	}
+	if handlerOpts.Tracer != nil {
+		_ = handlerOpts.Tracer.Close()
+	}
+	if cfg.AdminListen != "" {
+		if _, err := cfg.AdminListenAddr(); err != nil {
+			return err
+		}
+	}
+	if (cfg.DoHCert == "") != (cfg.DoHKey == "") {
+		return fmt.Errorf("doh-cert and doh-key should be specified together")
+	}
+	if cfg.CacheWarmup != "" {
+		if _, err := proxy.LoadWarmupNames(cfg.CacheWarmup); err != nil {
+			return err
+		}
+	}
+	provider, err := newProvider(cfg)
+	if err != nil {
+		return err
+	}
+	if closer, ok := provider.(io.Closer); ok {
+		defer func() { _ = closer.Close() }()
+	}
+	msg := new(dns.Msg)
+	msg.SetQuestion(".", dns.TypeNS)
+	rMsg, err := provider.Query(msg)
+	if err != nil {
+		return fmt.Errorf("test query failed: %v", err)
+	}
+	if rMsg.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("test query answered %v", dns.RcodeToString[rMsg.Rcode])
+	}
+
+	_, _ = fmt.Fprintf(output, "listen:    %v (tcp: %v, udp: %v)\n", cfg.ListenAddrs(), cfg.TCP, cfg.UDP)
+	if cfg.Recursive {
+		_, _ = fmt.Fprintln(output, "endpoints: none, recursive from the root servers")
+	} else {
+		_, _ = fmt.Fprintf(output, "endpoints: %v (%v, strategy %v)\n", cfg.Endpoints(), cfg.UpstreamProtocol, cfg.UpstreamStrategy)
+	}
+	_, _ = fmt.Fprintf(output, "cache:     %v\n", cfg.Cache)
+	if handlerOpts.Blocklist != nil {
+		_, _ = fmt.Fprintf(output, "blocklist: %v entries\n", handlerOpts.Blocklist.Len())
+	}
+	for _, listen := range [][2]string{{"admin", cfg.AdminListen}, {"metrics", cfg.MetricsListen}, {"doh", cfg.DoHListen}} {
+		if listen[1] != "" {
+			_, _ = fmt.Fprintf(output, "%-10v %v\n", listen[0]+":", listen[1])
+		}
+	}
+	return nil
+}
+
+// testQueryTimeout bounds resolving the query of -test-query.
+const testQueryTimeout = 10 * time.Second
+
+// parseTestQuery parses the name[:qtype] of -test-query, qtype defaults to A.
+func parseTestQuery(s string) (*dns.Msg, error) {
+	name, qtype := s, dns.TypeA
+	if i := strings.LastIndex(s, ":"); i >= 0 {
+		t, ok := dns.StringToType[strings.ToUpper(s[i+1:])]
+		if !ok {
+			return nil, fmt.Errorf("invalid qtype of test-query: %v", s[i+1:])
+		}
+		name, qtype = s[:i], t
+	}
+	if _, ok := dns.IsDomainName(name); !ok || name == "" {
+		return nil, fmt.Errorf("invalid name of test-query: %v", name)
+	}
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(name), qtype)
+	return msg, nil
+}
+
+// testQuery resolves query by the handler of cfg, as served, and writes the
+// answer to stdout in the format of dig, the errors to stderr; it returns the
+// exit status, the rcode of the answer or 1 if not answered.
+func testQuery(cfg *proxy.Config, query string, stdout io.Writer, stderr io.Writer) int {
+	msg, err := parseTestQuery(query)
+	if err != nil {
+		_, _ = fmt.Fprintln(stderr, err)
+		return 1
+	}
+	level, err := logrus.ParseLevel(cfg.LogLevel)
+	if err != nil {
+		_, _ = fmt.Fprintf(stderr, "invalid log level: %v\n", err)
+		return 1
+	}
+	componentLevels, err := proxy.ParseComponentLevels(cfg.LogLevelComponent)
+	if err != nil {
+		_, _ = fmt.Fprintf(stderr, "invalid loglevel-component: %v\n", err)
+		return 1
+	}
+	proxy.SetLogLevels(log, level, componentLevels)
+
+	provider, err := newProvider(cfg)
+	if err != nil {
+		_, _ = fmt.Fprintln(stderr, err)
+		return 1
+	}
+	if closer, ok := provider.(io.Closer); ok {
+		defer func() { _ = closer.Close() }()
+	}
+	handlerOpts, err := cfg.HandlerOptions()
+	if err != nil {
+		_, _ = fmt.Fprintln(stderr, err)
+		return 1
+	}
+	if handlerOpts.QueryLog != nil {
+		defer func() { _ = handlerOpts.QueryLog.Close() }()
+	}
+	if handlerOpts.Tracer != nil {
+		defer func() { _ = handlerOpts.Tracer.Close() }()
+	}
+	handler := proxy.NewHandler(provider, handlerOpts)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testQueryTimeout)
+	defer cancel()
+	startTime := time.Now()
+	rMsg, err := handler.Resolve(ctx, msg)
+	if err != nil {
+		_, _ = fmt.Fprintf(stderr, ";; %v %v not answered: %v\n", msg.Question[0].Name,
+			dns.TypeToString[msg.Question[0].Qtype], err)
+		return 1
+	}
+	_, _ = fmt.Fprintln(stdout, rMsg.String())
+	_, _ = fmt.Fprintf(stdout, ";; Query time: %v msec\n", time.Since(startTime).Milliseconds())
+	return rMsg.Rcode
+}
+
+// printConfig writes the effective config cfg to output in yaml, loadable by
+// -config.
+func printConfig(cfg *proxy.Config, output io.Writer) error {
+	content, err := cfg.DumpYAML()
+	if err != nil {
+		return err
+	}
+	_, err = output.Write(content)
+	return err
+}
+
+// run runs the resolver with the command line arguments, it returns the exit
+// status. The requested output, like the printed config, goes to stdout, and
+// the usage and the errors to stderr.
+func run(args []string, stdout io.Writer, stderr io.Writer) int {
+	opts, err := parseCmdOptions(args, stderr)
+	if err == flag.ErrHelp {
+		return 0
+	} else if err != nil {
+		log.Error(err)
+		return 2
+	}
+
+	if opts.version {
 		printVersion()
-		return
+		return 0
+	}
+	if opts.printConfig {
+		if err := printConfig(opts.config, stdout); err != nil {
+			log.Error(err)
+			return 1
+		}
+		return 0
 	}
+	if opts.validate {
+		if err := validate(opts.config, stdout); err != nil {
+			_, _ = fmt.Fprintf(stderr, "invalid: %v\n", err)
+			return 1
+		}
+		_, _ = fmt.Fprintln(stdout, "ok")
+		return 0
+	}
+	if opts.testQuery != "" {
+		return testQuery(opts.config, opts.testQuery, stdout, stderr)
+	}
+	serve(opts.config, args)
+	return 0
+}
 
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// serve serves dns until exiting on signals, the config is reloaded from args
+// on SIGHUP.
+func serve(cfg *proxy.Config, args []string) {
 	// seed the global random number generator
 	rand.Seed(time.Now().UTC().UnixNano())
 
 	// set the loglevel
-	level, err := logrus.ParseLevel(*logLevelFlag)
+	level, err := logrus.ParseLevel(cfg.LogLevel)
 	if err != nil {
 		log.Fatalf("invalid log level: %s", err.Error())
 	}
 
-	log.SetLevel(level)
+	componentLevels, err := proxy.ParseComponentLevels(cfg.LogLevelComponent)
+	if err != nil {
+		log.Fatalf("invalid loglevel-component: %s", err.Error())
+	}
+	proxy.SetLogLevels(log, level, componentLevels)
 	fmt.Println("log level: ", log.GetLevel())
 
-
-	endpointIps, err := proxy.CSVtoIPs(*endpointIPsFlag)
+	provider, err := newProvider(cfg)
 	if err != nil {
-		log.Fatalf("error parsing endpoint-ips: %v", err)
+		log.Fatal(err)
 	}
+	handlerOpts, err := cfg.HandlerOptions()
 	if err != nil {
-		log.Fatalf("error parsing dns-servers: %v", err)
+		log.Fatal(err)
 	}
-
-	ep := *endpointFlag
-	opts := &proxy.DMProviderOptions{
-		EndpointIPs:     endpointIps,
-		EDNSSubnet:      *ednsSubnetFlag,
-		QueryParameters: map[string][]string(queryParameters),
-		Headers:         http.Header(headersFlag),
-		HTTP2:           *http2Flag,
-		CACertFilePath:  *cacertFlag,
-		NoAAAA:          *noAAAAFlag,
-		Alternative:     *googleFlag,
-		JSONAPI:         *jsonFlag,
-		DnsResolver:     *dnsResolverFlag,
+	handler := proxy.NewHandler(provider, handlerOpts)
+	if cfg.CachePersist != "" {
+		if err := handler.LoadCache(cfg.CachePersist); err != nil {
+			log.Errorf("load cache failed, starting with an empty cache: %v", err)
+		}
 	}
-
-	provider, err := proxy.NewDMProvider(ep, opts)
-	if err != nil {
-		log.Fatal(err)
+	if cfg.Cache && cfg.CacheWarmup != "" {
+		questions, err := proxy.LoadWarmupNames(cfg.CacheWarmup)
+		if err != nil {
+			log.Fatalf("load warmup names failed: %v", err)
+		}
+		go handler.WarmupCache(questions)
+	}
+	if cfg.Blocklist != "" {
+		watcher, err := proxy.NewBlocklistWatcher(cfg.Blocklist, handler)
+		if err != nil {
+			log.Fatalf("watch blocklist failed: %v", err)
+		}
+		defer func() { _ = watcher.Close() }()
 	}
-	options := &proxy.HandlerOptions{Cache: *cacheFlag, NoAAAA: *noAAAAFlag}
-	handler := proxy.NewHandler(provider, options)
 
-	dns.HandleFunc(".", handler.Handle)
+	if cfg.MetricsListen != "" {
+		go serveMetrics(cfg.MetricsListen)
+	}
+	if cfg.AdminListen != "" {
+		addr, err := cfg.AdminListenAddr()
+		if err != nil {
+			log.Fatal(err)
+		}
+		go serveAdmin(addr, handler, &proxy.ListenOptions{Interface: cfg.ListenInterface})
+		go handler.ProbeUpstream()
+	}
+	if cfg.DoHListen != "" {
+		if (cfg.DoHCert == "") != (cfg.DoHKey == "") {
+			log.Fatal("doh-cert and doh-key should be specified together")
+		}
+		go serveDoH(cfg, handler)
+	}
 
 	// push the list of enabled protocols into an array
 	var protocols []string
-	if *enableTCPFlag {
+	if cfg.TCP {
 		protocols = append(protocols, "tcp")
 	}
-	if *enableUDPFlag {
+	if cfg.UDP {
 		protocols = append(protocols, "udp")
 	}
 
-	// start the servers and wait for exit.
-	servers := make(chan string)
-	defer close(servers)
-	for _, p := range protocols {
-		go serve(servers)
-		servers <- p
+	// notify before starting, signals in starting aren't lost.
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+
+	listenOpts := &proxy.ListenOptions{ReusePort: cfg.ReusePort, TCPFastOpen: cfg.TCPFastOpen,
+		UDPRcvBuf: int(cfg.UDPRcvBuf), UDPWorkers: int(cfg.UDPWorkers), Interface: cfg.ListenInterface}
+	var servers *dnsServers
+	if cfg.Systemd || proxy.SystemdActivated() {
+		servers, err = startSystemdServers(dns.HandlerFunc(handler.Handle), listenOpts)
+	} else {
+		servers, err = startServers(cfg.ListenAddrs(), protocols, dns.HandlerFunc(handler.Handle), listenOpts)
+	}
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	// serve until exit
-	sig := make(chan os.Signal)
-	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
-	<- sig
+	// serve until exit, reload the provider on SIGHUP.
+	waitSignals(sig, func() {
+		log.Infoln("reloading provider on SIGHUP")
+		reloaded, err := parseCmdOptions(args, os.Stderr)
+		if err != nil {
+			log.Errorf("reload config failed, keep using the old provider: %v", err)
+			return
+		}
+		newProvider, err := newProvider(reloaded.config)
+		if err != nil {
+			log.Errorf("reload provider failed, keep using the old one: %v", err)
+			return
+		}
+		handler.SwapProvider(newProvider)
+	})
 
+	servers.Shutdown(cfg.ShutdownTimeout)
+	// after the servers stopped, no more entries are inserted by queries.
+	if cfg.CachePersist != "" {
+		if err := handler.SaveCache(cfg.CachePersist); err != nil {
+			log.Errorf("save cache failed: %v", err)
+		}
+	}
+	if handlerOpts.QueryLog != nil {
+		if err := handlerOpts.QueryLog.Close(); err != nil {
+			log.Errorf("close query log error: %v", err)
+		}
+	}
+	if handlerOpts.Tracer != nil {
+		if err := handlerOpts.Tracer.Close(); err != nil {
+			log.Errorf("close tracer error: %v", err)
+		}
+	}
 	log.Infoln("servers exited, stopping")
 }
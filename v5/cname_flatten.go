@@ -0,0 +1,108 @@
+package dohProxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// max CNAMEs followed when flattening a chain.
+const maxCNAMEDepth = 8
+
+// flattenCNAME answers the A or AAAA query msg with the address records at the
+// end of the CNAME chain in rMsg, owned by the queried name; the chain is
+// followed by querying upstream if rMsg doesn't include all of it. rMsg is
+// returned if there is no chain or it can't be flattened.
+func (h *Handler) flattenCNAME(msg *dns.Msg, rMsg *dns.Msg, clientIP net.IP) *dns.Msg {
+	qname := msg.Question[0].Name
+	qtype := msg.Question[0].Qtype
+	name := qname
+	ttl := ^uint32(0)
+	answer := rMsg.Answer
+	seen := map[string]bool{}
+	for depth := 0; ; depth++ {
+		target, cnameTTL, ok := findCNAME(answer, name)
+		if !ok {
+			break
+		}
+		if seen[strings.ToLower(target)] || depth >= maxCNAMEDepth {
+			Log.Debugf("cname chain of %v is looping or too long", qname)
+			return rMsg
+		}
+		seen[strings.ToLower(name)] = true
+		name = target
+		if cnameTTL < ttl {
+			ttl = cnameTTL
+		}
+		if _, _, ok := findCNAME(answer, name); ok || hasAddress(answer, name, qtype) {
+			continue
+		}
+		// the chain isn't complete in the answer.
+		next, err := h.queryName(msg, name, clientIP)
+		if err != nil {
+			Log.Debugf("follow cname %v of %v failed: %v", name, qname, err)
+			return rMsg
+		}
+		answer = next.Answer
+	}
+	if name == qname {
+		return rMsg
+	}
+
+	var flattened []dns.RR
+	for _, rr := range answer {
+		if rr.Header().Rrtype != qtype || !strings.EqualFold(rr.Header().Name, name) {
+			continue
+		}
+		rr = dns.Copy(rr)
+		rr.Header().Name = qname
+		if ttl < rr.Header().Ttl {
+			rr.Header().Ttl = ttl
+		}
+		flattened = append(flattened, rr)
+	}
+	if len(flattened) == 0 {
+		return rMsg
+	}
+	resp := rMsg.Copy()
+	resp.Answer = flattened
+	Log.Debugf("flattened cname chain of %v to %v", qname, name)
+	return resp
+}
+
+// queryName queries upstream for name with the question type of msg.
+func (h *Handler) queryName(msg *dns.Msg, name string, clientIP net.IP) (*dns.Msg, error) {
+	qMsg := msg.Copy()
+	qMsg.Question[0].Name = name
+	v, err, _ := h.inFlightQueries.Do(getQueryStringForCache(qMsg), func() (interface{}, error) {
+		return h.queryUpstream(context.Background(), qMsg, clientIP)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if v == nil {
+		return nil, fmt.Errorf("no answer")
+	}
+	return v.(*dns.Msg), nil
+}
+
+func findCNAME(rrs []dns.RR, name string) (string, uint32, bool) {
+	for _, rr := range rrs {
+		if cname, ok := rr.(*dns.CNAME); ok && strings.EqualFold(cname.Hdr.Name, name) {
+			return cname.Target, cname.Hdr.Ttl, true
+		}
+	}
+	return "", 0, false
+}
+
+func hasAddress(rrs []dns.RR, name string, qtype uint16) bool {
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == qtype && strings.EqualFold(rr.Header().Name, name) {
+			return true
+		}
+	}
+	return false
+}
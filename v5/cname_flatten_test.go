@@ -0,0 +1,101 @@
+package dohProxy
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// zoneProvider answers questions with the records in zone by name, the same
+// way for all types.
+type zoneProvider struct {
+	zone map[string][]string
+}
+
+func (p *zoneProvider) Query(msg *dns.Msg) (*dns.Msg, error) {
+	rMsg := new(dns.Msg)
+	rMsg.SetReply(msg)
+	for _, record := range p.zone[strings.ToLower(msg.Question[0].Name)] {
+		rr, _ := dns.NewRR(record)
+		rMsg.Answer = append(rMsg.Answer, rr)
+	}
+	return rMsg, nil
+}
+
+func TestHandler_FlattenCNAME(t *testing.T) {
+	provider := &zoneProvider{zone: map[string][]string{
+		// the chain isn't complete in one response.
+		"www.example.com.": {
+			"www.example.com. 300 IN CNAME cdn.example.net.",
+			"cdn.example.net. 120 IN CNAME edge.example.org.",
+		},
+		"edge.example.org.": {
+			"edge.example.org. 600 IN A 192.0.2.1",
+			"edge.example.org. 600 IN A 192.0.2.2",
+		},
+		"loop.example.com.": {
+			"loop.example.com. 300 IN CNAME loop2.example.com.",
+			"loop2.example.com. 300 IN CNAME loop.example.com.",
+		},
+	}}
+	handler := NewHandler(provider, &HandlerOptions{FlattenCNAME: true})
+
+	writer := newTestResponseWriter("127.0.0.1:5353")
+	msg := new(dns.Msg)
+	msg.SetQuestion("www.example.com.", dns.TypeA)
+	handler.Handle(writer, msg)
+	rMsg := writer.waitMsg(t, time.Second)
+	if len(rMsg.Answer) != 2 {
+		t.Fatalf("expected 2 A records, got: %v", rMsg)
+	}
+	for _, rr := range rMsg.Answer {
+		a, ok := rr.(*dns.A)
+		if !ok || a.Hdr.Name != "www.example.com." {
+			t.Errorf("expected A record of www.example.com., got: %v", rr)
+			continue
+		}
+		if a.Hdr.Ttl != 120 {
+			t.Errorf("ttl should be the min of the chain 120, got: %v", a.Hdr.Ttl)
+		}
+	}
+
+	writer = newTestResponseWriter("127.0.0.1:5353")
+	msg.SetQuestion("loop.example.com.", dns.TypeA)
+	handler.Handle(writer, msg)
+	if rMsg := writer.waitMsg(t, time.Second); len(rMsg.Answer) != 2 {
+		t.Errorf("looping chain should be answered as is, got: %v", rMsg)
+	}
+}
+
+func TestHandler_FlattenCNAMEPrefetch(t *testing.T) {
+	provider := &zoneProvider{zone: map[string][]string{
+		"www.example.com.": {
+			"www.example.com. 300 IN CNAME edge.example.org.",
+			"edge.example.org. 600 IN A 192.0.2.1",
+		},
+	}}
+	handler := NewHandler(provider, &HandlerOptions{FlattenCNAME: true, Cache: true})
+	writer := newTestResponseWriter("127.0.0.1:5353")
+	msg := new(dns.Msg)
+	msg.SetQuestion("www.example.com.", dns.TypeA)
+	handler.Handle(writer, msg)
+	writer.waitMsg(t, time.Second)
+	for deadline := time.Now().Add(time.Second); handler.cache.Get(msg) == nil; {
+		if time.Now().After(deadline) {
+			t.Fatalf("answer should be cached")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the refreshed entry is flattened too.
+	handler.prefetch(msg.Copy())
+	rMsg := handler.cache.Get(msg)
+	if rMsg == nil || len(rMsg.Answer) != 1 {
+		t.Fatalf("expected the flattened answer cached, got: %v", rMsg)
+	}
+	if a, ok := rMsg.Answer[0].(*dns.A); !ok || a.Hdr.Name != "www.example.com." {
+		t.Errorf("expected A record of www.example.com., got: %v", rMsg.Answer[0])
+	}
+}
@@ -0,0 +1,695 @@
+package dohProxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// DefaultEndpoint is the DoH endpoint used if none specified.
+	DefaultEndpoint = "https://dns.google/dns-query"
+	// DefaultListen is the listen address used if none specified.
+	DefaultListen = ":53"
+	// DefaultUpstreamTimeout is the deadline of each query to an endpoint.
+	DefaultUpstreamTimeout = 5 * time.Second
+	// DefaultUpstreamRetries is the retries of an endpoint on transient errors.
+	DefaultUpstreamRetries = 2
+	// DefaultShutdownTimeout is how long in-flight queries are waited for on
+	// exit.
+	DefaultShutdownTimeout = 5 * time.Second
+)
+
+// Config mirrors the command line options of the resolver, keys in config
+// file are the same as the flag names.
+type Config struct {
+	Listen                   StringList    `yaml:"listen"`
+	LogLevel                 string        `yaml:"loglevel"`
+	LogLevelComponent        string        `yaml:"loglevel-component"`
+	Google                   bool          `yaml:"google"`
+	JSON                     bool          `yaml:"json"`
+	Endpoint                 StringList    `yaml:"endpoint"`
+	EndpointIPs              string        `yaml:"endpoint-ips"`
+	EDNSSubnet               string        `yaml:"edns-subnet"`
+	EDNSSubnetMode           string        `yaml:"edns-subnet-mode"`
+	ECSPolicyFile            string        `yaml:"ecs-policy-file"`
+	ECSv4Prefix              uint          `yaml:"ecs-v4-prefix"`
+	ECSv6Prefix              uint          `yaml:"ecs-v6-prefix"`
+	ECSCachePrefix           string        `yaml:"ecs-cache-prefix"`
+	EDNSPadding              uint          `yaml:"edns-padding"`
+	RequestNSID              bool          `yaml:"request-nsid"`
+	Cache                    bool          `yaml:"cache"`
+	MinTTL                   uint          `yaml:"min-ttl"`
+	MaxTTL                   uint          `yaml:"max-ttl"`
+	CacheMinTTL              uint          `yaml:"cache-min-ttl"`
+	CacheMaxTTL              uint          `yaml:"cache-max-ttl"`
+	CacheNegativeMaxTTL      uint          `yaml:"cache-negative-max-ttl"`
+	AAAACacheTTL             int           `yaml:"aaaa-cache-ttl"`
+	CachePrefetch            bool          `yaml:"cache-prefetch"`
+	CachePrefetchThreshold   uint          `yaml:"cache-prefetch-threshold"`
+	CacheServeStaleTTL       uint          `yaml:"cache-serve-stale-ttl"`
+	CacheTTLJitter           string        `yaml:"cache-ttl-jitter"`
+	CacheMaxEntries          uint          `yaml:"cache-max-entries"`
+	CachePersist             string        `yaml:"cache-persist"`
+	CacheExcludeQType        string        `yaml:"cache-exclude-qtype"`
+	BlockQType               string        `yaml:"block-qtype"`
+	CacheWarmup              string        `yaml:"cache-warmup"`
+	RotateAnswers            bool          `yaml:"rotate-answers"`
+	FlattenCNAME             bool          `yaml:"flatten-cname"`
+	SortAnswersByRTT         bool          `yaml:"sort-answers-by-rtt"`
+	Rewrite                  StringList    `yaml:"rewrite"`
+	StripDNSSEC              bool          `yaml:"strip-dnssec"`
+	StripAdditional          bool          `yaml:"strip-additional"`
+	StripAuthority           bool          `yaml:"strip-authority"`
+	MinimizeAnswers          bool          `yaml:"minimize-answers"`
+	TCP                      bool          `yaml:"tcp"`
+	UDP                      bool          `yaml:"udp"`
+	ReusePort                bool          `yaml:"reuseport"`
+	ListenInterface          string        `yaml:"listen-interface"`
+	TCPFastOpen              bool          `yaml:"tcp-fastopen"`
+	Systemd                  bool          `yaml:"systemd"`
+	UDPRcvBuf                uint          `yaml:"udp-rcvbuf"`
+	UDPWorkers               uint          `yaml:"udp-workers"`
+	ShutdownTimeout          time.Duration `yaml:"shutdown-timeout"`
+	Headers                  KeyValue      `yaml:"headers"`
+	Params                   KeyValue      `yaml:"param"`
+	HTTP2                    bool          `yaml:"http2"`
+	HTTP3                    bool          `yaml:"http3"`
+	CACert                   string        `yaml:"cacert"`
+	CACertSystem             bool          `yaml:"cacert-system"`
+	TLSServerName            string        `yaml:"tls-servername"`
+	NoIPv6                   bool          `yaml:"no-ipv6"`
+	NoIPv6Mode               string        `yaml:"no-ipv6-mode"`
+	DNS64Prefix              string        `yaml:"dns64-prefix"`
+	UpstreamProtocol         string        `yaml:"upstream-protocol"`
+	DoHMethod                string        `yaml:"doh-method"`
+	UpstreamStrategy         string        `yaml:"upstream-strategy"`
+	EndpointWeights          KeyValue      `yaml:"endpoint-weight"`
+	EndpointOptions          EndpointOpts  `yaml:"endpoint-options"`
+	UpstreamTimeout          time.Duration `yaml:"upstream-timeout"`
+	UpstreamFailureRcode     string        `yaml:"upstream-failure-rcode"`
+	UpstreamMaxInflight      uint          `yaml:"upstream-max-inflight"`
+	UpstreamRetries          uint          `yaml:"upstream-retries"`
+	UpstreamBreakerThreshold uint          `yaml:"upstream-breaker-threshold"`
+	UpstreamBreakerCooldown  time.Duration `yaml:"upstream-breaker-cooldown"`
+	UpstreamMaxConns         uint          `yaml:"upstream-max-conns"`
+	UpstreamIdleTimeout      time.Duration `yaml:"upstream-idle-timeout"`
+	UpstreamDisableKeepAlive bool          `yaml:"upstream-disable-keepalive"`
+	DNSResolver              string        `yaml:"dns-resolver"`
+	MetricsListen            string        `yaml:"metrics-listen"`
+	OTelEndpoint             string        `yaml:"otel-endpoint"`
+	QueryLog                 string        `yaml:"query-log"`
+	QueryLogFormat           string        `yaml:"query-log-format"`
+	QueryLogMaxSize          uint          `yaml:"query-log-max-size"`
+	AdminListen              string        `yaml:"admin-listen"`
+	ReadyMinSuccessRate      float64       `yaml:"ready-min-success-rate"`
+	DoHListen                string        `yaml:"doh-listen"`
+	DoHPath                  string        `yaml:"doh-path"`
+	DoHCert                  string        `yaml:"doh-cert"`
+	DoHKey                   string        `yaml:"doh-key"`
+	AllowFrom                string        `yaml:"allow-from"`
+	RateLimit                uint          `yaml:"rate-limit"`
+	RateLimitBurst           uint          `yaml:"rate-limit-burst"`
+	RateLimitAction          string        `yaml:"rate-limit-action"`
+	Blocklist                string        `yaml:"blocklist"`
+	BlocklistResponse        string        `yaml:"blocklist-response"`
+	BlocklistCNAME           string        `yaml:"blocklist-cname"`
+	RPZ                      string        `yaml:"rpz"`
+	Hosts                    string        `yaml:"hosts"`
+	HostsTTL                 uint          `yaml:"hosts-ttl"`
+	Routes                   string        `yaml:"routes"`
+	UpstreamGroup            StringList    `yaml:"upstream-group"`
+	VersionString            string        `yaml:"version-string"`
+	RootNSResponse           string        `yaml:"root-ns-response"`
+	SpecialUseDomains        string        `yaml:"special-use-domains"`
+	Proxy                    string        `yaml:"proxy"`
+	FallbackResolver         string        `yaml:"fallback-resolver"`
+	QnameRandomize           bool          `yaml:"qname-randomize"`
+	DNSCookies               bool          `yaml:"dns-cookies"`
+	QnameMinimize            bool          `yaml:"qname-minimize"`
+	Recursive                bool          `yaml:"recursive"`
+	DNSSECValidate           bool          `yaml:"dnssec-validate"`
+	DNSSECTrustAnchors       string        `yaml:"dnssec-trust-anchors"`
+	Compress                 bool          `yaml:"compress"`
+}
+
+// EndpointOpt is the block of an endpoint in config file, headers and query
+// parameters sent to it besides the global ones of the same keys.
+type EndpointOpt struct {
+	Headers KeyValue `yaml:"headers"`
+	Params  KeyValue `yaml:"param"`
+}
+
+// EndpointOpts are the blocks of endpoints by url, config file only, e.g.:
+//
+//	endpoint-options:
+//	  https://dns.example/dns-query:
+//	    headers:
+//	      X-Api-Key: secret
+type EndpointOpts map[string]EndpointOpt
+
+// NewConfig returns a Config with default values.
+func NewConfig() *Config {
+	return &Config{
+		LogLevel:                "info",
+		EDNSSubnet:              "auto",
+		EDNSSubnetMode:          EDNSSubnetModeGlobal,
+		ECSv4Prefix:             DefaultECSv4Prefix,
+		ECSv6Prefix:             DefaultECSv6Prefix,
+		EDNSPadding:             DefaultEDNSPadding,
+		Cache:                   true,
+		CachePrefetchThreshold:  10,
+		CacheMaxEntries:         DefaultCacheMaxEntries,
+		AAAACacheTTL:            -1,
+		TCP:                     true,
+		UDP:                     true,
+		Headers:                 make(KeyValue),
+		Params:                  make(KeyValue),
+		EndpointWeights:         make(KeyValue),
+		UpstreamProtocol:        ProtocolDoH,
+		DoHMethod:               DoHMethodGet,
+		DoHPath:                 DefaultDoHPath,
+		ReadyMinSuccessRate:     DefaultReadyMinSuccessRate,
+		UpstreamStrategy:        StrategyFirst,
+		UpstreamTimeout:         DefaultUpstreamTimeout,
+		UpstreamFailureRcode:    UpstreamFailureServFail,
+		UpstreamRetries:         DefaultUpstreamRetries,
+		ShutdownTimeout:         DefaultShutdownTimeout,
+		UpstreamBreakerCooldown: DefaultUpstreamBreakerCooldown,
+		UpstreamMaxConns:        DefaultUpstreamMaxConns,
+		UpstreamIdleTimeout:     DefaultUpstreamIdleTimeout,
+		BlocklistResponse:       BlocklistResponseNXDomain,
+		RateLimitAction:         RateLimitActionRefuse,
+		NoIPv6Mode:              NoAAAAModeFake,
+		QueryLogFormat:          QueryLogFormatText,
+		QueryLogMaxSize:         100,
+		HostsTTL:                DefaultStaticHostsTTL,
+		Compress:                true,
+		VersionString:           DefaultVersionString,
+		RootNSResponse:          RootNSResponseUpstream,
+		SpecialUseDomains:       SpecialUseDomainsLocalhost,
+	}
+}
+
+// LoadFile loads the yaml config file into c, keys absent in the file keep
+// their current values, unknown keys are reported as error.
+func (c *Config) LoadFile(path string) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read config file %v error: %v", path, err)
+	}
+	if err := yaml.UnmarshalStrict(content, c); err != nil {
+		return fmt.Errorf("parse config file %v error: %v", path, err)
+	}
+	return nil
+}
+
+// redactedValue replaces the credentials in dumped config.
+const redactedValue = "REDACTED"
+
+// credentialHeaderNames are the substrings of names of headers holding
+// credentials, in lower case.
+var credentialHeaderNames = []string{"auth", "cookie", "token", "key", "secret", "password"}
+
+// DumpYAML returns c as a yaml config file of all keys, with the default
+// endpoint and listen address filled in and durations written as e.g. "5s";
+// header values that look like credentials and the password of the proxy url
+// are redacted.
+func (c *Config) DumpYAML() ([]byte, error) {
+	effective := *c
+	effective.Endpoint = c.Endpoints()
+	effective.Listen = c.ListenAddrs()
+	v := reflect.ValueOf(&effective).Elem()
+	var out yaml.MapSlice
+	for i := 0; i < v.NumField(); i++ {
+		key := v.Type().Field(i).Tag.Get("yaml")
+		var value interface{}
+		switch fv := v.Field(i).Interface().(type) {
+		case time.Duration:
+			value = fv.String()
+		case StringList:
+			value = []string(fv)
+		case KeyValue:
+			if key == "headers" {
+				fv = redactHeaders(fv)
+			}
+			value = map[string][]string(fv)
+		case EndpointOpts:
+			redacted := make(EndpointOpts, len(fv))
+			for endpoint, opt := range fv {
+				redacted[endpoint] = EndpointOpt{Headers: redactHeaders(opt.Headers), Params: opt.Params}
+			}
+			value = redacted
+		default:
+			value = fv
+		}
+		if key == "proxy" {
+			value = redactURL(c.Proxy)
+		}
+		out = append(out, yaml.MapItem{Key: key, Value: value})
+	}
+	return yaml.Marshal(out)
+}
+
+// redactHeaders returns a copy of headers, values of credential headers and
+// values of authorization schemes are redacted.
+func redactHeaders(headers KeyValue) KeyValue {
+	redacted := make(KeyValue, len(headers))
+	for name, vs := range headers {
+		credential := false
+		for _, s := range credentialHeaderNames {
+			if strings.Contains(strings.ToLower(name), s) {
+				credential = true
+				break
+			}
+		}
+		for _, v := range vs {
+			fields := strings.Fields(strings.ToLower(v))
+			if credential || (len(fields) == 2 && (fields[0] == "bearer" || fields[0] == "basic")) {
+				v = redactedValue
+			}
+			redacted[name] = append(redacted[name], v)
+		}
+	}
+	return redacted
+}
+
+// redactURL returns rawURL with the password redacted, as is if it has none.
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.User == nil {
+		return rawURL
+	}
+	if _, ok := u.User.Password(); !ok {
+		return rawURL
+	}
+	u.User = url.UserPassword(u.User.Username(), redactedValue)
+	return u.String()
+}
+
+// Endpoints returns the endpoints for NewDMProvider, DefaultEndpoint is used
+// if none specified.
+func (c *Config) Endpoints() []string {
+	if len(c.Endpoint) == 0 {
+		return []string{DefaultEndpoint}
+	}
+	return c.Endpoint
+}
+
+// allEndpoints returns the endpoints, and the upstreams of the upstream groups
+// and of the routes file.
+func (c *Config) allEndpoints() ([]string, error) {
+	endpoints := append([]string(nil), c.Endpoints()...)
+	groups, err := c.UpstreamGroups()
+	if err != nil {
+		return nil, err
+	}
+	for _, upstreams := range groups {
+		endpoints = append(endpoints, upstreams...)
+	}
+	if c.Routes != "" {
+		routes, err := LoadRoutes(c.Routes)
+		if err != nil {
+			return nil, err
+		}
+		for _, route := range routes {
+			endpoints = append(endpoints, route.Upstreams...)
+		}
+	}
+	return endpoints, nil
+}
+
+// ListenAddrs returns the listen addresses of dns service, values may be comma
+// separated; DefaultListen is used if none specified.
+func (c *Config) ListenAddrs() []string {
+	var addrs []string
+	for _, v := range c.Listen {
+		for _, addr := range strings.Split(v, ",") {
+			if addr = strings.TrimSpace(addr); addr != "" {
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+	if len(addrs) == 0 {
+		return []string{DefaultListen}
+	}
+	return addrs
+}
+
+// AdminListenAddr returns the listen address of the admin api, the host
+// defaults to 127.0.0.1; it can't be the port of dns service.
+func (c *Config) AdminListenAddr() (string, error) {
+	host, port, err := net.SplitHostPort(c.AdminListen)
+	if err != nil {
+		return "", fmt.Errorf("invalid admin-listen: %v", err)
+	}
+	for _, listen := range c.ListenAddrs() {
+		if _, listenPort, err := net.SplitHostPort(listen); err == nil && listenPort == port {
+			return "", fmt.Errorf("admin-listen %v conflicts with dns service on %v", c.AdminListen, listen)
+		}
+	}
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// DMProviderOptions returns the options for NewDMProvider.
+func (c *Config) DMProviderOptions() (*DMProviderOptions, error) {
+	endpointIps, err := CSVtoIPs(c.EndpointIPs)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing endpoint-ips: %v", err)
+	}
+	if c.ECSv4Prefix > 32 {
+		return nil, fmt.Errorf("invalid ecs-v4-prefix: %v", c.ECSv4Prefix)
+	}
+	if c.ECSv6Prefix > 128 {
+		return nil, fmt.Errorf("invalid ecs-v6-prefix: %v", c.ECSv6Prefix)
+	}
+	ednsPadding := int(c.EDNSPadding)
+	if ednsPadding == 0 {
+		ednsPadding = -1
+	}
+	var weights map[string]int
+	for endpoint, vs := range c.EndpointWeights {
+		if weights == nil {
+			weights = make(map[string]int)
+		}
+		// the last one wins if specified multiple times.
+		weight, err := strconv.Atoi(vs[len(vs)-1])
+		if err != nil || weight <= 0 {
+			return nil, fmt.Errorf("invalid endpoint-weight of %v: %v", endpoint, vs[len(vs)-1])
+		}
+		weights[endpoint] = weight
+	}
+	var endpointHeaders map[string]http.Header
+	var endpointParams map[string]map[string][]string
+	var endpoints []string
+	if len(c.EndpointOptions) > 0 {
+		if endpoints, err = c.allEndpoints(); err != nil {
+			return nil, err
+		}
+	}
+	for endpoint, opt := range c.EndpointOptions {
+		if !containsString(endpoints, endpoint) {
+			return nil, fmt.Errorf("endpoint-options of unknown endpoint: %v", endpoint)
+		}
+		if endpointHeaders == nil {
+			endpointHeaders = make(map[string]http.Header)
+			endpointParams = make(map[string]map[string][]string)
+		}
+		if len(opt.Headers) != 0 {
+			endpointHeaders[endpoint] = http.Header(opt.Headers)
+		}
+		if len(opt.Params) != 0 {
+			endpointParams[endpoint] = map[string][]string(opt.Params)
+		}
+	}
+	var ecsPolicies *ECSPolicies
+	if c.ECSPolicyFile != "" {
+		if ecsPolicies, err = LoadECSPolicies(c.ECSPolicyFile); err != nil {
+			return nil, err
+		}
+	}
+	return &DMProviderOptions{
+		EndpointIPs:        endpointIps,
+		EDNSSubnet:         c.EDNSSubnet,
+		EDNSSubnetMode:     c.EDNSSubnetMode,
+		ECSv4Prefix:        int(c.ECSv4Prefix),
+		ECSv6Prefix:        int(c.ECSv6Prefix),
+		ECSPolicies:        ecsPolicies,
+		EDNSPadding:        ednsPadding,
+		RequestNSID:        c.RequestNSID,
+		QueryParameters:    map[string][]string(c.Params),
+		Headers:            http.Header(c.Headers),
+		HTTP2:              c.HTTP2,
+		HTTP3:              c.HTTP3,
+		CACertFilePath:     c.CACert,
+		CACertAppendSystem: c.CACertSystem,
+		TLSServerName:      c.TLSServerName,
+		NoAAAA:             c.NoIPv6,
+		Alternative:        c.Google,
+		JSONAPI:            c.JSON,
+		DnsResolver:        c.DNSResolver,
+		Protocol:           c.UpstreamProtocol,
+		DoHMethod:          c.DoHMethod,
+		Strategy:           c.UpstreamStrategy,
+		EndpointWeights:    weights,
+		EndpointHeaders:    endpointHeaders,
+		EndpointParameters: endpointParams,
+		UpstreamTimeout:    c.UpstreamTimeout,
+		Retries:            int(c.UpstreamRetries),
+		BreakerThreshold:   int(c.UpstreamBreakerThreshold),
+		BreakerCooldown:    c.UpstreamBreakerCooldown,
+		MaxConns:           int(c.UpstreamMaxConns),
+		IdleTimeout:        c.UpstreamIdleTimeout,
+		DisableKeepAlive:   c.UpstreamDisableKeepAlive,
+		Proxy:              c.Proxy,
+		FallbackResolver:   c.FallbackResolver,
+		QnameRandomize:     c.QnameRandomize,
+		Cookies:            c.DNSCookies,
+		QnameMinimize:      c.QnameMinimize,
+	}, nil
+}
+
+// RecursiveProviderOptions returns the options of the RecursiveProvider of
+// "recursive", the root servers are primed from "dns-resolver".
+func (c *Config) RecursiveProviderOptions() *RecursiveProviderOptions {
+	return &RecursiveProviderOptions{
+		Bootstrap:      c.DNSResolver,
+		Timeout:        c.UpstreamTimeout,
+		QnameRandomize: c.QnameRandomize,
+		Cookies:        c.DNSCookies,
+	}
+}
+
+// UpstreamGroups returns the upstreams of the "upstream-group" flags by the
+// group names.
+func (c *Config) UpstreamGroups() (map[string][]string, error) {
+	groups := make(map[string][]string)
+	for _, v := range c.UpstreamGroup {
+		name, upstreams, err := ParseUpstreamGroup(v)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := groups[name]; ok {
+			return nil, fmt.Errorf("duplicate upstream group: %v", name)
+		}
+		groups[name] = upstreams
+	}
+	return groups, nil
+}
+
+// HandlerOptions returns the options for NewHandler, the blocklist and hosts
+// files are loaded and the query log is opened if specified.
+func (c *Config) HandlerOptions() (*HandlerOptions, error) {
+	opts := &HandlerOptions{
+		Cache:                  c.Cache,
+		NoAAAA:                 c.NoIPv6,
+		MinTTL:                 uint32(c.MinTTL),
+		MaxTTL:                 uint32(c.MaxTTL),
+		NoAAAAMode:             c.NoIPv6Mode,
+		CacheMinTTL:            uint32(c.CacheMinTTL),
+		CacheMaxTTL:            uint32(c.CacheMaxTTL),
+		CacheNegativeMaxTTL:    uint32(c.CacheNegativeMaxTTL),
+		CacheClampAAAA:         c.AAAACacheTTL >= 0,
+		CachePrefetch:          c.CachePrefetch,
+		CachePrefetchThreshold: uint32(c.CachePrefetchThreshold),
+		CacheServeStaleTTL:     uint32(c.CacheServeStaleTTL),
+		CacheMaxEntries:        int(c.CacheMaxEntries),
+		RotateAnswers:          c.RotateAnswers,
+		FlattenCNAME:           c.FlattenCNAME,
+		BlocklistResponse:      c.BlocklistResponse,
+		BlocklistCNAME:         c.BlocklistCNAME,
+		RateLimit:              uint32(c.RateLimit),
+		RateLimitBurst:         uint32(c.RateLimitBurst),
+		RateLimitAction:        c.RateLimitAction,
+		ReadyMinSuccessRate:    c.ReadyMinSuccessRate,
+		StripEDNSSubnet:        c.EDNSSubnet == "no" && c.EDNSSubnetMode != EDNSSubnetModePassthrough,
+		StripDNSSEC:            c.StripDNSSEC,
+		StripAdditional:        c.StripAdditional,
+		StripAuthority:         c.StripAuthority,
+		MinimizeAnswers:        c.MinimizeAnswers,
+		VersionString:          c.VersionString,
+		RootNSResponse:         c.RootNSResponse,
+		SpecialUseDomains:      c.SpecialUseDomains,
+		UpstreamFailureRcode:   c.UpstreamFailureRcode,
+		Compress:               c.Compress,
+		UpstreamMaxInflight:    uint32(c.UpstreamMaxInflight),
+		UpstreamTimeout:        c.UpstreamTimeout,
+	}
+	if c.MaxTTL > 0 && c.MinTTL > c.MaxTTL {
+		return nil, fmt.Errorf("min-ttl %v is greater than max-ttl %v", c.MinTTL, c.MaxTTL)
+	}
+	if opts.CacheClampAAAA {
+		opts.CacheAAAAMaxTTL = uint32(c.AAAACacheTTL)
+	}
+	if c.ECSCachePrefix != "" {
+		v4, v6, err := parseECSCachePrefix(c.ECSCachePrefix)
+		if err != nil {
+			return nil, err
+		}
+		opts.CacheECSv4Prefix, opts.CacheECSv6Prefix = v4, v6
+	}
+	if c.CacheTTLJitter != "" {
+		jitter, err := parseTTLJitter(c.CacheTTLJitter)
+		if err != nil {
+			return nil, err
+		}
+		opts.CacheTTLJitter = jitter
+	}
+	switch c.NoIPv6Mode {
+	case NoAAAAModeFake, NoAAAAModeNoData, NoAAAAModeRefused:
+	default:
+		return nil, fmt.Errorf("invalid no-ipv6-mode: %v", c.NoIPv6Mode)
+	}
+	if c.UpstreamFailureRcode != UpstreamFailureServFail && c.UpstreamFailureRcode != UpstreamFailureRefused {
+		return nil, fmt.Errorf("invalid upstream-failure-rcode: %v", c.UpstreamFailureRcode)
+	}
+	switch c.RootNSResponse {
+	case RootNSResponseUpstream, RootNSResponseLocal, RootNSResponseRefused:
+	default:
+		return nil, fmt.Errorf("invalid root-ns-response: %v", c.RootNSResponse)
+	}
+	switch c.SpecialUseDomains {
+	case SpecialUseDomainsOff, SpecialUseDomainsLocalhost, SpecialUseDomainsAll:
+	default:
+		return nil, fmt.Errorf("invalid special-use-domains: %v", c.SpecialUseDomains)
+	}
+	if c.RateLimitAction != RateLimitActionRefuse && c.RateLimitAction != RateLimitActionDrop {
+		return nil, fmt.Errorf("invalid rate-limit-action: %v", c.RateLimitAction)
+	}
+	if c.BlocklistResponse != BlocklistResponseNXDomain && net.ParseIP(c.BlocklistResponse) == nil {
+		return nil, fmt.Errorf("invalid blocklist-response: %v", c.BlocklistResponse)
+	}
+	if _, ok := dns.IsDomainName(c.BlocklistCNAME); c.BlocklistCNAME != "" && !ok {
+		return nil, fmt.Errorf("invalid blocklist-cname: %v", c.BlocklistCNAME)
+	}
+	if c.DNS64Prefix != "" {
+		if c.NoIPv6 {
+			return nil, fmt.Errorf("dns64-prefix conflicts with no-ipv6")
+		}
+		prefix, err := ParseDNS64Prefix(c.DNS64Prefix)
+		if err != nil {
+			return nil, fmt.Errorf("invalid dns64-prefix: %v", err)
+		}
+		opts.DNS64Prefix = prefix
+	}
+	if c.CacheExcludeQType != "" {
+		excludeQTypes, err := ParseQTypes(c.CacheExcludeQType)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cache-exclude-qtype: %v", err)
+		}
+		opts.CacheExcludeQTypes = excludeQTypes
+	}
+	if c.BlockQType != "" {
+		blockQTypes, err := ParseQTypes(c.BlockQType)
+		if err != nil {
+			return nil, fmt.Errorf("invalid block-qtype: %v", err)
+		}
+		opts.BlockQTypes = blockQTypes
+	}
+	for _, v := range c.Rewrite {
+		rule, err := ParseRewriteRule(v)
+		if err != nil {
+			return nil, err
+		}
+		opts.RewriteRules = append(opts.RewriteRules, rule)
+	}
+	groups, err := c.UpstreamGroups()
+	if err != nil {
+		return nil, err
+	}
+	for name := range groups {
+		if opts.UpstreamGroups == nil {
+			opts.UpstreamGroups = make(map[string]bool)
+		}
+		opts.UpstreamGroups[name] = true
+	}
+	allowFrom, err := CSVtoIPNets(c.AllowFrom)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing allow-from: %v", err)
+	}
+	opts.AllowFrom = allowFrom
+	if c.Blocklist != "" {
+		blocklist, err := LoadBlocklist(c.Blocklist)
+		if err != nil {
+			return nil, err
+		}
+		Log.Infof("loaded %v entries from blocklist %v", blocklist.Len(), c.Blocklist)
+		opts.Blocklist = blocklist
+	}
+	if c.RPZ != "" {
+		rpz, err := LoadRPZ(c.RPZ)
+		if err != nil {
+			return nil, err
+		}
+		Log.Infof("loaded %v triggers from rpz %v", rpz.Len(), c.RPZ)
+		opts.RPZ = rpz
+	}
+	if c.Hosts != "" {
+		hosts, err := NewStaticHosts(c.Hosts, uint32(c.HostsTTL))
+		if err != nil {
+			return nil, err
+		}
+		opts.StaticHosts = hosts
+	}
+	if c.QueryLog != "" {
+		queryLog, err := NewQueryLog(c.QueryLog, &QueryLogOptions{
+			Format:  c.QueryLogFormat,
+			MaxSize: int64(c.QueryLogMaxSize) << 20,
+		})
+		if err != nil {
+			return nil, err
+		}
+		opts.QueryLog = queryLog
+	}
+	if c.OTelEndpoint != "" {
+		exporter, err := NewOTLPExporter(c.OTelEndpoint, nil)
+		if err != nil {
+			return nil, err
+		}
+		opts.Tracer = NewTracer(exporter, nil)
+	}
+	if c.SortAnswersByRTT {
+		opts.RTTProber = NewRTTProber(&RTTProberOptions{})
+	}
+	return opts, nil
+}
+
+// parseTTLJitter parses cache-ttl-jitter, a percentage below 100 with an
+// optional "%", e.g. "10%", as a fraction.
+func parseTTLJitter(s string) (float64, error) {
+	percent, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(s), "%"), 64)
+	if err != nil || percent < 0 || percent >= 100 {
+		return 0, fmt.Errorf("invalid cache-ttl-jitter: %v", s)
+	}
+	return percent / 100, nil
+}
+
+// parseECSCachePrefix parses the prefix lengths of ecs-cache-prefix, as v4 or
+// v4,v6; 0 keeps the exact subnets of the family.
+func parseECSCachePrefix(s string) (uint8, uint8, error) {
+	var prefixes [2]uint8
+	parts := strings.Split(s, ",")
+	if len(parts) > len(prefixes) {
+		return 0, 0, fmt.Errorf("invalid ecs-cache-prefix: %v", s)
+	}
+	for i, part := range parts {
+		prefix, err := strconv.ParseUint(strings.TrimSpace(part), 10, 8)
+		if err != nil || (i == 0 && prefix > 32) || prefix > 128 {
+			return 0, 0, fmt.Errorf("invalid ecs-cache-prefix: %v", s)
+		}
+		prefixes[i] = uint8(prefix)
+	}
+	return prefixes[0], prefixes[1], nil
+}
@@ -0,0 +1,208 @@
+package dohProxy
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const sampleConfig = `
+listen: 127.0.0.1:5353
+endpoint: https://dns.example/resolve
+endpoint-ips: 8.8.8.8,8.8.4.4
+edns-subnet: 66.66.66.66/24
+google: true
+http2: true
+cacert: /etc/ssl/ca.pem
+no-ipv6: true
+dns-resolver: 1.1.1.1:53
+cache-min-ttl: 30
+cache-max-ttl: 3600
+upstream-timeout: 2s
+headers:
+  X-Api-Key: secret
+  Accept-Language:
+    - en
+    - zh
+param:
+  ct: application/dns-message
+`
+
+func writeTestConfig(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "doh-proxy-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	path := filepath.Join(dir, "config.yaml")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestConfig_LoadFile(t *testing.T) {
+	cfg := NewConfig()
+	if err := cfg.LoadFile(writeTestConfig(t, sampleConfig)); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(cfg.ListenAddrs(), []string{"127.0.0.1:5353"}) || !reflect.DeepEqual(cfg.Endpoints(), []string{"https://dns.example/resolve"}) {
+		t.Errorf("unexpected config: %+v", cfg)
+	}
+	// absent keys keep default values
+	if !cfg.Cache || !cfg.UDP || cfg.UpstreamProtocol != ProtocolDoH {
+		t.Errorf("default values should be kept: %+v", cfg)
+	}
+
+	providerOpts, err := cfg.DMProviderOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedProviderOpts := &DMProviderOptions{
+		EndpointIPs:    []net.IP{net.ParseIP("8.8.8.8"), net.ParseIP("8.8.4.4")},
+		EDNSSubnet:     "66.66.66.66/24",
+		EDNSSubnetMode: EDNSSubnetModeGlobal,
+		ECSv4Prefix:    DefaultECSv4Prefix,
+		ECSv6Prefix:    DefaultECSv6Prefix,
+		EDNSPadding:    DefaultEDNSPadding,
+		Headers: http.Header{
+			"X-Api-Key":       []string{"secret"},
+			"Accept-Language": []string{"en", "zh"},
+		},
+		QueryParameters: map[string][]string{"ct": {"application/dns-message"}},
+		HTTP2:           true,
+		CACertFilePath:  "/etc/ssl/ca.pem",
+		NoAAAA:          true,
+		Alternative:     true,
+		DnsResolver:     "1.1.1.1:53",
+		Protocol:        ProtocolDoH,
+		DoHMethod:       DoHMethodGet,
+		Strategy:        StrategyFirst,
+		UpstreamTimeout: 2 * time.Second,
+		Retries:         DefaultUpstreamRetries,
+		BreakerCooldown: DefaultUpstreamBreakerCooldown,
+		MaxConns:        DefaultUpstreamMaxConns,
+		IdleTimeout:     DefaultUpstreamIdleTimeout,
+	}
+	if !reflect.DeepEqual(providerOpts, expectedProviderOpts) {
+		t.Errorf("unexpected provider options:\n%+v\nexpected:\n%+v", providerOpts, expectedProviderOpts)
+	}
+
+	expectedHandlerOpts := &HandlerOptions{Cache: true, NoAAAA: true, CacheMinTTL: 30, CacheMaxTTL: 3600,
+		CachePrefetchThreshold: 10, BlocklistResponse: BlocklistResponseNXDomain, RateLimitAction: RateLimitActionRefuse,
+		NoAAAAMode: NoAAAAModeFake, ReadyMinSuccessRate: DefaultReadyMinSuccessRate, CacheMaxEntries: DefaultCacheMaxEntries,
+		UpstreamFailureRcode: UpstreamFailureServFail, Compress: true,
+		VersionString: DefaultVersionString, RootNSResponse: RootNSResponseUpstream, UpstreamTimeout: 2 * time.Second,
+		SpecialUseDomains: SpecialUseDomainsLocalhost}
+	handlerOpts, err := cfg.HandlerOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(handlerOpts, expectedHandlerOpts) {
+		t.Errorf("unexpected handler options:\n%+v\nexpected:\n%+v", handlerOpts, expectedHandlerOpts)
+	}
+}
+
+func TestConfig_LoadFileEndpoints(t *testing.T) {
+	cfg := NewConfig()
+	if endpoints := cfg.Endpoints(); !reflect.DeepEqual(endpoints, []string{DefaultEndpoint}) {
+		t.Errorf("default endpoint should be used, got: %v", endpoints)
+	}
+	content := "endpoint:\n  - https://a.example/dns-query\n  - https://b.example/dns-query\n"
+	if err := cfg.LoadFile(writeTestConfig(t, content)); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"https://a.example/dns-query", "https://b.example/dns-query"}
+	if endpoints := cfg.Endpoints(); !reflect.DeepEqual(endpoints, expected) {
+		t.Errorf("unexpected endpoints: %v", endpoints)
+	}
+}
+
+func TestConfig_LoadFileEndpointOptions(t *testing.T) {
+	cfg := NewConfig()
+	content := `endpoint:
+  - https://a.example/dns-query
+  - https://b.example/dns-query
+endpoint-options:
+  https://a.example/dns-query:
+    headers:
+      X-Api-Key: key-a
+  https://b.example/dns-query:
+    param:
+      key: key-b
+`
+	if err := cfg.LoadFile(writeTestConfig(t, content)); err != nil {
+		t.Fatal(err)
+	}
+	opts, err := cfg.DMProviderOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedHeaders := map[string]http.Header{"https://a.example/dns-query": {"X-Api-Key": []string{"key-a"}}}
+	if !reflect.DeepEqual(opts.EndpointHeaders, expectedHeaders) {
+		t.Errorf("unexpected endpoint headers: %v", opts.EndpointHeaders)
+	}
+	expectedParams := map[string]map[string][]string{"https://b.example/dns-query": {"key": []string{"key-b"}}}
+	if !reflect.DeepEqual(opts.EndpointParameters, expectedParams) {
+		t.Errorf("unexpected endpoint parameters: %v", opts.EndpointParameters)
+	}
+	dump, err := cfg.DumpYAML()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(dump), "key-a") {
+		t.Errorf("credential header of endpoint should be redacted:\n%s", dump)
+	}
+
+	cfg = NewConfig()
+	content = "endpoint: https://a.example/dns-query\nendpoint-options:\n" +
+		"  https://a.example/dns-qeury:\n    headers:\n      X-Api-Key: key-a\n"
+	if err := cfg.LoadFile(writeTestConfig(t, content)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cfg.DMProviderOptions(); err == nil || !strings.Contains(err.Error(), "dns-qeury") {
+		t.Errorf("endpoint-options of unknown endpoint should be rejected, got: %v", err)
+	}
+}
+
+func TestConfig_LoadFileUnknownKey(t *testing.T) {
+	cfg := NewConfig()
+	err := cfg.LoadFile(writeTestConfig(t, "endpoint: https://dns.example/resolve\nendpoints: x\n"))
+	if err == nil {
+		t.Fatal("expected error for unknown key")
+	}
+	if !strings.Contains(err.Error(), "endpoints") {
+		t.Errorf("error should name the unknown key: %v", err)
+	}
+}
+
+func TestConfig_AdminListenAddr(t *testing.T) {
+	cases := []struct {
+		listen   string
+		admin    string
+		expected string
+		err      bool
+	}{
+		{":53", ":8080", "127.0.0.1:8080", false},
+		{":53", "0.0.0.0:8080", "0.0.0.0:8080", false},
+		{"127.0.0.1:5353", "127.0.0.1:5353", "", true},
+		{":53", "8080", "", true},
+		{"127.0.0.1:53,[::1]:5353", ":5353", "", true},
+	}
+	for _, c := range cases {
+		cfg := NewConfig()
+		cfg.Listen = StringList{c.listen}
+		cfg.AdminListen = c.admin
+		addr, err := cfg.AdminListenAddr()
+		if (err != nil) != c.err || addr != c.expected {
+			t.Errorf("admin-listen %v: expected %q, error %v; got %q, %v", c.admin, c.expected, c.err, addr, err)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package dohProxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// ParseDNS64Prefix parses the DNS64 prefix in CIDR, the prefix length is one
+// of 32, 40, 48, 56, 64 and 96, RFC 6052.
+func ParseDNS64Prefix(s string) (*net.IPNet, error) {
+	ip, prefix, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, err
+	}
+	if ip.To4() != nil {
+		return nil, fmt.Errorf("not an ipv6 prefix: %v", s)
+	}
+	switch ones, _ := prefix.Mask.Size(); ones {
+	case 32, 40, 48, 56, 64, 96:
+	default:
+		return nil, fmt.Errorf("unsupported prefix length: %v", ones)
+	}
+	return prefix, nil
+}
+
+// dns64Addr embeds ip4 in prefix, skipping the reserved octet 8, RFC 6052.
+func dns64Addr(prefix *net.IPNet, ip4 net.IP) net.IP {
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, prefix.IP.To16())
+	ones, _ := prefix.Mask.Size()
+	pos := ones / 8
+	for _, b := range ip4.To4() {
+		if pos == 8 {
+			pos++
+		}
+		ip[pos] = b
+		pos++
+	}
+	return ip
+}
+
+// isNoData reports whether rMsg answers no records of the question type.
+func isNoData(rMsg *dns.Msg) bool {
+	if rMsg.Rcode != dns.RcodeSuccess {
+		return false
+	}
+	for _, rr := range rMsg.Answer {
+		if rr.Header().Rrtype == rMsg.Question[0].Qtype {
+			return false
+		}
+	}
+	return true
+}
+
+// synthesizeDNS64 answers the AAAA query msg, answered with NODATA in rMsg,
+// with the A records of the name mapped into prefix; rMsg is returned if the
+// name has no A records.
+func (h *Handler) synthesizeDNS64(msg *dns.Msg, rMsg *dns.Msg, prefix *net.IPNet, clientIP net.IP) *dns.Msg {
+	aMsg := msg.Copy()
+	aMsg.Question[0].Qtype = dns.TypeA
+	key := getQueryStringForCache(aMsg)
+	v, err, _ := h.inFlightQueries.Do(key, func() (interface{}, error) {
+		return h.queryUpstream(context.Background(), aMsg, clientIP)
+	})
+	if err != nil || v == nil {
+		Log.Debugf("DNS64 A query of %v failed: %v", msg.Question[0].Name, err)
+		return rMsg
+	}
+	aResp := v.(*dns.Msg)
+
+	// the synthesized records live no longer than the negative answer of AAAA.
+	ttl := uint32(0)
+	hasNegativeTTL := false
+	for _, rr := range rMsg.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			ttl = soa.Minttl
+			if soa.Hdr.Ttl < ttl {
+				ttl = soa.Hdr.Ttl
+			}
+			hasNegativeTTL = true
+			break
+		}
+	}
+
+	var answer []dns.RR
+	for _, rr := range aResp.Answer {
+		switch r := rr.(type) {
+		case *dns.CNAME:
+			answer = append(answer, dns.Copy(r))
+		case *dns.A:
+			hdr := r.Hdr
+			hdr.Rrtype = dns.TypeAAAA
+			if hasNegativeTTL && ttl < hdr.Ttl {
+				hdr.Ttl = ttl
+			}
+			answer = append(answer, &dns.AAAA{Hdr: hdr, AAAA: dns64Addr(prefix, r.A)})
+		}
+	}
+	if !hasAAAA(answer) {
+		return rMsg
+	}
+
+	synthesized := rMsg.Copy()
+	synthesized.Answer = answer
+	synthesized.Ns = nil
+	synthesized.AuthenticatedData = false
+	Log.Debugf("synthesized %v DNS64 records for: %v", len(answer), msg.Question[0].Name)
+	return synthesized
+}
+
+func hasAAAA(rrs []dns.RR) bool {
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == dns.TypeAAAA {
+			return true
+		}
+	}
+	return false
+}
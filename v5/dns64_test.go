@@ -0,0 +1,112 @@
+package dohProxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// ipv4OnlyProvider answers A questions with ips, and others with NODATA.
+type ipv4OnlyProvider struct {
+	ips []string
+}
+
+func (p *ipv4OnlyProvider) Query(msg *dns.Msg) (*dns.Msg, error) {
+	rMsg := new(dns.Msg)
+	rMsg.SetReply(msg)
+	rMsg.AuthenticatedData = true
+	if msg.Question[0].Qtype != dns.TypeA {
+		soa, _ := dns.NewRR("example.com. 3600 IN SOA ns.example.com. admin.example.com. 1 7200 900 1209600 120")
+		rMsg.Ns = append(rMsg.Ns, soa)
+		return rMsg, nil
+	}
+	for _, ip := range p.ips {
+		rr, _ := dns.NewRR(msg.Question[0].Name + " 600 IN A " + ip)
+		rMsg.Answer = append(rMsg.Answer, rr)
+	}
+	return rMsg, nil
+}
+
+func TestHandler_DNS64(t *testing.T) {
+	prefix, err := ParseDNS64Prefix("64:ff9b::/96")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := NewHandler(&ipv4OnlyProvider{ips: []string{"192.0.2.1", "192.0.2.2"}},
+		&HandlerOptions{DNS64Prefix: prefix})
+	writer := newTestResponseWriter("127.0.0.1:5353")
+	msg := new(dns.Msg)
+	msg.SetQuestion("ipv4only.example.com.", dns.TypeAAAA)
+	handler.Handle(writer, msg)
+	rMsg := writer.waitMsg(t, time.Second)
+
+	if len(rMsg.Answer) != 2 || rMsg.AuthenticatedData {
+		t.Fatalf("expected 2 synthesized records without AD bit, got: %v", rMsg)
+	}
+	for i, expected := range []string{"64:ff9b::c000:201", "64:ff9b::c000:202"} {
+		aaaa, ok := rMsg.Answer[i].(*dns.AAAA)
+		if !ok || aaaa.AAAA.String() != expected {
+			t.Errorf("expected %v, got: %v", expected, rMsg.Answer[i])
+			continue
+		}
+		if aaaa.Hdr.Ttl != 120 {
+			t.Errorf("ttl should be clamped to the negative ttl 120, got: %v", aaaa.Hdr.Ttl)
+		}
+	}
+}
+
+func TestHandler_DNS64Prefetch(t *testing.T) {
+	prefix, err := ParseDNS64Prefix("64:ff9b::/96")
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := &ipv4OnlyProvider{ips: []string{"192.0.2.1"}}
+	handler := NewHandler(provider, &HandlerOptions{DNS64Prefix: prefix, Cache: true})
+	writer := newTestResponseWriter("127.0.0.1:5353")
+	msg := new(dns.Msg)
+	msg.SetQuestion("ipv4only.example.com.", dns.TypeAAAA)
+	handler.Handle(writer, msg)
+	writer.waitMsg(t, time.Second)
+	for deadline := time.Now().Add(time.Second); handler.cache.Get(msg) == nil; {
+		if time.Now().After(deadline) {
+			t.Fatalf("answer should be cached")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the refreshed entry is synthesized from the new A records.
+	provider.ips = []string{"192.0.2.2"}
+	handler.prefetch(msg.Copy())
+	rMsg := handler.cache.Get(msg)
+	if rMsg == nil || len(rMsg.Answer) != 1 {
+		t.Fatalf("expected the synthesized record cached, got: %v", rMsg)
+	}
+	if aaaa, ok := rMsg.Answer[0].(*dns.AAAA); !ok || aaaa.AAAA.String() != "64:ff9b::c000:202" {
+		t.Errorf("expected the refreshed synthesized record, got: %v", rMsg.Answer[0])
+	}
+}
+
+func TestDNS64Addr(t *testing.T) {
+	cases := []struct {
+		prefix   string
+		expected string
+	}{
+		{"64:ff9b::/96", "64:ff9b::c000:221"},
+		{"2001:db8::/32", "2001:db8:c000:221::"},
+		{"2001:db8:100::/40", "2001:db8:1c0:2:21::"},
+		{"2001:db8:122:344::/64", "2001:db8:122:344:c0:2:2100:0"},
+	}
+	for _, c := range cases {
+		prefix, err := ParseDNS64Prefix(c.prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ip := dns64Addr(prefix, []byte{192, 0, 2, 33}); ip.String() != c.expected {
+			t.Errorf("%v: expected %v, got: %v", c.prefix, c.expected, ip)
+		}
+	}
+	if _, err := ParseDNS64Prefix("64:ff9b::/80"); err == nil {
+		t.Error("prefix length 80 should be rejected")
+	}
+}
@@ -0,0 +1,376 @@
+package dohProxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// RootTrustAnchor is the DS record of the root KSK-2017.
+const RootTrustAnchor = ". 172800 IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D"
+
+// ttl of validated zone keys is capped to this duration.
+const dnssecMaxKeyTTL = time.Hour
+
+// errDNSSECBogus is wrapped by the errors of answers failing validation.
+var errDNSSECBogus = errors.New("dnssec validation failed")
+
+// DNSSECProvider requests DNSSEC records from the wrapped provider and
+// validates the signed answers up to the trust anchors, answers failing
+// validation are replaced with SERVFAIL; it implements the Provider interface.
+//
+// This is a first cut: unsigned answers are passed as insecure without
+// proving the zone is unsigned, and NSEC/NSEC3 records of negative answers are
+// verified but not checked to cover the question.
+type DNSSECProvider struct {
+	provider Provider
+	// DS or DNSKEY records by zone.
+	anchors map[string][]dns.RR
+	lock    sync.Mutex
+	keys    map[string]*zoneKeys
+	// now is replaceable for testing.
+	now func() time.Time
+}
+
+// zoneKeys are the DNSKEYs of a zone validated up to the trust anchors.
+type zoneKeys struct {
+	keys   []*dns.DNSKEY
+	expire time.Time
+}
+
+// NewDNSSECProvider creates a DNSSECProvider, anchors are DS or DNSKEY
+// records, RootTrustAnchor is used if none specified.
+func NewDNSSECProvider(provider Provider, anchors []dns.RR) (*DNSSECProvider, error) {
+	if len(anchors) == 0 {
+		root, err := dns.NewRR(RootTrustAnchor)
+		if err != nil {
+			return nil, err
+		}
+		anchors = []dns.RR{root}
+	}
+	p := &DNSSECProvider{
+		provider: provider,
+		anchors:  make(map[string][]dns.RR),
+		keys:     make(map[string]*zoneKeys),
+		now:      time.Now,
+	}
+	for _, anchor := range anchors {
+		switch anchor.(type) {
+		case *dns.DS, *dns.DNSKEY:
+		default:
+			return nil, fmt.Errorf("trust anchor should be DS or DNSKEY: %v", anchor)
+		}
+		zone := dns.CanonicalName(anchor.Header().Name)
+		p.anchors[zone] = append(p.anchors[zone], anchor)
+	}
+	return p, nil
+}
+
+// LoadTrustAnchors reads DS or DNSKEY records in zone file format.
+func LoadTrustAnchors(path string) ([]dns.RR, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open trust anchors %v error: %v", path, err)
+	}
+	defer func() { _ = f.Close() }()
+
+	var anchors []dns.RR
+	zp := dns.NewZoneParser(f, ".", path)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		anchors = append(anchors, rr)
+	}
+	if err := zp.Err(); err != nil {
+		return nil, fmt.Errorf("parse trust anchors %v error: %v", path, err)
+	}
+	return anchors, nil
+}
+
+func (p *DNSSECProvider) Query(msg *dns.Msg) (*dns.Msg, error) {
+	return p.QueryClient(msg, nil)
+}
+
+// QueryClient is like Query, passing clientIP to the provider for the answer;
+// DS and DNSKEY records are queried without it.
+func (p *DNSSECProvider) QueryClient(msg *dns.Msg, clientIP net.IP) (*dns.Msg, error) {
+	if len(msg.Question) == 0 {
+		Log.Debugf("no questions in resolve request.")
+		return nil, fmt.Errorf("should have question in resolve request")
+	}
+	clientDO := false
+	if opt := msg.IsEdns0(); opt != nil {
+		clientDO = opt.Do()
+	}
+
+	rMsg, err := queryClient(p.provider, withDO(msg), clientIP)
+	if err != nil {
+		return nil, err
+	}
+	if rMsg.Rcode != dns.RcodeSuccess && rMsg.Rcode != dns.RcodeNameError {
+		return rMsg, nil
+	}
+	secure, err := p.validate(rMsg)
+	if err != nil {
+		Log.Warnf("answer of %v is bogus: %v", msg.Question[0].Name, err)
+		sMsg := new(dns.Msg)
+		sMsg.SetRcode(msg, dns.RcodeServerFailure)
+		return sMsg, nil
+	}
+	rMsg.AuthenticatedData = secure
+	if !clientDO {
+		stripDNSSECRecords(rMsg)
+	}
+	return rMsg, nil
+}
+
+// Close closes the wrapped provider.
+func (p *DNSSECProvider) Close() error {
+	if closer, ok := p.provider.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// withDO returns a copy of msg with the DO bit set.
+func withDO(msg *dns.Msg) *dns.Msg {
+	msg = msg.Copy()
+	if opt := msg.IsEdns0(); opt != nil {
+		opt.SetDo()
+		if opt.UDPSize() < dns.DefaultMsgSize {
+			opt.SetUDPSize(dns.DefaultMsgSize)
+		}
+	} else {
+		msg.SetEdns0(dns.DefaultMsgSize, true)
+	}
+	msg.CheckingDisabled = true
+	return msg
+}
+
+// dnssecOK reports whether msg has the DO bit set.
+func dnssecOK(msg *dns.Msg) bool {
+	opt := msg.IsEdns0()
+	return opt != nil && opt.Do()
+}
+
+// setDNSSECOK sets or clears the DO bit of msg, an OPT record is added for
+// setting if there's none.
+func setDNSSECOK(msg *dns.Msg, ok bool) {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		if ok {
+			msg.SetEdns0(dns.DefaultMsgSize, true)
+		}
+		return
+	}
+	opt.SetDo(ok)
+}
+
+// isDNSSECQuestion reports whether the records of qtype are removed by
+// stripDNSSECRecords.
+func isDNSSECQuestion(qtype uint16) bool {
+	switch qtype {
+	case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+		return true
+	}
+	return false
+}
+
+func stripDNSSECRecords(msg *dns.Msg) {
+	strip := func(rrs []dns.RR) []dns.RR {
+		var kept []dns.RR
+		for _, rr := range rrs {
+			switch rr.Header().Rrtype {
+			case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+				continue
+			}
+			kept = append(kept, rr)
+		}
+		return kept
+	}
+	msg.Answer = strip(msg.Answer)
+	msg.Ns = strip(msg.Ns)
+}
+
+// validate verifies the RRsets in the answer and authority sections, secure is
+// false if the answer isn't signed.
+func (p *DNSSECProvider) validate(msg *dns.Msg) (secure bool, err error) {
+	rrsets, sigs := splitRRsets(append(append([]dns.RR(nil), msg.Answer...), msg.Ns...))
+	if len(sigs) == 0 {
+		return false, nil
+	}
+	for key, rrset := range rrsets {
+		if err := p.verifyRRset(rrset, sigs[key]); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// splitRRsets groups rrs by name and type, RRSIGs are grouped by the covered
+// type.
+func splitRRsets(rrs []dns.RR) (rrsets map[string][]dns.RR, sigs map[string][]*dns.RRSIG) {
+	rrsets = make(map[string][]dns.RR)
+	sigs = make(map[string][]*dns.RRSIG)
+	for _, rr := range rrs {
+		name := dns.CanonicalName(rr.Header().Name)
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			key := name + "/" + dns.TypeToString[sig.TypeCovered]
+			sigs[key] = append(sigs[key], sig)
+			continue
+		}
+		key := name + "/" + dns.TypeToString[rr.Header().Rrtype]
+		rrsets[key] = append(rrsets[key], rr)
+	}
+	return
+}
+
+// verifyRRset verifies rrset with one of sigs, by the validated keys of the
+// signer zone.
+func (p *DNSSECProvider) verifyRRset(rrset []dns.RR, sigs []*dns.RRSIG) error {
+	name := rrset[0].Header().Name
+	if len(sigs) == 0 {
+		return fmt.Errorf("%w: no signature of %v %v", errDNSSECBogus, name,
+			dns.TypeToString[rrset[0].Header().Rrtype])
+	}
+	var err error
+	for _, sig := range sigs {
+		if !dns.IsSubDomain(sig.SignerName, name) {
+			err = fmt.Errorf("%w: %v signed by %v", errDNSSECBogus, name, sig.SignerName)
+			continue
+		}
+		var keys []*dns.DNSKEY
+		if keys, err = p.zoneKeys(dns.CanonicalName(sig.SignerName)); err != nil {
+			continue
+		}
+		if err = verifySig(sig, keys, rrset, p.now()); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// verifySig verifies rrset with sig by the key in keys matching the key tag.
+func verifySig(sig *dns.RRSIG, keys []*dns.DNSKEY, rrset []dns.RR, now time.Time) error {
+	if !sig.ValidityPeriod(now) {
+		return fmt.Errorf("%w: signature of %v expired or not yet valid", errDNSSECBogus, sig.Header().Name)
+	}
+	for _, key := range keys {
+		if key.KeyTag() != sig.KeyTag || key.Algorithm != sig.Algorithm {
+			continue
+		}
+		if err := sig.Verify(key, rrset); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: bad signature of %v %v by key %v", errDNSSECBogus, sig.Header().Name,
+		dns.TypeToString[sig.TypeCovered], sig.KeyTag)
+}
+
+// zoneKeys returns the DNSKEYs of zone, the DNSKEY RRset is verified by a key
+// matching the trust anchor, or the DS RRset validated in the parent zone.
+func (p *DNSSECProvider) zoneKeys(zone string) ([]*dns.DNSKEY, error) {
+	p.lock.Lock()
+	cached := p.keys[zone]
+	p.lock.Unlock()
+	if cached != nil && p.now().Before(cached.expire) {
+		return cached.keys, nil
+	}
+
+	dnskeyRRset, dnskeySigs, err := p.queryRRset(zone, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, err
+	}
+	var keys []*dns.DNSKEY
+	for _, rr := range dnskeyRRset {
+		keys = append(keys, rr.(*dns.DNSKEY))
+	}
+
+	anchors := p.anchors[zone]
+	if len(anchors) == 0 {
+		if zone == "." {
+			return nil, fmt.Errorf("%w: no trust anchor", errDNSSECBogus)
+		}
+		dsRRset, dsSigs, err := p.queryRRset(zone, dns.TypeDS)
+		if err != nil {
+			return nil, err
+		}
+		if err := p.verifyRRset(dsRRset, dsSigs); err != nil {
+			return nil, err
+		}
+		anchors = dsRRset
+	}
+
+	var trusted []*dns.DNSKEY
+	for _, key := range keys {
+		if isTrustedKey(key, anchors) {
+			trusted = append(trusted, key)
+		}
+	}
+	if len(trusted) == 0 {
+		return nil, fmt.Errorf("%w: no DNSKEY of %v matches the DS records", errDNSSECBogus, zone)
+	}
+	verified := false
+	for _, sig := range dnskeySigs {
+		if verifySig(sig, trusted, dnskeyRRset, p.now()) == nil {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, fmt.Errorf("%w: DNSKEY of %v isn't signed by trusted key", errDNSSECBogus, zone)
+	}
+
+	ttl := time.Duration(dnskeyRRset[0].Header().Ttl) * time.Second
+	if ttl > dnssecMaxKeyTTL {
+		ttl = dnssecMaxKeyTTL
+	}
+	p.lock.Lock()
+	p.keys[zone] = &zoneKeys{keys: keys, expire: p.now().Add(ttl)}
+	p.lock.Unlock()
+	Log.Debugf("validated %v DNSKEYs of %v", len(keys), zone)
+	return keys, nil
+}
+
+// queryRRset queries qtype of name, returns the RRset in answer and the
+// signatures of it.
+func (p *DNSSECProvider) queryRRset(name string, qtype uint16) ([]dns.RR, []*dns.RRSIG, error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(name, qtype)
+	rMsg, err := p.provider.Query(withDO(msg))
+	if err != nil {
+		return nil, nil, fmt.Errorf("query %v %v error: %v", name, dns.TypeToString[qtype], err)
+	}
+	rrsets, sigs := splitRRsets(rMsg.Answer)
+	key := name + "/" + dns.TypeToString[qtype]
+	if len(rrsets[key]) == 0 {
+		return nil, nil, fmt.Errorf("%w: no %v of %v", errDNSSECBogus, dns.TypeToString[qtype], name)
+	}
+	return rrsets[key], sigs[key], nil
+}
+
+// isTrustedKey reports whether key matches one of the DS or DNSKEY anchors.
+func isTrustedKey(key *dns.DNSKEY, anchors []dns.RR) bool {
+	for _, anchor := range anchors {
+		switch a := anchor.(type) {
+		case *dns.DS:
+			if a.KeyTag != key.KeyTag() || a.Algorithm != key.Algorithm {
+				continue
+			}
+			if ds := key.ToDS(a.DigestType); ds != nil && strings.EqualFold(ds.Digest, a.Digest) {
+				return true
+			}
+		case *dns.DNSKEY:
+			if a.Flags == key.Flags && a.Protocol == key.Protocol && a.Algorithm == key.Algorithm &&
+				a.PublicKey == key.PublicKey {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,205 @@
+package dohProxy
+
+import (
+	"crypto"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// signedTestZone is a zone signed by a single ECDSA key.
+type signedTestZone struct {
+	name   string
+	key    *dns.DNSKEY
+	signer crypto.Signer
+}
+
+func newSignedTestZone(t *testing.T, name string) *signedTestZone {
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: name, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     257,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	privateKey, err := key.Generate(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &signedTestZone{name: name, key: key, signer: privateKey.(crypto.Signer)}
+}
+
+func (z *signedTestZone) sign(t *testing.T, rrset ...dns.RR) []dns.RR {
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Name: rrset[0].Header().Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: 3600},
+		KeyTag:     z.key.KeyTag(),
+		SignerName: z.name,
+		Algorithm:  z.key.Algorithm,
+		Inception:  uint32(time.Now().Add(-time.Hour).Unix()),
+		Expiration: uint32(time.Now().Add(time.Hour).Unix()),
+	}
+	if err := sig.Sign(z.signer, rrset); err != nil {
+		t.Fatal(err)
+	}
+	return append(rrset, sig)
+}
+
+// dnssecTestProvider answers from the records by "name/type".
+type dnssecTestProvider struct {
+	records map[string][]dns.RR
+}
+
+func (p *dnssecTestProvider) Query(msg *dns.Msg) (*dns.Msg, error) {
+	rMsg := new(dns.Msg)
+	rMsg.SetReply(msg)
+	q := msg.Question[0]
+	rMsg.Answer = p.records[q.Name+"/"+dns.TypeToString[q.Qtype]]
+	return rMsg, nil
+}
+
+func newDNSSECTestProvider(t *testing.T) (*dnssecTestProvider, []dns.RR) {
+	parent := newSignedTestZone(t, "test.")
+	child := newSignedTestZone(t, "example.test.")
+	a, _ := dns.NewRR("www.example.test. 300 IN A 93.184.216.34")
+	bogus, _ := dns.NewRR("bogus.example.test. 300 IN A 93.184.216.34")
+	unsigned, _ := dns.NewRR("unsigned.example.test. 300 IN A 93.184.216.35")
+	ds := child.key.ToDS(dns.SHA256)
+	ds.Hdr.Ttl = 3600
+
+	bogusSigned := child.sign(t, bogus)
+	// tampered after signing.
+	bogusSigned[0] = dns.Copy(bogus)
+	bogusSigned[0].(*dns.A).A[3] = 35
+
+	provider := &dnssecTestProvider{records: map[string][]dns.RR{
+		"test./DNSKEY":             parent.sign(t, parent.key),
+		"example.test./DS":         parent.sign(t, ds),
+		"example.test./DNSKEY":     child.sign(t, child.key),
+		"www.example.test./A":      child.sign(t, a),
+		"bogus.example.test./A":    bogusSigned,
+		"unsigned.example.test./A": {unsigned},
+	}}
+	return provider, []dns.RR{parent.key.ToDS(dns.SHA256)}
+}
+
+func TestDNSSECProvider_Query(t *testing.T) {
+	upstream, anchors := newDNSSECTestProvider(t)
+	provider, err := NewDNSSECProvider(upstream, anchors)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name  string
+		rcode int
+		ad    bool
+	}{
+		{"www.example.test.", dns.RcodeSuccess, true},
+		{"bogus.example.test.", dns.RcodeServerFailure, false},
+		{"unsigned.example.test.", dns.RcodeSuccess, false},
+	}
+	for _, c := range cases {
+		msg := new(dns.Msg)
+		msg.SetQuestion(c.name, dns.TypeA)
+		rMsg, err := provider.Query(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rMsg.Rcode != c.rcode || rMsg.AuthenticatedData != c.ad {
+			t.Errorf("%v: expected rcode %v, AD %v, got: %v", c.name, dns.RcodeToString[c.rcode], c.ad, rMsg)
+		}
+		for _, rr := range rMsg.Answer {
+			if rr.Header().Rrtype == dns.TypeRRSIG {
+				t.Errorf("%v: RRSIG should be stripped if DO bit isn't set: %v", c.name, rr)
+			}
+		}
+	}
+}
+
+func TestDNSSECProvider_UntrustedChain(t *testing.T) {
+	upstream, _ := newDNSSECTestProvider(t)
+	other := newSignedTestZone(t, "test.")
+	provider, err := NewDNSSECProvider(upstream, []dns.RR{other.key.ToDS(dns.SHA256)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := new(dns.Msg)
+	msg.SetQuestion("www.example.test.", dns.TypeA)
+	msg.SetEdns0(dns.DefaultMsgSize, true)
+	rMsg, err := provider.Query(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rMsg.Rcode != dns.RcodeServerFailure {
+		t.Errorf("chain not matching the trust anchor should fail, got: %v", rMsg)
+	}
+}
+
+func TestNewDNSSECProvider_RootAnchor(t *testing.T) {
+	provider, err := NewDNSSECProvider(&dnssecTestProvider{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if anchors := provider.anchors["."]; len(anchors) != 1 || anchors[0].(*dns.DS).KeyTag != 20326 {
+		t.Errorf("root KSK should be the default trust anchor, got: %v", provider.anchors)
+	}
+}
+
+func TestHandler_DNSSECOK(t *testing.T) {
+	zone := newSignedTestZone(t, "example.com.")
+	a, _ := dns.NewRR("www.example.com. 300 IN A 192.0.2.1")
+	signed := zone.sign(t, a)
+	stub := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Answer = []dns.RR{a}
+		if opt := r.IsEdns0(); opt != nil && opt.Do() {
+			m.Answer = signed
+			m.AuthenticatedData = true
+			m.SetEdns0(dns.DefaultMsgSize, true)
+		}
+		_ = w.WriteMsg(m)
+	})
+	provider, err := NewPlainProvider([]string{startPlainTestServer(t, stub)}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	query := func(handler *Handler, do bool) *dns.Msg {
+		msg := new(dns.Msg)
+		msg.SetQuestion("www.example.com.", dns.TypeA)
+		if do {
+			msg.SetEdns0(dns.DefaultMsgSize, true)
+		}
+		writer := newTestResponseWriter("127.0.0.1:5353")
+		handler.Handle(writer, msg)
+		return writer.waitMsg(t, time.Second)
+	}
+	hasRRSIG := func(msg *dns.Msg) bool {
+		for _, rr := range msg.Answer {
+			if rr.Header().Rrtype == dns.TypeRRSIG {
+				return true
+			}
+		}
+		return false
+	}
+
+	handler := NewHandler(provider, &HandlerOptions{Cache: true})
+	rMsg := query(handler, true)
+	if !hasRRSIG(rMsg) || !rMsg.AuthenticatedData || !dnssecOK(rMsg) {
+		t.Errorf("RRSIG, AD and DO should be passed through, got: %v", rMsg)
+	}
+	// the answer is inserted into cache asynchronously.
+	time.Sleep(50 * time.Millisecond)
+	if rMsg = query(handler, false); hasRRSIG(rMsg) || rMsg.AuthenticatedData {
+		t.Errorf("the answer of DO query should not be served without DO, got: %v", rMsg)
+	}
+	if rMsg = query(handler, true); !hasRRSIG(rMsg) {
+		t.Errorf("RRSIG should be cached, got: %v", rMsg)
+	}
+
+	handler = NewHandler(provider, &HandlerOptions{StripDNSSEC: true})
+	if rMsg = query(handler, true); hasRRSIG(rMsg) || dnssecOK(rMsg) {
+		t.Errorf("DNSSEC should be stripped, got: %v", rMsg)
+	}
+}
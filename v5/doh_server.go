@@ -0,0 +1,100 @@
+package dohProxy
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// DefaultDoHPath is the path DNS-over-HTTPS queries are served on if not
+// specified.
+const DefaultDoHPath = "/dns-query"
+
+// NewDoHHandler returns the http handler serving DNS-over-HTTPS queries on
+// path, RFC 8484: GET with the base64url "dns" parameter and POST of
+// "application/dns-message"; the queries are answered by handler.
+func NewDoHHandler(handler *Handler, path string) http.Handler {
+	if path == "" {
+		path = DefaultDoHPath
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		msg, err := readDoHQuery(r)
+		if err != nil {
+			Log.Debugf("bad DoH request from %v: %v", r.RemoteAddr, err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		writer := &memoryResponseWriter{remoteAddr: dohRemoteAddr(r)}
+		handler.Handle(writer, msg)
+		rMsg := writer.answer()
+		if rMsg == nil {
+			// dropped or failed queries.
+			rMsg = new(dns.Msg)
+			rMsg.SetRcode(msg, dns.RcodeServerFailure)
+		}
+		bytesMsg, err := rMsg.Pack()
+		if err != nil {
+			Log.Errorf("pack DoH response error: %v", err)
+			http.Error(w, "pack response error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", ContentType)
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", GetMinTTLFromDnsMsg(rMsg)))
+		if _, err := w.Write(bytesMsg); err != nil {
+			Log.Debugf("write DoH response error: %v", err)
+		}
+	})
+	return mux
+}
+
+// readDoHQuery reads the dns message from the GET or POST request.
+func readDoHQuery(r *http.Request) (*dns.Msg, error) {
+	var raw []byte
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		param := r.URL.Query().Get("dns")
+		if param == "" {
+			return nil, fmt.Errorf("no dns parameter")
+		}
+		// padding is omitted per RFC 8484, but accepted.
+		if raw, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(param, "=")); err != nil {
+			return nil, fmt.Errorf("decode dns parameter error: %v", err)
+		}
+	case http.MethodPost:
+		if contentType := r.Header.Get("Content-Type"); contentType != ContentType {
+			return nil, fmt.Errorf("unsupported content type: %v", contentType)
+		}
+		if raw, err = ioutil.ReadAll(io.LimitReader(r.Body, dns.MaxMsgSize+1)); err != nil {
+			return nil, fmt.Errorf("read body error: %v", err)
+		}
+		if len(raw) > dns.MaxMsgSize {
+			return nil, fmt.Errorf("message too large")
+		}
+	default:
+		return nil, fmt.Errorf("method not allowed: %v", r.Method)
+	}
+	msg := new(dns.Msg)
+	if err := msg.Unpack(raw); err != nil {
+		return nil, fmt.Errorf("unpack query error: %v", err)
+	}
+	return msg, nil
+}
+
+// dohRemoteAddr returns the client address as tcp, answers are never
+// truncated over http.
+func dohRemoteAddr(r *http.Request) net.Addr {
+	addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	if err != nil {
+		return &net.TCPAddr{}
+	}
+	return addr
+}
@@ -0,0 +1,65 @@
+package dohProxy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func newTestDoHRequest(t *testing.T, method string, name string) *http.Request {
+	t.Helper()
+	msg := new(dns.Msg)
+	msg.SetQuestion(name, dns.TypeTXT)
+	raw, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if method == http.MethodGet {
+		return httptest.NewRequest(method, DefaultDoHPath+"?dns="+base64.RawURLEncoding.EncodeToString(raw), nil)
+	}
+	r := httptest.NewRequest(method, DefaultDoHPath, bytes.NewReader(raw))
+	r.Header.Set("Content-Type", ContentType)
+	return r
+}
+
+func TestDoHHandler(t *testing.T) {
+	dohHandler := NewDoHHandler(NewHandler(&testProvider{name: "upstream"}, &HandlerOptions{}), "")
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		recorder := httptest.NewRecorder()
+		dohHandler.ServeHTTP(recorder, newTestDoHRequest(t, method, "doh.example.com."))
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("%v: unexpected status: %v %v", method, recorder.Code, recorder.Body)
+		}
+		if contentType := recorder.Header().Get("Content-Type"); contentType != ContentType {
+			t.Errorf("%v: unexpected content type: %v", method, contentType)
+		}
+		rMsg := new(dns.Msg)
+		if err := rMsg.Unpack(recorder.Body.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+		if len(rMsg.Answer) != 1 || rMsg.Answer[0].(*dns.TXT).Txt[0] != "upstream" {
+			t.Errorf("%v: unexpected answer: %v", method, rMsg)
+		}
+	}
+}
+
+func TestDoHHandler_BadRequest(t *testing.T) {
+	dohHandler := NewDoHHandler(NewHandler(&testProvider{name: "upstream"}, &HandlerOptions{}), "")
+	bad := newTestDoHRequest(t, http.MethodPost, "doh.example.com.")
+	bad.Header.Set("Content-Type", "text/plain")
+	for _, r := range []*http.Request{
+		httptest.NewRequest(http.MethodGet, DefaultDoHPath, nil),
+		httptest.NewRequest(http.MethodGet, DefaultDoHPath+"?dns=not-base64!", nil),
+		bad,
+	} {
+		recorder := httptest.NewRecorder()
+		dohHandler.ServeHTTP(recorder, r)
+		if recorder.Code != http.StatusBadRequest {
+			t.Errorf("%v %v: expected 400, got: %v", r.Method, r.URL, recorder.Code)
+		}
+	}
+}
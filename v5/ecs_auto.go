@@ -0,0 +1,124 @@
+package dohProxy
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// source prefix lengths of the subnets sent with "auto" edns subnet if not
+	// specified, as recommended by RFC 7871 section 11.1.
+	DefaultECSv4Prefix = 24
+	DefaultECSv6Prefix = 56
+)
+
+// autoSubnet holds the subnets of the external ips of both families, for the
+// "auto" edns subnet; they are obtained on first use and renewed in
+// background after the renew interval.
+type autoSubnet struct {
+	families [2]*autoSubnetFamily
+	renew    time.Duration
+	// obtain returns the external ip reached by network, "tcp4" or "tcp6",
+	// replaceable for testing.
+	obtain func(network string) (string, error)
+	now    func() time.Time
+}
+
+type autoSubnetFamily struct {
+	network string
+	prefix  int
+	lock    sync.Mutex
+	subnet  string
+	expire  time.Time
+	// obtaining the external ip.
+	updating bool
+}
+
+func newAutoSubnet(v4Prefix int, v6Prefix int, renew time.Duration, obtain func(network string) (string, error)) *autoSubnet {
+	if v4Prefix == 0 {
+		v4Prefix = DefaultECSv4Prefix
+	}
+	if v6Prefix == 0 {
+		v6Prefix = DefaultECSv6Prefix
+	}
+	return &autoSubnet{
+		families: [2]*autoSubnetFamily{{network: "tcp4", prefix: v4Prefix}, {network: "tcp6", prefix: v6Prefix}},
+		renew:    renew,
+		obtain:   obtain,
+		now:      time.Now,
+	}
+}
+
+// get returns the subnet of the family of clientIP, ipv4 if clientIP is nil;
+// the subnet of the other family if there's none of the family, e.g. on
+// single stack networks.
+func (a *autoSubnet) get(clientIP net.IP) string {
+	first, second := a.families[0], a.families[1]
+	if clientIP != nil && clientIP.To4() == nil {
+		first, second = second, first
+	}
+	if subnet := a.subnet(first); subnet != "" {
+		return subnet
+	}
+	return a.subnet(second)
+}
+
+// subnet returns the subnet of family, obtaining the external ip if there's
+// none yet, or renewing it in background if expired.
+func (a *autoSubnet) subnet(family *autoSubnetFamily) string {
+	family.lock.Lock()
+	subnet := family.subnet
+	expired := !a.now().Before(family.expire)
+	if !expired || family.updating {
+		family.lock.Unlock()
+		return subnet
+	}
+	family.updating = true
+	family.lock.Unlock()
+
+	if family.expire.IsZero() {
+		return a.update(family)
+	}
+	go a.update(family)
+	return subnet
+}
+
+// update obtains the external ip of family, the last subnet is kept if it
+// fails.
+func (a *autoSubnet) update(family *autoSubnetFamily) string {
+	ip, err := a.obtain(family.network)
+	subnet := ""
+	if err == nil {
+		subnet, err = truncateSubnet(ip, family.prefix)
+	}
+	family.lock.Lock()
+	defer family.lock.Unlock()
+	family.updating = false
+	family.expire = a.now().Add(a.renew)
+	if err != nil {
+		upstreamLog.Debugf("obtain external ip over %v error: %v", family.network, err)
+		return family.subnet
+	}
+	family.subnet = subnet
+	upstreamLog.Debugf("renew subnet: %v", subnet)
+	return subnet
+}
+
+// truncateSubnet returns the subnet of ip with the prefix length, e.g.
+// "203.0.113.0/24" of "203.0.113.7".
+func truncateSubnet(ip string, prefix int) (string, error) {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return "", fmt.Errorf("invalid ip: %v", ip)
+	}
+	bits := 8 * net.IPv6len
+	if ip4 := parsed.To4(); ip4 != nil {
+		parsed, bits = ip4, 8*net.IPv4len
+	}
+	if prefix < 0 || prefix > bits {
+		return "", fmt.Errorf("invalid prefix length %v of %v", prefix, ip)
+	}
+	return fmt.Sprintf("%v/%v", parsed.Mask(net.CIDRMask(prefix, bits)), prefix), nil
+}
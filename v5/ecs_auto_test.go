@@ -0,0 +1,98 @@
+package dohProxy
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func testAutoSubnet(external map[string]string) *autoSubnet {
+	return newAutoSubnet(24, 56, time.Minute, func(network string) (string, error) {
+		if ip, ok := external[network]; ok {
+			return ip, nil
+		}
+		return "", errors.New("network unreachable")
+	})
+}
+
+func TestAutoSubnet_Get(t *testing.T) {
+	auto := testAutoSubnet(map[string]string{"tcp4": "203.0.113.77", "tcp6": "2001:db8:1234:5678::1"})
+	tests := []struct {
+		clientIP net.IP
+		expected string
+	}{
+		{net.ParseIP("192.0.2.1"), "203.0.113.0/24"},
+		{net.ParseIP("2001:db8::1"), "2001:db8:1234:5600::/56"},
+		{nil, "203.0.113.0/24"},
+	}
+	for _, test := range tests {
+		if subnet := auto.get(test.clientIP); subnet != test.expected {
+			t.Errorf("subnet for %v should be %v, got %v", test.clientIP, test.expected, subnet)
+		}
+	}
+
+	auto = testAutoSubnet(map[string]string{"tcp4": "203.0.113.77"})
+	if subnet := auto.get(net.ParseIP("2001:db8::1")); subnet != "203.0.113.0/24" {
+		t.Errorf("subnet should fall back to ipv4 without ipv6, got %v", subnet)
+	}
+	auto = testAutoSubnet(map[string]string{"tcp6": "2001:db8:1234:5678::1"})
+	if subnet := auto.get(net.ParseIP("192.0.2.1")); subnet != "2001:db8:1234:5600::/56" {
+		t.Errorf("subnet should fall back to ipv6 without ipv4, got %v", subnet)
+	}
+}
+
+func TestTruncateSubnet(t *testing.T) {
+	tests := []struct {
+		ip       string
+		prefix   int
+		expected string
+	}{
+		{"203.0.113.77", 24, "203.0.113.0/24"},
+		{"203.0.113.77", 32, "203.0.113.77/32"},
+		{"2001:db8:1234:5678::1", 56, "2001:db8:1234:5600::/56"},
+		{"2001:db8:1234:5678::1", 48, "2001:db8:1234::/48"},
+	}
+	for _, test := range tests {
+		subnet, err := truncateSubnet(test.ip, test.prefix)
+		if err != nil || subnet != test.expected {
+			t.Errorf("%v/%v should be %v, got %v, %v", test.ip, test.prefix, test.expected, subnet, err)
+		}
+	}
+	if _, err := truncateSubnet("203.0.113.77", 33); err == nil {
+		t.Error("prefix 33 of ipv4 should be invalid")
+	}
+	if _, err := truncateSubnet("invalid", 24); err == nil {
+		t.Error("invalid ip should be rejected")
+	}
+}
+
+func TestDMProvider_AutoSubnetOfClient(t *testing.T) {
+	provider, err := NewDMProvider([]string{"https://dns.example/dns-query"}, &DMProviderOptions{EDNSSubnet: "auto"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider.autoSubnetGetter = testAutoSubnet(map[string]string{"tcp4": "203.0.113.77", "tcp6": "2001:db8:1234:5678::1"})
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeAAAA)
+	if err := provider.setEDNSOptions(msg, net.ParseIP("2001:db8::1")); err != nil {
+		t.Fatal(err)
+	}
+	opt := msg.IsEdns0()
+	if opt == nil {
+		t.Fatal("edns subnet should be placed")
+	}
+	for _, o := range opt.Option {
+		if subnet, ok := o.(*dns.EDNS0_SUBNET); ok {
+			if subnet.Family != 2 || subnet.SourceNetmask != 56 ||
+				!subnet.Address.Equal(net.ParseIP("2001:db8:1234:5600::")) {
+				t.Errorf("unexpected subnet for ipv6 client: %v", subnet)
+			}
+			return
+		}
+	}
+	t.Errorf("edns subnet should be placed, got: %v", opt)
+}
@@ -0,0 +1,107 @@
+package dohProxy
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// ECSPolicySend sends the edns0-client-subnet in queries of the domain as
+	// EDNSSubnetModeGlobal, "auto" if EDNSSubnet is "no".
+	ECSPolicySend = "send"
+	// ECSPolicyStrip removes the edns0-client-subnet from queries of the
+	// domain.
+	ECSPolicyStrip = "strip"
+)
+
+// ECSPolicies are the edns0-client-subnet policies by domain, overriding
+// EDNSSubnetMode for the domains and their subdomains; the longest matched
+// domain wins.
+type ECSPolicies struct {
+	// policies by domain, in canonical form.
+	domains map[string]string
+}
+
+// LoadECSPolicies reads the policy file, one domain and its policy per line:
+//
+//	cdn.example send
+//	*.video.example send
+//	tracker.cdn.example strip
+//
+// "*.video.example" is the same as "video.example".
+func LoadECSPolicies(path string) (*ECSPolicies, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open ecs policy file %v error: %v", path, err)
+	}
+	defer func() { _ = f.Close() }()
+
+	policies := &ECSPolicies{domains: make(map[string]string)}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			// Discard comments.
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 || (fields[1] != ECSPolicySend && fields[1] != ECSPolicyStrip) {
+			return nil, fmt.Errorf("invalid ecs policy at %v:%v: %v", path, n, line)
+		}
+		domain := dns.CanonicalName(strings.TrimPrefix(fields[0], "*."))
+		if _, ok := dns.IsDomainName(domain); !ok {
+			return nil, fmt.Errorf("invalid domain of ecs policy at %v:%v: %v", path, n, fields[0])
+		}
+		policies.domains[domain] = fields[1]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read ecs policy file %v error: %v", path, err)
+	}
+	return policies, nil
+}
+
+// Len returns the number of domains.
+func (p *ECSPolicies) Len() int {
+	return len(p.domains)
+}
+
+// Match returns the policy of the longest domain matching name, "" if none;
+// p may be nil.
+func (p *ECSPolicies) Match(name string) string {
+	if p == nil {
+		return ""
+	}
+	name = dns.CanonicalName(name)
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if policy, ok := p.domains[name[off:]]; ok {
+			return policy
+		}
+	}
+	return ""
+}
+
+// ednsSubnetSettings returns the EDNSSubnetMode and EDNSSubnet of querying
+// msg, by the policy of its name if any.
+func (provider DMProvider) ednsSubnetSettings(msg *dns.Msg) (mode string, subnet string) {
+	mode, subnet = provider.opts.EDNSSubnetMode, provider.opts.EDNSSubnet
+	if len(msg.Question) == 0 {
+		return
+	}
+	switch provider.opts.ECSPolicies.Match(msg.Question[0].Name) {
+	case ECSPolicySend:
+		mode = EDNSSubnetModeGlobal
+		if subnet == "no" {
+			subnet = "auto"
+		}
+	case ECSPolicyStrip:
+		mode = EDNSSubnetModeStrip
+	}
+	return
+}
@@ -0,0 +1,66 @@
+package dohProxy
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestECSPolicies_Match(t *testing.T) {
+	policies, err := LoadECSPolicies(writeTestConfig(t, `# cdn domains
+cdn.example send
+*.video.example send
+tracker.cdn.example strip
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, policy := range map[string]string{
+		"cdn.example.":               ECSPolicySend,
+		"img.CDN.example.":           ECSPolicySend,
+		"a.video.example.":           ECSPolicySend,
+		"tracker.cdn.example.":       ECSPolicyStrip,
+		"pixel.tracker.cdn.example.": ECSPolicyStrip,
+		"example.org.":               "",
+		"notcdn.example.":            "",
+	} {
+		if got := policies.Match(name); got != policy {
+			t.Errorf("policy of %v should be %q, got %q", name, policy, got)
+		}
+	}
+	if policy := (*ECSPolicies)(nil).Match("cdn.example."); policy != "" {
+		t.Errorf("nil policies should match nothing, got %q", policy)
+	}
+
+	if _, err := LoadECSPolicies(writeTestConfig(t, "cdn.example always\n")); err == nil {
+		t.Error("unknown policy should be rejected")
+	}
+}
+
+func TestDMProvider_ECSPolicies(t *testing.T) {
+	policies, err := LoadECSPolicies(writeTestConfig(t, "cdn.example send\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider, err := NewDMProvider([]string{"https://dns.example/dns-query"}, &DMProviderOptions{
+		EDNSSubnet:     "203.0.113.0/24",
+		EDNSSubnetMode: EDNSSubnetModeStrip,
+		ECSPolicies:    policies,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, sent := range map[string]bool{"img.cdn.example.": true, "example.org.": false} {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, dns.TypeA)
+		if err := provider.setEDNSOptions(msg, nil); err != nil {
+			t.Fatal(err)
+		}
+		if hasEDNS0Subnet(msg) != sent {
+			t.Errorf("edns subnet of %v should be sent: %v, got: %v", name, sent, msg.IsEdns0())
+		}
+		if provider.stripsEDNSSubnet(msg) == sent {
+			t.Errorf("edns subnet of answers of %v should be stripped: %v", name, !sent)
+		}
+	}
+}
@@ -1,9 +1,18 @@
 package dohProxy
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/miekg/dns"
 	"github.com/panjf2000/ants/v2"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/singleflight"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -12,28 +21,198 @@ const (
 	concurrentPoolSize  = 32
 )
 
+const (
+	// NoAAAAModeFake answers AAAA questions with an empty answer, the default;
+	// NoAAAAModeNoData answers with NODATA and a synthesized SOA, so clients
+	// cache the negative answer; NoAAAAModeRefused answers with REFUSED.
+	NoAAAAModeFake    = "fake"
+	NoAAAAModeNoData  = "nodata"
+	NoAAAAModeRefused = "refused"
+
+	// ttl of the SOA synthesized for NODATA answers of AAAA questions.
+	noAAAANegativeTTL = 300
+
+	// UpstreamFailureServFail answers queries upstream failed to answer with
+	// SERVFAIL, the default; UpstreamFailureRefused answers with REFUSED.
+	UpstreamFailureServFail = "servfail"
+	UpstreamFailureRefused  = "refused"
+)
+
 var (
 	isSerialMode     bool
 	serialTaskNotify chan bool
+	// guards isSerialMode and serialTaskNotify, used by the goroutines of
+	// concurrent queries.
+	serialModeLock sync.Mutex
 )
 
+// serialTasks returns the channel serializing upstream queries, nil if not in
+// serial mode.
+func serialTasks() chan bool {
+	serialModeLock.Lock()
+	defer serialModeLock.Unlock()
+	if !isSerialMode {
+		return nil
+	}
+	return serialTaskNotify
+}
+
 // HandlerOptions specifies options to be used when instantiating a handler
 type HandlerOptions struct {
 	Cache  bool
 	NoAAAA bool
+	// clamp the ttl of records in answers before caching and serving, 0 means
+	// no clamping.
+	MinTTL uint32
+	MaxTTL uint32
+	// how AAAA questions are answered if NoAAAA, NoAAAAModeFake if empty.
+	NoAAAAMode string
+	// clamp the ttl of cache entries, 0 means no clamping.
+	CacheMinTTL uint32
+	CacheMaxTTL uint32
+	// max ttl of cached NXDOMAIN and NODATA answers, CacheMaxTTL is used if 0.
+	CacheNegativeMaxTTL uint32
+	// clamp the ttl of cached AAAA records to at most CacheAAAAMaxTTL if
+	// CacheClampAAAA, AAAA answers aren't cached if it's 0.
+	CacheClampAAAA  bool
+	CacheAAAAMaxTTL uint32
+	// refresh entries hit more than CachePrefetchThreshold times before they
+	// expire.
+	CachePrefetch          bool
+	CachePrefetchThreshold uint32
+	// expired answers are kept CacheServeStaleTTL seconds more, and served if
+	// the upstream query failed, RFC 8767; 0 disables serving stale answers.
+	CacheServeStaleTTL uint32
+	// the least recently used entries are evicted beyond CacheMaxEntries, 0
+	// means no limit.
+	CacheMaxEntries int
+	// edns0-client-subnet in cache keys is truncated to at most
+	// CacheECSv4Prefix or CacheECSv6Prefix bits, exact if 0.
+	CacheECSv4Prefix uint8
+	CacheECSv6Prefix uint8
+	// the expiry of cache entries is brought forward by a random fraction of
+	// their ttl of up to CacheTTLJitter, in [0, 1).
+	CacheTTLJitter float64
+	// answers of the qtypes in CacheExcludeQTypes are never cached.
+	CacheExcludeQTypes map[uint16]bool
+	// queries of the qtypes in BlockQTypes are refused without querying
+	// upstream, e.g. ANY and AXFR.
+	BlockQTypes map[uint16]bool
+	// the addresses of A and AAAA records in upstream answers are rewritten
+	// by the first matched rule of RewriteRules, before caching.
+	RewriteRules []*RewriteRule
+	// A and AAAA records are rotated on each answer, by cache entry if caching.
+	RotateAnswers bool
+	// names in blocklist are answered without querying, with NXDOMAIN or the
+	// sinkhole ip in BlocklistResponse; replaced by SwapBlocklist.
+	Blocklist         *Blocklist
+	BlocklistResponse string
+	// blocked A and AAAA queries are answered with a CNAME to BlocklistCNAME
+	// and its address record if not empty, for clients expecting one.
+	BlocklistCNAME string
+	// queries of names triggering rules of RPZ are answered by their actions
+	// after the blocklist, and so are answers having addresses triggering
+	// rules, before caching.
+	RPZ *RPZ
+	// A and AAAA queries of names in StaticHosts are answered from it, before
+	// the cache and upstream.
+	StaticHosts *StaticHosts
+	// only clients in AllowFrom may query if not empty, others are refused.
+	AllowFrom []*net.IPNet
+	// queries per second of each client ip, 0 means no limit; queries over
+	// the limit are handled by RateLimitAction.
+	RateLimit       uint32
+	RateLimitBurst  uint32
+	RateLimitAction string
+	// the answered queries are logged to QueryLog if not nil.
+	QueryLog *QueryLog
+	// the edns0-client-subnet of clients is removed from queries, so answers
+	// have none either.
+	StripEDNSSubnet bool
+	// the DO bit of clients is cleared in queries and DNSSEC records are
+	// removed from answers; they are passed through by default.
+	StripDNSSEC bool
+	// the additional section, except OPT, and the authority section, except
+	// the SOA of negative answers, are removed from answers to shrink them.
+	StripAdditional bool
+	StripAuthority  bool
+	// records of the answer section not of the question type are removed,
+	// except the CNAME chain to the answer.
+	MinimizeAnswers bool
+	// the names of upstream groups queries may be tagged with by the EDNS0
+	// option UpstreamGroupOptionCode, tags of other names are removed so the
+	// queries are of the default upstream; see GroupProvider.
+	UpstreamGroups map[string]bool
+	// answered to CH TXT queries of version.bind, DefaultVersionString if
+	// empty; VersionStringHidden refuses them.
+	VersionString string
+	// how NS queries of the root are answered, one of RootNSResponseUpstream,
+	// RootNSResponseLocal and RootNSResponseRefused; sent upstream if empty.
+	RootNSResponse string
+	// how queries of special-use domains are answered, one of
+	// SpecialUseDomainsOff, SpecialUseDomainsLocalhost and
+	// SpecialUseDomainsAll; sent upstream if empty.
+	SpecialUseDomains string
+	// AAAA queries answered with NODATA are answered with the A records
+	// mapped into DNS64Prefix if not nil, RFC 6147.
+	DNS64Prefix *net.IPNet
+	// CNAME chains in answers of A and AAAA queries are replaced with the
+	// address records at the end, owned by the queried name.
+	FlattenCNAME bool
+	// A and AAAA records are sorted by the rtt measured by RTTProber if not
+	// nil, the fastest first.
+	RTTProber *RTTProber
+	// /readyz of the admin api fails if the success rate of recent upstream
+	// queries is below ReadyMinSuccessRate.
+	ReadyMinSuccessRate float64
+	// how queries are answered if upstream failed, UpstreamFailureServFail if
+	// empty.
+	UpstreamFailureRcode string
+	// each query is traced by Tracer if not nil, with child spans of the
+	// cache lookup, upstream query and response writing.
+	Tracer *Tracer
+	// names in answers are compressed if Compress, so large answers fit in
+	// udp; it can be off for clients mishandling compression.
+	Compress bool
+	// at most UpstreamMaxInflight queries are sent upstream concurrently if
+	// not 0, further queries wait for at most UpstreamTimeout,
+	// DefaultUpstreamTimeout if 0.
+	UpstreamMaxInflight uint32
+	UpstreamTimeout     time.Duration
 }
 
 // Handler represents a DNS handler
 type Handler struct {
-	options           *HandlerOptions
-	provider          Provider
+	options *HandlerOptions
+	// holds *providerRef, swapped on reloading.
+	provider          atomic.Value
 	hostsFileProvider Provider
 	cache             *Cache
 	pool              *ants.PoolWithFunc
+	inFlightQueries   singleflight.Group
+	// holds *Blocklist, swapped on reloading.
+	blocklist atomic.Value
+	// sinkhole ip for blocked names, nil for NXDOMAIN.
+	blockedIP   net.IP
+	rateLimiter *RateLimiter
+	// advanced on each upstream answer if rotating answers without cache.
+	rotation uint32
+	// a slot is taken by each upstream query if UpstreamMaxInflight is set.
+	upstreamSlots chan struct{}
+}
+
+// providerRef tracks the in-flight queries of a provider, so the provider
+// can be discarded after all queries using it completed.
+type providerRef struct {
+	Provider
+	inFlight sync.RWMutex
 }
 
 type ctxParamsPoolFunc struct {
-	req  *dns.Msg
+	provider Provider
+	req      *dns.Msg
+	clientIP net.IP
+	ctx      context.Context
 	resp chan *dns.Msg
 	err  error
 }
@@ -43,59 +222,274 @@ type writerCtx struct {
 	isAnsweredCh  chan bool
 	isCache       bool
 	edns0SubnetIn dns.EDNS0_SUBNET
+	dnssecOK      bool
+	upstreamGroup string
 	receivedTime  time.Time
+	clientIP      net.IP
+	// the context carrying the query span, a no-op one if not traced.
+	spanCtx context.Context
 }
 
 // NewHandler creates a new Handler
 func NewHandler(provider Provider, options *HandlerOptions) *Handler {
 	handler := &Handler{
 		options:           options,
-		provider:          provider,
 		hostsFileProvider: NewHostsFileProvider(),
 	}
+	handler.provider.Store(&providerRef{Provider: provider})
+	handler.blocklist.Store(options.Blocklist)
 	p, _ := ants.NewPoolWithFunc(concurrentPoolSize, func(payload interface{}) {
 		ctx, ok := payload.(*ctxParamsPoolFunc)
 		if !ok {
 			ctx.err = fmt.Errorf("cast pool func context failed")
 			return
 		}
-		resp, err := handler.provider.Query(ctx.req)
+		resp, err := queryContext(ctx.ctx, ctx.provider, ctx.req, ctx.clientIP)
 		ctx.err = err
 		ctx.resp <- resp
 	},
 		ants.WithLogger(Log))
 	handler.pool = p
+	if options.UpstreamMaxInflight > 0 {
+		handler.upstreamSlots = make(chan struct{}, options.UpstreamMaxInflight)
+	}
 	if options.Cache {
-		handler.cache = NewCache()
+		handler.cache = NewCache(&CacheOptions{
+			MinTTL:            options.CacheMinTTL,
+			MaxTTL:            options.CacheMaxTTL,
+			NegativeMaxTTL:    options.CacheNegativeMaxTTL,
+			ClampAAAA:         options.CacheClampAAAA,
+			AAAAMaxTTL:        options.CacheAAAAMaxTTL,
+			Prefetch:          options.CachePrefetch,
+			PrefetchThreshold: options.CachePrefetchThreshold,
+			ServeStaleTTL:     options.CacheServeStaleTTL,
+			RotateAnswers:     options.RotateAnswers,
+			MaxEntries:        options.CacheMaxEntries,
+			ECSv4Prefix:       options.CacheECSv4Prefix,
+			ECSv6Prefix:       options.CacheECSv6Prefix,
+			TTLJitter:         options.CacheTTLJitter,
+		})
+	}
+	if options.BlocklistResponse != "" &&
+		options.BlocklistResponse != BlocklistResponseNXDomain {
+		handler.blockedIP = net.ParseIP(options.BlocklistResponse)
+		if handler.blockedIP == nil {
+			Log.Errorf("invalid blocklist response: %v, answer with NXDOMAIN.", options.BlocklistResponse)
+		}
+	}
+	if options.RateLimit > 0 {
+		handler.rateLimiter = NewRateLimiter(options.RateLimit, options.RateLimitBurst)
 	}
 	handler.initSerialMode()
 	return handler
 }
 
+// SwapProvider replaces the provider used for upstream queries, it blocks
+// until the in-flight queries using the old provider completed, then the old
+// provider is closed if it's an io.Closer.
+func (h *Handler) SwapProvider(provider Provider) {
+	old := h.provider.Load().(*providerRef)
+	h.provider.Store(&providerRef{Provider: provider})
+
+	old.inFlight.Lock()
+	defer old.inFlight.Unlock()
+	if closer, ok := old.Provider.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			Log.Errorf("close old provider error: %v", err)
+		}
+	}
+	Log.Infof("provider swapped, in-flight queries of old provider completed.")
+}
+
+// SwapBlocklist replaces the blocklist, queries in progress may still use the
+// old one.
+func (h *Handler) SwapBlocklist(blocklist *Blocklist) {
+	h.blocklist.Store(blocklist)
+}
+
+func (h *Handler) currentBlocklist() *Blocklist {
+	return h.blocklist.Load().(*Blocklist)
+}
+
+// acquireProvider returns the current provider, the caller must release it
+// with inFlight.RUnlock when the query completed.
+func (h *Handler) acquireProvider() *providerRef {
+	for {
+		ref := h.provider.Load().(*providerRef)
+		ref.inFlight.RLock()
+		// swapped between loading and locking, try the new one.
+		if h.provider.Load().(*providerRef) == ref {
+			return ref
+		}
+		ref.inFlight.RUnlock()
+	}
+}
+
 // Handle handles a DNS request
 func (h *Handler) Handle(writer dns.ResponseWriter, msg *dns.Msg) {
 
+	clientIP := remoteIP(writer.RemoteAddr())
+	if _, ok := writer.RemoteAddr().(*net.UDPAddr); ok {
+		writer = &udpWriter{ResponseWriter: writer, size: udpPayloadSize(msg)}
+	}
+	writer = &compressWriter{ResponseWriter: writer, compress: h.options.Compress}
+	cacheHit := false
+	var upstreamLatency time.Duration
+	if h.options.QueryLog != nil {
+		logWriter := newQueryLogWriter(writer, clientIP, msg)
+		writer = logWriter
+		defer func() { logWriter.finish(h.options.QueryLog, cacheHit, upstreamLatency) }()
+	}
+	spanCtx, span := h.options.Tracer.start(context.Background(), spanNameQuery, trace.SpanKindServer)
+	if h.options.Tracer != nil {
+		traceWriter := newRcodeWriter(writer)
+		writer = traceWriter
+		defer func() {
+			setQuerySpanAttributes(span, msg, traceWriter.answeredRcode(), cacheHit)
+			span.End()
+		}()
+	}
+	if !h.isAllowed(clientIP) {
+		Log.Infof("refused query from %v", writer.RemoteAddr())
+		metricRefused.Inc()
+		writeRefused(writer, msg)
+		return
+	}
+	if h.rateLimiter != nil && clientIP != nil && !h.rateLimiter.Allow(clientIP) {
+		Log.Debugf("rate limited query from %v", writer.RemoteAddr())
+		metricRateLimited.Inc()
+		if h.options.RateLimitAction != RateLimitActionDrop {
+			writeRefused(writer, msg)
+		}
+		return
+	}
+	if err := validateQuery(msg); err != nil {
+		Log.Debugf("malformed query from %v: %v", clientIP, err)
+		writeRcode(writer, msg, dns.RcodeFormatError)
+		return
+	}
+	if opt := msg.IsEdns0(); opt != nil && opt.Version() != 0 {
+		Log.Debugf("unsupported edns version %v from %v", opt.Version(), clientIP)
+		writeBadVers(writer, msg)
+		return
+	}
+
+	if h.options.StripEDNSSubnet {
+		RemoveEDNS0Subnet(msg)
+	}
+	if h.options.StripDNSSEC {
+		setDNSSECOK(msg, false)
+	}
+	upstreamGroup := upstreamGroupTag(msg)
+	if upstreamGroup != "" && !h.options.UpstreamGroups[upstreamGroup] {
+		setUpstreamGroupTag(msg, "")
+		upstreamGroup = ""
+	}
+
 	Log.Infoln("requesting", msg.Question[0].Name, dns.TypeToString[msg.Question[0].Qtype])
+	observeQuery(msg)
 
+	receivedTime := time.Now()
 	isAnsweredCh := make(chan bool)
 	defer close(isAnsweredCh)
 
+	if qtype := msg.Question[0].Qtype; h.options.BlockQTypes[qtype] {
+		Log.Infof("refused %v query of %v from %v", dns.TypeToString[qtype], msg.Question[0].Name, writer.RemoteAddr())
+		metricQTypeBlocked.Inc()
+		writeRefused(writer, msg)
+		return
+	}
+
+	if rMsg := chaosReply(msg, h.options.VersionString); rMsg != nil {
+		if err := writer.WriteMsg(rMsg); err != nil {
+			Log.Errorf("Error writing DNS response: %v", err)
+		}
+		return
+	}
+
+	if rMsg := rootNSReply(msg, h.options.RootNSResponse); rMsg != nil {
+		if err := writer.WriteMsg(rMsg); err != nil {
+			Log.Errorf("Error writing DNS response: %v", err)
+		}
+		return
+	}
+
+	if rMsg := specialUseReply(msg, h.options.SpecialUseDomains); rMsg != nil {
+		if err := writer.WriteMsg(rMsg); err != nil {
+			Log.Errorf("Error writing DNS response: %v", err)
+		}
+		return
+	}
+
+	if blocklist := h.currentBlocklist(); blocklist != nil && blocklist.Match(msg.Question[0].Name) {
+		metricBlocked.Inc()
+		rMsg := blockedReply(msg, h.blockedIP)
+		if h.options.BlocklistCNAME != "" {
+			rMsg = blockedCNAMEReply(msg, h.blockedIP, h.options.BlocklistCNAME)
+		}
+		if err := writer.WriteMsg(rMsg); err != nil {
+			Log.Errorf("Error writing DNS response: %v", err)
+		}
+		Log.Infof("blocked: %v, cost time: %v", msg.Question[0].Name, time.Now().Sub(receivedTime))
+		return
+	}
+
+	if rpz := h.options.RPZ; rpz != nil {
+		if rule := rpz.matchName(msg.Question[0].Name); rule != nil && rule.action != rpzPassthru {
+			if err := writer.WriteMsg(h.rpzReply(msg, rule, clientIP)); err != nil {
+				Log.Errorf("Error writing DNS response: %v", err)
+			}
+			Log.Infof("rpz %v: %v, cost time: %v", rule.action, msg.Question[0].Name, time.Now().Sub(receivedTime))
+			return
+		}
+	}
+
+	if h.options.StaticHosts != nil {
+		if rMsg := h.options.StaticHosts.Lookup(msg); rMsg != nil {
+			if err := writer.WriteMsg(rMsg); err != nil {
+				Log.Errorf("Error writing DNS response: %v", err)
+			}
+			Log.Infof("resolved from static hosts: %v, cost time: %v",
+				msg.Question[0].Name, time.Now().Sub(receivedTime))
+			return
+		}
+	}
+
+	if h.options.NoAAAA && msg.Question[0].Qtype == dns.TypeAAAA &&
+		h.options.NoAAAAMode != "" && h.options.NoAAAAMode != NoAAAAModeFake {
+		if err := writer.WriteMsg(noAAAAReply(msg, h.options.NoAAAAMode)); err != nil {
+			Log.Errorf("Error writing DNS response: %v", err)
+		}
+		Log.Infof("answered AAAA with %v: %v", h.options.NoAAAAMode, msg.Question[0].Name)
+		return
+	}
+
 	edns0SubnetIn := ObtainEDN0Subnet(msg)
 	ctx := &writerCtx{msg: msg, isCache: false, isAnsweredCh: isAnsweredCh,
-		edns0SubnetIn: edns0SubnetIn, receivedTime: time.Now()}
-	if h.options.Cache {
-		rmsg := h.cache.Get(msg)
+		edns0SubnetIn: edns0SubnetIn, dnssecOK: dnssecOK(msg), upstreamGroup: upstreamGroup,
+		receivedTime: receivedTime, clientIP: clientIP, spanCtx: spanCtx}
+	if h.cacheable(msg) {
+		_, lookupSpan := h.options.Tracer.start(spanCtx, spanNameCacheLookup, trace.SpanKindInternal)
+		rmsg, prefetch := h.cache.Lookup(msg)
+		lookupSpan.SetAttributes(attribute.Bool("dns.cache_hit", rmsg != nil))
+		lookupSpan.End()
+		if prefetch {
+			go h.prefetch(msg.Copy())
+		}
 		if rmsg != nil {
 			rmsg.Id = msg.Id
 			ctx.msg = rmsg
 			ctx.isCache = true
 			go h.TryWriteAnswer(&writer, ctx)
 			if <-isAnsweredCh {
+				cacheHit = true
 				Log.Infof("resolved from cache: %v, cost time: %v",
 					msg.Question[0].Name, time.Now().Sub(ctx.receivedTime))
+				observeCacheHit()
 				return
 			}
 		}
+		metricCacheMisses.Inc()
 	}
 
 	// lookup hosts file if retrieving ip address
@@ -108,41 +502,194 @@ func (h *Handler) Handle(writer dns.ResponseWriter, msg *dns.Msg) {
 		}
 	}
 
-	if isSerialMode && serialTaskNotify != nil {
-		select {
-		case <-serialTaskNotify:
-			break
-		case <-time.After(queryExpireDuration):
-			Log.Errorf("timeout for waiting serial task channel.")
-			return
-		}
-	}
-
+	upstreamStart := time.Now()
 	go h.AnswerByDoH(&writer, ctx)
 	if <-isAnsweredCh {
+		cacheHit = ctx.isCache
+		upstreamLatency = time.Now().Sub(upstreamStart)
 		Log.Infof("resolved from DoH: %v, cost time: %v",
 			msg.Question[0].Name, time.Now().Sub(ctx.receivedTime))
 		return
 	}
 
-	if !isSerialMode {
+	if serialTasks() == nil {
 		h.initSerialMode()
 	}
 }
 
+// remoteIP returns the ip of the udp or tcp client at addr.
+func remoteIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	default:
+		return nil
+	}
+}
+
+// udpWriter truncates the answers exceeding the udp payload size of client, so
+// the client retries over tcp.
+type udpWriter struct {
+	dns.ResponseWriter
+	size int
+}
+
+func (w *udpWriter) WriteMsg(msg *dns.Msg) error {
+	if msg.Len() > w.size {
+		// truncate a copy, the message may be inserting into cache.
+		msg = msg.Copy()
+		msg.Truncate(w.size)
+	}
+	return w.ResponseWriter.WriteMsg(msg)
+}
+
+// compressWriter sets the name compression of answers.
+type compressWriter struct {
+	dns.ResponseWriter
+	compress bool
+}
+
+func (w *compressWriter) WriteMsg(msg *dns.Msg) error {
+	if msg.Compress != w.compress {
+		// set on a shallow copy, the message may be inserting into cache.
+		m := *msg
+		m.Compress = w.compress
+		msg = &m
+	}
+	return w.ResponseWriter.WriteMsg(msg)
+}
+
+// udpPayloadSize returns the udp payload size advertised in msg, 512 if none.
+func udpPayloadSize(msg *dns.Msg) int {
+	if opt := msg.IsEdns0(); opt != nil && opt.UDPSize() > dns.MinMsgSize {
+		return int(opt.UDPSize())
+	}
+	return dns.MinMsgSize
+}
+
+func writeRefused(writer dns.ResponseWriter, msg *dns.Msg) {
+	writeRcode(writer, msg, dns.RcodeRefused)
+}
+
+// writeRcode answers msg with rcode and no records.
+func writeRcode(writer dns.ResponseWriter, msg *dns.Msg, rcode int) {
+	rMsg := new(dns.Msg)
+	rMsg.SetRcode(msg, rcode)
+	if err := writer.WriteMsg(rMsg); err != nil {
+		Log.Errorf("Error writing DNS response: %v", err)
+	}
+}
+
+// writeBadVers answers msg of an unsupported edns version with BADVERS, and
+// the OPT of version 0, rfc6891 6.1.3.
+func writeBadVers(writer dns.ResponseWriter, msg *dns.Msg) {
+	rMsg := new(dns.Msg)
+	rMsg.SetRcode(msg, dns.RcodeBadVers)
+	rMsg.SetEdns0(dns.DefaultMsgSize, false)
+	if err := writer.WriteMsg(rMsg); err != nil {
+		Log.Errorf("Error writing DNS response: %v", err)
+	}
+}
+
+// validateQuery checks msg is a query of exactly one question with a
+// queryable type and class.
+func validateQuery(msg *dns.Msg) error {
+	if msg.Response {
+		return errors.New("not a query")
+	}
+	if len(msg.Question) != 1 {
+		return fmt.Errorf("%v questions", len(msg.Question))
+	}
+	q := msg.Question[0]
+	switch q.Qtype {
+	case dns.TypeNone, dns.TypeOPT, dns.TypeReserved:
+		return fmt.Errorf("invalid qtype %v", q.Qtype)
+	}
+	switch q.Qclass {
+	case dns.ClassINET, dns.ClassCHAOS, dns.ClassHESIOD, dns.ClassANY:
+	default:
+		return fmt.Errorf("invalid qclass %v", q.Qclass)
+	}
+	if _, ok := dns.IsDomainName(q.Name); !ok {
+		return fmt.Errorf("invalid qname %q", q.Name)
+	}
+	return nil
+}
+
+// noAAAAReply answers the AAAA question in msg by mode, NODATA answers have a
+// SOA of the question name as the zone apex.
+func noAAAAReply(msg *dns.Msg, mode string) *dns.Msg {
+	rMsg := new(dns.Msg)
+	if mode == NoAAAAModeRefused {
+		rMsg.SetRcode(msg, dns.RcodeRefused)
+		return rMsg
+	}
+	rMsg.SetReply(msg)
+	name := msg.Question[0].Name
+	rMsg.Ns = append(rMsg.Ns, &dns.SOA{
+		Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeSOA, Class: dns.ClassINET,
+			Ttl: noAAAANegativeTTL},
+		Ns:      name,
+		Mbox:    "hostmaster." + name,
+		Serial:  1,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  noAAAANegativeTTL,
+	})
+	return rMsg
+}
+
+// isAllowed reports whether the client at ip may query.
+func (h *Handler) isAllowed(ip net.IP) bool {
+	if len(h.options.AllowFrom) == 0 {
+		return true
+	}
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range h.options.AllowFrom {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
 func (h *Handler) initSerialMode() {
+	serialModeLock.Lock()
 	isSerialMode = true
 	if serialTaskNotify == nil {
 		serialTaskNotify = make(chan bool)
 	}
-	go func() { serialTaskNotify <- true }()
+	notify := serialTaskNotify
+	serialModeLock.Unlock()
+	go func() { notify <- true }()
 	Log.Infof("enter serial mode.")
 }
 
 func (h *Handler) TryWriteAnswer(writer *dns.ResponseWriter, ctx *writerCtx) {
 	if ctx.msg != nil {
-		ReplaceEDNS0Subnet(ctx.msg, &ctx.edns0SubnetIn)
-		if h.options.Cache && !ctx.isCache {
+		if !ctx.isCache {
+			clampMsgTTL(ctx.msg, h.options.MinTTL, h.options.MaxTTL)
+		}
+		if h.options.RTTProber != nil {
+			h.options.RTTProber.Sort(ctx.msg)
+		}
+		if ctx.edns0SubnetIn.Code == dns.EDNS0SUBNET {
+			subnet := answerEDNS0Subnet(ctx.msg, ctx.edns0SubnetIn)
+			ReplaceEDNS0Subnet(ctx.msg, &subnet)
+		} else {
+			// the client sent none.
+			RemoveEDNS0Subnet(ctx.msg)
+		}
+		h.matchDNSSECOK(ctx.msg, ctx.dnssecOK)
+		// the tag is kept in answers, so they are cached by the group.
+		setUpstreamGroupTag(ctx.msg, ctx.upstreamGroup)
+		h.stripSections(ctx.msg)
+		if h.cacheable(ctx.msg) && !ctx.isCache {
 			msgch := make(chan *dns.Msg)
 			defer close(msgch)
 			go h.cache.Insert(msgch)
@@ -150,14 +697,16 @@ func (h *Handler) TryWriteAnswer(writer *dns.ResponseWriter, ctx *writerCtx) {
 		}
 		// Write the response
 		writerReal := *writer
+		_, writeSpan := h.options.Tracer.start(ctx.spanCtx, spanNameWrite, trace.SpanKindInternal)
 		err := writerReal.WriteMsg(ctx.msg)
+		writeSpan.End()
 		if err != nil {
 			Log.Errorf("Error writing DNS response: %v", err)
 			ctx.isAnsweredCh <- false
 		} else {
 			ctx.isAnsweredCh <- true
 			Log.Debugf("Successfully write response message")
-			if isSerialMode && !ctx.isCache &&
+			if notify := serialTasks(); notify != nil && !ctx.isCache &&
 				!(h.options.NoAAAA && ctx.msg.Question[0].Qtype == dns.TypeAAAA) {
 				// drain the waiting queries.
 				go func() {
@@ -166,7 +715,7 @@ func (h *Handler) TryWriteAnswer(writer *dns.ResponseWriter, ctx *writerCtx) {
 						count := 0
 						for {
 							select {
-							case serialTaskNotify <- true:
+							case notify <- true:
 								count ++
 								break
 							default:
@@ -175,8 +724,10 @@ func (h *Handler) TryWriteAnswer(writer *dns.ResponseWriter, ctx *writerCtx) {
 							}
 						}
 					}()
+					serialModeLock.Lock()
 					isSerialMode = false
 					serialTaskNotify = nil
+					serialModeLock.Unlock()
 					Log.Infof("leave serial mode.")
 				}()
 
@@ -201,22 +752,198 @@ func (h *Handler) AnswerByHostsFile(writer *dns.ResponseWriter, ctx *writerCtx)
 }
 
 func (h *Handler) AnswerByDoH(writer *dns.ResponseWriter, ctx *writerCtx) {
-	ctxP := &ctxParamsPoolFunc{req: ctx.msg, resp: make(chan *dns.Msg)}
-	if err := h.pool.Invoke(ctxP); err != nil {
-		Log.Errorf("dns-message provider failed: %v", err)
+	// identical queries in flight share one upstream query.
+	key := getQueryStringForCache(ctx.msg)
+	v, err, shared := h.inFlightQueries.Do(key, func() (interface{}, error) {
+		return h.queryUpstream(ctx.spanCtx, ctx.msg, ctx.clientIP)
+	})
+	if err != nil || v == nil {
+		Log.Errorf("query failed: %v", err)
+		if h.answerStale(writer, ctx) {
+			return
+		}
+		// answer promptly rather than letting the client time out.
+		writeRcode(*writer, ctx.msg, h.upstreamFailureRcode())
 		ctx.isAnsweredCh <- false
 		return
 	}
-
-	if ctxP.err != nil {
-		Log.Errorf("query failed: %v", ctxP.err)
-		ctx.isAnsweredCh <- false
-		return
+	// each waiter gets its own copy, the message will be modified when writing.
+	resp := v.(*dns.Msg).Copy()
+	if shared {
+		Log.Debugf("shared upstream answer for: %v", key)
+		resp.Id = ctx.msg.Id
+		resp.Question = append([]dns.Question(nil), ctx.msg.Question...)
 	}
-	ctx.msg = <-ctxP.resp
+	resp = h.processAnswer(ctx.msg, resp, ctx.clientIP)
+	if h.options.RotateAnswers && !h.cacheable(ctx.msg) {
+		rotateAddressRecords(resp, atomic.AddUint32(&h.rotation, 1)-1)
+	}
+	ctx.msg = resp
 	ctx.isCache = false
 	go h.TryWriteAnswer(writer, ctx)
-	if isSerialMode && serialTaskNotify != nil {
-		go func() { serialTaskNotify <- true }()
+}
+
+func (h *Handler) upstreamFailureRcode() int {
+	if h.options.UpstreamFailureRcode == UpstreamFailureRefused {
+		return dns.RcodeRefused
+	}
+	return dns.RcodeServerFailure
+}
+
+// cacheable reports whether the answer of msg is looked up and inserted in
+// cache.
+func (h *Handler) cacheable(msg *dns.Msg) bool {
+	return h.options.Cache && len(msg.Question) > 0 && !h.options.CacheExcludeQTypes[msg.Question[0].Qtype]
+}
+
+// answerStale answers with the expired cache entry if serving stale is enabled,
+// and refreshes the entry in background.
+func (h *Handler) answerStale(writer *dns.ResponseWriter, ctx *writerCtx) bool {
+	if !h.cacheable(ctx.msg) || h.options.CacheServeStaleTTL == 0 {
+		return false
+	}
+	stale := h.cache.GetStale(ctx.msg)
+	if stale == nil {
+		return false
+	}
+	Log.Debugf("serving stale answer: %v", ctx.msg.Question[0].Name)
+	go h.prefetch(ctx.msg.Copy())
+	stale.Id = ctx.msg.Id
+	ctx.msg = stale
+	ctx.isCache = true
+	go h.TryWriteAnswer(writer, ctx)
+	return true
+}
+
+// prefetch refreshes the cache entry of msg in background.
+func (h *Handler) prefetch(msg *dns.Msg) {
+	if _, err := h.refresh(msg); err != nil {
+		Log.Warnf("prefetch %v failed: %v", msg.Question[0].Name, err)
+		return
+	}
+	metricCachePrefetches.Inc()
+	Log.Debugf("prefetched: %v", msg.Question[0].Name)
+}
+
+// refresh queries upstream for msg and inserts the answer into cache, sharing
+// the upstream query with identical queries in flight; the answer is returned.
+func (h *Handler) refresh(msg *dns.Msg) (*dns.Msg, error) {
+	key := getQueryStringForCache(msg)
+	v, err, _ := h.inFlightQueries.Do(key, func() (interface{}, error) {
+		return h.queryUpstream(context.Background(), msg, nil)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if v == nil {
+		return nil, fmt.Errorf("no answer")
+	}
+	resp := v.(*dns.Msg).Copy()
+	resp.Question = append([]dns.Question(nil), msg.Question...)
+	resp = h.processAnswer(msg, resp, nil)
+	if subnet := ObtainEDN0Subnet(msg); subnet.Code == dns.EDNS0SUBNET {
+		subnet = answerEDNS0Subnet(resp, subnet)
+		ReplaceEDNS0Subnet(resp, &subnet)
+	} else {
+		RemoveEDNS0Subnet(resp)
+	}
+	h.matchDNSSECOK(resp, dnssecOK(msg))
+	setUpstreamGroupTag(resp, upstreamGroupTag(msg))
+	h.stripSections(resp)
+	h.cache.realInsert(resp)
+	return resp, nil
+}
+
+// processAnswer synthesizes DNS64 records, flattens CNAME chains, rewrites
+// addresses and applies RPZ to the upstream answer resp of msg, the same for
+// the answers written and the cache refreshes.
+func (h *Handler) processAnswer(msg *dns.Msg, resp *dns.Msg, clientIP net.IP) *dns.Msg {
+	qtype := msg.Question[0].Qtype
+	if h.options.DNS64Prefix != nil && qtype == dns.TypeAAAA && isNoData(resp) {
+		resp = h.synthesizeDNS64(msg, resp, h.options.DNS64Prefix, clientIP)
+	}
+	if h.options.FlattenCNAME && (qtype == dns.TypeA || qtype == dns.TypeAAAA) {
+		resp = h.flattenCNAME(msg, resp, clientIP)
+	}
+	if len(h.options.RewriteRules) > 0 {
+		rewriteAnswers(resp, h.options.RewriteRules)
+	}
+	return h.applyRPZ(msg, resp, clientIP)
+}
+
+// matchDNSSECOK sets the DO bit of the answer resp as the query, so it's
+// cached for the queries alike; DNSSEC records are removed if they are
+// stripped, unless queried for.
+func (h *Handler) matchDNSSECOK(resp *dns.Msg, ok bool) {
+	setDNSSECOK(resp, ok)
+	if h.options.StripDNSSEC && len(resp.Question) > 0 && !isDNSSECQuestion(resp.Question[0].Qtype) {
+		stripDNSSECRecords(resp)
+	}
+}
+
+// queryUpstream queries the current provider in pool, serialized in serial mode;
+// clientIP may be nil, e.g. for prefetching. The query is traced as a child of
+// the span of ctx.
+func (h *Handler) queryUpstream(ctx context.Context, msg *dns.Msg, clientIP net.IP) (*dns.Msg, error) {
+	if trace.SpanContextFromContext(ctx).IsValid() {
+		var span trace.Span
+		ctx, span = h.options.Tracer.start(ctx, spanNameUpstream, trace.SpanKindClient)
+		defer span.End()
+	}
+	if notify := serialTasks(); notify != nil {
+		select {
+		case <-notify:
+			break
+		case <-time.After(queryExpireDuration):
+			return nil, fmt.Errorf("timeout for waiting serial task channel")
+		}
+	}
+
+	if h.upstreamSlots != nil {
+		if err := h.acquireUpstreamSlot(ctx); err != nil {
+			return nil, err
+		}
+		defer func() { <-h.upstreamSlots }()
+	}
+
+	ref := h.acquireProvider()
+	ctxP := &ctxParamsPoolFunc{provider: ref.Provider, req: msg, clientIP: clientIP, ctx: ctx, resp: make(chan *dns.Msg)}
+	if err := h.pool.Invoke(ctxP); err != nil {
+		ref.inFlight.RUnlock()
+		return nil, fmt.Errorf("dns-message provider failed: %v", err)
+	}
+
+	resp := <-ctxP.resp
+	ref.inFlight.RUnlock()
+	if ctxP.err != nil {
+		return nil, ctxP.err
+	}
+	if notify := serialTasks(); notify != nil {
+		go func() { notify <- true }()
+	}
+	return resp, nil
+}
+
+// acquireUpstreamSlot waits for a slot of upstream queries, at most the
+// upstream timeout.
+func (h *Handler) acquireUpstreamSlot(ctx context.Context) error {
+	select {
+	case h.upstreamSlots <- struct{}{}:
+		return nil
+	default:
+	}
+	timeout := h.options.UpstreamTimeout
+	if timeout == 0 {
+		timeout = DefaultUpstreamTimeout
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case h.upstreamSlots <- struct{}{}:
+		return nil
+	case <-timer.C:
+		return fmt.Errorf("timeout for waiting %v upstream queries in flight", cap(h.upstreamSlots))
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
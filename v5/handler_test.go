@@ -0,0 +1,897 @@
+package dohProxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// testResponseWriter implements dns.ResponseWriter and captures the messages written.
+type testResponseWriter struct {
+	remoteAddr net.Addr
+	msgs       chan *dns.Msg
+}
+
+func newTestResponseWriter(remoteAddr string) *testResponseWriter {
+	addr, _ := net.ResolveUDPAddr("udp", remoteAddr)
+	return &testResponseWriter{remoteAddr: addr, msgs: make(chan *dns.Msg, 16)}
+}
+
+func (w *testResponseWriter) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 53}
+}
+func (w *testResponseWriter) RemoteAddr() net.Addr { return w.remoteAddr }
+func (w *testResponseWriter) WriteMsg(msg *dns.Msg) error {
+	w.msgs <- msg.Copy()
+	return nil
+}
+func (w *testResponseWriter) Write(b []byte) (int, error) {
+	msg := new(dns.Msg)
+	if err := msg.Unpack(b); err != nil {
+		return 0, err
+	}
+	return len(b), w.WriteMsg(msg)
+}
+func (w *testResponseWriter) Close() error        { return nil }
+func (w *testResponseWriter) TsigStatus() error   { return nil }
+func (w *testResponseWriter) TsigTimersOnly(bool) {}
+func (w *testResponseWriter) Hijack()             {}
+
+// waitMsg waits for a message written to the writer.
+func (w *testResponseWriter) waitMsg(t *testing.T, timeout time.Duration) *dns.Msg {
+	t.Helper()
+	select {
+	case msg := <-w.msgs:
+		return msg
+	case <-time.After(timeout):
+		t.Fatalf("no response written in %v", timeout)
+		return nil
+	}
+}
+
+// testProvider answers every question with a TXT record of its name.
+type testProvider struct {
+	name    string
+	rcode   int
+	err     error
+	queries int32
+	release chan bool
+	queried chan bool
+	closed  int32
+	// ttl of the TXT record, 60 if 0.
+	ttl uint32
+}
+
+func (p *testProvider) Query(msg *dns.Msg) (*dns.Msg, error) {
+	atomic.AddInt32(&p.queries, 1)
+	if p.queried != nil {
+		p.queried <- true
+	}
+	if p.release != nil {
+		<-p.release
+	}
+	if p.err != nil {
+		return nil, p.err
+	}
+	rMsg := new(dns.Msg)
+	if p.rcode != dns.RcodeSuccess {
+		rMsg.SetRcode(msg, p.rcode)
+		soa, _ := dns.NewRR("example.com. 3600 IN SOA ns.example.com. admin.example.com. 1 7200 900 1209600 300")
+		rMsg.Ns = append(rMsg.Ns, soa)
+		return rMsg, nil
+	}
+	rMsg.SetReply(msg)
+	ttl := p.ttl
+	if ttl == 0 {
+		ttl = 60
+	}
+	rr, _ := dns.NewRR(fmt.Sprintf("%v %v IN TXT %v", msg.Question[0].Name, ttl, p.name))
+	rMsg.Answer = append(rMsg.Answer, rr)
+	return rMsg, nil
+}
+
+func (p *testProvider) Close() error {
+	atomic.StoreInt32(&p.closed, 1)
+	return nil
+}
+
+func txtOf(msg *dns.Msg) string {
+	if msg == nil || len(msg.Answer) == 0 {
+		return ""
+	}
+	if txt, ok := msg.Answer[0].(*dns.TXT); ok && len(txt.Txt) > 0 {
+		return txt.Txt[0]
+	}
+	return ""
+}
+
+func TestHandler_SwapProvider(t *testing.T) {
+	providerOld := &testProvider{name: "old", release: make(chan bool), queried: make(chan bool, 1)}
+	providerNew := &testProvider{name: "new"}
+	handler := NewHandler(providerOld, &HandlerOptions{})
+
+	writer := newTestResponseWriter("127.0.0.1:5353")
+	msg := new(dns.Msg)
+	msg.SetQuestion("swap.example.com.", dns.TypeTXT)
+	go handler.Handle(writer, msg)
+	<-providerOld.queried
+
+	swapped := make(chan bool)
+	go func() {
+		handler.SwapProvider(providerNew)
+		close(swapped)
+	}()
+	select {
+	case <-swapped:
+		t.Fatal("swap should wait for the in-flight query of the old provider")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(providerOld.release)
+	if txt := txtOf(writer.waitMsg(t, time.Second)); txt != "old" {
+		t.Errorf("in-flight query should be answered by old provider, got: %v", txt)
+	}
+	<-swapped
+	if atomic.LoadInt32(&providerOld.closed) != 1 {
+		t.Errorf("old provider should be closed after swapping")
+	}
+
+	msg = new(dns.Msg)
+	msg.SetQuestion("swap2.example.com.", dns.TypeTXT)
+	handler.Handle(writer, msg)
+	if txt := txtOf(writer.waitMsg(t, time.Second)); txt != "new" {
+		t.Errorf("query after swapping should be answered by new provider, got: %v", txt)
+	}
+}
+
+func TestHandler_DeduplicateInFlightQueries(t *testing.T) {
+	provider := &testProvider{name: "dedup", release: make(chan bool)}
+	handler := NewHandler(provider, &HandlerOptions{})
+
+	const count = 100
+	writers := make([]*testResponseWriter, count)
+	for i := 0; i < count; i++ {
+		writers[i] = newTestResponseWriter("127.0.0.1:5353")
+		msg := new(dns.Msg)
+		msg.SetQuestion("dedup.example.com.", dns.TypeTXT)
+		msg.Id = uint16(i + 1)
+		go handler.Handle(writers[i], msg)
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(provider.release)
+
+	for i, writer := range writers {
+		msg := writer.waitMsg(t, time.Second)
+		if msg.Id != uint16(i+1) {
+			t.Errorf("response id mismatch, expected: %v, got: %v", i+1, msg.Id)
+		}
+		if txt := txtOf(msg); txt != "dedup" {
+			t.Errorf("unexpected answer: %v", txt)
+		}
+	}
+	if queries := atomic.LoadInt32(&provider.queries); queries != 1 {
+		t.Errorf("identical queries should be sent upstream once, got: %v", queries)
+	}
+}
+
+func TestHandler_Blocklist(t *testing.T) {
+	blocklist, err := LoadBlocklist(writeTestConfig(t, "0.0.0.0 blocked.example.com\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := &testProvider{name: "upstream"}
+	handler := NewHandler(provider, &HandlerOptions{Cache: true, Blocklist: blocklist})
+
+	writer := newTestResponseWriter("127.0.0.1:5353")
+	msg := new(dns.Msg)
+	msg.SetQuestion("blocked.example.com.", dns.TypeTXT)
+	handler.Handle(writer, msg)
+	if rMsg := writer.waitMsg(t, time.Second); rMsg.Rcode != dns.RcodeNameError {
+		t.Errorf("expected NXDOMAIN for blocked name, got: %v", rMsg)
+	}
+	if queries := atomic.LoadInt32(&provider.queries); queries != 0 {
+		t.Errorf("blocked name should not be queried, got: %v", queries)
+	}
+}
+
+func TestHandler_BlocklistCNAME(t *testing.T) {
+	blocklist, err := LoadBlocklist(writeTestConfig(t, "blocked.example.com\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := &testProvider{name: "upstream"}
+	handler := NewHandler(provider, &HandlerOptions{Blocklist: blocklist, BlocklistResponse: "192.0.2.53",
+		BlocklistCNAME: "sinkhole.example.net"})
+
+	writer := newTestResponseWriter("127.0.0.1:5353")
+	msg := new(dns.Msg)
+	msg.SetQuestion("blocked.example.com.", dns.TypeA)
+	handler.Handle(writer, msg)
+	rMsg := writer.waitMsg(t, time.Second)
+	if rMsg.Rcode != dns.RcodeSuccess || len(rMsg.Answer) != 2 {
+		t.Fatalf("expected CNAME and address answers, got: %v", rMsg)
+	}
+	if cname, ok := rMsg.Answer[0].(*dns.CNAME); !ok || cname.Hdr.Name != "blocked.example.com." ||
+		cname.Target != "sinkhole.example.net." {
+		t.Errorf("expected CNAME to the sinkhole host, got: %v", rMsg.Answer[0])
+	}
+	if a, ok := rMsg.Answer[1].(*dns.A); !ok || a.Hdr.Name != "sinkhole.example.net." || !a.A.Equal(net.ParseIP("192.0.2.53")) {
+		t.Errorf("expected sinkhole A record, got: %v", rMsg.Answer[1])
+	}
+
+	writer = newTestResponseWriter("127.0.0.1:5353")
+	msg.SetQuestion("blocked.example.com.", dns.TypeTXT)
+	handler.Handle(writer, msg)
+	if rMsg = writer.waitMsg(t, time.Second); rMsg.Rcode != dns.RcodeSuccess || len(rMsg.Answer) != 0 {
+		t.Errorf("expected no data for other types, got: %v", rMsg)
+	}
+	if queries := atomic.LoadInt32(&provider.queries); queries != 0 {
+		t.Errorf("blocked name should not be queried, got: %v", queries)
+	}
+}
+
+func TestHandler_CacheNXDomain(t *testing.T) {
+	clock := &fakeClock{t: time.Now()}
+	provider := &testProvider{name: "upstream", rcode: dns.RcodeNameError}
+	handler := NewHandler(provider, &HandlerOptions{Cache: true})
+	handler.cache = newCache(handler.cache.opts, clock.now)
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("nx.example.com.", dns.TypeA)
+	writer := newTestResponseWriter("127.0.0.1:5353")
+	handler.Handle(writer, msg)
+	if rMsg := writer.waitMsg(t, time.Second); rMsg.Rcode != dns.RcodeNameError {
+		t.Fatalf("expected NXDOMAIN, got: %v", rMsg)
+	}
+	// the answer is inserted into cache asynchronously.
+	for deadline := time.Now().Add(time.Second); handler.cache.Get(msg) == nil; {
+		if time.Now().After(deadline) {
+			t.Fatalf("NXDOMAIN should be cached")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	clock.advance(10 * time.Second)
+	writer = newTestResponseWriter("127.0.0.1:5353")
+	handler.Handle(writer, msg)
+	rMsg := writer.waitMsg(t, time.Second)
+	if rMsg.Rcode != dns.RcodeNameError || len(rMsg.Ns) == 0 || rMsg.Ns[0].Header().Ttl != 290 {
+		t.Errorf("expected cached NXDOMAIN with decremented ttl, got: %v", rMsg)
+	}
+	if queries := atomic.LoadInt32(&provider.queries); queries != 1 {
+		t.Errorf("NXDOMAIN should be answered from cache, upstream queries: %v", queries)
+	}
+}
+
+func TestHandler_Prefetch(t *testing.T) {
+	clock := &fakeClock{t: time.Now()}
+	provider := &testProvider{name: "upstream"}
+	handler := NewHandler(provider, &HandlerOptions{Cache: true, CachePrefetch: true, CachePrefetchThreshold: 2})
+	handler.cache = newCache(handler.cache.opts, clock.now)
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("prefetch.example.com.", dns.TypeTXT)
+	writer := newTestResponseWriter("127.0.0.1:5353")
+	handler.Handle(writer, msg)
+	writer.waitMsg(t, time.Second)
+	for deadline := time.Now().Add(time.Second); handler.cache.Get(msg) == nil; {
+		if time.Now().After(deadline) {
+			t.Fatalf("answer should be cached")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	provider.release = make(chan bool)
+	provider.queried = make(chan bool, 16)
+	clock.advance(55 * time.Second)
+	// a burst of hits on the entry about to expire.
+	for i := 0; i < 10; i++ {
+		handler.Handle(writer, msg)
+		if rMsg := writer.waitMsg(t, time.Second); txtOf(rMsg) != "upstream" {
+			t.Fatalf("expected answer from cache, got: %v", rMsg)
+		}
+	}
+	<-provider.queried
+	close(provider.release)
+
+	for deadline := time.Now().Add(time.Second); ; {
+		if rMsg := handler.cache.Get(msg); rMsg != nil && rMsg.Answer[0].Header().Ttl == 60 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("entry should be refreshed by prefetching")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if queries := atomic.LoadInt32(&provider.queries); queries != 2 {
+		t.Errorf("expected one prefetch query, upstream queries: %v", queries)
+	}
+}
+
+func TestHandler_ServeStale(t *testing.T) {
+	clock := &fakeClock{t: time.Now()}
+	provider := &testProvider{name: "upstream"}
+	handler := NewHandler(provider, &HandlerOptions{Cache: true, CacheServeStaleTTL: 86400})
+	handler.cache = newCache(handler.cache.opts, clock.now)
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("stale.example.com.", dns.TypeTXT)
+	writer := newTestResponseWriter("127.0.0.1:5353")
+	handler.Handle(writer, msg)
+	writer.waitMsg(t, time.Second)
+	for deadline := time.Now().Add(time.Second); handler.cache.Get(msg) == nil; {
+		if time.Now().After(deadline) {
+			t.Fatalf("answer should be cached")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	provider.err = errors.New("upstream is down")
+	clock.advance(120 * time.Second)
+	handler.Handle(writer, msg)
+	rMsg := writer.waitMsg(t, time.Second)
+	if rMsg.Rcode != dns.RcodeSuccess || txtOf(rMsg) != "upstream" {
+		t.Fatalf("expected stale answer, got: %v", rMsg)
+	}
+	if ttl := rMsg.Answer[0].Header().Ttl; ttl != staleAnswerTTL {
+		t.Errorf("stale answer should have ttl %v, got: %v", staleAnswerTTL, ttl)
+	}
+}
+
+func TestHandler_AllowFrom(t *testing.T) {
+	allowFrom, err := CSVtoIPNets("10.0.0.0/8,192.168.1.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := NewHandler(&testProvider{name: "upstream"}, &HandlerOptions{AllowFrom: allowFrom})
+
+	cases := []struct {
+		addr    net.Addr
+		allowed bool
+	}{
+		{&net.UDPAddr{IP: net.ParseIP("10.1.2.3"), Port: 5353}, true},
+		{&net.TCPAddr{IP: net.ParseIP("192.168.1.1"), Port: 5353}, true},
+		{&net.UDPAddr{IP: net.ParseIP("192.168.1.2"), Port: 5353}, false},
+		{&net.TCPAddr{IP: net.ParseIP("8.8.8.8"), Port: 5353}, false},
+	}
+	for _, c := range cases {
+		writer := newTestResponseWriter("127.0.0.1:5353")
+		writer.remoteAddr = c.addr
+		msg := new(dns.Msg)
+		msg.SetQuestion("acl.example.com.", dns.TypeTXT)
+		handler.Handle(writer, msg)
+		rMsg := writer.waitMsg(t, time.Second)
+		if c.allowed && (rMsg.Rcode != dns.RcodeSuccess || txtOf(rMsg) != "upstream") {
+			t.Errorf("client %v should be answered, got: %v", c.addr, rMsg)
+		}
+		if !c.allowed && rMsg.Rcode != dns.RcodeRefused {
+			t.Errorf("client %v should be refused, got: %v", c.addr, rMsg)
+		}
+	}
+}
+
+func TestHandler_RateLimit(t *testing.T) {
+	for _, action := range []string{RateLimitActionRefuse, RateLimitActionDrop} {
+		handler := NewHandler(&testProvider{name: "upstream"},
+			&HandlerOptions{RateLimit: 1, RateLimitBurst: 5, RateLimitAction: action})
+
+		noisy := newTestResponseWriter("10.0.0.1:5353")
+		refused := 0
+		for i := 0; i < 20; i++ {
+			msg := new(dns.Msg)
+			msg.SetQuestion("flood.example.com.", dns.TypeTXT)
+			handler.Handle(noisy, msg)
+			select {
+			case rMsg := <-noisy.msgs:
+				if rMsg.Rcode == dns.RcodeRefused {
+					refused++
+				}
+			case <-time.After(100 * time.Millisecond):
+				if action != RateLimitActionDrop {
+					t.Fatalf("%v: queries over the limit should be refused", action)
+				}
+			}
+		}
+		if action == RateLimitActionRefuse && refused != 15 {
+			t.Errorf("expected 15 queries refused, got: %v", refused)
+		}
+		if action == RateLimitActionDrop && refused != 0 {
+			t.Errorf("queries over the limit should be dropped, got %v refused", refused)
+		}
+
+		quiet := newTestResponseWriter("10.0.0.2:5353")
+		msg := new(dns.Msg)
+		msg.SetQuestion("quiet.example.com.", dns.TypeTXT)
+		handler.Handle(quiet, msg)
+		if rMsg := quiet.waitMsg(t, time.Second); txtOf(rMsg) != "upstream" {
+			t.Errorf("%v: other clients shouldn't be limited, got: %v", action, rMsg)
+		}
+	}
+}
+
+func TestHandler_StaticHosts(t *testing.T) {
+	path := writeTestConfig(t, "# local overrides\n192.168.1.10 printer.home\n192.168.1.11 Printer.Home\nfd00::10 printer.home\n")
+	hosts, err := NewStaticHosts(path, 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := &testProvider{name: "upstream"}
+	handler := NewHandler(provider, &HandlerOptions{Cache: true, StaticHosts: hosts})
+
+	first := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		writer := newTestResponseWriter("127.0.0.1:5353")
+		msg := new(dns.Msg)
+		msg.SetQuestion("printer.home.", dns.TypeA)
+		handler.Handle(writer, msg)
+		rMsg := writer.waitMsg(t, time.Second)
+		if len(rMsg.Answer) != 2 || rMsg.Answer[0].Header().Ttl != 300 {
+			t.Fatalf("expected 2 static answers with ttl 300, got: %v", rMsg)
+		}
+		first[rMsg.Answer[0].(*dns.A).A.String()] = true
+	}
+	if !first["192.168.1.10"] || !first["192.168.1.11"] {
+		t.Errorf("static answers should be rotated, got first answers: %v", first)
+	}
+
+	writer := newTestResponseWriter("127.0.0.1:5353")
+	msg := new(dns.Msg)
+	msg.SetQuestion("printer.home.", dns.TypeAAAA)
+	handler.Handle(writer, msg)
+	if rMsg := writer.waitMsg(t, time.Second); len(rMsg.Answer) != 1 ||
+		!rMsg.Answer[0].(*dns.AAAA).AAAA.Equal(net.ParseIP("fd00::10")) {
+		t.Errorf("expected static ipv6 answer, got: %v", rMsg)
+	}
+	if queries := atomic.LoadInt32(&provider.queries); queries != 0 {
+		t.Errorf("static names should not be queried, got: %v", queries)
+	}
+
+	writer = newTestResponseWriter("127.0.0.1:5353")
+	msg = new(dns.Msg)
+	msg.SetQuestion("other.example.com.", dns.TypeA)
+	handler.Handle(writer, msg)
+	if rMsg := writer.waitMsg(t, time.Second); txtOf(rMsg) != "upstream" {
+		t.Errorf("names not in static hosts should be queried upstream, got: %v", rMsg)
+	}
+}
+
+func TestStaticHosts_Weighted(t *testing.T) {
+	path := writeTestConfig(t, "printer.home 10.0.0.9#3 10.0.0.10 # weighted\n10.0.0.20 nas.home\n")
+	hosts, err := NewStaticHosts(path, 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts.rand = rand.New(rand.NewSource(1))
+
+	const queries = 4000
+	counts := make(map[string]int)
+	for i := 0; i < queries; i++ {
+		msg := new(dns.Msg)
+		msg.SetQuestion("Printer.Home.", dns.TypeA)
+		rMsg := hosts.Lookup(msg)
+		if rMsg == nil || len(rMsg.Answer) != 1 {
+			t.Fatalf("expected one weighted answer, got: %v", rMsg)
+		}
+		counts[rMsg.Answer[0].(*dns.A).A.String()]++
+	}
+	if ratio := float64(counts["10.0.0.9"]) / queries; ratio < 0.72 || ratio > 0.78 {
+		t.Errorf("10.0.0.9 should be answered about 3/4 of queries, got: %v", counts)
+	}
+	if counts["10.0.0.9"]+counts["10.0.0.10"] != queries {
+		t.Errorf("only the mapped ips should be answered, got: %v", counts)
+	}
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("9.0.0.10.in-addr.arpa.", dns.TypePTR)
+	if rMsg := hosts.Lookup(msg); rMsg == nil || len(rMsg.Answer) != 1 || rMsg.Answer[0].(*dns.PTR).Ptr != "printer.home." {
+		t.Errorf("weighted ips should be answered to PTR queries, got: %v", rMsg)
+	}
+	msg.SetQuestion("nas.home.", dns.TypeA)
+	if rMsg := hosts.Lookup(msg); rMsg == nil || len(rMsg.Answer) != 1 {
+		t.Errorf("lines in hosts format should still be answered, got: %v", rMsg)
+	}
+}
+
+func TestHandler_StaticHostsPTR(t *testing.T) {
+	path := writeTestConfig(t, "10.0.0.9 printer.home\n10.0.0.9 scanner.home printer.home\nfd00::10 nas.home\n")
+	hosts, err := NewStaticHosts(path, 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := &testProvider{name: "upstream"}
+	handler := NewHandler(provider, &HandlerOptions{StaticHosts: hosts})
+
+	for name, expected := range map[string][]string{
+		"9.0.0.10.in-addr.arpa.": {"printer.home.", "scanner.home."},
+		"0.1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa.": {"nas.home."},
+	} {
+		writer := newTestResponseWriter("127.0.0.1:5353")
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, dns.TypePTR)
+		handler.Handle(writer, msg)
+		rMsg := writer.waitMsg(t, time.Second)
+		if len(rMsg.Answer) != len(expected) || !rMsg.Authoritative {
+			t.Fatalf("%v: expected %v static PTR answers, got: %v", name, len(expected), rMsg)
+		}
+		for i, ptr := range expected {
+			if rr := rMsg.Answer[i].(*dns.PTR); rr.Ptr != ptr || rr.Hdr.Ttl != 300 {
+				t.Errorf("%v: expected PTR %v with ttl 300, got: %v", name, ptr, rr)
+			}
+		}
+	}
+	if queries := atomic.LoadInt32(&provider.queries); queries != 0 {
+		t.Errorf("static ips should not be queried, got: %v", queries)
+	}
+
+	writer := newTestResponseWriter("127.0.0.1:5353")
+	msg := new(dns.Msg)
+	msg.SetQuestion("10.0.0.10.in-addr.arpa.", dns.TypePTR)
+	handler.Handle(writer, msg)
+	if rMsg := writer.waitMsg(t, time.Second); txtOf(rMsg) != "upstream" {
+		t.Errorf("ips not in static hosts should be queried upstream, got: %v", rMsg)
+	}
+}
+
+func TestHandler_Compress(t *testing.T) {
+	provider := &multiAProvider{ips: []string{"192.0.2.1", "192.0.2.2", "192.0.2.3", "192.0.2.4"}}
+	sizes := make(map[bool]int)
+	for _, compress := range []bool{true, false} {
+		handler := NewHandler(provider, &HandlerOptions{Compress: compress})
+		writer := newTestResponseWriter("127.0.0.1:5353")
+		msg := new(dns.Msg)
+		msg.SetQuestion("repeated.example.com.", dns.TypeA)
+		handler.Handle(writer, msg)
+		rMsg := writer.waitMsg(t, time.Second)
+		if rMsg.Compress != compress || len(rMsg.Answer) != 5 {
+			t.Fatalf("expected 5 answers with compression %v, got: %v", compress, rMsg)
+		}
+		bytesMsg, err := rMsg.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes[compress] = len(bytesMsg)
+	}
+	if sizes[false] <= sizes[true] {
+		t.Errorf("uncompressed answer should be larger, got sizes: %v", sizes)
+	}
+}
+
+func TestHandler_NoAAAAMode(t *testing.T) {
+	provider := &testProvider{name: "upstream"}
+	handler := NewHandler(provider, &HandlerOptions{NoAAAA: true, NoAAAAMode: NoAAAAModeNoData})
+	writer := newTestResponseWriter("127.0.0.1:5353")
+	msg := new(dns.Msg)
+	msg.SetQuestion("ipv4only.example.com.", dns.TypeAAAA)
+	handler.Handle(writer, msg)
+	rMsg := writer.waitMsg(t, time.Second)
+	if rMsg.Rcode != dns.RcodeSuccess || len(rMsg.Answer) != 0 || len(rMsg.Ns) != 1 {
+		t.Fatalf("expected NODATA with one SOA, got: %v", rMsg)
+	}
+	if soa, ok := rMsg.Ns[0].(*dns.SOA); !ok || soa.Minttl == 0 {
+		t.Errorf("expected SOA in authority, got: %v", rMsg.Ns[0])
+	}
+	if queries := atomic.LoadInt32(&provider.queries); queries != 0 {
+		t.Errorf("AAAA should not be queried, got: %v", queries)
+	}
+
+	handler = NewHandler(provider, &HandlerOptions{NoAAAA: true, NoAAAAMode: NoAAAAModeRefused})
+	writer = newTestResponseWriter("127.0.0.1:5353")
+	handler.Handle(writer, msg)
+	if rMsg := writer.waitMsg(t, time.Second); rMsg.Rcode != dns.RcodeRefused {
+		t.Errorf("expected REFUSED, got: %v", rMsg)
+	}
+}
+
+// multiAProvider answers every question with the A records of ips.
+type multiAProvider struct {
+	ips []string
+}
+
+func (p *multiAProvider) Query(msg *dns.Msg) (*dns.Msg, error) {
+	rMsg := new(dns.Msg)
+	rMsg.SetReply(msg)
+	cname, _ := dns.NewRR(msg.Question[0].Name + " 300 IN CNAME lb.example.com.")
+	rMsg.Answer = append(rMsg.Answer, cname)
+	for _, ip := range p.ips {
+		rr, _ := dns.NewRR("lb.example.com. 300 IN A " + ip)
+		rMsg.Answer = append(rMsg.Answer, rr)
+	}
+	return rMsg, nil
+}
+
+func TestHandler_RotateAnswers(t *testing.T) {
+	ips := []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"}
+	for _, cache := range []bool{true, false} {
+		handler := NewHandler(&multiAProvider{ips: ips}, &HandlerOptions{Cache: cache, RotateAnswers: true})
+		for i := 0; i < 4; i++ {
+			writer := newTestResponseWriter("127.0.0.1:5353")
+			msg := new(dns.Msg)
+			msg.SetQuestion("www.example.com.", dns.TypeA)
+			handler.Handle(writer, msg)
+			rMsg := writer.waitMsg(t, time.Second)
+			if len(rMsg.Answer) != 4 || rMsg.Answer[0].Header().Rrtype != dns.TypeCNAME {
+				t.Fatalf("cache %v: CNAME should stay first with all records, got: %v", cache, rMsg)
+			}
+			if a := rMsg.Answer[1].(*dns.A).A.String(); a != ips[i%len(ips)] {
+				t.Errorf("cache %v, query %v: expected first address %v, got: %v", cache, i, ips[i%len(ips)], a)
+			}
+			// wait for inserting into cache.
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+}
+
+func TestHandler_MinTTL(t *testing.T) {
+	handler := NewHandler(&testProvider{name: "upstream", ttl: 1}, &HandlerOptions{Cache: true, MinTTL: 30})
+	clock := &fakeClock{t: time.Now()}
+	handler.cache = newCache(handler.cache.opts, clock.now)
+	msg := new(dns.Msg)
+	msg.SetQuestion("short-ttl.example.com.", dns.TypeTXT)
+
+	writer := newTestResponseWriter("127.0.0.1:5353")
+	handler.Handle(writer, msg)
+	if rMsg := writer.waitMsg(t, time.Second); rMsg.Answer[0].Header().Ttl != 30 {
+		t.Errorf("expected served ttl 30, got: %v", rMsg.Answer[0])
+	}
+	// wait for inserting into cache.
+	time.Sleep(10 * time.Millisecond)
+
+	handler.cache.lock.RLock()
+	item := handler.cache.cacheStore[getQueryStringForCache(msg)]
+	handler.cache.lock.RUnlock()
+	if item == nil || item.TimeExpire-item.TimeArrival != 30 {
+		t.Fatalf("cache entry should expire in 30s, got: %+v", item)
+	}
+	cached := handler.cache.Get(msg)
+	if cached == nil || cached.Answer[0].Header().Ttl != 30 {
+		t.Errorf("expected cached ttl 30, got: %v", cached)
+	}
+}
+
+func TestHandler_TruncateUDP(t *testing.T) {
+	ips := make([]string, 0, 64)
+	for i := 1; i <= 64; i++ {
+		ips = append(ips, fmt.Sprintf("192.0.2.%v", i))
+	}
+	handler := NewHandler(&multiAProvider{ips: ips}, &HandlerOptions{})
+
+	cases := []struct {
+		network   string
+		udpSize   uint16
+		truncated bool
+	}{
+		{"udp", 0, true},
+		{"udp", 1232, false},
+		{"tcp", 0, false},
+	}
+	for _, c := range cases {
+		writer := newTestResponseWriter("127.0.0.1:5353")
+		if c.network == "tcp" {
+			writer.remoteAddr = &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5353}
+		}
+		msg := new(dns.Msg)
+		msg.SetQuestion("large.example.com.", dns.TypeA)
+		if c.udpSize > 0 {
+			msg.SetEdns0(c.udpSize, false)
+		}
+		handler.Handle(writer, msg)
+		rMsg := writer.waitMsg(t, time.Second)
+		if rMsg.Truncated != c.truncated {
+			t.Errorf("%v, udp size %v: expected TC %v, got: %v", c.network, c.udpSize, c.truncated, rMsg.Truncated)
+		}
+		if c.truncated && (len(rMsg.Answer) >= len(ips)+1 || rMsg.Len() > dns.MinMsgSize) {
+			t.Errorf("%v: answer should be trimmed to 512 bytes, got %v records, %v bytes",
+				c.network, len(rMsg.Answer), rMsg.Len())
+		}
+		if !c.truncated && len(rMsg.Answer) != len(ips)+1 {
+			t.Errorf("%v, udp size %v: expected all %v records, got: %v",
+				c.network, c.udpSize, len(ips)+1, len(rMsg.Answer))
+		}
+	}
+}
+
+func TestHandler_MalformedQuery(t *testing.T) {
+	provider := &testProvider{name: "upstream"}
+	handler := NewHandler(provider, &HandlerOptions{})
+
+	empty := new(dns.Msg)
+	empty.Id = dns.Id()
+	two := new(dns.Msg)
+	two.SetQuestion("a.example.com.", dns.TypeA)
+	two.Question = append(two.Question, dns.Question{Name: "b.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	badClass := new(dns.Msg)
+	badClass.SetQuestion("c.example.com.", dns.TypeA)
+	badClass.Question[0].Qclass = 42
+	for _, msg := range []*dns.Msg{empty, two, badClass} {
+		writer := newTestResponseWriter("192.0.2.1:5353")
+		handler.Handle(writer, msg)
+		rMsg := writer.waitMsg(t, time.Second)
+		if rMsg.Rcode != dns.RcodeFormatError || rMsg.Id != msg.Id {
+			t.Errorf("expected FORMERR for %v, got: %v", msg, rMsg)
+		}
+	}
+	if queries := atomic.LoadInt32(&provider.queries); queries != 0 {
+		t.Errorf("malformed queries should not be forwarded, got: %v", queries)
+	}
+}
+
+func TestHandler_BadVers(t *testing.T) {
+	provider := &testProvider{name: "upstream"}
+	handler := NewHandler(provider, &HandlerOptions{})
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	msg.SetEdns0(dns.DefaultMsgSize, false)
+	msg.IsEdns0().SetVersion(1)
+	writer := newTestResponseWriter("192.0.2.1:5353")
+	handler.Handle(writer, msg)
+	rMsg := writer.waitMsg(t, time.Second)
+
+	// the extended rcode is in the OPT on the wire.
+	buf, err := rMsg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wire := new(dns.Msg)
+	if err := wire.Unpack(buf); err != nil {
+		t.Fatal(err)
+	}
+	if wire.Rcode != dns.RcodeBadVers || wire.Id != msg.Id {
+		t.Errorf("expected BADVERS, got: %v", wire)
+	}
+	if opt := wire.IsEdns0(); opt == nil || opt.Version() != 0 {
+		t.Errorf("expected OPT of version 0, got: %v", wire)
+	}
+	if queries := atomic.LoadInt32(&provider.queries); queries != 0 {
+		t.Errorf("query of unsupported edns version should not be forwarded, got: %v", queries)
+	}
+}
+
+// qtypeProvider answers A and TXT questions, counting the queries by qtype.
+type qtypeProvider struct {
+	lock    sync.Mutex
+	queries map[uint16]int
+}
+
+func (p *qtypeProvider) Query(msg *dns.Msg) (*dns.Msg, error) {
+	p.lock.Lock()
+	p.queries[msg.Question[0].Qtype]++
+	p.lock.Unlock()
+	rMsg := new(dns.Msg)
+	rMsg.SetReply(msg)
+	rr, _ := dns.NewRR(fmt.Sprintf("%v 300 IN %v", msg.Question[0].Name,
+		map[uint16]string{dns.TypeA: "A 192.0.2.1", dns.TypeTXT: "TXT dynamic"}[msg.Question[0].Qtype]))
+	rMsg.Answer = append(rMsg.Answer, rr)
+	return rMsg, nil
+}
+
+func TestHandler_CacheExcludeQTypes(t *testing.T) {
+	excluded, err := ParseQTypes("txt, ANY")
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := &qtypeProvider{queries: make(map[uint16]int)}
+	handler := NewHandler(provider, &HandlerOptions{Cache: true, CacheExcludeQTypes: excluded})
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeTXT} {
+		msg := new(dns.Msg)
+		msg.SetQuestion("dynamic.example.com.", qtype)
+		for i := 0; i < 3; i++ {
+			writer := newTestResponseWriter("127.0.0.1:5353")
+			handler.Handle(writer, msg)
+			writer.waitMsg(t, time.Second)
+			// the answer is inserted into cache asynchronously.
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+	provider.lock.Lock()
+	defer provider.lock.Unlock()
+	if provider.queries[dns.TypeA] != 1 {
+		t.Errorf("A should be answered from cache, upstream queries: %v", provider.queries[dns.TypeA])
+	}
+	if provider.queries[dns.TypeTXT] != 3 {
+		t.Errorf("TXT should never be cached, upstream queries: %v", provider.queries[dns.TypeTXT])
+	}
+
+	if _, err := ParseQTypes("TXT,BOGUS"); err == nil {
+		t.Errorf("unknown qtype should be rejected")
+	}
+}
+
+func TestHandler_BlockQTypes(t *testing.T) {
+	blocked, err := ParseQTypes("ANY,AXFR")
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := &qtypeProvider{queries: make(map[uint16]int)}
+	handler := NewHandler(provider, &HandlerOptions{BlockQTypes: blocked})
+	query := func(qtype uint16) *dns.Msg {
+		writer := newTestResponseWriter("127.0.0.1:5353")
+		msg := new(dns.Msg)
+		msg.SetQuestion("example.com.", qtype)
+		handler.Handle(writer, msg)
+		return writer.waitMsg(t, time.Second)
+	}
+
+	if rMsg := query(dns.TypeAXFR); rMsg.Rcode != dns.RcodeRefused {
+		t.Errorf("AXFR should be refused, got: %v", rMsg)
+	}
+	if rMsg := query(dns.TypeA); rMsg.Rcode != dns.RcodeSuccess {
+		t.Errorf("A should be answered, got: %v", rMsg)
+	}
+	provider.lock.Lock()
+	defer provider.lock.Unlock()
+	if provider.queries[dns.TypeAXFR] != 0 || provider.queries[dns.TypeA] != 1 {
+		t.Errorf("only A should be sent upstream, queries: %v", provider.queries)
+	}
+}
+
+func TestHandler_UpstreamFailureRcode(t *testing.T) {
+	cases := map[string]int{
+		"":                      dns.RcodeServerFailure,
+		UpstreamFailureServFail: dns.RcodeServerFailure,
+		UpstreamFailureRefused:  dns.RcodeRefused,
+	}
+	for setting, expected := range cases {
+		provider := &testProvider{name: "upstream", err: errors.New("upstream is down")}
+		handler := NewHandler(provider, &HandlerOptions{UpstreamFailureRcode: setting})
+		msg := new(dns.Msg)
+		msg.SetQuestion("down.example.com.", dns.TypeA)
+		writer := newTestResponseWriter("127.0.0.1:5353")
+		handler.Handle(writer, msg)
+		if rMsg := writer.waitMsg(t, time.Second); rMsg.Rcode != expected {
+			t.Errorf("%q: expected %v, got: %v", setting, dns.RcodeToString[expected], dns.RcodeToString[rMsg.Rcode])
+		}
+	}
+}
+
+// concurrencyProvider records the max number of queries in flight.
+type concurrencyProvider struct {
+	inFlight    int32
+	maxInFlight int32
+}
+
+func (p *concurrencyProvider) Query(msg *dns.Msg) (*dns.Msg, error) {
+	n := atomic.AddInt32(&p.inFlight, 1)
+	defer atomic.AddInt32(&p.inFlight, -1)
+	for {
+		max := atomic.LoadInt32(&p.maxInFlight)
+		if n <= max || atomic.CompareAndSwapInt32(&p.maxInFlight, max, n) {
+			break
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+	rMsg := new(dns.Msg)
+	rMsg.SetReply(msg)
+	return rMsg, nil
+}
+
+func TestHandler_UpstreamMaxInflight(t *testing.T) {
+	const maxInflight = 4
+	provider := &concurrencyProvider{}
+	handler := NewHandler(provider, &HandlerOptions{UpstreamMaxInflight: maxInflight})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 40; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			msg := new(dns.Msg)
+			msg.SetQuestion(fmt.Sprintf("q%d.example.com.", i), dns.TypeA)
+			if _, err := handler.Resolve(context.Background(), msg); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if max := atomic.LoadInt32(&provider.maxInFlight); max > maxInflight || max == 0 {
+		t.Errorf("at most %v upstream queries should be in flight, got: %v", maxInflight, max)
+	}
+}
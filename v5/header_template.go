@@ -0,0 +1,125 @@
+package dohProxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"text/template"
+
+	"github.com/miekg/dns"
+)
+
+// HeaderTemplateVars are the variables of the header values sent to DoH
+// endpoints, expanded per query, e.g. "X-Client={{.ClientIP}}".
+type HeaderTemplateVars struct {
+	// ip of the client, empty if unknown.
+	ClientIP string
+	// the queried name, canonical, and the hex of the first 8 bytes of its
+	// sha256.
+	QName     string
+	QNameHash string
+	// the queried type, e.g. "AAAA".
+	QType string
+}
+
+// headerTemplates are the templates of the header values having actions, by
+// header name and the index of the value; nil for static values.
+type headerTemplates map[string][]*template.Template
+
+// newHeaderTemplates parses the values of headers having template actions,
+// they're executed once so unknown variables are errors on startup.
+func newHeaderTemplates(headers http.Header) (headerTemplates, error) {
+	var templates headerTemplates
+	for name, values := range headers {
+		for i, value := range values {
+			if !strings.Contains(value, "{{") {
+				continue
+			}
+			tmpl, err := template.New(name).Parse(value)
+			if err == nil {
+				err = tmpl.Execute(new(strings.Builder), HeaderTemplateVars{})
+			}
+			if err != nil {
+				return nil, fmt.Errorf("invalid template of header %v: %v", name, err)
+			}
+			if templates == nil {
+				templates = make(headerTemplates)
+			}
+			if templates[name] == nil {
+				templates[name] = make([]*template.Template, len(values))
+			}
+			templates[name][i] = tmpl
+		}
+	}
+	return templates, nil
+}
+
+// canonicalHeader returns a copy of header with the canonical names, values
+// of the names differing in case are merged; nil if header is empty.
+func canonicalHeader(header http.Header) http.Header {
+	if len(header) == 0 {
+		return nil
+	}
+	canonical := make(http.Header, len(header))
+	for name, values := range header {
+		key := http.CanonicalHeaderKey(name)
+		canonical[key] = append(canonical[key], values...)
+	}
+	return canonical
+}
+
+// mergeKeyValues returns a copy of values with the keys of overrides replaced,
+// nil if both are empty.
+func mergeKeyValues(values, overrides map[string][]string) map[string][]string {
+	if len(values) == 0 && len(overrides) == 0 {
+		return values
+	}
+	merged := make(map[string][]string, len(values)+len(overrides))
+	for k, vs := range values {
+		merged[k] = append([]string(nil), vs...)
+	}
+	for k, vs := range overrides {
+		merged[k] = append([]string(nil), vs...)
+	}
+	return merged
+}
+
+// requestHeader returns the headers of the request of msg, a copy of the
+// headers of the endpoint with the templates expanded for msg and clientIP.
+func (provider DMProvider) requestHeader(msg *dns.Msg, clientIP net.IP) http.Header {
+	if provider.headers == nil {
+		return make(http.Header)
+	}
+	header := provider.headers.Clone()
+	if len(provider.headerTemplates) == 0 || len(msg.Question) == 0 {
+		return header
+	}
+	vars := newHeaderTemplateVars(msg.Question[0], clientIP)
+	for name, templates := range provider.headerTemplates {
+		for i, tmpl := range templates {
+			if tmpl == nil {
+				continue
+			}
+			var value strings.Builder
+			if err := tmpl.Execute(&value, vars); err != nil {
+				upstreamLog.Errorf("expand template of header %v error: %v", name, err)
+				continue
+			}
+			header[name][i] = value.String()
+		}
+	}
+	return header
+}
+
+func newHeaderTemplateVars(q dns.Question, clientIP net.IP) HeaderTemplateVars {
+	qName := dns.CanonicalName(q.Name)
+	sum := sha256.Sum256([]byte(qName))
+	vars := HeaderTemplateVars{QName: qName, QNameHash: hex.EncodeToString(sum[:8]), QType: dns.Type(q.Qtype).String()}
+	if clientIP != nil {
+		vars.ClientIP = clientIP.String()
+	}
+	return vars
+}
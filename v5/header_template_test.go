@@ -0,0 +1,124 @@
+package dohProxy
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestHeaderTemplates(t *testing.T) {
+	var hits int32
+	var mu sync.Mutex
+	var clients, qNames, apiKeys []string
+	ok := newDoHTestHandler(t, http.StatusOK, dns.RcodeSuccess, &hits)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		clients = append(clients, r.Header.Get("X-Client"))
+		qNames = append(qNames, r.Header.Get("X-Query"))
+		apiKeys = append(apiKeys, r.Header.Get("X-Api-Key"))
+		mu.Unlock()
+		ok.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	if _, err := NewDMProvider([]string{ts.URL}, &DMProviderOptions{
+		Headers: http.Header{"X-Client": []string{"{{.ClientAddr}}"}},
+	}); err == nil {
+		t.Error("template of unknown variable should be rejected")
+	}
+	provider, err := NewDMProvider([]string{ts.URL}, &DMProviderOptions{
+		EDNSSubnet: "no",
+		Headers: http.Header{
+			"X-Client":  []string{"{{.ClientIP}}"},
+			"X-Query":   []string{"{{.QName}} {{.QType}}"},
+			"X-Api-Key": []string{"secret"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, clientIP := range []string{"198.51.100.7", "2001:db8::7"} {
+		msg := new(dns.Msg)
+		msg.SetQuestion("Template.Example.com.", dns.TypeAAAA)
+		if _, err := provider.QueryClient(msg, net.ParseIP(clientIP)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(clients) != 2 || clients[0] != "198.51.100.7" || clients[1] != "2001:db8::7" {
+		t.Errorf("templated header should be the client ip of each query, got: %v", clients)
+	}
+	if len(qNames) != 2 || qNames[0] != "template.example.com. AAAA" {
+		t.Errorf("templated header should be the queried name and type, got: %v", qNames)
+	}
+	if len(apiKeys) != 2 || apiKeys[1] != "secret" {
+		t.Errorf("static header should be sent as is, got: %v", apiKeys)
+	}
+	if v := provider.opts.Headers.Get("X-Client"); v != "{{.ClientIP}}" {
+		t.Errorf("template should not be replaced in the options, got: %v", v)
+	}
+}
+
+func TestEndpointHeaders(t *testing.T) {
+	var hits int32
+	var mu sync.Mutex
+	received := make(map[string][]string)
+	ok := newDoHTestHandler(t, http.StatusOK, dns.RcodeSuccess, &hits)
+	newServer := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			received[name] = append(received[name], strings.Join([]string{
+				strings.Join(r.Header.Values("Authorization"), ","),
+				r.Header.Get("X-Shared"),
+				r.URL.Query().Get("key"),
+			}, " "))
+			mu.Unlock()
+			ok.ServeHTTP(w, r)
+		}))
+	}
+	a, b := newServer("a"), newServer("b")
+	defer a.Close()
+	defer b.Close()
+
+	provider, err := NewDMProvider([]string{a.URL, b.URL}, &DMProviderOptions{
+		EDNSSubnet:      "no",
+		Strategy:        StrategyRoundRobin,
+		Headers:         http.Header{"authorization": []string{"global"}, "X-Shared": []string{"shared"}},
+		QueryParameters: map[string][]string{"key": {"global"}},
+		EndpointHeaders: map[string]http.Header{
+			a.URL: {"Authorization": []string{"key-a"}},
+			b.URL: {"AUTHORIZATION": []string{"key-b"}},
+			// of the providers of routes.
+			"https://other.example/dns-query": {"Authorization": []string{"other"}},
+		},
+		EndpointParameters: map[string]map[string][]string{
+			a.URL: {"key": {"param-a"}},
+			b.URL: {"key": {"param-b"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		msg := new(dns.Msg)
+		msg.SetQuestion("example.com.", dns.TypeA)
+		if _, err := provider.Query(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for name, expected := range map[string]string{"a": "key-a shared param-a", "b": "key-b shared param-b"} {
+		if len(received[name]) != 2 || received[name][0] != expected || received[name][1] != expected {
+			t.Errorf("endpoint %v should receive its own header and param %q, got: %v", name, expected, received[name])
+		}
+	}
+}
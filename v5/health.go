@@ -0,0 +1,106 @@
+package dohProxy
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// DefaultReadyMinSuccessRate is the min success rate of recent upstream
+	// queries for being ready.
+	DefaultReadyMinSuccessRate = 0.5
+
+	// results of this many recent upstream queries are kept.
+	upstreamHealthWindow = 100
+	// the success rate applies only with this many results.
+	upstreamHealthMinSamples = 10
+	// how often upstream is probed until the first successful query.
+	upstreamProbeInterval = 10 * time.Second
+)
+
+// upstreamHealth records the results of recent upstream queries, updated
+// after each query by the providers.
+var upstreamHealth = newUpstreamHealth(upstreamHealthWindow)
+
+// UpstreamHealth tracks whether upstream has ever answered, and the success
+// rate of the recent queries.
+type UpstreamHealth struct {
+	lock      sync.Mutex
+	succeeded bool
+	// ring of recent results, true if succeeded.
+	results []bool
+	next    int
+	full    bool
+}
+
+func newUpstreamHealth(window int) *UpstreamHealth {
+	return &UpstreamHealth{results: make([]bool, window)}
+}
+
+// Record records the result of an upstream query.
+func (h *UpstreamHealth) Record(err error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if err == nil {
+		h.succeeded = true
+	}
+	h.results[h.next] = err == nil
+	h.next = (h.next + 1) % len(h.results)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// Ready reports whether upstream has answered at least once, and the recent
+// success rate isn't below minSuccessRate; the reason is returned if not.
+func (h *UpstreamHealth) Ready(minSuccessRate float64) (bool, string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if !h.succeeded {
+		return false, "upstream not reachable yet"
+	}
+	n := h.next
+	if h.full {
+		n = len(h.results)
+	}
+	if n < upstreamHealthMinSamples {
+		return true, ""
+	}
+	successes := 0
+	for _, ok := range h.results[:n] {
+		if ok {
+			successes++
+		}
+	}
+	if rate := float64(successes) / float64(n); rate < minSuccessRate {
+		return false, fmt.Sprintf("upstream success rate %.2f is below %.2f", rate, minSuccessRate)
+	}
+	return true, ""
+}
+
+func (h *UpstreamHealth) hasSucceeded() bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.succeeded
+}
+
+// ProbeUpstream queries upstream for the root NS records until it answered
+// once, so being ready doesn't wait for client queries.
+func (h *Handler) ProbeUpstream() {
+	msg := new(dns.Msg)
+	msg.SetQuestion(".", dns.TypeNS)
+	for !upstreamHealth.hasSucceeded() {
+		ref := h.acquireProvider()
+		_, err := ref.Query(msg.Copy())
+		ref.inFlight.RUnlock()
+		if err == nil {
+			Log.Infof("upstream probed.")
+			return
+		}
+		Log.Warnf("probe upstream failed: %v", err)
+		time.Sleep(upstreamProbeInterval)
+	}
+}
@@ -0,0 +1,56 @@
+package dohProxy
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestUpstreamHealth_Ready(t *testing.T) {
+	health := newUpstreamHealth(upstreamHealthWindow)
+	errUpstream := errors.New("upstream failed")
+
+	health.Record(errUpstream)
+	if ready, _ := health.Ready(DefaultReadyMinSuccessRate); ready {
+		t.Error("should not be ready before upstream answered")
+	}
+	health.Record(nil)
+	if ready, reason := health.Ready(DefaultReadyMinSuccessRate); !ready {
+		t.Errorf("should be ready after upstream answered: %v", reason)
+	}
+
+	// 3 successes out of 20.
+	for i := 0; i < 18; i++ {
+		health.Record(errUpstream)
+	}
+	health.Record(nil)
+	if ready, _ := health.Ready(DefaultReadyMinSuccessRate); ready {
+		t.Error("should not be ready with a low success rate")
+	}
+
+	// failures are pushed out of the window by successes.
+	for i := 0; i < upstreamHealthWindow; i++ {
+		health.Record(nil)
+	}
+	if ready, reason := health.Ready(DefaultReadyMinSuccessRate); !ready {
+		t.Errorf("should be ready again after recovering: %v", reason)
+	}
+}
+
+func TestAdmin_Health(t *testing.T) {
+	saved := upstreamHealth
+	defer func() { upstreamHealth = saved }()
+	upstreamHealth = newUpstreamHealth(upstreamHealthWindow)
+
+	handler := NewHandler(&testProvider{name: "upstream"}, &HandlerOptions{ReadyMinSuccessRate: 0.5})
+	if rec := adminRequest(handler, http.MethodGet, "/healthz"); rec.Code != http.StatusOK {
+		t.Errorf("healthz: unexpected status: %v", rec.Code)
+	}
+	if rec := adminRequest(handler, http.MethodGet, "/readyz"); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("readyz should fail before upstream answered, got: %v", rec.Code)
+	}
+	upstreamHealth.Record(nil)
+	if rec := adminRequest(handler, http.MethodGet, "/readyz"); rec.Code != http.StatusOK {
+		t.Errorf("readyz should succeed after upstream answered, got: %v %v", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,65 @@
+package dohProxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
+// ListenOptions specifies the socket options of dns listeners.
+type ListenOptions struct {
+	// SO_REUSEPORT is set, so another instance can bind the address while the
+	// old one is draining; linux only.
+	ReusePort bool
+	// TCP Fast Open is enabled on tcp listeners; linux only.
+	TCPFastOpen bool
+	// SO_RCVBUF of udp listeners in bytes if not 0, the kernel may cap it,
+	// e.g. by net.core.rmem_max on linux.
+	UDPRcvBuf int
+	// at most UDPWorkers udp queries are handled concurrently if not 0, see
+	// UDPWorkers.
+	UDPWorkers int
+	// the listeners are bound to the network interface of the name by
+	// SO_BINDTODEVICE if not empty, e.g. "eth1"; linux only.
+	Interface string
+}
+
+// ListenTCP listens on the tcp address addr with the socket options of opts.
+func ListenTCP(addr string, opts *ListenOptions) (net.Listener, error) {
+	lc, err := listenConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
+
+// ListenUDP listens on the udp address addr with the socket options of opts.
+func ListenUDP(addr string, opts *ListenOptions) (net.PacketConn, error) {
+	lc, err := listenConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	pc, err := lc.ListenPacket(context.Background(), "udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if opts != nil && opts.UDPRcvBuf > 0 && lc.Control == nil {
+		// set after listening where there's no control hook.
+		if err := pc.(*net.UDPConn).SetReadBuffer(opts.UDPRcvBuf); err != nil {
+			_ = pc.Close()
+			return nil, fmt.Errorf("set udp receive buffer error: %v", err)
+		}
+	}
+	return pc, nil
+}
+
+func listenConfig(opts *ListenOptions) (*net.ListenConfig, error) {
+	if opts == nil || (!opts.ReusePort && !opts.TCPFastOpen && opts.UDPRcvBuf == 0 && opts.Interface == "") {
+		return &net.ListenConfig{}, nil
+	}
+	control, err := listenControl(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &net.ListenConfig{Control: control}, nil
+}
@@ -0,0 +1,50 @@
+//go:build linux
+// +build linux
+
+package dohProxy
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// length of the queue of pending TCP Fast Open requests.
+const tcpFastOpenQueueLen = 256
+
+func listenControl(opts *ListenOptions) (func(network, address string, c syscall.RawConn) error, error) {
+	return func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			if opts.Interface != "" {
+				if err := unix.BindToDevice(int(fd), opts.Interface); err != nil {
+					sockErr = fmt.Errorf("bind to interface %v error: %v", opts.Interface, err)
+					return
+				}
+			}
+			if opts.ReusePort {
+				if err := unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1); err != nil {
+					sockErr = fmt.Errorf("set SO_REUSEPORT error: %v", err)
+					return
+				}
+			}
+			if opts.TCPFastOpen && strings.HasPrefix(network, "tcp") {
+				if err := unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_FASTOPEN, tcpFastOpenQueueLen); err != nil {
+					sockErr = fmt.Errorf("set TCP_FASTOPEN error: %v", err)
+					return
+				}
+			}
+			if opts.UDPRcvBuf > 0 && strings.HasPrefix(network, "udp") {
+				if err := unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_RCVBUF, opts.UDPRcvBuf); err != nil {
+					sockErr = fmt.Errorf("set SO_RCVBUF error: %v", err)
+				}
+			}
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	}, nil
+}
@@ -0,0 +1,112 @@
+//go:build linux
+// +build linux
+
+package dohProxy
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestListen_ReusePort(t *testing.T) {
+	opts := &ListenOptions{ReusePort: true, TCPFastOpen: true}
+	first, err := ListenTCP("127.0.0.1:0", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = first.Close() }()
+	addr := first.Addr().String()
+
+	second, err := ListenTCP(addr, opts)
+	if err != nil {
+		t.Fatalf("tcp %v should be bound again with reuseport: %v", addr, err)
+	}
+	_ = second.Close()
+	if l, err := ListenTCP(addr, nil); err == nil {
+		_ = l.Close()
+		t.Errorf("tcp %v should not be bound again without reuseport", addr)
+	}
+
+	firstUDP, err := ListenUDP("127.0.0.1:0", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = firstUDP.Close() }()
+	secondUDP, err := ListenUDP(firstUDP.LocalAddr().(*net.UDPAddr).String(), opts)
+	if err != nil {
+		t.Fatalf("udp should be bound again with reuseport: %v", err)
+	}
+	_ = secondUDP.Close()
+}
+
+func TestListen_UDPRcvBuf(t *testing.T) {
+	const size = 65536
+	pc, err := ListenUDP("127.0.0.1:0", &ListenOptions{UDPRcvBuf: size})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = pc.Close() }()
+	rawConn, err := pc.(*net.UDPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got int
+	var sockErr error
+	if err := rawConn.Control(func(fd uintptr) {
+		got, sockErr = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_RCVBUF)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if sockErr != nil {
+		t.Fatal(sockErr)
+	}
+	// linux doubles the size for bookkeeping.
+	if got < size {
+		t.Errorf("SO_RCVBUF should be at least %v, got: %v", size, got)
+	}
+}
+
+func TestListen_Interface(t *testing.T) {
+	opts := &ListenOptions{Interface: "lo"}
+	pc, err := ListenUDP("127.0.0.1:0", opts)
+	if err != nil {
+		if errors.Is(err, unix.EPERM) {
+			t.Skipf("SO_BINDTODEVICE not permitted: %v", err)
+		}
+		t.Fatal(err)
+	}
+	defer func() { _ = pc.Close() }()
+	l, err := ListenTCP("127.0.0.1:0", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = l.Close() }()
+
+	for _, conn := range []syscall.Conn{pc.(*net.UDPConn), l.(*net.TCPListener)} {
+		rawConn, err := conn.SyscallConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var device string
+		var sockErr error
+		if err := rawConn.Control(func(fd uintptr) {
+			device, sockErr = unix.GetsockoptString(int(fd), unix.SOL_SOCKET, unix.SO_BINDTODEVICE)
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if sockErr != nil {
+			t.Fatal(sockErr)
+		}
+		if device != "lo" {
+			t.Errorf("socket should be bound to lo, got: %q", device)
+		}
+	}
+
+	if _, err := ListenUDP("127.0.0.1:0", &ListenOptions{Interface: "no-such-if0"}); err == nil {
+		t.Error("listening on unknown interface should fail")
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package dohProxy
+
+import (
+	"errors"
+	"syscall"
+)
+
+// listenControl returns no control hook, the udp receive buffer is set after
+// listening.
+func listenControl(opts *ListenOptions) (func(network, address string, c syscall.RawConn) error, error) {
+	if opts.ReusePort || opts.TCPFastOpen || opts.Interface != "" {
+		return nil, errors.New("reuseport, tcp-fastopen and listen-interface are only supported on linux")
+	}
+	return nil, nil
+}
@@ -0,0 +1,101 @@
+package dohProxy
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+)
+
+// components of log entries in the "component" field, their levels can be
+// set apart from the global level.
+const (
+	LogComponentCache    = "cache"
+	LogComponentUpstream = "upstream"
+)
+
+var (
+	cacheLog    = Log.WithField("component", LogComponentCache)
+	upstreamLog = Log.WithField("component", LogComponentUpstream)
+)
+
+// componentLevels is the global level and overrides of components.
+type componentLevels struct {
+	level      logrus.Level
+	components map[string]logrus.Level
+}
+
+func (l *componentLevels) enabled(entry *logrus.Entry) bool {
+	level := l.level
+	if component, ok := entry.Data["component"].(string); ok {
+		if override, ok := l.components[component]; ok {
+			level = override
+		}
+	}
+	return entry.Level <= level
+}
+
+// componentLevelFormatter drops entries over the level of their component,
+// the level of logger is the most verbose one of all components.
+type componentLevelFormatter struct {
+	logrus.Formatter
+	// holds *componentLevels, nil if no overrides.
+	levels atomic.Value
+}
+
+func (f *componentLevelFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	if levels, _ := f.levels.Load().(*componentLevels); levels != nil && !levels.enabled(entry) {
+		return nil, nil
+	}
+	return f.Formatter.Format(entry)
+}
+
+// SetLogLevels sets the level of logger, and overrides the level of the
+// components in components.
+func SetLogLevels(logger *logrus.Logger, level logrus.Level, components map[string]logrus.Level) {
+	verbose := level
+	for _, l := range components {
+		if l > verbose {
+			verbose = l
+		}
+	}
+	if formatter, ok := logger.Formatter.(*componentLevelFormatter); ok {
+		if len(components) == 0 {
+			formatter.levels.Store((*componentLevels)(nil))
+		} else {
+			formatter.levels.Store(&componentLevels{level: level, components: components})
+		}
+	} else {
+		verbose = level
+	}
+	logger.SetLevel(verbose)
+}
+
+// ParseComponentLevels parses the levels of components like
+// "cache=debug,upstream=warn".
+func ParseComponentLevels(s string) (map[string]logrus.Level, error) {
+	levels := make(map[string]logrus.Level)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid component level: %v", pair)
+		}
+		component := strings.TrimSpace(kv[0])
+		switch component {
+		case LogComponentCache, LogComponentUpstream:
+		default:
+			return nil, fmt.Errorf("unknown log component: %v", component)
+		}
+		level, err := logrus.ParseLevel(strings.TrimSpace(kv[1]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid level of %v: %v", component, err)
+		}
+		levels[component] = level
+	}
+	return levels, nil
+}
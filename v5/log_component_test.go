@@ -0,0 +1,49 @@
+package dohProxy
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestSetLogLevels(t *testing.T) {
+	levels, err := ParseComponentLevels("cache=debug, upstream=warn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	out, level := Log.Out, Log.GetLevel()
+	Log.SetOutput(&buf)
+	defer func() {
+		Log.SetOutput(out)
+		SetLogLevels(Log, level, nil)
+	}()
+	SetLogLevels(Log, logrus.InfoLevel, levels)
+
+	cacheLog.Debug("cache debug line")
+	upstreamLog.Debug("upstream debug line")
+	upstreamLog.Info("upstream info line")
+	Log.Debug("global debug line")
+	Log.Info("global info line")
+
+	output := buf.String()
+	for line, expected := range map[string]bool{
+		"cache debug line":    true,
+		"upstream debug line": false,
+		"upstream info line":  false,
+		"global debug line":   false,
+		"global info line":    true,
+	} {
+		if strings.Contains(output, line) != expected {
+			t.Errorf("%q logged: %v, expected: %v, output: %v", line, !expected, expected, output)
+		}
+	}
+
+	for _, s := range []string{"cache", "dns=debug", "cache=verbose"} {
+		if _, err := ParseComponentLevels(s); err == nil {
+			t.Errorf("%q should be rejected", s)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package dohProxy
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const metricsNamespace = "dns_proxy"
+
+// Upstream error classes used as label of dns_proxy_upstream_errors_total.
+const (
+	UpstreamErrorTimeout    = "timeout"
+	UpstreamErrorConnection = "connection"
+	UpstreamErrorHTTP       = "http"
+	UpstreamErrorMalformed  = "malformed"
+	UpstreamErrorOther      = "other"
+)
+
+// collectors are always updated, they are only exposed after RegisterMetrics.
+var (
+	metricQueries = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "queries_total",
+		Help:      "Total number of DNS queries handled.",
+	})
+	metricQueriesByQType = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "queries_by_qtype_total",
+		Help:      "Number of DNS queries handled by question type.",
+	}, []string{"qtype"})
+	metricCacheHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "cache_hits_total",
+		Help:      "Number of DNS queries answered from cache.",
+	})
+	metricCacheMisses = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "cache_misses_total",
+		Help:      "Number of DNS queries not found in cache.",
+	})
+	metricCachePrefetches = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "cache_prefetches_total",
+		Help:      "Number of cache entries refreshed before expiring.",
+	})
+	metricCacheEntries = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "cache_entries",
+		Help:      "Number of entries in cache.",
+	})
+	metricCacheEvictions = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "cache_evictions_total",
+		Help:      "Number of least recently used cache entries evicted as the cache is full.",
+	})
+	metricBlocked = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "blocked_total",
+		Help:      "Number of DNS queries answered by blocklist.",
+	})
+	metricRefused = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "refused_total",
+		Help:      "Number of DNS queries refused by access control.",
+	})
+	metricQTypeBlocked = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "qtype_blocked_total",
+		Help:      "Number of DNS queries refused by their blocked qtypes.",
+	})
+	metricRateLimited = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "rate_limited_total",
+		Help:      "Number of DNS queries over the per client rate limit.",
+	})
+	metricQueryLogDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "query_log_dropped_total",
+		Help:      "Number of query log entries dropped as the log can't keep up.",
+	})
+	metricUDPWorkersBusy = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "udp_workers_busy_total",
+		Help:      "Number of times udp packets waited in the socket buffer as all udp workers were busy.",
+	})
+	metricFallbacks = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "fallback_queries_total",
+		Help:      "Number of DNS queries sent to the plain DNS fallback resolver.",
+	})
+	metricUpstreamDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "upstream_request_duration_seconds",
+		Help:      "Latency of upstream requests.",
+		Buckets:   []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+	})
+	metricUpstreamErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "upstream_errors_total",
+		Help:      "Number of failed upstream requests by error class.",
+	}, []string{"class"})
+	metricUpstreamConnsActive = newUpstreamConnsGauge("active", func() int64 {
+		return activeUpstreamConns()
+	})
+	metricUpstreamConnsIdle = newUpstreamConnsGauge("idle", func() int64 {
+		return atomic.LoadInt64(&upstreamOpenConns) - activeUpstreamConns()
+	})
+)
+
+// open http connections to the endpoints and http requests in flight.
+var upstreamOpenConns, upstreamActiveRequests int64
+
+// activeUpstreamConns approximates the connections in use by the requests in
+// flight, http2 requests share a connection.
+func activeUpstreamConns() int64 {
+	open := atomic.LoadInt64(&upstreamOpenConns)
+	if active := atomic.LoadInt64(&upstreamActiveRequests); active < open {
+		return active
+	}
+	return open
+}
+
+func newUpstreamConnsGauge(state string, value func() int64) prometheus.GaugeFunc {
+	return prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace:   metricsNamespace,
+		Name:        "upstream_connections",
+		Help:        "Number of http connections to upstream endpoints by state.",
+		ConstLabels: prometheus.Labels{"state": state},
+	}, func() float64 { return float64(value()) })
+}
+
+// countedConn counts the open connections in upstreamOpenConns.
+type countedConn struct {
+	net.Conn
+	closed int32
+}
+
+func newCountedConn(conn net.Conn) *countedConn {
+	atomic.AddInt64(&upstreamOpenConns, 1)
+	return &countedConn{Conn: conn}
+}
+
+func (c *countedConn) Close() error {
+	if atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		atomic.AddInt64(&upstreamOpenConns, -1)
+	}
+	return c.Conn.Close()
+}
+
+// RegisterMetrics registers all collectors of the proxy to the registerer.
+func RegisterMetrics(registerer prometheus.Registerer) error {
+	for _, c := range []prometheus.Collector{
+		metricQueries,
+		metricQueriesByQType,
+		metricCacheHits,
+		metricCacheMisses,
+		metricCachePrefetches,
+		metricCacheEntries,
+		metricCacheEvictions,
+		metricBlocked,
+		metricRefused,
+		metricQTypeBlocked,
+		metricRateLimited,
+		metricQueryLogDropped,
+		metricUDPWorkersBusy,
+		metricFallbacks,
+		metricUpstreamDuration,
+		metricUpstreamErrors,
+		metricUpstreamConnsActive,
+		metricUpstreamConnsIdle,
+	} {
+		if err := registerer.Register(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func observeQuery(msg *dns.Msg) {
+	metricQueries.Inc()
+	queryStats.recordQuery()
+	if len(msg.Question) > 0 {
+		metricQueriesByQType.WithLabelValues(dns.TypeToString[msg.Question[0].Qtype]).Inc()
+	}
+}
+
+func observeCacheHit() {
+	metricCacheHits.Inc()
+	queryStats.recordCacheHit()
+}
+
+func observeUpstream(startTime time.Time, err error) {
+	latency := time.Since(startTime)
+	metricUpstreamDuration.Observe(latency.Seconds())
+	queryStats.recordUpstream(latency, err)
+	upstreamHealth.Record(err)
+	if err != nil {
+		metricUpstreamErrors.WithLabelValues(UpstreamErrorClass(err)).Inc()
+	}
+}
+
+// UpstreamErrorClass classifies the error returned from upstream querying.
+func UpstreamErrorClass(err error) string {
+	var statusErr *HTTPStatusError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &statusErr):
+		return UpstreamErrorHTTP
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return UpstreamErrorTimeout
+	case errors.As(err, &netErr):
+		return UpstreamErrorConnection
+	case errors.Is(err, errUnpackResponse):
+		return UpstreamErrorMalformed
+	default:
+		return UpstreamErrorOther
+	}
+}
@@ -0,0 +1,94 @@
+package dohProxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestUpstreamErrorClass(t *testing.T) {
+	cases := []struct {
+		err      error
+		expected string
+	}{
+		{&HTTPStatusError{StatusCode: 500, Message: "500 Internal Server Error"}, UpstreamErrorHTTP},
+		{fmt.Errorf("HttpRequest Error: %w", timeoutError{}), UpstreamErrorTimeout},
+		{fmt.Errorf("HttpRequest Error: %w", &net.OpError{Op: "dial", Err: errors.New("refused")}), UpstreamErrorConnection},
+		{fmt.Errorf("%w: bad", errUnpackResponse), UpstreamErrorMalformed},
+		{context.Canceled, UpstreamErrorOther},
+	}
+	for _, c := range cases {
+		if class := UpstreamErrorClass(c.err); class != c.expected {
+			t.Errorf("error %v: expected class %v, got %v", c.err, c.expected, class)
+		}
+	}
+}
+
+func TestRegisterMetrics(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	if err := RegisterMetrics(registry); err != nil {
+		t.Fatal(err)
+	}
+	if err := RegisterMetrics(registry); err == nil {
+		t.Errorf("expected error when registering collectors twice")
+	}
+}
+
+func TestUpstreamErrorsMetric(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+
+	provider, err := NewDMProvider([]string{ts.URL}, &DMProviderOptions{EDNSSubnet: "no"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := testutil.ToFloat64(metricUpstreamErrors.WithLabelValues(UpstreamErrorHTTP))
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	if _, err := provider.Query(msg); err == nil {
+		t.Fatal("expected error from upstream")
+	}
+	after := testutil.ToFloat64(metricUpstreamErrors.WithLabelValues(UpstreamErrorHTTP))
+	if after-before != 1 {
+		t.Errorf("expected http upstream errors to increase by 1, got %v", after-before)
+	}
+}
+
+func TestUpstreamConnectionsMetric(t *testing.T) {
+	var hits int32
+	ts := newDoHTestServer(t, http.StatusOK, dns.RcodeSuccess, &hits)
+	defer ts.Close()
+
+	provider, err := NewDMProvider([]string{ts.URL}, &DMProviderOptions{EDNSSubnet: "no"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	if _, err := provider.Query(msg); err != nil {
+		t.Fatal(err)
+	}
+	if idle := testutil.ToFloat64(metricUpstreamConnsIdle); idle < 1 {
+		t.Errorf("connection should be kept idle, got: %v", idle)
+	}
+	if active := testutil.ToFloat64(metricUpstreamConnsActive); active != 0 {
+		t.Errorf("expected no active connection, got: %v", active)
+	}
+}
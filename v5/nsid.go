@@ -0,0 +1,90 @@
+package dohProxy
+
+import (
+	"encoding/hex"
+	"strconv"
+
+	"github.com/miekg/dns"
+)
+
+// hasEDNS0Option tells whether the OPT record of msg has an option of code.
+func hasEDNS0Option(msg *dns.Msg, code uint16) bool {
+	if opt := msg.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if o.Option() == code {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// removeEDNS0Option removes the options of code from the OPT record of msg.
+func removeEDNS0Option(msg *dns.Msg, code uint16) {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return
+	}
+	var options []dns.EDNS0
+	for _, o := range opt.Option {
+		if o.Option() != code {
+			options = append(options, o)
+		}
+	}
+	opt.Option = options
+}
+
+// requestNSID adds an empty NSID option to msg to request the id of the name
+// server, RFC 5001; msg is made EDNS0 if not.
+func requestNSID(msg *dns.Msg) {
+	if hasEDNS0Option(msg, dns.EDNS0NSID) {
+		return
+	}
+	opt := msg.IsEdns0()
+	if opt == nil {
+		msg.SetEdns0(dns.DefaultMsgSize, false)
+		opt = msg.IsEdns0()
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_NSID{Code: dns.EDNS0NSID})
+}
+
+// nsidOf returns the NSID answered in msg, quoted if printable, else in hex;
+// "" if none.
+func nsidOf(msg *dns.Msg) string {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return ""
+	}
+	for _, o := range opt.Option {
+		nsid, ok := o.(*dns.EDNS0_NSID)
+		if !ok || nsid.Nsid == "" {
+			continue
+		}
+		if raw, err := hex.DecodeString(nsid.Nsid); err == nil && isPrintable(raw) {
+			return strconv.Quote(string(raw))
+		}
+		return nsid.Nsid
+	}
+	return ""
+}
+
+func isPrintable(raw []byte) bool {
+	for _, b := range raw {
+		if b < 0x20 || b > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// observeNSID logs the NSID answered by u for msg, the option is removed from
+// rMsg if it's not requested by the client.
+func (provider DMProvider) observeNSID(u *upstream, msg *dns.Msg, rMsg *dns.Msg) {
+	if nsid := nsidOf(rMsg); nsid != "" {
+		upstreamLog.Debugf("nsid of endpoint %v for %v %v: %v", u.endpoint,
+			msg.Question[0].Name, dns.TypeToString[msg.Question[0].Qtype], nsid)
+	}
+	if provider.opts.RequestNSID && !hasEDNS0Option(msg, dns.EDNS0NSID) {
+		removeEDNS0Option(rMsg, dns.EDNS0NSID)
+	}
+}
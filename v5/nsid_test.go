@@ -0,0 +1,83 @@
+package dohProxy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+func TestRequestNSID(t *testing.T) {
+	var nsidRequests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		raw, _ := base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		req := new(dns.Msg)
+		if err := req.Unpack(raw); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		m := new(dns.Msg)
+		m.SetReply(req)
+		if hasEDNS0Option(req, dns.EDNS0NSID) {
+			atomic.AddInt32(&nsidRequests, 1)
+			m.SetEdns0(dns.DefaultMsgSize, false)
+			opt := m.IsEdns0()
+			opt.Option = append(opt.Option, &dns.EDNS0_NSID{Code: dns.EDNS0NSID, Nsid: hex.EncodeToString([]byte("node-7.fra"))})
+		}
+		bytesMsg, _ := m.Pack()
+		w.Header().Set("Content-Type", ContentType)
+		_, _ = w.Write(bytesMsg)
+	}))
+	defer ts.Close()
+
+	var buf bytes.Buffer
+	out, level := Log.Out, Log.GetLevel()
+	Log.SetOutput(&buf)
+	defer func() {
+		Log.SetOutput(out)
+		SetLogLevels(Log, level, nil)
+	}()
+	SetLogLevels(Log, logrus.DebugLevel, nil)
+
+	provider, err := NewDMProvider([]string{ts.URL}, &DMProviderOptions{EDNSSubnet: "no", RequestNSID: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := new(dns.Msg)
+	msg.SetQuestion("nsid.example.com.", dns.TypeA)
+	rMsg, err := provider.Query(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&nsidRequests); n != 1 {
+		t.Errorf("NSID should be requested upstream, requested %v times", n)
+	}
+	if !strings.Contains(buf.String(), `"node-7.fra"`) {
+		t.Errorf("NSID should be logged, output: %v", buf.String())
+	}
+	if hasEDNS0Option(rMsg, dns.EDNS0NSID) {
+		t.Errorf("NSID should not be answered to the client not requesting it, got: %v", rMsg)
+	}
+
+	// the NSID requested by the client is passed through.
+	provider, err = NewDMProvider([]string{ts.URL}, &DMProviderOptions{EDNSSubnet: "no"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg = new(dns.Msg)
+	msg.SetQuestion("nsid.example.com.", dns.TypeA)
+	requestNSID(msg)
+	if rMsg, err = provider.Query(msg); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&nsidRequests); n != 2 || nsidOf(rMsg) != `"node-7.fra"` {
+		t.Errorf("NSID requested by the client should be answered, requested %v times, got: %v", n, rMsg)
+	}
+}
@@ -1,10 +1,42 @@
 package dohProxy
 
 import (
+	"context"
+	"net"
+
 	"github.com/miekg/dns"
 )
 
 // Provider is an interface representing a service of DNS queries.
 type Provider interface {
 	Query(msg *dns.Msg) (*dns.Msg, error)
-}
\ No newline at end of file
+}
+
+// ClientProvider is implemented by providers selecting the upstream by the
+// client, clientIP may be nil if unknown.
+type ClientProvider interface {
+	QueryClient(msg *dns.Msg, clientIP net.IP) (*dns.Msg, error)
+}
+
+// ContextProvider is implemented by providers passing ctx to the upstream
+// requests, e.g. the span of the query for the traceparent header.
+type ContextProvider interface {
+	QueryContext(ctx context.Context, msg *dns.Msg, clientIP net.IP) (*dns.Msg, error)
+}
+
+// queryContext queries provider with ctx if it's a ContextProvider, or with
+// clientIP otherwise.
+func queryContext(ctx context.Context, provider Provider, msg *dns.Msg, clientIP net.IP) (*dns.Msg, error) {
+	if p, ok := provider.(ContextProvider); ok {
+		return p.QueryContext(ctx, msg, clientIP)
+	}
+	return queryClient(provider, msg, clientIP)
+}
+
+// queryClient queries provider with clientIP if it's a ClientProvider.
+func queryClient(provider Provider, msg *dns.Msg, clientIP net.IP) (*dns.Msg, error) {
+	if p, ok := provider.(ClientProvider); ok {
+		return p.QueryClient(msg, clientIP)
+	}
+	return provider.Query(msg)
+}
@@ -1,21 +1,29 @@
 package dohProxy
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
-	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/miekg/dns"
+	"hash/fnv"
 	"io/ioutil"
+	"math"
 	"math/rand"
 	"net"
 	"net/http"
 	"net/url"
-	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"golang.org/x/net/proxy"
 )
 
 const (
@@ -28,18 +36,137 @@ const (
 	ContentType          = "application/dns-message"
 	MaxBytesOfDNSMessage = 512
 	maxUInt16            = ^uint16(0)
+
+	// ProtocolDoH queries the upstream with DNS-over-HTTPS, the default.
+	ProtocolDoH = "doh"
+	// ProtocolDoT queries the upstream with DNS-over-TLS.
+	ProtocolDoT = "dot"
+	// ProtocolDoQ queries the upstream with DNS-over-QUIC, RFC 9250; only
+	// available if built with tag "http3".
+	ProtocolDoQ = "doq"
+	// DoTDefaultPort is the port used for DNS-over-TLS when endpoint has none.
+	DoTDefaultPort = "853"
+
+	// endpoints failed consecutively more than this are tried after others.
+	maxConsecutiveFailures = 3
+
+	// backoff before the first retry of transient errors, doubled for each
+	// retry up to upstreamRetryMaxBackoff.
+	upstreamRetryBackoff    = 100 * time.Millisecond
+	upstreamRetryMaxBackoff = 2 * time.Second
+
+	// StrategyFirst tries the endpoints in order, the default.
+	StrategyFirst = "first"
+	// StrategyRace queries all endpoints simultaneously, the first successful
+	// answer wins.
+	StrategyRace = "race"
+	// StrategyRoundRobin starts from the next endpoint for each query, by
+	// weight of the endpoints.
+	StrategyRoundRobin = "round-robin"
+	// StrategyIPHash starts from the endpoint chosen by hash of the client ip,
+	// by weight of the endpoints; the clients of an endpoint going unhealthy
+	// are redistributed over the others.
+	StrategyIPHash = "ip-hash"
+
+	// EDNSSubnetModeGlobal sends the EDNSSubnet option in every query, the
+	// default.
+	EDNSSubnetModeGlobal = "global"
+	// EDNSSubnetModePassthrough forwards the edns0-client-subnet of the client
+	// unchanged, EDNSSubnet is sent if the client has none.
+	EDNSSubnetModePassthrough = "passthrough"
+	// EDNSSubnetModeStrip removes the edns0-client-subnet from every query.
+	EDNSSubnetModeStrip = "strip"
+
+	// DoHMethodGet sends DoH queries base64url encoded in the dns parameter
+	// of GET requests, the default.
+	DoHMethodGet = "get"
+	// DoHMethodPost sends DoH queries in the body of POST requests, not
+	// limited by the url length, RFC 8484 section 4.1.
+	DoHMethodPost = "post"
+
+	// DefaultEDNSPadding is the block size queries are padded to, RFC 8467.
+	DefaultEDNSPadding = 128
+
+	// DefaultUpstreamMaxConns is the connections per endpoint, many small
+	// queries are better served by reusing more connections than the default
+	// 2 idle ones of http.Transport.
+	DefaultUpstreamMaxConns = 32
+	// DefaultUpstreamIdleTimeout is how long idle connections are kept.
+	DefaultUpstreamIdleTimeout = 90 * time.Second
+
+	// delay between connection attempts to the endpoint ips, RFC 8305.
+	happyEyeballsDelay = 250 * time.Millisecond
 )
 
+var errUnpackResponse = errors.New("unpack upstream response error")
+
+// HTTPStatusError is returned when the DoH endpoint answers with an
+// unexpected http status code.
+type HTTPStatusError struct {
+	StatusCode int
+	Message    string
+	// from the Retry-After header, 0 if absent.
+	RetryAfter time.Duration
+}
+
+func (e *HTTPStatusError) Error() string {
+	return e.Message
+}
+
 // DMProvider is the Google DNS-over-HTTPS provider; it implements the
 // Provider interface, the abbreviation "DM" stands for dns-message.
 type DMProvider struct {
-	endpoint         string
+	upstreams []*upstream
+	// index of the endpoint to start from in round-robin strategy.
+	roundRobin *uint32
+	// the endpoint being queried, set from upstreams for each query.
 	url              *url.URL
 	host             string
 	opts             *DMProviderOptions
 	client           *http.Client
-	autoSubnetGetter func() (ip string)
+	dialer           *net.Dialer
+	proxyDialer      proxy.ContextDialer
+	fallback         *PlainProvider
+	tlsConfig        *tls.Config
+	dotClient        *dns.Client
+	autoSubnetGetter *autoSubnet
 	ipResolvers      map[string]func() ([]string, []string)
+	// resolves the endpoint hosts by DnsResolver.
+	bootstrap *bootstrapResolver
+	// the QUIC connection of the endpoint being queried with ProtocolDoQ.
+	doq *doqConn
+	// the idle connections of the endpoint being queried with ProtocolDoT.
+	dot *dotConns
+	// Headers and QueryParameters of the endpoint being queried, with those
+	// of EndpointHeaders and EndpointParameters.
+	headers         http.Header
+	queryParameters map[string][]string
+	// the templated values of headers.
+	headerTemplates headerTemplates
+}
+
+// upstream is one of the endpoints of DMProvider.
+type upstream struct {
+	endpoint  string
+	url       *url.URL
+	tlsConfig *tls.Config
+	// consecutive failures, reset on success.
+	failures int32
+	// opened by BreakerThreshold consecutive failures.
+	breaker upstreamBreaker
+	// unix nano of the last success, and its latency in nanoseconds.
+	lastSuccess int64
+	latency     int64
+	// the QUIC connection of ProtocolDoQ.
+	doq *doqConn
+	// the idle connections of ProtocolDoT.
+	dot *dotConns
+	// share of queries in round-robin and ip-hash strategy, 1 by default.
+	weight int
+	// headers and query parameters sent to the endpoint.
+	headers         http.Header
+	queryParameters map[string][]string
+	headerTemplates headerTemplates
 }
 
 // DMProviderOptions is a configuration object for optional DMProvider configuration
@@ -54,6 +181,29 @@ type DMProviderOptions struct {
 	// option should not be set, use the value "0.0.0.0/0".
 
 	EDNSSubnet string
+
+	// source prefix lengths of the subnets of the external ips sent with the
+	// "auto" EDNSSubnet, the one of the family of the client is sent;
+	// DefaultECSv4Prefix and DefaultECSv6Prefix if 0.
+	ECSv4Prefix int
+	ECSv6Prefix int
+
+	// how the edns0-client-subnet is set, EDNSSubnetModeGlobal (default),
+	// EDNSSubnetModePassthrough or EDNSSubnetModeStrip
+	EDNSSubnetMode string
+	// EDNSSubnetMode is overridden for the domains in ECSPolicies, if not nil.
+	ECSPolicies *ECSPolicies
+
+	// wire format queries are padded to a multiple of EDNSPadding bytes with
+	// the edns0 padding option, DefaultEDNSPadding if 0; negative disables
+	// padding.
+	EDNSPadding int
+
+	// the NSID of the name server is requested in wire format queries and
+	// logged at debug, RFC 5001; answered to clients requesting it only. The
+	// NSID and EXPIRE options of clients are passed through regardless.
+	RequestNSID bool
+
 	// Additional headers to be sent with requests to the DNS provider
 	Headers http.Header
 
@@ -63,8 +213,17 @@ type DMProviderOptions struct {
 	// if using http2 for query
 	HTTP2 bool
 
-	// using specific CA cert file for TLS establishment
-	CACertFilePath string
+	// query over HTTP/3, falling back to HTTP2/HTTP1.1 if the endpoint can't
+	// be reached over QUIC; only available if built with tag "http3".
+	HTTP3 bool
+
+	// using specific CA cert file for TLS establishment, it replaces the system
+	// certificates unless CACertAppendSystem.
+	CACertFilePath     string
+	CACertAppendSystem bool
+	// server name sent in SNI and verified against the certificates, rather
+	// than the host of the endpoint url, e.g. for domain fronting.
+	TLSServerName string
 
 	// Reply All AAAA Questions with a Empty Answer
 	NoAAAA bool
@@ -74,163 +233,657 @@ type DMProviderOptions struct {
 
 	JSONAPI bool
 
-	// dns resolver for retrieve ip of DoH enpoint host
+	// dns resolver for retrieve ip of DoH enpoint host, the endpoint hosts are
+	// resolved on creating the provider and refreshed by ttl; the system
+	// resolver is used if it fails.
 	DnsResolver string
 
 	DnsMsgEncoder base64.Encoding
+
+	// upstream protocol, ProtocolDoH (default), ProtocolDoT or ProtocolDoQ
+	Protocol string
+
+	// http method of DoH queries in dns-message, DoHMethodGet (default) or
+	// DoHMethodPost; JSON queries are always sent by GET.
+	DoHMethod string
+
+	// how the endpoints are queried, StrategyFirst (default), StrategyRace,
+	// StrategyRoundRobin or StrategyIPHash
+	Strategy string
+
+	// weights of endpoints by endpoint, for StrategyRoundRobin and
+	// StrategyIPHash; endpoints absent weigh 1.
+	EndpointWeights map[string]int
+
+	// headers and query parameters by endpoint, sent with requests to the
+	// endpoint in addition to Headers and QueryParameters, replacing those of
+	// the same name; header names are case-insensitive. Shared with the
+	// providers of routes and upstream groups, so those of other endpoints
+	// are ignored.
+	EndpointHeaders    map[string]http.Header
+	EndpointParameters map[string]map[string][]string
+
+	// deadline of each query to an endpoint, failing over to the next one on
+	// timeout; 0 means the client timeout of 15s.
+	UpstreamTimeout time.Duration
+
+	// retry an endpoint this many times with exponential backoff on transient
+	// errors, http 429 and 503, before failing over; it fails over at once on a
+	// Retry-After longer than upstreamRetryMaxBackoff.
+	Retries int
+
+	// an endpoint failed BreakerThreshold times consecutively is skipped for
+	// BreakerCooldown, DefaultUpstreamBreakerCooldown if 0, then probed by one
+	// query; 0 disables the circuit breaker.
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+
+	// maximum connections to each endpoint, also the idle connections kept;
+	// DefaultUpstreamMaxConns if 0. Only the idle ones are limited with
+	// ProtocolDoT.
+	MaxConns int
+
+	// idle connections are closed after IdleTimeout, DefaultUpstreamIdleTimeout
+	// if 0; also of ProtocolDoT.
+	IdleTimeout time.Duration
+
+	// open a new connection for each query, also with ProtocolDoT.
+	DisableKeepAlive bool
+
+	// connect to the endpoints through the SOCKS5 proxy, like
+	// "socks5://[user:pass@]host:port"; the proxy connects to the endpoint ips
+	// or the ips resolved by DnsResolver if specified, endpoint names are
+	// resolved by the proxy otherwise.
+	Proxy string
+
+	// plain dns resolver like "1.1.1.1:53", queried as the last resort when
+	// all endpoints are unreachable.
+	FallbackResolver string
+
+	// randomize the letter case of query names sent to plain dns servers, i.e.
+	// FallbackResolver and plain dns routes; DNS 0x20 encoding.
+	QnameRandomize bool
+
+	// send DNS cookies to plain dns servers, see PlainProviderOptions.Cookies.
+	Cookies bool
+
+	// resolve iteratively with plain dns servers as the root servers, see
+	// PlainProviderOptions.QnameMinimize.
+	QnameMinimize bool
 }
 
-// NewDMProvider creates a DMProvider
-func NewDMProvider(endpoint string, opts *DMProviderOptions) (*DMProvider, error) {
+// NewDMProvider creates a DMProvider, the endpoints are tried in order,
+// falling over to the next one on failure.
+func NewDMProvider(endpoints []string, opts *DMProviderOptions) (*DMProvider, error) {
 	if opts == nil {
 		opts = &DMProviderOptions{}
 	}
+	if len(endpoints) == 0 {
+		return nil, errors.New("no endpoint specified")
+	}
 
-	u, err := url.Parse(endpoint)
-	if err != nil {
-		return nil, err
+	switch opts.Strategy {
+	case "", StrategyFirst, StrategyRace, StrategyRoundRobin, StrategyIPHash:
+	default:
+		return nil, fmt.Errorf("unsupported upstream strategy: %v", opts.Strategy)
+	}
+	switch opts.EDNSSubnetMode {
+	case "", EDNSSubnetModeGlobal, EDNSSubnetModePassthrough, EDNSSubnetModeStrip:
+	default:
+		return nil, fmt.Errorf("unsupported edns subnet mode: %v", opts.EDNSSubnetMode)
+	}
+	switch opts.DoHMethod {
+	case "", DoHMethodGet, DoHMethodPost:
+	default:
+		return nil, fmt.Errorf("unsupported doh method: %v", opts.DoHMethod)
+	}
+
+	provider := &DMProvider{opts: opts, roundRobin: new(uint32)}
+	var err error
+	for _, endpoint := range endpoints {
+		var u *url.URL
+		switch opts.Protocol {
+		case "", ProtocolDoH:
+			u, err = url.Parse(endpoint)
+		case ProtocolDoT:
+			u, err = parseDoTEndpoint(endpoint)
+		case ProtocolDoQ:
+			u, err = parseDoQEndpoint(endpoint)
+		default:
+			err = fmt.Errorf("unsupported upstream protocol: %v", opts.Protocol)
+		}
+		if err != nil {
+			return nil, err
+		}
+		weight := 1
+		if w, ok := opts.EndpointWeights[endpoint]; ok {
+			if w <= 0 {
+				return nil, fmt.Errorf("invalid weight of endpoint %v: %v", endpoint, w)
+			}
+			weight = w
+		}
+		headers := http.Header(mergeKeyValues(canonicalHeader(opts.Headers),
+			canonicalHeader(opts.EndpointHeaders[endpoint])))
+		headerTemplates, err := newHeaderTemplates(headers)
+		if err != nil {
+			return nil, err
+		}
+		provider.upstreams = append(provider.upstreams, &upstream{endpoint: endpoint, url: u, weight: weight,
+			headers: headers, headerTemplates: headerTemplates,
+			queryParameters: mergeKeyValues(opts.QueryParameters, opts.EndpointParameters[endpoint])})
+	}
+	for endpoint := range opts.EndpointWeights {
+		if !containsString(endpoints, endpoint) {
+			return nil, fmt.Errorf("weight of unknown endpoint: %v", endpoint)
+		}
 	}
 
-	provider := &DMProvider{
-		endpoint: endpoint,
-		url:      u,
-		host:     u.Host,
-		opts:     opts,
+	if opts.DnsResolver != "" && len(opts.EndpointIPs) == 0 {
+		if provider.bootstrap, err = newBootstrapResolver(opts.DnsResolver); err != nil {
+			return nil, err
+		}
+	}
+	switch opts.Protocol {
+	case ProtocolDoT:
+		err = configDoTClient(provider)
+	case ProtocolDoQ:
+		err = configDoQClient(provider)
+	default:
+		err = configHTTPClient(provider)
 	}
-	err = configHTTPClient(provider)
 	if err != nil {
-		Log.Errorf("config http client error: %v", err)
+		upstreamLog.Errorf("config upstream client error: %v", err)
 		return nil, err
 	}
+	for _, u := range provider.upstreams {
+		// http transport takes the server name from request url, DoT needs
+		// it for each endpoint.
+		u.tlsConfig = provider.tlsConfig.Clone()
+		if u.tlsConfig.ServerName == "" {
+			u.tlsConfig.ServerName = u.url.Hostname()
+		}
+		u.doq = &doqConn{}
+		u.dot = newDoTConns(provider.opts)
+	}
+	*provider = provider.withUpstream(provider.upstreams[0])
+	if provider.bootstrap != nil {
+		// resolve the endpoint hosts on startup, so endpoint ips are pinned
+		// before the first query.
+		go provider.bootstrap.prefetch(provider.upstreams)
+	}
+
+	if opts.FallbackResolver != "" {
+		provider.fallback, err = NewPlainProvider([]string{opts.FallbackResolver},
+			&PlainProviderOptions{QnameRandomize: opts.QnameRandomize, Cookies: opts.Cookies,
+				QnameMinimize: opts.QnameMinimize})
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	// renew external ip every 15min.
-	provider.autoSubnetGetter = provider.currentSubnetClosure(provider.opts.DnsResolver, 15*60)
+	dnsResolver := provider.opts.DnsResolver
+	if dnsResolver == "" {
+		dnsResolver = "8.8.8.8"
+	}
+	provider.autoSubnetGetter = newAutoSubnet(opts.ECSv4Prefix, opts.ECSv6Prefix, 15*time.Minute,
+		func(network string) (string, error) { return provider.obtainExternalIP(dnsResolver, network) })
 
 	provider.ipResolvers = make(map[string]func() ([]string, []string))
 
 	return provider, nil
 }
 
-func configHTTPClient(provider *DMProvider) error {
-	// Create TLS configuration with the certificate of the server
-	serverName, _, err := net.SplitHostPort(provider.url.Host)
+// parseDoTEndpoint accepts "tls://host[:port]", "host[:port]" or a DoH url,
+// the port defaults to 853.
+func parseDoTEndpoint(endpoint string) (*url.URL, error) {
+	return parseHostEndpoint(endpoint, "tls")
+}
+
+// parseHostEndpoint parses endpoint of host and port like parseDoTEndpoint,
+// with scheme of the protocol.
+func parseHostEndpoint(endpoint string, scheme string) (*url.URL, error) {
+	if !strings.Contains(endpoint, "://") {
+		endpoint = scheme + "://" + endpoint
+	}
+	u, err := url.Parse(endpoint)
 	if err != nil {
-		serverName = provider.url.Host
+		return nil, err
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("no host in %v endpoint: %v", scheme, endpoint)
 	}
-	tlsConfig := &tls.Config{
-		ServerName: serverName,
+	if u.Port() == "" || u.Scheme != scheme {
+		u.Host = net.JoinHostPort(u.Hostname(), DoTDefaultPort)
 	}
+	u.Scheme = scheme
+	u.Path = ""
+	u.RawQuery = ""
+	return u, nil
+}
+
+func configTLS(provider *DMProvider) error {
+	// the server name is set for each endpoint, unless overridden.
+	tlsConfig := &tls.Config{ServerName: provider.opts.TLSServerName}
 
 	// using custom CA certificate
-	if _, err := os.Stat(provider.opts.CACertFilePath); err == nil {
-		caCert, err := ioutil.ReadFile(provider.opts.CACertFilePath)
+	if provider.opts.CACertFilePath != "" {
+		caCertPool, err := loadCACertPool(provider.opts.CACertFilePath, provider.opts.CACertAppendSystem)
 		if err != nil {
-			Log.Errorf("read custom CA certificate failed : %s", err)
+			upstreamLog.Errorf("load custom CA certificate failed: %v", err)
 			return err
 		}
-		caCertPool := x509.NewCertPool()
-		caCertPool.AppendCertsFromPEM(caCert)
 		tlsConfig.RootCAs = caCertPool
 	}
+	provider.tlsConfig = tlsConfig
 
 	keepAliveTimeout := 300 * time.Second
 	timeout := 15 * time.Second
 
-	dialer := &net.Dialer{
+	provider.dialer = &net.Dialer{
 		Timeout:   timeout,
 		KeepAlive: keepAliveTimeout,
 	}
+	return configProxy(provider)
+}
+
+func configProxy(provider *DMProvider) error {
+	if provider.opts.Proxy == "" {
+		return nil
+	}
+	u, err := url.Parse(provider.opts.Proxy)
+	if err != nil {
+		return fmt.Errorf("parse proxy url error: %v", err)
+	}
+	if u.Scheme != "socks5" && u.Scheme != "socks5h" {
+		return fmt.Errorf("unsupported proxy: %v", u.Scheme)
+	}
+	dialer, err := proxy.FromURL(u, provider.dialer)
+	if err != nil {
+		return fmt.Errorf("config proxy error: %v", err)
+	}
+	contextDialer, ok := dialer.(proxy.ContextDialer)
+	if !ok {
+		return fmt.Errorf("unsupported proxy: %v", u.Scheme)
+	}
+	provider.proxyDialer = contextDialer
+	return nil
+}
+
+// dialContext dials addr directly or through the proxy.
+func (provider *DMProvider) dialContext(ctx context.Context, network string, addr string) (net.Conn, error) {
+	if provider.proxyDialer != nil {
+		upstreamLog.Debugf("dial %v through proxy", addr)
+		return provider.proxyDialer.DialContext(ctx, network, addr)
+	}
+	return provider.dialer.DialContext(ctx, network, addr)
+}
+
+func configHTTPClient(provider *DMProvider) error {
+	if err := configTLS(provider); err != nil {
+		return err
+	}
 
 	// custom transport for supporting server name which may not match the url,
 	// in cases where we request directly against an IP.
+	maxConns := provider.opts.MaxConns
+	if maxConns <= 0 {
+		maxConns = DefaultUpstreamMaxConns
+	}
+	idleTimeout := provider.opts.IdleTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = DefaultUpstreamIdleTimeout
+	}
 	tr := &http.Transport{
-		Proxy:             nil,
-		TLSClientConfig:   tlsConfig,
-		ForceAttemptHTTP2: provider.opts.HTTP2,
-		DialContext: func(ctx context.Context, network string, addr string) (net.Conn, error) {
-			h, p, err := net.SplitHostPort(addr)
-			if len(provider.opts.EndpointIPs) > 0 {
-				if err == nil {
-					ip := provider.opts.EndpointIPs[rand.Intn(len(provider.opts.EndpointIPs))]
-					addr = net.JoinHostPort(ip.String(), p)
-					Log.Info("endpoint ip address from specified: ", addr)
-				}
-			} else if provider.opts.DnsResolver != "" {
-				var ip4s, ip16s, ipsResolved []string
-				var closure func() ([]string, []string)
-				if provider.ipResolvers[h] == nil {
-					// try set closure for resolving domain name.
-					closure = ResolveHostToIPClosure(dns.CanonicalName(h), provider.opts.DnsResolver)
-					provider.ipResolvers[h] = closure
-				}
-				// use the closure set for resolving domain name
-				ip4s, ip16s = provider.ipResolvers[h]()
-				ipsResolved = append(ip4s, ip16s...)
-				if len(ipsResolved) == 0 {
-					Log.Info("Can't resolve endpoint from provided dns server")
-					return nil, fmt.Errorf("resolve failed during dailing")
-				}
-				ip := ipsResolved[rand.Intn(len(ipsResolved))]
-				// only ipv4 if NoAAAA option is on.
-				if provider.opts.NoAAAA {
-					if len(ip4s) == 0 {
-						return nil, fmt.Errorf("no ipv4 address avaiable for dailing")
-					}
-					ip = ipsResolved[rand.Intn(len(ip4s))]
-				}
-				addr = net.JoinHostPort(ip, p)
-			}
-			return dialer.DialContext(ctx, network, addr)
-		},
+		Proxy:               nil,
+		TLSClientConfig:     provider.tlsConfig,
+		ForceAttemptHTTP2:   provider.opts.HTTP2,
+		DialContext:         provider.dialHTTPEndpoint,
+		MaxConnsPerHost:     maxConns,
+		MaxIdleConnsPerHost: maxConns,
+		IdleConnTimeout:     idleTimeout,
+		DisableKeepAlives:   provider.opts.DisableKeepAlive,
+	}
+	provider.client = &http.Client{Transport: tr, Timeout: provider.dialer.Timeout}
+	if provider.opts.HTTP3 {
+		return configHTTP3(provider, tr)
+	}
+	return nil
+}
+
+func configDoTClient(provider *DMProvider) error {
+	if err := configTLS(provider); err != nil {
+		return err
+	}
+	// resume the TLS sessions of new connections, shared by the endpoints.
+	provider.tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+	provider.dotClient = &dns.Client{
+		Net:       "tcp-tls",
+		TLSConfig: provider.tlsConfig,
+		Timeout:   provider.dialer.Timeout,
 	}
-	provider.client = &http.Client{Transport: tr, Timeout: timeout}
 	return nil
 }
 
-func (provider *DMProvider) currentSubnetClosure(dnsResolver string, secondsBeforeRetry int64) (getter func() string) {
-	expireTime := int64(0)
-	subnetLastUpdated := ""
-	updating := false
-	renewSubnet := func() {
-		updating = true
-		Log.Debugf("start obtain your external ip: %v", time.Now().Unix())
-		dnsS := dnsResolver
-		if dnsS == "" {
-			dnsS = "8.8.8.8"
+// dialEndpoint dials the upstream endpoint, the address is replaced with the
+// pinned endpoint ips or the ips resolved by the specified dns resolver;
+// multiple ips are raced by dialParallel.
+func (provider *DMProvider) dialEndpoint(ctx context.Context, network string, addr string) (net.Conn, error) {
+	addrs, err := provider.endpointAddrs(addr)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 1 {
+		return provider.dialContext(ctx, network, addrs[0])
+	}
+	return provider.dialParallel(ctx, network, addrs)
+}
+
+// dialParallel races the connections to addrs Happy Eyeballs style, RFC 8305:
+// the attempts are started happyEyeballsDelay apart, or at once if the
+// previous one failed; the first connected wins and the others are closed.
+func (provider *DMProvider) dialParallel(ctx context.Context, network string, addrs []string) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, len(addrs))
+	next, pending := 0, 0
+	var delay <-chan time.Time
+	start := func() {
+		addr := addrs[next]
+		next++
+		pending++
+		go func() {
+			conn, err := provider.dialContext(ctx, network, addr)
+			results <- result{conn: conn, err: err}
+		}()
+		delay = nil
+		if next < len(addrs) {
+			delay = time.After(happyEyeballsDelay)
 		}
-		ipExternal, err := provider.ObtainCurrentExternalIP(dnsS)
-		if err == nil {
-			ipInt := net.ParseIP(ipExternal)
-			if ipInt.To4() == nil {
-				subnetLastUpdated = ipExternal + "/64"
-				Log.Debugf("renew subnet: %v", subnetLastUpdated)
-			} else {
-				subnetLastUpdated = ipExternal + "/32"
-				Log.Debugf("renew subnet: %v", subnetLastUpdated)
+	}
+
+	start()
+	var err error
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				go func(pending int) {
+					// close the connections made before being cancelled.
+					for ; pending > 0; pending-- {
+						if r := <-results; r.conn != nil {
+							_ = r.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			err = r.err
+			if next < len(addrs) {
+				start()
 			}
+		case <-delay:
+			start()
+		}
+	}
+	return nil, err
+}
+
+// dialHTTPEndpoint dials the endpoint for http transport, the connections are
+// counted in metrics.
+func (provider *DMProvider) dialHTTPEndpoint(ctx context.Context, network string, addr string) (net.Conn, error) {
+	conn, err := provider.dialEndpoint(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return newCountedConn(conn), nil
+}
+
+// endpointAddr replaces the host of addr with one of the pinned endpoint ips
+// or the ips resolved by the specified dns resolver.
+func (provider *DMProvider) endpointAddr(addr string) (string, error) {
+	addrs, err := provider.endpointAddrs(addr)
+	if err != nil {
+		return "", err
+	}
+	return addrs[rand.Intn(len(addrs))], nil
+}
+
+// endpointAddrs replaces the host of addr with each of the pinned endpoint ips
+// or the ips resolved by the specified dns resolver, shuffled and ordered by
+// happyEyeballsOrder; addr is kept if neither specified.
+func (provider *DMProvider) endpointAddrs(addr string) ([]string, error) {
+	h, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		return []string{addr}, nil
+	}
+	var ips []string
+	if len(provider.opts.EndpointIPs) > 0 {
+		for _, ip := range provider.opts.EndpointIPs {
+			ips = append(ips, ip.String())
+		}
+		upstreamLog.Debugf("endpoint ip addresses from specified: %v", ips)
+	} else if provider.bootstrap != nil {
+		ip4s, ip16s := provider.bootstrap.lookup(dns.CanonicalName(h))
+		ips = append(ips, ip4s...)
+		// only ipv4 if NoAAAA option is on.
+		if !provider.opts.NoAAAA {
+			ips = append(ips, ip16s...)
+		}
+		if len(ips) == 0 {
+			upstreamLog.Info("Can't resolve endpoint from provided dns server")
+			return nil, fmt.Errorf("resolve failed during dailing")
+		}
+	} else {
+		return []string{addr}, nil
+	}
+
+	addrs := make([]string, 0, len(ips))
+	for _, ip := range happyEyeballsOrder(ips) {
+		addrs = append(addrs, net.JoinHostPort(ip, p))
+	}
+	return addrs, nil
+}
+
+// happyEyeballsOrder shuffles ips of each family, then interleaves them
+// starting from ipv6.
+func happyEyeballsOrder(ips []string) []string {
+	var ip4s, ip16s []string
+	for _, ip := range ips {
+		if parsed := net.ParseIP(ip); parsed != nil && parsed.To4() == nil {
+			ip16s = append(ip16s, ip)
+		} else {
+			ip4s = append(ip4s, ip)
+		}
+	}
+	for _, family := range [][]string{ip4s, ip16s} {
+		rand.Shuffle(len(family), func(i, j int) { family[i], family[j] = family[j], family[i] })
+	}
+	ordered := make([]string, 0, len(ips))
+	for i := 0; i < len(ip4s) || i < len(ip16s); i++ {
+		if i < len(ip16s) {
+			ordered = append(ordered, ip16s[i])
+		}
+		if i < len(ip4s) {
+			ordered = append(ordered, ip4s[i])
+		}
+	}
+	return ordered
+}
+
+const (
+	// ttl of resolved endpoint ips is clamped to this range.
+	bootstrapMinTTL = 10 * time.Second
+	bootstrapMaxTTL = time.Hour
+	// failed refresh is retried after this duration, keeping the last ips.
+	bootstrapRetryInterval = 10 * time.Second
+	// ttl of ips resolved by the system resolver, which reports none.
+	bootstrapSystemTTL = 5 * time.Minute
+)
+
+// bootstrapResolver resolves the endpoint hosts by a plain dns resolver,
+// falling back to the system resolver; the ips are cached by their ttl and
+// refreshed in background when expired; the last resolved ips are kept if
+// refreshing fails.
+type bootstrapResolver struct {
+	provider Provider
+	lock     sync.Mutex
+	hosts    map[string]*bootstrapHost
+	// now and lookupSystem are replaceable for testing.
+	now          func() time.Time
+	lookupSystem func(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+type bootstrapHost struct {
+	ip4s, ip16s []string
+	expire      time.Time
+	refreshing  bool
+}
+
+func newBootstrapResolver(resolver string) (*bootstrapResolver, error) {
+	provider, err := NewPlainProvider([]string{resolver}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("dns resolver can't be recognized: %v", err)
+	}
+	return &bootstrapResolver{provider: provider, hosts: make(map[string]*bootstrapHost), now: time.Now,
+		lookupSystem: net.DefaultResolver.LookupIPAddr}, nil
+}
+
+// prefetch resolves the hosts of upstreams, except ip addresses.
+func (r *bootstrapResolver) prefetch(upstreams []*upstream) {
+	for _, u := range upstreams {
+		if h := u.url.Hostname(); net.ParseIP(h) == nil {
+			r.lookup(dns.CanonicalName(h))
 		}
-		expireTime = time.Now().Unix() + secondsBeforeRetry
-		updating = false
-	}
-	return func() string {
-		if time.Now().Unix() < expireTime {
-			Log.Debugf("seconds left to obtain external ip again: %v",
-				time.Now().Unix()-expireTime)
-			return subnetLastUpdated
-		} else if subnetLastUpdated != "" {
-			if !updating {
-				go renewSubnet()
+	}
+}
+
+// lookup returns the cached ips of name, resolving it if none cached; expired
+// ips are returned while refreshing in background.
+func (r *bootstrapResolver) lookup(name string) (ip4s []string, ip16s []string) {
+	r.lock.Lock()
+	host := r.hosts[name]
+	if host != nil && len(host.ip4s)+len(host.ip16s) > 0 {
+		if r.now().After(host.expire) && !host.refreshing {
+			host.refreshing = true
+			go r.refresh(name)
+		}
+		ip4s, ip16s = host.ip4s, host.ip16s
+		r.lock.Unlock()
+		return
+	}
+	r.lock.Unlock()
+
+	r.refresh(name)
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if host = r.hosts[name]; host != nil {
+		return host.ip4s, host.ip16s
+	}
+	return nil, nil
+}
+
+// refresh resolves name and updates the cached ips, the last ips are kept if
+// none resolved.
+func (r *bootstrapResolver) refresh(name string) {
+	ip4s, ip16s, ttl := r.resolve(name)
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	host := r.hosts[name]
+	if host == nil {
+		host = &bootstrapHost{}
+		r.hosts[name] = host
+	}
+	host.refreshing = false
+	if len(ip4s)+len(ip16s) == 0 {
+		upstreamLog.Warnf("can't resolve endpoint %v with dns resolver, retry in %v", name, bootstrapRetryInterval)
+		host.expire = r.now().Add(bootstrapRetryInterval)
+		return
+	}
+	if ttl < bootstrapMinTTL {
+		ttl = bootstrapMinTTL
+	} else if ttl > bootstrapMaxTTL {
+		ttl = bootstrapMaxTTL
+	}
+	host.ip4s, host.ip16s = ip4s, ip16s
+	host.expire = r.now().Add(ttl)
+	upstreamLog.Debugf("resolved endpoint %v: %v %v, ttl: %v", name, ip4s, ip16s, ttl)
+}
+
+// resolve queries the A and AAAA records of name, ttl is the minimum of the
+// answers.
+func (r *bootstrapResolver) resolve(name string) (ip4s []string, ip16s []string, ttl time.Duration) {
+	ttl = bootstrapMaxTTL
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, qtype)
+		rMsg, err := r.provider.Query(msg)
+		if err != nil {
+			upstreamLog.Errorf("can't resolve endpoint host with provided dns resolver: %v", err)
+			continue
+		}
+		for _, answer := range rMsg.Answer {
+			switch rr := answer.(type) {
+			case *dns.A:
+				ip4s = append(ip4s, rr.A.String())
+			case *dns.AAAA:
+				ip16s = append(ip16s, rr.AAAA.String())
+			default:
+				continue
 			}
-			return subnetLastUpdated
+			if d := time.Duration(answer.Header().Ttl) * time.Second; d < ttl {
+				ttl = d
+			}
+		}
+	}
+	if len(ip4s)+len(ip16s) > 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultUpstreamTimeout)
+	defer cancel()
+	addrs, err := r.lookupSystem(ctx, strings.TrimSuffix(name, "."))
+	if err != nil {
+		upstreamLog.Errorf("can't resolve endpoint host with system resolver: %v", err)
+		return
+	}
+	for _, addr := range addrs {
+		if addr.IP.To4() != nil {
+			ip4s = append(ip4s, addr.IP.String())
 		} else {
-			renewSubnet()
+			ip16s = append(ip16s, addr.IP.String())
 		}
-		return subnetLastUpdated
 	}
+	upstreamLog.Infof("resolved endpoint %v with system resolver: %v %v", name, ip4s, ip16s)
+	return ip4s, ip16s, bootstrapSystemTTL
+}
+
+// Close closes the idle connections to the endpoint.
+func (provider DMProvider) Close() error {
+	if provider.client != nil {
+		provider.client.CloseIdleConnections()
+	}
+	for _, u := range provider.upstreams {
+		u.doq.close()
+		u.dot.close()
+	}
+	return nil
 }
 
 // obtain external ip through some public apis.
 func (provider *DMProvider) ObtainCurrentExternalIP(dnsResolver string) (string, error) {
+	return provider.obtainExternalIP(dnsResolver, "tcp")
+}
+
+// obtainExternalIP obtains the external ip reached by network, "tcp4" and
+// "tcp6" for the ip of that family.
+func (provider *DMProvider) obtainExternalIP(dnsResolver string, network string) (string, error) {
 	ip := ""
 	type IPRespModel struct {
 		Address string `json:"address"`
@@ -257,7 +910,7 @@ func (provider *DMProvider) ObtainCurrentExternalIP(dnsResolver string) (string,
 	// in cases where we request directly against an IP
 	tr := &http.Transport{
 		Proxy: nil,
-		DialContext: func(ctx context.Context, network string, addr string) (net.Conn, error) {
+		DialContext: func(ctx context.Context, _ string, addr string) (net.Conn, error) {
 			h, p, _ := net.SplitHostPort(addr)
 			var ipResolved, ip4s, ip16s []string
 			var closure func() ([]string, []string)
@@ -266,23 +919,33 @@ func (provider *DMProvider) ObtainCurrentExternalIP(dnsResolver string) (string,
 					// if specified ip for endpoint, only try self query
 					closure = provider.GetIPsClosure(dns.CanonicalName(h))
 					provider.ipResolvers[h] = closure
-					Log.Infof("using self query  as ns resolver")
+					upstreamLog.Infof("using self query  as ns resolver")
 				} else {
 					closure = ResolveHostToIPClosure(dns.CanonicalName(h), dnsResolver)
 					provider.ipResolvers[h] = closure
-					Log.Infof("using %v  as ns resolver: ", dnsResolver)
+					upstreamLog.Infof("using %v  as ns resolver: ", dnsResolver)
 				}
 			}
 			ip4s, ip16s = provider.ipResolvers[h]()
-			ipResolved = append(ip4s, ip16s...)
+			switch network {
+			case "tcp4":
+				ipResolved = ip4s
+			case "tcp6":
+				ipResolved = ip16s
+			default:
+				ipResolved = append(ip4s, ip16s...)
+			}
 
 			if len(ipResolved) == 0 {
-				Log.Errorf("Can't resolve endpoint %v from self or provided dns server: %v", h, dnsResolver)
+				upstreamLog.Errorf("Can't resolve endpoint %v from self or provided dns server: %v", h, dnsResolver)
 				return nil, fmt.Errorf("resolve failed during dailing")
 			}
 			ip := ipResolved[rand.Intn(len(ipResolved))]
 			addr = net.JoinHostPort(ip, p)
-			Log.Infof("external ip fetcher api endpoint resolved: %v", addr)
+			upstreamLog.Infof("external ip fetcher api endpoint resolved: %v", addr)
+			if provider.proxyDialer != nil {
+				return provider.proxyDialer.DialContext(ctx, network, addr)
+			}
 			return dialer.DialContext(ctx, network, addr)
 		},
 	}
@@ -290,15 +953,15 @@ func (provider *DMProvider) ObtainCurrentExternalIP(dnsResolver string) (string,
 	client := &http.Client{Transport: tr, Timeout: timeout}
 
 	for _, uri := range apiToTry {
-		Log.Debugf("start obtain external ip from: %v", uri)
+		upstreamLog.Debugf("start obtain external ip from: %v", uri)
 		httpReq, err := http.NewRequest(http.MethodGet, uri, nil)
 		if err != nil {
-			Log.Errorf("retrieve external ip error: %v", err)
+			upstreamLog.Errorf("retrieve external ip error: %v", err)
 			continue
 		}
 		httpResp, err := client.Do(httpReq)
 		if err != nil {
-			Log.Errorf("http api call failed: %v", err)
+			upstreamLog.Errorf("http api call failed: %v", err)
 			client.CloseIdleConnections()
 			continue
 		}
@@ -310,20 +973,20 @@ func (provider *DMProvider) ObtainCurrentExternalIP(dnsResolver string) (string,
 
 		httpRespBytes, err := ioutil.ReadAll(httpResp.Body)
 		if err != nil {
-			Log.Errorf("http api call result read error: %v, %v", httpRespBytes, err)
+			upstreamLog.Errorf("http api call result read error: %v, %v", httpRespBytes, err)
 		}
 		err = json.Unmarshal(httpRespBytes, &ipResp)
 		if err != nil {
-			Log.Errorf("retrieve external ip error: %v", err)
+			upstreamLog.Errorf("retrieve external ip error: %v", err)
 			continue
 		}
 		if ipResp.Ip != "" {
 			ip = ipResp.Ip
-			Log.Infof("API result of obtain external ip: %v", ipResp)
+			upstreamLog.Infof("API result of obtain external ip: %v", ipResp)
 		}
 		if ipResp.Address != "" {
 			ip = ipResp.Address
-			Log.Infof("API result of obtain external ip: %v", ipResp)
+			upstreamLog.Infof("API result of obtain external ip: %v", ipResp)
 		}
 		if ip != "" {
 			break
@@ -337,26 +1000,355 @@ func (provider *DMProvider) ObtainCurrentExternalIP(dnsResolver string) (string,
 }
 
 func (provider DMProvider) Query(msg *dns.Msg) (*dns.Msg, error) {
+	return provider.QueryClient(msg, nil)
+}
 
+// QueryClient is like Query, the endpoints are chosen by clientIP with
+// StrategyIPHash.
+func (provider DMProvider) QueryClient(msg *dns.Msg, clientIP net.IP) (*dns.Msg, error) {
+	return provider.QueryContext(context.Background(), msg, clientIP)
+}
+
+// QueryContext is like QueryClient, the upstream requests are made with ctx.
+func (provider DMProvider) QueryContext(ctx context.Context, msg *dns.Msg, clientIP net.IP) (*dns.Msg, error) {
 	if len(msg.Question) == 0 {
-		Log.Debugf("no questions in resolve request.")
+		upstreamLog.Debugf("no questions in resolve request.")
 		return nil, errors.New("should have question in resolve request")
 	}
 
+	var rMsg *dns.Msg
+	var err error
+	switch provider.opts.Strategy {
+	case StrategyRace:
+		rMsg, err = provider.raceQuery(ctx, msg, clientIP, provider.allowedUpstreams(provider.upstreams))
+	case StrategyRoundRobin:
+		rMsg, err = provider.failoverQuery(ctx, msg, clientIP, provider.roundRobinUpstreams())
+	case StrategyIPHash:
+		rMsg, err = provider.failoverQuery(ctx, msg, clientIP, provider.ipHashUpstreams(clientIP))
+	default:
+		rMsg, err = provider.failoverQuery(ctx, msg, clientIP, provider.orderedUpstreams())
+	}
+	if err == nil || provider.fallback == nil || !isUnreachableError(err) {
+		return rMsg, err
+	}
+
+	upstreamLog.Warnf("all endpoints unreachable, fall back to plain dns resolver %v for %v: %v",
+		provider.opts.FallbackResolver, msg.Question[0].Name, err)
+	metricFallbacks.Inc()
+	return provider.fallback.Query(msg)
+}
+
+// failoverQuery tries the endpoints in order until one answers, the endpoints
+// of open circuit breakers are skipped unless all are.
+func (provider DMProvider) failoverQuery(ctx context.Context, msg *dns.Msg, clientIP net.IP,
+	upstreams []*upstream) (*dns.Msg, error) {
+	rMsg, queried, err := provider.tryUpstreams(ctx, msg, clientIP, upstreams, true)
+	if queried == 0 && len(upstreams) > 0 {
+		upstreamLog.Debugf("circuits of all endpoints open, query them regardless")
+		rMsg, _, err = provider.tryUpstreams(ctx, msg, clientIP, upstreams, false)
+	}
+	return rMsg, err
+}
+
+// tryUpstreams tries the endpoints in order until one answers, the endpoints
+// not allowed by their breakers are skipped if skipOpen; the number of the
+// endpoints queried is returned.
+func (provider DMProvider) tryUpstreams(ctx context.Context, msg *dns.Msg, clientIP net.IP,
+	upstreams []*upstream, skipOpen bool) (*dns.Msg, int, error) {
+	var err error
+	queried := 0
+	now := time.Now()
+	for _, u := range upstreams {
+		if skipOpen && !provider.breakerAllows(u, now) {
+			continue
+		}
+		queried++
+		var rMsg *dns.Msg
+		rMsg, err = provider.queryUpstream(ctx, u, msg, clientIP)
+		if err == nil {
+			return rMsg, queried, nil
+		}
+		if !isRetryableError(err) {
+			break
+		}
+	}
+	return nil, queried, err
+}
+
+// raceQuery queries the endpoints simultaneously and returns the first
+// successful answer, the other queries are cancelled.
+func (provider DMProvider) raceQuery(ctx context.Context, msg *dns.Msg, clientIP net.IP,
+	upstreams []*upstream) (*dns.Msg, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		msg *dns.Msg
+		err error
+	}
+	results := make(chan result, len(upstreams))
+	for _, u := range upstreams {
+		go func(u *upstream) {
+			rMsg, err := provider.queryUpstream(ctx, u, msg, clientIP)
+			results <- result{msg: rMsg, err: err}
+		}(u)
+	}
+
+	var err error
+	for range upstreams {
+		r := <-results
+		if r.err == nil {
+			return r.msg, nil
+		}
+		err = r.err
+	}
+	return nil, err
+}
+
+// queryUpstream queries the endpoint u, tracking its consecutive failures.
+func (provider DMProvider) queryUpstream(ctx context.Context, u *upstream, msg *dns.Msg,
+	clientIP net.IP) (*dns.Msg, error) {
+	if provider.opts.UpstreamTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, provider.opts.UpstreamTimeout)
+		defer cancel()
+	}
+	var rMsg *dns.Msg
+	var err error
+	var startTime time.Time
+	for retry := 0; ; retry++ {
+		startTime = time.Now()
+		// each query modifies its message.
+		rMsg, err = provider.withUpstream(u).query(ctx, msg.Copy(), clientIP)
+		if err != nil && errors.Is(err, context.Canceled) {
+			// lost the race, not a failure of the endpoint.
+			u.breaker.abort()
+			return nil, err
+		}
+		observeUpstream(startTime, err)
+		if err == nil || retry >= provider.opts.Retries || !isTransientError(err) {
+			break
+		}
+		backoff := retryBackoff(err, retry)
+		// fail over rather than wait for a Retry-After longer than any backoff,
+		// also without a deadline.
+		if backoff > upstreamRetryMaxBackoff {
+			break
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(backoff).After(deadline) {
+			break
+		}
+		upstreamLog.Debugf("retry endpoint %v in %v: %v", u.endpoint, backoff, err)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+	if err != nil {
+		failures := atomic.AddInt32(&u.failures, 1)
+		upstreamLog.Warnf("query endpoint %v failed, consecutive failures: %v, error: %v", u.endpoint, failures, err)
+		provider.observeBreaker(u, failures)
+		return nil, err
+	}
+	atomic.StoreInt32(&u.failures, 0)
+	now := time.Now()
+	u.observeSuccess(now, now.Sub(startTime))
+	provider.observeBreaker(u, 0)
+	provider.observeNSID(u, msg, rMsg)
+	if provider.stripsEDNSSubnet(msg) {
+		// echoed by some upstreams.
+		RemoveEDNS0Subnet(rMsg)
+	}
+	return rMsg, nil
+}
+
+// withUpstream returns a copy of provider querying the endpoint u.
+func (provider DMProvider) withUpstream(u *upstream) DMProvider {
+	provider.url = u.url
+	provider.host = u.url.Host
+	provider.tlsConfig = u.tlsConfig
+	provider.doq = u.doq
+	provider.dot = u.dot
+	provider.headers = u.headers
+	provider.queryParameters = u.queryParameters
+	provider.headerTemplates = u.headerTemplates
+	return provider
+}
+
+// orderedUpstreams returns the endpoints in configured order, endpoints
+// failed consecutively too many times are moved to the end.
+func (provider DMProvider) orderedUpstreams() []*upstream {
+	healthy := make([]*upstream, 0, len(provider.upstreams))
+	var failing []*upstream
+	for _, u := range provider.upstreams {
+		if atomic.LoadInt32(&u.failures) >= maxConsecutiveFailures {
+			failing = append(failing, u)
+		} else {
+			healthy = append(healthy, u)
+		}
+	}
+	return append(healthy, failing...)
+}
+
+// roundRobinUpstreams returns the ordered endpoints rotated to start from the
+// next one for each call, each healthy endpoint starts as many calls as its
+// weight in turn.
+func (provider DMProvider) roundRobinUpstreams() []*upstream {
+	ordered := provider.orderedUpstreams()
+	candidates := healthyPrefix(ordered)
+	total := 0
+	for _, u := range candidates {
+		total += u.weight
+	}
+	n := int(atomic.AddUint32(provider.roundRobin, 1)-1) % total
+	start := 0
+	for ; n >= candidates[start].weight; start++ {
+		n -= candidates[start].weight
+	}
+	return append(ordered[start:], ordered[:start]...)
+}
+
+// ipHashUpstreams returns the endpoints ordered by the weighted rendezvous
+// hash of clientIP, healthy ones first; an unhealthy endpoint only moves its
+// own clients. The ordered endpoints are returned if clientIP is nil.
+func (provider DMProvider) ipHashUpstreams(clientIP net.IP) []*upstream {
+	ordered := provider.orderedUpstreams()
+	if clientIP == nil {
+		return ordered
+	}
+	candidates := healthyPrefix(ordered)
+	scores := make(map[*upstream]float64, len(ordered))
+	for _, u := range ordered {
+		h := fnv.New64a()
+		_, _ = h.Write(clientIP.To16())
+		_, _ = h.Write([]byte(u.endpoint))
+		// uniform in (0, 1), the score is -weight/ln(x).
+		x := (float64(h.Sum64()>>11) + 0.5) / (1 << 53)
+		scores[u] = -float64(u.weight) / math.Log(x)
+	}
+	rest := ordered[len(candidates):]
+	sort.SliceStable(candidates, func(i, j int) bool { return scores[candidates[i]] > scores[candidates[j]] })
+	sort.SliceStable(rest, func(i, j int) bool { return scores[rest[i]] > scores[rest[j]] })
+	return ordered
+}
+
+// healthyPrefix returns the healthy endpoints at the front of ordered, all of
+// them if none is healthy.
+func healthyPrefix(ordered []*upstream) []*upstream {
+	n := 0
+	for n < len(ordered) && atomic.LoadInt32(&ordered[n].failures) < maxConsecutiveFailures {
+		n++
+	}
+	if n == 0 {
+		return ordered
+	}
+	return ordered[:n]
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// isTransientError reports whether the endpoint may answer if retried later:
+// on http 429 and 503.
+func isTransientError(err error) bool {
+	var statusErr *HTTPStatusError
+	return errors.As(err, &statusErr) &&
+		(statusErr.StatusCode == http.StatusTooManyRequests || statusErr.StatusCode == http.StatusServiceUnavailable)
+}
+
+// retryBackoff returns the Retry-After of err if any, or the exponential
+// backoff of retry with jitter.
+func retryBackoff(err error, retry int) time.Duration {
+	var statusErr *HTTPStatusError
+	if errors.As(err, &statusErr) && statusErr.RetryAfter > 0 {
+		return statusErr.RetryAfter
+	}
+	backoff := upstreamRetryBackoff << uint(retry)
+	if backoff > upstreamRetryMaxBackoff || backoff <= 0 {
+		backoff = upstreamRetryMaxBackoff
+	}
+	// between half and the full backoff.
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+// parseRetryAfter parses the Retry-After header in seconds or http date, 0 if
+// absent or invalid.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// isUnreachableError reports whether the endpoint is unreachable: on
+// connection errors and timeouts.
+func isUnreachableError(err error) bool {
+	class := UpstreamErrorClass(err)
+	return class == UpstreamErrorTimeout || class == UpstreamErrorConnection
+}
+
+// isRetryableError reports whether the query should be retried on the next
+// endpoint: on http 5xx, connection errors and timeouts.
+func isRetryableError(err error) bool {
+	if isUnreachableError(err) {
+		return true
+	}
+	switch UpstreamErrorClass(err) {
+	case UpstreamErrorHTTP:
+		var statusErr *HTTPStatusError
+		return errors.As(err, &statusErr) && statusErr.StatusCode >= 500
+	default:
+		return false
+	}
+}
+
+func (provider DMProvider) query(ctx context.Context, msg *dns.Msg, clientIP net.IP) (*dns.Msg, error) {
 	if provider.opts.Alternative {
-		return provider.urlParamsQuery(msg)
+		return provider.urlParamsQuery(ctx, msg, clientIP)
 	}
 
 	if provider.opts.JSONAPI {
-		return provider.jsonQuery(msg)
+		return provider.jsonQuery(ctx, msg, clientIP)
+	}
+
+	if provider.opts.Protocol == ProtocolDoT {
+		return provider.dotQuery(ctx, msg, clientIP)
 	}
 
-	return provider.dnsMessageQuery(msg)
+	if provider.opts.Protocol == ProtocolDoQ {
+		return provider.doqQuery(ctx, msg, clientIP)
+	}
+
+	return provider.dnsMessageQuery(ctx, msg, clientIP)
+}
+
+// stripsEDNSSubnet reports whether no edns0-client-subnet is sent for msg,
+// it's removed from answers too then.
+func (provider DMProvider) stripsEDNSSubnet(msg *dns.Msg) bool {
+	mode, subnet := provider.ednsSubnetSettings(msg)
+	return mode == EDNSSubnetModeStrip || (subnet == "no" && mode != EDNSSubnetModePassthrough)
 }
 
 // urlParamsQuery sends a DNS question to Google, and returns the response.
 // endpoint: https://dns.google/resolve
-func (provider DMProvider) urlParamsQuery(msg *dns.Msg) (*dns.Msg, error) {
+func (provider DMProvider) urlParamsQuery(ctx context.Context, msg *dns.Msg, clientIP net.IP) (*dns.Msg, error) {
 	// Return fake answer (empty) if NoAAAA option is on.
 	isAAAAQuestion := false
 	if provider.opts.NoAAAA {
@@ -374,9 +1366,9 @@ func (provider DMProvider) urlParamsQuery(msg *dns.Msg) (*dns.Msg, error) {
 		}
 	}
 
-	Log.Debugf("Dns Question Msg: \n%v", msg)
+	upstreamLog.Debugf("Dns Question Msg: \n%v", msg)
 
-	httpReq, err := provider.parameterizedRequest(msg)
+	httpReq, err := provider.parameterizedRequest(ctx, msg, clientIP)
 	if err != nil {
 		return nil, err
 	}
@@ -398,17 +1390,17 @@ func (provider DMProvider) urlParamsQuery(msg *dns.Msg) (*dns.Msg, error) {
 	rMsg := new(dns.Msg)
 	err = rMsg.Unpack(rawResponse)
 	if err != nil {
-		Log.Errorf("unpack dns-message error: %v", err)
-		return nil, err
+		upstreamLog.Errorf("unpack dns-message error: %v", err)
+		return nil, fmt.Errorf("%w: %v", errUnpackResponse, err)
 	}
 	rMsg.SetReply(msg)
 
-	Log.Debugf("Dns Answer Msg: \n%v", msg)
+	upstreamLog.Debugf("Dns Answer Msg: \n%v", msg)
 
 	return rMsg, nil
 }
 
-func (provider DMProvider) dnsMessageQuery(msg *dns.Msg) (*dns.Msg, error) {
+func (provider DMProvider) dnsMessageQuery(ctx context.Context, msg *dns.Msg, clientIP net.IP) (*dns.Msg, error) {
 	// Return fake answer (empty) if NoAAAA option is on.
 	isAAAAQuestion := false
 	if provider.opts.NoAAAA {
@@ -425,119 +1417,234 @@ func (provider DMProvider) dnsMessageQuery(msg *dns.Msg) (*dns.Msg, error) {
 		}
 	}
 
-	Log.Debugf("Dns Question Msg: \n%v", msg)
+	upstreamLog.Debugf("Dns Question Msg: \n%v", msg)
 
-	ednsSubnet := ""
-	if provider.opts.EDNSSubnet == "no" {
-		//ReplaceEDNS0Subnet(msg, nil)
-		Log.Debug("will not use EDNSSubnet.")
-	} else if provider.opts.EDNSSubnet == "auto" {
-		ednsSubnet = provider.autoSubnetGetter()
-	} else {
-		ednsSubnet = provider.opts.EDNSSubnet
-		Log.Debugf("will try to use EDNSSubnet you specified: %v", provider.opts.EDNSSubnet)
+	if err := provider.setEDNSOptions(msg, clientIP); err != nil {
+		return nil, err
 	}
 
-	if ednsSubnet != "" {
-		placeSubnetToMsg(ednsSubnet, msg)
+	bytesMsg, err := msg.Pack()
+	if err != nil {
+		upstreamLog.Errorf("pack message error: %v", err)
+		return nil, err
 	}
+	upstreamLog.Debugf("request msg packed size: %v", len(bytesMsg))
 
-	pad := func(length int) {
-		paddingBytes := make([]byte, length)
-		for i := range paddingBytes {
-			paddingBytes[i] &= 0x0
-		}
-		optPadding := &dns.EDNS0_PADDING{Padding: paddingBytes}
-
-		ReplaceEDNS0Padding(msg, optPadding)
+	httpReq, err := provider.dnsMessageRequest(ctx, msg, bytesMsg, clientIP)
+	if err != nil {
+		return nil, err
 	}
 
-	// first try padding 0, then replace padding with rational value.
-	pad(0)
-	bytesMsg, err := msg.Pack()
+	httpResp, err := provider.doHTTPRequest(httpReq)
 	if err != nil {
-		Log.Errorf("pack message error: %v", err)
 		return nil, err
 	}
-	lenOfBytes := len(bytesMsg)
 
-	paddingLength := CalculatePaddingLength(lenOfBytes, 32, 16)
-	if paddingLength > 0 {
-		pad(paddingLength)
-	}
+	httpResp.Close = true
+	defer func() { _ = httpResp.Body.Close() }()
+
+	rawResponse, err := ioutil.ReadAll(httpResp.Body)
 
-	bytesMsg, err = msg.Pack()
 	if err != nil {
-		Log.Errorf("pack message error: %v", err)
 		return nil, err
 	}
-	Log.Debugf("request msg packed size: %v", len(bytesMsg))
 
-	// Http POST
-	//httpReq, err := http.NewRequest(http.MethodPost, provider.url.String(), bytes.NewBuffer(bytesMsg))
+	err = msg.Unpack(rawResponse)
+	if err != nil {
+		upstreamLog.Errorf("unpack dns-message error: %v", err)
+		return nil, fmt.Errorf("%w: %v", errUnpackResponse, err)
+	}
+	upstreamLog.Debugf("Dns Answer Msg: \n%v", msg)
 
-	// Http GET
-	httpReq, err := http.NewRequest(http.MethodGet, provider.url.String(), nil)
+	return msg, nil
+}
 
+// dnsMessageRequest builds the http request of the packed query bytesMsg, by
+// the DoH method of the provider.
+func (provider DMProvider) dnsMessageRequest(ctx context.Context, msg *dns.Msg, bytesMsg []byte,
+	clientIP net.IP) (*http.Request, error) {
+	method, body := http.MethodGet, []byte(nil)
+	if provider.opts.DoHMethod == DoHMethodPost {
+		method, body = http.MethodPost, bytesMsg
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, method, provider.url.String(), bytes.NewReader(body))
 	if err != nil {
 		return nil, err
 	}
 
-	// set headers if provided; we don't merge these for now, as we don't set any headers by default
-	if provider.opts.Headers != nil {
-		httpReq.Header = provider.opts.Headers
-	}
-	// Http GET
+	// set headers if provided, copied as the ones below are added per request.
+	httpReq.Header = provider.requestHeader(msg, clientIP)
 	httpReq.Header.Add("Accept", "application/dns-message")
-	// HTTP POST
-	//httpReq.Header.Add("Content-Type", "application/dns-message")
 
-	// Http GET
+	// add additional query parameters
+	qry := httpReq.URL.Query()
+	for k, vs := range provider.queryParameters {
+		for _, v := range vs {
+			qry.Add(k, v)
+		}
+	}
+	if method == http.MethodPost {
+		httpReq.Header.Set("Content-Type", "application/dns-message")
+		httpReq.URL.RawQuery = qry.Encode()
+		upstreamLog.Debugf("http url: %v <- body size: %v", httpReq.URL, len(body))
+		return httpReq, nil
+	}
+
 	dnsMsgBase64Url := base64.URLEncoding.WithPadding(base64.NoPadding).EncodeToString(bytesMsg)
 
-	httpReq.URL.RawQuery = fmt.Sprintf("dns=%v", dnsMsgBase64Url)
+	qry.Set("dns", dnsMsgBase64Url)
+	httpReq.URL.RawQuery = qry.Encode()
 
 	lenQuery := len([]byte(httpReq.URL.RawQuery))
 	if lenQuery > MaxBytesOfDNSMessage {
-		Log.Errorf("GET Header is too large: %v > %v", lenQuery, MaxBytesOfDNSMessage)
+		upstreamLog.Errorf("GET Header is too large: %v > %v", lenQuery, MaxBytesOfDNSMessage)
 	}
-	Log.Debugf("http url: %v <- size: %v", httpReq.URL, len([]byte(httpReq.URL.String())))
+	upstreamLog.Debugf("http url: %v <- size: %v", httpReq.URL, len([]byte(httpReq.URL.String())))
+	return httpReq, nil
+}
 
-	httpResp, err := provider.doHTTPRequest(httpReq)
-	if err != nil {
+// dotQuery sends the DNS question over a TLS connection to the endpoint.
+func (provider DMProvider) dotQuery(ctx context.Context, msg *dns.Msg, clientIP net.IP) (*dns.Msg, error) {
+	// Return fake answer (empty) if NoAAAA option is on.
+	if provider.opts.NoAAAA {
+		for _, q := range msg.Question {
+			if q.Qtype == dns.TypeAAAA {
+				msgR := new(dns.Msg)
+				msgR.SetReply(msg)
+				return msgR, nil
+			}
+		}
+	}
+
+	upstreamLog.Debugf("Dns Question Msg: \n%v", msg)
+
+	if err := provider.setEDNSOptions(msg, clientIP); err != nil {
 		return nil, err
 	}
 
-	httpResp.Close = true
-	defer func() { _ = httpResp.Body.Close() }()
+	ctx, cancel := context.WithTimeout(ctx, provider.dotClient.Timeout)
+	defer cancel()
+	// an idle connection may have been closed by the endpoint, the query is
+	// retried on a new one.
+	for {
+		dnsConn, reused := provider.dot.get(), true
+		if dnsConn == nil {
+			conn, err := provider.dialEndpoint(ctx, "tcp", provider.url.Host)
+			if err != nil {
+				upstreamLog.Errorf("dial DoT endpoint error: %v", err)
+				return nil, fmt.Errorf("dial DoT endpoint error: %w", err)
+			}
+			dnsConn, reused = &dns.Conn{Conn: tls.Client(conn, provider.tlsConfig)}, false
+		}
+		rMsg, rtt, err := provider.dotExchange(ctx, msg, dnsConn)
+		if err == nil {
+			provider.dot.put(dnsConn)
+			upstreamLog.Debugf("Dns Answer Msg: \n%v, rtt: %v", rMsg, rtt)
+			return rMsg, nil
+		}
+		_ = dnsConn.Close()
+		if ctx.Err() == context.Canceled {
+			return nil, fmt.Errorf("DoT exchange error: %w", ctx.Err())
+		}
+		if reused && ctx.Err() == nil {
+			upstreamLog.Debugf("DoT exchange on idle connection error, retrying: %v", err)
+			continue
+		}
+		upstreamLog.Errorf("DoT exchange error: %v", err)
+		return nil, fmt.Errorf("DoT exchange error: %w", err)
+	}
+}
 
-	rawResponse, err := ioutil.ReadAll(httpResp.Body)
+// dotExchange exchanges msg on dnsConn, interrupted when ctx is done.
+func (provider DMProvider) dotExchange(ctx context.Context, msg *dns.Msg, dnsConn *dns.Conn) (*dns.Msg, time.Duration, error) {
+	exchanged := make(chan bool)
+	interrupted := make(chan bool)
+	go func() {
+		defer close(interrupted)
+		select {
+		case <-ctx.Done():
+			_ = dnsConn.SetDeadline(time.Now())
+		case <-exchanged:
+		}
+	}()
+	rMsg, rtt, err := provider.dotClient.ExchangeWithConn(msg, dnsConn)
+	close(exchanged)
+	// dnsConn is reused only if not interrupted.
+	<-interrupted
+	return rMsg, rtt, err
+}
 
-	if err != nil {
-		return nil, err
+// setEDNSOptions places the edns0-client-subnet and padding options into the
+// message before wire format (dns-message or DoT) querying, the "auto" subnet
+// is of the family of clientIP.
+func (provider DMProvider) setEDNSOptions(msg *dns.Msg, clientIP net.IP) error {
+	ednsSubnet := ""
+	mode, subnet := provider.ednsSubnetSettings(msg)
+	if mode == EDNSSubnetModeStrip {
+		RemoveEDNS0Subnet(msg)
+		upstreamLog.Debug("strip EDNSSubnet.")
+	} else if mode == EDNSSubnetModePassthrough && hasEDNS0Subnet(msg) {
+		upstreamLog.Debug("will pass through EDNSSubnet of client.")
+	} else if subnet == "no" {
+		// the subnet of client isn't forwarded either.
+		RemoveEDNS0Subnet(msg)
+		upstreamLog.Debug("will not use EDNSSubnet.")
+	} else if subnet == "auto" {
+		ednsSubnet = provider.autoSubnetGetter.get(clientIP)
+	} else {
+		ednsSubnet = subnet
+		upstreamLog.Debugf("will try to use EDNSSubnet you specified: %v", subnet)
 	}
 
-	err = msg.Unpack(rawResponse)
+	if ednsSubnet != "" {
+		placeSubnetToMsg(ednsSubnet, msg)
+	}
+	if provider.opts.RequestNSID {
+		requestNSID(msg)
+	}
+
+	pad := func(length int) {
+		paddingBytes := make([]byte, length)
+		for i := range paddingBytes {
+			paddingBytes[i] &= 0x0
+		}
+		optPadding := &dns.EDNS0_PADDING{Padding: paddingBytes}
+
+		ReplaceEDNS0Padding(msg, optPadding)
+	}
+
+	blockSize := provider.opts.EDNSPadding
+	if blockSize < 0 {
+		return nil
+	}
+	if blockSize == 0 {
+		blockSize = DefaultEDNSPadding
+	}
+
+	// first try padding 0, then replace padding with rational value.
+	pad(0)
+	bytesMsg, err := msg.Pack()
 	if err != nil {
-		Log.Errorf("unpack dns-message error: %v", err)
-		return nil, err
+		upstreamLog.Errorf("pack message error: %v", err)
+		return err
 	}
-	Log.Debugf("Dns Answer Msg: \n%v", msg)
+	lenOfBytes := len(bytesMsg)
 
-	return msg, nil
+	paddingLength := CalculatePaddingLength(lenOfBytes, blockSize, blockSize)
+	if paddingLength > 0 {
+		pad(paddingLength)
+	}
+	return nil
 }
 
-func (provider DMProvider) parameterizedRequest(msg *dns.Msg) (*http.Request, error) {
-	httpReq, err := http.NewRequest(http.MethodGet, provider.url.String(), nil)
+func (provider DMProvider) parameterizedRequest(ctx context.Context, msg *dns.Msg, clientIP net.IP) (*http.Request, error) {
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, provider.url.String(), nil)
 	if err != nil {
 		return nil, err
 	}
 
-	// set headers if provided; we don't merge these for now, as we don't set
-	// any headers by default
-	if provider.opts.Headers != nil {
-		httpReq.Header = provider.opts.Headers
-	}
+	// set headers if provided, copied as templates are expanded per request.
+	httpReq.Header = provider.requestHeader(msg, clientIP)
 
 	qry := httpReq.URL.Query()
 	dnsType := fmt.Sprintf("%v", msg.Question[0].Qtype)
@@ -546,32 +1653,20 @@ func (provider DMProvider) parameterizedRequest(msg *dns.Msg) (*http.Request, er
 	qry.Add("type", dnsType)
 
 	// add additional query parameters
-	if provider.opts.QueryParameters != nil {
-		for k, vs := range provider.opts.QueryParameters {
+	if provider.queryParameters != nil {
+		for k, vs := range provider.queryParameters {
 			for _, v := range vs {
 				qry.Add(k, v)
 			}
 		}
 	}
 
-	ednsSubnet := ""
-	if provider.opts.EDNSSubnet == "no" {
-		//ReplaceEDNS0Subnet(msg, nil)
-		Log.Debug("will not use EDNSSubnet.")
-	} else if provider.opts.EDNSSubnet == "auto" {
-		ednsSubnet = provider.autoSubnetGetter()
-	} else {
-		_, _, err := net.ParseCIDR(provider.opts.EDNSSubnet)
-		if err != nil {
-			Log.Debugf("specified subnet is not OK: %v", provider.opts.EDNSSubnet)
-		}
-		Log.Debugf("will use EDNSSubnet you specified: %v", provider.opts.EDNSSubnet)
-		ednsSubnet = provider.opts.EDNSSubnet
-	}
-
-	if ednsSubnet != "" {
+	if ednsSubnet := provider.paramEDNSSubnet(msg, clientIP); ednsSubnet != "" {
 		qry.Add("edns_client_subnet", ednsSubnet)
 	}
+	if dnssecOK(msg) {
+		qry.Add("do", "1")
+	}
 
 	qry.Add("ct", ContentType)
 	httpReq.URL.RawQuery = qry.Encode()
@@ -590,93 +1685,121 @@ func (provider DMProvider) parameterizedRequest(msg *dns.Msg) (*http.Request, er
 	if lenQName > MaxBytesOfDNSName {
 		return nil, fmt.Errorf("name length of %v exceeds DNS name max length", lenQName)
 	}
-	Log.Debugf("http url: %v <- size %v", httpReq.URL, len([]byte(httpReq.URL.String())))
+	upstreamLog.Debugf("http url: %v <- size %v", httpReq.URL, len([]byte(httpReq.URL.String())))
 	return httpReq, nil
 }
 
 func (provider DMProvider) doHTTPRequest(req *http.Request) (rsp *http.Response, err error) {
+	injectTraceparent(req)
 
+	atomic.AddInt64(&upstreamActiveRequests, 1)
 	httpResp, err := provider.client.Do(req)
+	atomic.AddInt64(&upstreamActiveRequests, -1)
 
+	if err != nil && errors.Is(err, context.Canceled) {
+		return nil, fmt.Errorf("HttpRequest Error: %w", err)
+	}
 	if err != nil {
-		Log.Errorf("HttpRequest Error: %v", err)
+		upstreamLog.Errorf("HttpRequest Error: %v", err)
 		provider.client.CloseIdleConnections()
-		return nil, fmt.Errorf("HttpRequest Error: %v", err)
+		return nil, fmt.Errorf("HttpRequest Error: %w", err)
 	} else {
 		logHttpResp := func() {
 			headerKV := httpResp.Header
 			bodyBytes, _ := ioutil.ReadAll(httpResp.Body)
-			Log.Errorf("Error Header:\n%v\nError Body:\n%v", headerKV, string(bodyBytes))
+			upstreamLog.Errorf("Error Header:\n%v\nError Body:\n%v", headerKV, string(bodyBytes))
 		}
 		switch httpResp.StatusCode {
 		case 301:
 			// follow 301 redirect once.
-			Log.Warnf("301 Moved Permanently")
+			upstreamLog.Warnf("301 Moved Permanently")
 			newLocation := httpResp.Header.Get("Location")
 			logHttpResp()
 			newUrl, err := url.Parse(newLocation)
 			if err != nil {
-				Log.Warnf("parse 301 location error: %v", err)
+				upstreamLog.Warnf("parse 301 location error: %v", err)
 				return nil, err
 			}
 			// if no dns parameter, give up.
 			// refer: https://developers.google.com/speed/public-dns/docs/doh
 			dnsQ := newUrl.Query().Get("dns")
-			if dnsQ == "" {
-				Log.Warnf("301 location invalid")
+			if dnsQ == "" && req.Method == http.MethodGet {
+				upstreamLog.Warnf("301 location invalid")
 				return nil, fmt.Errorf("301 location invalid")
 			}
+			if req.GetBody != nil {
+				// the body of POST is sent again.
+				if req.Body, err = req.GetBody(); err != nil {
+					return nil, err
+				}
+			}
 			req.URL = newUrl
-			Log.Debugf("will try follow redirect url: %v", newUrl)
+			upstreamLog.Debugf("will try follow redirect url: %v", newUrl)
 			return provider.doHTTPRequest(req)
 		case 400:
 			errStr := "400 Bad Request: may be invalid DNS request"
-			Log.Errorf(errStr)
+			upstreamLog.Errorf(errStr)
 			logHttpResp()
-			return nil, fmt.Errorf(errStr)
+			return nil, &HTTPStatusError{StatusCode: httpResp.StatusCode, Message: errStr}
 		case 413:
 			errStr := "413 Payload Too Large"
-			Log.Errorf(errStr)
+			upstreamLog.Errorf(errStr)
 			logHttpResp()
-			return nil, fmt.Errorf(errStr)
+			return nil, &HTTPStatusError{StatusCode: httpResp.StatusCode, Message: errStr}
 		case 414:
 			errStr := "414 URI Too Long"
-			Log.Errorf(errStr)
+			upstreamLog.Errorf(errStr)
 			logHttpResp()
-			return nil, fmt.Errorf(errStr)
+			return nil, &HTTPStatusError{StatusCode: httpResp.StatusCode, Message: errStr}
 		case 415:
 			errStr := "415 Unsupported Media Type: " +
 				"The POST body did not have an application/dns-message Content-Type header"
-			Log.Errorf(errStr)
+			upstreamLog.Errorf(errStr)
 			logHttpResp()
-			return nil, fmt.Errorf(errStr)
+			return nil, &HTTPStatusError{StatusCode: httpResp.StatusCode, Message: errStr}
 		case 429:
 			errStr := "429 Too Many Requests: The client has sent too many requests in a given amount of time"
-			Log.Errorf(errStr)
+			upstreamLog.Errorf(errStr)
 			logHttpResp()
-			return nil, fmt.Errorf(errStr)
+			return nil, &HTTPStatusError{StatusCode: httpResp.StatusCode, Message: errStr,
+				RetryAfter: parseRetryAfter(httpResp.Header.Get("Retry-After"))}
 		case 500:
 			errStr := "500 Internal Server Error"
-			Log.Errorf(errStr)
+			upstreamLog.Errorf(errStr)
 			logHttpResp()
-			return nil, fmt.Errorf(errStr)
+			return nil, &HTTPStatusError{StatusCode: httpResp.StatusCode, Message: errStr}
 		case 501:
 			errStr := "501 Not Implemented: " +
 				"Only GET and POST methods are implemented, other methods get this error"
-			Log.Errorf(errStr)
+			upstreamLog.Errorf(errStr)
 			logHttpResp()
-			return nil, fmt.Errorf(errStr)
+			return nil, &HTTPStatusError{StatusCode: httpResp.StatusCode, Message: errStr}
 		case 502:
 			errStr := "502 Bad Gateway: The DoH service could not contact DNS resolvers"
-			Log.Errorf(errStr)
+			upstreamLog.Errorf(errStr)
 			logHttpResp()
-			return nil, fmt.Errorf(errStr)
+			return nil, &HTTPStatusError{StatusCode: httpResp.StatusCode, Message: errStr}
 		default:
+			if httpResp.StatusCode >= 500 {
+				errStr := fmt.Sprintf("%v Server Error", httpResp.StatusCode)
+				upstreamLog.Errorf(errStr)
+				logHttpResp()
+				return nil, &HTTPStatusError{StatusCode: httpResp.StatusCode, Message: errStr,
+					RetryAfter: parseRetryAfter(httpResp.Header.Get("Retry-After"))}
+			}
 			return httpResp, nil
 		}
 	}
 }
 
+func (provider *DMProvider) endpoints() []string {
+	endpoints := make([]string, 0, len(provider.upstreams))
+	for _, u := range provider.upstreams {
+		endpoints = append(endpoints, u.endpoint)
+	}
+	return endpoints
+}
+
 // resolve domain name to ips (ipv4 and ipv6) using Dns over HTTPS.
 func (provider *DMProvider) GetIPsClosure(name string) (closure func() (ip4s []string, ip16s []string)) {
 	// hijack the EDNSSubnet option with a special msg id.
@@ -688,25 +1811,20 @@ func (provider *DMProvider) GetIPsClosure(name string) (closure func() (ip4s []s
 	expireTime := time.Now().Unix()
 	qName := dns.CanonicalName(name)
 	resolve := func() {
-		opts := &DMProviderOptions{
-			EndpointIPs:     provider.opts.EndpointIPs,
-			EDNSSubnet:      "no",
-			QueryParameters: provider.opts.QueryParameters,
-			Headers:         provider.opts.Headers,
-			HTTP2:           provider.opts.HTTP2,
-			CACertFilePath:  provider.opts.CACertFilePath,
-			NoAAAA:          provider.opts.NoAAAA,
-			Alternative:     provider.opts.Alternative,
-			JSONAPI:         provider.opts.JSONAPI,
-			DnsResolver:     provider.opts.DnsResolver,
-		}
-		providerTmp, err := NewDMProvider(provider.endpoint, opts)
+		// the same options querying without the client subnet, policies
+		// sending it included.
+		o := *provider.opts
+		o.EDNSSubnet = "no"
+		o.EDNSSubnetMode = EDNSSubnetModeStrip
+		o.ECSPolicies = nil
+		opts := &o
+		providerTmp, err := NewDMProvider(provider.endpoints(), opts)
 		if err != nil {
-			Log.Errorf("can't get new provider: %v", err)
+			upstreamLog.Errorf("can't get new provider: %v", err)
 			return
 		}
 		if providerTmp == nil {
-			Log.Errorf("temporary provider is nil")
+			upstreamLog.Errorf("temporary provider is nil")
 			return
 		}
 		m4.SetQuestion(qName, dns.TypeA)
@@ -766,7 +1884,7 @@ func (provider *DMProvider) GetIPsClosure(name string) (closure func() (ip4s []s
 	}
 }
 
-func (provider DMProvider) jsonQuery(msg *dns.Msg) (*dns.Msg, error) {
+func (provider DMProvider) jsonQuery(ctx context.Context, msg *dns.Msg, clientIP net.IP) (*dns.Msg, error) {
 	// Return fake answer (empty) if NoAAAA option is on.
 	isAAAAQuestion := false
 	if provider.opts.NoAAAA {
@@ -784,9 +1902,9 @@ func (provider DMProvider) jsonQuery(msg *dns.Msg) (*dns.Msg, error) {
 		}
 	}
 
-	Log.Debugf("Dns Question Msg: \n%v", msg)
+	upstreamLog.Debugf("Dns Question Msg: \n%v", msg)
 
-	httpReq, err := provider.parameterizedRequest2(msg)
+	httpReq, err := provider.parameterizedRequest2(ctx, msg, clientIP)
 	if err != nil {
 		return nil, err
 	}
@@ -806,13 +1924,13 @@ func (provider DMProvider) jsonQuery(msg *dns.Msg) (*dns.Msg, error) {
 	if err != nil && json_.Answer == nil && json_.Authority == nil {
 		headerKV := httpResp.Header
 		bodyBytes, _ := ioutil.ReadAll(httpResp.Body)
-		Log.Errorf("Error json decoding Header:\n%v\nError Body:\n%v", headerKV, string(bodyBytes))
-		return nil, fmt.Errorf("json decoding error")
+		upstreamLog.Errorf("Error json decoding Header:\n%v\nError Body:\n%v", headerKV, string(bodyBytes))
+		return nil, fmt.Errorf("%w: json decoding error", errUnpackResponse)
 	}
 
 	rMsg := provider.obtainDMFromJSON(json_, msg)
 
-	Log.Debugf("Dns Answer Msg: \n%v", rMsg)
+	upstreamLog.Debugf("Dns Answer Msg: \n%v", rMsg)
 
 	return rMsg, nil
 }
@@ -828,11 +1946,41 @@ type DNSRR struct {
 // GDNSRRs represents an array of GDNSRR objects
 type DNSRRs []DNSRR
 
-// RR transforms a DNSRR to a dns.RR
+// RR transforms a DNSRR to a dns.RR, the data is in presentation format;
+// unquoted TXT data is taken as one string, names not ending with a dot are
+// taken as absolute.
 func (r DNSRR) RR() (dns.RR, error) {
-	hdr := dns.RR_Header{Name: r.Name, Rrtype: r.Type, Class: dns.ClassINET, Ttl: r.TTL}
-	str := hdr.String() + r.Data
-	return dns.NewRR(str)
+	hdr := dns.RR_Header{Name: dns.Fqdn(r.Name), Rrtype: r.Type, Class: dns.ClassINET, Ttl: r.TTL}
+	data := strings.TrimSpace(r.Data)
+	if (r.Type == dns.TypeTXT || r.Type == dns.TypeSPF) && !strings.HasPrefix(data, `"`) {
+		data = quoteTXTData(data)
+	}
+	rr, err := dns.NewRR(hdr.String() + data)
+	if err != nil {
+		return nil, err
+	}
+	if rr == nil {
+		return nil, fmt.Errorf("empty data of %v record", dns.TypeToString[r.Type])
+	}
+	return rr, nil
+}
+
+// quoteTXTData quotes the text data as the character strings of a TXT record,
+// split by the limit of 255 bytes.
+func quoteTXTData(data string) string {
+	var quoted []string
+	for {
+		chunk := data
+		if len(chunk) > 255 {
+			chunk = chunk[:255]
+		}
+		data = data[len(chunk):]
+		chunk = strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(chunk)
+		quoted = append(quoted, `"`+chunk+`"`)
+		if data == "" {
+			return strings.Join(quoted, " ")
+		}
+	}
 }
 
 // DNSQuestion represents a DNS question to be resolved by a DNS server
@@ -858,17 +2006,14 @@ type JSONDNSResponse struct {
 	Comment          string       `json:"Comment,omitempty"`
 }
 
-func (provider DMProvider) parameterizedRequest2(msg *dns.Msg) (*http.Request, error) {
-	httpReq, err := http.NewRequest(http.MethodGet, provider.url.String(), nil)
+func (provider DMProvider) parameterizedRequest2(ctx context.Context, msg *dns.Msg, clientIP net.IP) (*http.Request, error) {
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, provider.url.String(), nil)
 	if err != nil {
 		return nil, err
 	}
 
-	// set headers if provided; we don't merge these for now, as we don't set
-	// any headers by default
-	if provider.opts.Headers != nil {
-		httpReq.Header = provider.opts.Headers
-	}
+	// set headers if provided, copied as templates are expanded per request.
+	httpReq.Header = provider.requestHeader(msg, clientIP)
 
 	httpReq.Header.Add("Accept", "application/json")
 
@@ -879,32 +2024,21 @@ func (provider DMProvider) parameterizedRequest2(msg *dns.Msg) (*http.Request, e
 	qry.Add("type", dnsType)
 
 	// add additional query parameters
-	if provider.opts.QueryParameters != nil {
-		for k, vs := range provider.opts.QueryParameters {
+	if provider.queryParameters != nil {
+		for k, vs := range provider.queryParameters {
 			for _, v := range vs {
 				qry.Add(k, v)
 			}
 		}
 	}
 
-	ednsSubnet := ""
-	if provider.opts.EDNSSubnet == "no" {
-		//ReplaceEDNS0Subnet(msg, nil)
-		Log.Debug("will not use EDNSSubnet.")
-	} else if provider.opts.EDNSSubnet == "auto" {
-		ednsSubnet = provider.autoSubnetGetter()
-	} else {
-		_, _, err := net.ParseCIDR(provider.opts.EDNSSubnet)
-		if err != nil {
-			Log.Debugf("specified subnet is not OK: %v", provider.opts.EDNSSubnet)
-		}
-		Log.Debugf("will use EDNSSubnet you specified: %v", provider.opts.EDNSSubnet)
-		ednsSubnet = provider.opts.EDNSSubnet
-	}
-
-	if ednsSubnet != "" {
+	if ednsSubnet := provider.paramEDNSSubnet(msg, clientIP); ednsSubnet != "" {
 		qry.Add("edns_client_subnet", ednsSubnet)
 	}
+	if dnssecOK(msg) {
+		// DNSSEC records are answered then.
+		qry.Add("do", "1")
+	}
 
 	httpReq.URL.RawQuery = qry.Encode()
 
@@ -922,31 +2056,29 @@ func (provider DMProvider) parameterizedRequest2(msg *dns.Msg) (*http.Request, e
 	if lenQName > MaxBytesOfDNSName {
 		return nil, fmt.Errorf("name length of %v exceeds DNS name max length", lenQName)
 	}
-	Log.Debugf("http url: %v <- size %v", httpReq.URL, len([]byte(httpReq.URL.String())))
+	upstreamLog.Debugf("http url: %v <- size %v", httpReq.URL, len([]byte(httpReq.URL.String())))
 	return httpReq, nil
 }
 
 func (provider DMProvider) obtainDMFromJSON(json_ *JSONDNSResponse, qMsg *dns.Msg) *dns.Msg {
-	rMsg := new (dns.Msg)
+	rMsg := new(dns.Msg)
+	// the flags and rcode are set after, SetReply resets the rcode.
+	rMsg.SetReply(qMsg)
 	rMsg.Truncated = json_.TC
 	rMsg.RecursionDesired = json_.RD
-	rMsg.RecursionAvailable = json_.AD
+	rMsg.RecursionAvailable = json_.RA
 	rMsg.AuthenticatedData = json_.AD
 	rMsg.CheckingDisabled = json_.CD
 	rMsg.Rcode = int(json_.Status)
 
-	answers := transformRR(json_.Answer, "answer")
-	authorities := transformRR(json_.Authority, "authority")
-
 	if json_.Comment != "" {
-		Log.Infof(json_.Comment)
+		upstreamLog.Infof(json_.Comment)
 	}
 
-	rMsg.Answer = answers
-	rMsg.Ns = authorities
-
-	msg_ := rMsg.SetReply(qMsg)
-	return msg_
+	rMsg.Answer = transformRR(json_.Answer, "answer")
+	rMsg.Ns = transformRR(json_.Authority, "authority")
+	rMsg.Extra = transformRR(json_.Additional, "additional")
+	return rMsg
 }
 
 // for a given []DNSRR, transform to dns.RR, logging if any errors occur
@@ -954,8 +2086,12 @@ func transformRR(rrs []DNSRR, logType string) []dns.RR {
 	var t []dns.RR
 
 	for _, r := range rrs {
+		if r.Type == dns.TypeOPT {
+			// edns is answered by the handler.
+			continue
+		}
 		if rr, err := r.RR(); err != nil {
-			Log.Errorln("unable to translate record rr", logType, r, err)
+			upstreamLog.Errorln("unable to translate record rr", logType, r, err)
 		} else {
 			t = append(t, rr)
 		}
@@ -964,10 +2100,42 @@ func transformRR(rrs []DNSRR, logType string) []dns.RR {
 	return t
 }
 
+// paramEDNSSubnet returns the subnet of the edns_client_subnet parameter for
+// querying msg by url parameters for clientIP, "" if not to send.
+func (provider DMProvider) paramEDNSSubnet(msg *dns.Msg, clientIP net.IP) string {
+	mode, subnet := provider.ednsSubnetSettings(msg)
+	switch mode {
+	case EDNSSubnetModeStrip:
+		upstreamLog.Debug("strip EDNSSubnet.")
+		return ""
+	case EDNSSubnetModePassthrough:
+		if hasEDNS0Subnet(msg) {
+			subnet := ObtainEDN0Subnet(msg)
+			upstreamLog.Debug("will pass through EDNSSubnet of client.")
+			return fmt.Sprintf("%v/%v", subnet.Address, subnet.SourceNetmask)
+		}
+	}
+
+	ednsSubnet := ""
+	if subnet == "no" {
+		upstreamLog.Debug("will not use EDNSSubnet.")
+	} else if subnet == "auto" {
+		ednsSubnet = provider.autoSubnetGetter.get(clientIP)
+	} else {
+		_, _, err := net.ParseCIDR(subnet)
+		if err != nil {
+			upstreamLog.Debugf("specified subnet is not OK: %v", subnet)
+		}
+		upstreamLog.Debugf("will use EDNSSubnet you specified: %v", subnet)
+		ednsSubnet = subnet
+	}
+	return ednsSubnet
+}
+
 func placeSubnetToMsg(subnet string, msg *dns.Msg) {
 	_, ipNet, err := net.ParseCIDR(subnet)
 	if err != nil {
-		Log.Debugf("subnet is not OK: %v", subnet)
+		upstreamLog.Debugf("subnet is not OK: %v", subnet)
 	} else {
 		mask := ipNet.Mask
 		// mask bits count.
@@ -997,7 +2165,7 @@ func CalculatePaddingLength(preAllocatedLen int, least int, gain int) int {
 		nextDesireTotalLen := least + i*gain
 		if nextDesireTotalLen >= preAllocatedLen {
 			paddingLength = nextDesireTotalLen - preAllocatedLen
-			Log.Debugf("padding length: %v", paddingLength)
+			upstreamLog.Debugf("padding length: %v", paddingLength)
 			break
 		}
 	}
@@ -1,12 +1,31 @@
 package dohProxy
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"io"
+	"io/ioutil"
+	mathBig "math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/miekg/dns"
 )
@@ -34,7 +53,7 @@ func TestQuery(t *testing.T) {
 	}))
 	defer ts.Close()
 
-	_, err := NewDMProvider(ts.URL, nil)
+	_, err := NewDMProvider([]string{ts.URL}, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -60,7 +79,7 @@ func TestEDNS(t *testing.T) {
 	}))
 	defer ts.Close()
 
-	_, err := NewDMProvider(ts.URL, &DMProviderOptions{
+	_, err := NewDMProvider([]string{ts.URL}, &DMProviderOptions{
 		EDNSSubnet:          "64.10.0.0/20",
 	})
 	if err != nil {
@@ -88,7 +107,7 @@ func TestEDNSOmittedWhenBlank(t *testing.T) {
 	}))
 	defer ts.Close()
 
-	_, err := NewDMProvider(ts.URL, &DMProviderOptions{
+	_, err := NewDMProvider([]string{ts.URL}, &DMProviderOptions{
 		EDNSSubnet:          "",
 	})
 	if err != nil {
@@ -117,10 +136,1390 @@ func TestEDNSIgnoredByDefault(t *testing.T) {
 	}))
 	defer ts.Close()
 
-	_, err := NewDMProvider(ts.URL, &DMProviderOptions{
+	_, err := NewDMProvider([]string{ts.URL}, &DMProviderOptions{
 		EDNSSubnet: "64.10.0.0/20",
 	})
 	if err != nil {
 		t.Fatal(err)
 	}
 }
+
+// newTestCert generates a self-signed certificate for host and 127.0.0.1,
+// returns the certificate and the path of a PEM file for CACertFilePath.
+func newTestCert(t *testing.T, host string) (tls.Certificate, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          mathBig.NewInt(1),
+		Subject:               pkix.Name{CommonName: host},
+		DNSNames:              []string{host},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "doh-proxy-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := ioutil.WriteFile(caFile, certPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return cert, caFile
+}
+
+func TestDoTQuery(t *testing.T) {
+	cert, caFile := newTestCert(t, "dot.test")
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &dns.Server{Listener: l, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		rr, _ := dns.NewRR(r.Question[0].Name + " 300 IN A 93.184.216.34")
+		m.Answer = append(m.Answer, rr)
+		_ = w.WriteMsg(m)
+	})}
+	go func() { _ = server.ActivateAndServe() }()
+	defer func() { _ = server.Shutdown() }()
+
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	provider, err := NewDMProvider([]string{"tls://dot.test:" + port}, &DMProviderOptions{
+		Protocol:       ProtocolDoT,
+		EndpointIPs:    []net.IP{net.ParseIP("127.0.0.1")},
+		CACertFilePath: caFile,
+		EDNSSubnet:     "no",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	rMsg, err := provider.Query(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rMsg.Answer) != 1 {
+		t.Fatalf("expected 1 answer, got: %v", rMsg)
+	}
+	if a, ok := rMsg.Answer[0].(*dns.A); !ok || a.A.String() != "93.184.216.34" {
+		t.Errorf("unexpected answer: %v", rMsg.Answer[0])
+	}
+}
+
+func TestParseDoTEndpoint(t *testing.T) {
+	cases := map[string]string{
+		"tls://dns.google":             "dns.google:853",
+		"tls://dns.google:8853":        "dns.google:8853",
+		"dns.google":                   "dns.google:853",
+		"1.1.1.1:853":                  "1.1.1.1:853",
+		"https://dns.google/dns-query": "dns.google:853",
+	}
+	for endpoint, expected := range cases {
+		u, err := parseDoTEndpoint(endpoint)
+		if err != nil {
+			t.Errorf("parse %v error: %v", endpoint, err)
+			continue
+		}
+		if u.Host != expected {
+			t.Errorf("parse %v: expected %v, got %v", endpoint, expected, u.Host)
+		}
+	}
+}
+
+// newDoHTestServer serves dns-message queries, answering with rcode, or with
+// status if it's not http.StatusOK; queries are counted in hits.
+func newDoHTestServer(t *testing.T, status int, rcode int, hits *int32) *httptest.Server {
+	return httptest.NewServer(newDoHTestHandler(t, status, rcode, hits))
+}
+
+func newDoHTestHandler(t *testing.T, status int, rcode int, hits *int32) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(hits, 1)
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+		raw, err := base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		if err != nil {
+			t.Errorf("decode dns parameter error: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		req := new(dns.Msg)
+		if err := req.Unpack(raw); err != nil {
+			t.Errorf("unpack query error: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		m := new(dns.Msg)
+		m.SetRcode(req, rcode)
+		if rcode == dns.RcodeSuccess {
+			rr, _ := dns.NewRR(req.Question[0].Name + " 300 IN A 93.184.216.34")
+			m.Answer = append(m.Answer, rr)
+		}
+		bytesMsg, _ := m.Pack()
+		w.Header().Set("Content-Type", ContentType)
+		_, _ = w.Write(bytesMsg)
+	})
+}
+
+func TestFailover(t *testing.T) {
+	var hitsFailed, hitsOK int32
+	tsFailed := newDoHTestServer(t, http.StatusInternalServerError, dns.RcodeSuccess, &hitsFailed)
+	defer tsFailed.Close()
+	tsOK := newDoHTestServer(t, http.StatusOK, dns.RcodeSuccess, &hitsOK)
+	defer tsOK.Close()
+
+	provider, err := NewDMProvider([]string{tsFailed.URL, tsOK.URL}, &DMProviderOptions{EDNSSubnet: "no"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	rMsg, err := provider.Query(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rMsg.Answer) != 1 {
+		t.Errorf("expected answer from the second endpoint, got: %v", rMsg)
+	}
+	if hitsFailed != 1 || hitsOK != 1 {
+		t.Errorf("expected each endpoint queried once, got: %v, %v", hitsFailed, hitsOK)
+	}
+	if failures := provider.upstreams[0].failures; failures != 1 {
+		t.Errorf("expected 1 consecutive failure of the first endpoint, got: %v", failures)
+	}
+	if failures := provider.upstreams[1].failures; failures != 0 {
+		t.Errorf("expected no failure of the second endpoint, got: %v", failures)
+	}
+}
+
+func TestFailoverNotOnNXDomain(t *testing.T) {
+	var hitsNX, hitsOK int32
+	tsNX := newDoHTestServer(t, http.StatusOK, dns.RcodeNameError, &hitsNX)
+	defer tsNX.Close()
+	tsOK := newDoHTestServer(t, http.StatusOK, dns.RcodeSuccess, &hitsOK)
+	defer tsOK.Close()
+
+	provider, err := NewDMProvider([]string{tsNX.URL, tsOK.URL}, &DMProviderOptions{EDNSSubnet: "no"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("nx.example.com.", dns.TypeA)
+	rMsg, err := provider.Query(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rMsg.Rcode != dns.RcodeNameError {
+		t.Errorf("expected NXDOMAIN, got: %v", dns.RcodeToString[rMsg.Rcode])
+	}
+	if hitsOK != 0 {
+		t.Errorf("NXDOMAIN should not fall over to the next endpoint")
+	}
+}
+
+func TestRaceStrategy(t *testing.T) {
+	cancelled := make(chan bool, 1)
+	tsSlow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			cancelled <- true
+		case <-time.After(5 * time.Second):
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer tsSlow.Close()
+	var hitsFast int32
+	tsFast := newDoHTestServer(t, http.StatusOK, dns.RcodeSuccess, &hitsFast)
+	defer tsFast.Close()
+
+	provider, err := NewDMProvider([]string{tsSlow.URL, tsFast.URL}, &DMProviderOptions{
+		EDNSSubnet: "no",
+		Strategy:   StrategyRace,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	startTime := time.Now()
+	rMsg, err := provider.Query(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(startTime); elapsed > time.Second {
+		t.Errorf("slow endpoint should not delay the answer, took: %v", elapsed)
+	}
+	if len(rMsg.Answer) != 1 {
+		t.Errorf("expected answer from the fast endpoint, got: %v", rMsg)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Errorf("query to the slow endpoint should be cancelled")
+	}
+	if failures := provider.upstreams[0].failures; failures != 0 {
+		t.Errorf("cancelled query should not count as failure, got: %v", failures)
+	}
+}
+
+func TestUpstreamTimeout(t *testing.T) {
+	tsSlow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer tsSlow.Close()
+
+	provider, err := NewDMProvider([]string{tsSlow.URL}, &DMProviderOptions{
+		EDNSSubnet:      "no",
+		UpstreamTimeout: 100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := NewHandler(provider, &HandlerOptions{})
+
+	writer := newTestResponseWriter("192.0.2.1:5353")
+	msg := new(dns.Msg)
+	msg.SetQuestion("slow.example.com.", dns.TypeA)
+	startTime := time.Now()
+	handler.Handle(writer, msg)
+	rMsg := writer.waitMsg(t, time.Second)
+	if rMsg.Rcode != dns.RcodeServerFailure {
+		t.Errorf("expected SERVFAIL on timeout, got: %v", dns.RcodeToString[rMsg.Rcode])
+	}
+	if elapsed := time.Since(startTime); elapsed > time.Second {
+		t.Errorf("timeout should be answered promptly, took: %v", elapsed)
+	}
+}
+
+func TestUpstreamRetries(t *testing.T) {
+	var hits int32
+	ok := newDoHTestHandler(t, http.StatusOK, dns.RcodeSuccess, &hits)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&hits) < 2 {
+			atomic.AddInt32(&hits, 1)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		ok.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	provider, err := NewDMProvider([]string{ts.URL}, &DMProviderOptions{
+		EDNSSubnet:      "no",
+		UpstreamTimeout: 2 * time.Second,
+		Retries:         2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := new(dns.Msg)
+	msg.SetQuestion("retry.example.com.", dns.TypeA)
+	startTime := time.Now()
+	rMsg, err := provider.Query(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rMsg.Answer) != 1 || hits != 3 {
+		t.Errorf("expected answer after 2 retries, hits: %v, got: %v", hits, rMsg)
+	}
+	// backoff of 2 retries is under 100ms + 200ms.
+	if elapsed := time.Since(startTime); elapsed > time.Second {
+		t.Errorf("retries should be within the budget, took: %v", elapsed)
+	}
+	if failures := provider.upstreams[0].failures; failures != 0 {
+		t.Errorf("retried query should not count as failure, got: %v", failures)
+	}
+
+	var hitsNX int32
+	tsNX := newDoHTestServer(t, http.StatusOK, dns.RcodeNameError, &hitsNX)
+	defer tsNX.Close()
+	provider, err = NewDMProvider([]string{tsNX.URL}, &DMProviderOptions{EDNSSubnet: "no", Retries: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := provider.Query(msg); err != nil || hitsNX != 1 {
+		t.Errorf("NXDOMAIN should not be retried, hits: %v, error: %v", hitsNX, err)
+	}
+}
+
+func TestUpstreamRetries_LongRetryAfter(t *testing.T) {
+	var hitsBusy, hits int32
+	busy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hitsBusy, 1)
+		w.Header().Set("Retry-After", "3600")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer busy.Close()
+	ts := newDoHTestServer(t, http.StatusOK, dns.RcodeSuccess, &hits)
+	defer ts.Close()
+
+	// no upstream timeout bounding the backoff.
+	provider, err := NewDMProvider([]string{busy.URL, ts.URL}, &DMProviderOptions{
+		EDNSSubnet: "no",
+		Retries:    2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := new(dns.Msg)
+	msg.SetQuestion("retry-after.example.com.", dns.TypeA)
+	startTime := time.Now()
+	rMsg, err := provider.Query(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rMsg.Answer) != 1 || hitsBusy != 1 || hits != 1 {
+		t.Errorf("expected failing over without retry, hits: %v %v, got: %v", hitsBusy, hits, rMsg)
+	}
+	if elapsed := time.Since(startTime); elapsed > time.Second {
+		t.Errorf("long Retry-After should not be waited for, took: %v", elapsed)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	if d := parseRetryAfter("3"); d != 3*time.Second {
+		t.Errorf("expected 3s, got: %v", d)
+	}
+	date := time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)
+	if d := parseRetryAfter(date); d <= 0 || d > time.Minute {
+		t.Errorf("expected within 1m, got: %v", d)
+	}
+	if d := parseRetryAfter("soon"); d != 0 {
+		t.Errorf("expected 0 for invalid value, got: %v", d)
+	}
+}
+
+// BenchmarkDMProvider_MaxConns compares parallel queries to an endpoint with
+// 1ms latency, by the connections allowed.
+func BenchmarkDMProvider_MaxConns(b *testing.B) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Millisecond)
+		raw, _ := base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		req := new(dns.Msg)
+		_ = req.Unpack(raw)
+		m := new(dns.Msg)
+		m.SetReply(req)
+		bytesMsg, _ := m.Pack()
+		w.Header().Set("Content-Type", ContentType)
+		_, _ = w.Write(bytesMsg)
+	}))
+	defer ts.Close()
+
+	for _, maxConns := range []int{2, DefaultUpstreamMaxConns} {
+		b.Run(fmt.Sprintf("max-conns=%v", maxConns), func(b *testing.B) {
+			provider, err := NewDMProvider([]string{ts.URL}, &DMProviderOptions{EDNSSubnet: "no", MaxConns: maxConns})
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.SetParallelism(16)
+			b.RunParallel(func(pb *testing.PB) {
+				msg := new(dns.Msg)
+				msg.SetQuestion("example.com.", dns.TypeA)
+				for pb.Next() {
+					if _, err := provider.Query(msg); err != nil {
+						b.Error(err)
+					}
+				}
+			})
+			provider.client.CloseIdleConnections()
+		})
+	}
+}
+
+func TestBootstrapResolver(t *testing.T) {
+	var hits, failing int32
+	var ip atomic.Value
+	ip.Store("192.0.2.1")
+	stub := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		if r.Question[0].Qtype == dns.TypeA {
+			atomic.AddInt32(&hits, 1)
+			if atomic.LoadInt32(&failing) == 1 {
+				m.Rcode = dns.RcodeServerFailure
+			} else {
+				rr, _ := dns.NewRR(r.Question[0].Name + " 60 IN A " + ip.Load().(string))
+				m.Answer = append(m.Answer, rr)
+			}
+		}
+		_ = w.WriteMsg(m)
+	})
+	resolver, err := newBootstrapResolver(startPlainTestServer(t, stub))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := &fakeClock{t: time.Now()}
+	resolver.now = clock.now
+	name := "doh.example.com."
+	lookup := func() string {
+		ip4s, _ := resolver.lookup(name)
+		if len(ip4s) != 1 {
+			t.Fatalf("expected 1 ip, got: %v", ip4s)
+		}
+		return ip4s[0]
+	}
+	waitRefreshed := func() {
+		for i := 0; i < 100; i++ {
+			resolver.lock.Lock()
+			refreshing := resolver.hosts[name].refreshing
+			resolver.lock.Unlock()
+			if !refreshing {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatal("refreshing not finished")
+	}
+
+	lookup()
+	clock.advance(30 * time.Second)
+	if got := lookup(); got != "192.0.2.1" || atomic.LoadInt32(&hits) != 1 {
+		t.Errorf("ip should be reused within ttl, got: %v, hits: %v", got, hits)
+	}
+
+	ip.Store("192.0.2.2")
+	clock.advance(31 * time.Second)
+	if got := lookup(); got != "192.0.2.1" {
+		t.Errorf("expired ip should be used while refreshing, got: %v", got)
+	}
+	waitRefreshed()
+	if got := lookup(); got != "192.0.2.2" || atomic.LoadInt32(&hits) != 2 {
+		t.Errorf("ip should be re-resolved after expiry, got: %v, hits: %v", got, hits)
+	}
+
+	atomic.StoreInt32(&failing, 1)
+	clock.advance(61 * time.Second)
+	lookup()
+	waitRefreshed()
+	if got := lookup(); got != "192.0.2.2" || atomic.LoadInt32(&hits) != 3 {
+		t.Errorf("last ip should be kept when refreshing failed, got: %v, hits: %v", got, hits)
+	}
+}
+
+func TestHappyEyeballs(t *testing.T) {
+	var hits int32
+	ts := newDoHTestServer(t, http.StatusOK, dns.RcodeSuccess, &hits)
+	defer ts.Close()
+	_, port, _ := net.SplitHostPort(ts.Listener.Addr().String())
+
+	// 100::1 is in the discard prefix, RFC 6666.
+	provider, err := NewDMProvider([]string{"http://doh.example:" + port + "/dns-query"}, &DMProviderOptions{
+		EDNSSubnet:  "no",
+		EndpointIPs: []net.IP{net.ParseIP("100::1"), net.ParseIP("127.0.0.1")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	startTime := time.Now()
+	if _, err := provider.Query(msg); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(startTime); elapsed > time.Second {
+		t.Errorf("blackholed ipv6 should not delay the answer, took: %v", elapsed)
+	}
+
+	ordered := happyEyeballsOrder([]string{"192.0.2.1", "192.0.2.2", "2001:db8::1"})
+	if len(ordered) != 3 || ordered[0] != "2001:db8::1" || net.ParseIP(ordered[1]).To4() == nil {
+		t.Errorf("expected ipv6 first then interleaved, got: %v", ordered)
+	}
+}
+
+func TestRoundRobinStrategy(t *testing.T) {
+	provider, err := NewDMProvider([]string{"https://a.example", "https://b.example"}, &DMProviderOptions{
+		EDNSSubnet: "no",
+		Strategy:   StrategyRoundRobin,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"https://a.example", "https://b.example", "https://a.example"} {
+		if u := provider.roundRobinUpstreams()[0]; u.endpoint != expected {
+			t.Errorf("expected start from %v, got: %v", expected, u.endpoint)
+		}
+	}
+	if _, err := NewDMProvider([]string{"https://a.example"}, &DMProviderOptions{Strategy: "random"}); err == nil {
+		t.Errorf("expected error for unknown strategy")
+	}
+}
+
+// socks5TestServer is a minimal SOCKS5 server requiring user/password
+// authentication, names are resolved by resolve.
+type socks5TestServer struct {
+	listener net.Listener
+	user     string
+	password string
+	resolve  map[string]string
+	// targets requested by clients.
+	targets chan string
+}
+
+func newSocks5TestServer(t *testing.T, user, password string, resolve map[string]string) *socks5TestServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &socks5TestServer{listener: l, user: user, password: password, resolve: resolve, targets: make(chan string, 16)}
+	t.Cleanup(func() { _ = l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *socks5TestServer) serve(conn net.Conn) {
+	defer func() { _ = conn.Close() }()
+	buf := make([]byte, 256)
+	// greeting: version, methods; choose user/password.
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil || buf[0] != 5 {
+		return
+	}
+	if _, err := io.ReadFull(conn, buf[:buf[1]]); err != nil {
+		return
+	}
+	_, _ = conn.Write([]byte{5, 2})
+	// user/password sub-negotiation.
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return
+	}
+	user := make([]byte, buf[1])
+	if _, err := io.ReadFull(conn, user); err != nil {
+		return
+	}
+	if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+		return
+	}
+	password := make([]byte, buf[0])
+	if _, err := io.ReadFull(conn, password); err != nil {
+		return
+	}
+	if string(user) != s.user || string(password) != s.password {
+		_, _ = conn.Write([]byte{1, 1})
+		return
+	}
+	_, _ = conn.Write([]byte{1, 0})
+	// connect request.
+	if _, err := io.ReadFull(conn, buf[:4]); err != nil || buf[1] != 1 {
+		return
+	}
+	var host string
+	switch buf[3] {
+	case 1:
+		if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+			return
+		}
+		host = net.IP(buf[:4]).String()
+	case 3:
+		if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+			return
+		}
+		name := make([]byte, buf[0])
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return
+		}
+		host = string(name)
+	default:
+		return
+	}
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return
+	}
+	port := strconv.Itoa(int(buf[0])<<8 | int(buf[1]))
+	s.targets <- net.JoinHostPort(host, port)
+	if ip, ok := s.resolve[host]; ok {
+		host = ip
+	}
+	target, err := net.Dial("tcp", net.JoinHostPort(host, port))
+	if err != nil {
+		_, _ = conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer func() { _ = target.Close() }()
+	_, _ = conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	go func() { _, _ = io.Copy(target, conn) }()
+	_, _ = io.Copy(conn, target)
+}
+
+func TestSocks5Proxy(t *testing.T) {
+	var hits int32
+	ts := newDoHTestServer(t, http.StatusOK, dns.RcodeSuccess, &hits)
+	defer ts.Close()
+	_, port, _ := net.SplitHostPort(ts.Listener.Addr().String())
+	socks := newSocks5TestServer(t, "user", "pass", map[string]string{"doh.test": "127.0.0.1"})
+
+	provider, err := NewDMProvider([]string{"http://doh.test:" + port + "/dns-query"}, &DMProviderOptions{
+		EDNSSubnet: "no",
+		Proxy:      "socks5://user:pass@" + socks.listener.Addr().String(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	rMsg, err := provider.Query(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rMsg.Answer) != 1 {
+		t.Errorf("unexpected answer: %v", rMsg)
+	}
+	select {
+	case target := <-socks.targets:
+		if target != "doh.test:"+port {
+			t.Errorf("endpoint name should be resolved by proxy, got target: %v", target)
+		}
+	default:
+		t.Errorf("request should traverse the proxy")
+	}
+
+	// the proxy connects to the pinned endpoint ips.
+	provider, err = NewDMProvider([]string{"http://doh.test:" + port + "/dns-query"}, &DMProviderOptions{
+		EDNSSubnet:  "no",
+		EndpointIPs: []net.IP{net.ParseIP("127.0.0.1")},
+		Proxy:       "socks5://user:pass@" + socks.listener.Addr().String(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := provider.Query(msg); err != nil {
+		t.Fatal(err)
+	}
+	if target := <-socks.targets; target != "127.0.0.1:"+port {
+		t.Errorf("proxy should connect to endpoint ips, got target: %v", target)
+	}
+
+	if _, err := NewDMProvider([]string{ts.URL}, &DMProviderOptions{Proxy: "http://127.0.0.1:8080"}); err == nil {
+		t.Errorf("expected error for unsupported proxy")
+	}
+}
+
+func TestFallbackResolver(t *testing.T) {
+	var hits int32
+	ts := newDoHTestServer(t, http.StatusOK, dns.RcodeSuccess, &hits)
+	// endpoint unreachable.
+	ts.Close()
+	fallback := newPlainTestServer(t, "udp", "10.0.0.1")
+
+	provider, err := NewDMProvider([]string{ts.URL}, &DMProviderOptions{
+		EDNSSubnet:       "no",
+		FallbackResolver: fallback,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	rMsg, err := provider.Query(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a, ok := rMsg.Answer[0].(*dns.A); !ok || a.A.String() != "10.0.0.1" {
+		t.Errorf("expected answer from fallback resolver, got: %v", rMsg)
+	}
+
+	// not falling back on http errors.
+	tsFailed := newDoHTestServer(t, http.StatusBadGateway, dns.RcodeSuccess, &hits)
+	defer tsFailed.Close()
+	provider, err = NewDMProvider([]string{tsFailed.URL}, &DMProviderOptions{
+		EDNSSubnet:       "no",
+		FallbackResolver: fallback,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg.SetQuestion("example.com.", dns.TypeA)
+	if _, err := provider.Query(msg); err == nil {
+		t.Errorf("http error should not fall back to plain dns")
+	}
+}
+
+func TestEDNSSubnetMode(t *testing.T) {
+	clientSubnet := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24,
+		Address: net.ParseIP("198.51.100.0").To4()}
+	cases := []struct {
+		mode      string
+		clientECS bool
+		expected  string
+	}{
+		{EDNSSubnetModeGlobal, false, "64.10.0.0/20"},
+		{EDNSSubnetModeGlobal, true, "64.10.0.0/20"},
+		{EDNSSubnetModePassthrough, false, "64.10.0.0/20"},
+		{EDNSSubnetModePassthrough, true, "198.51.100.0/24"},
+		{EDNSSubnetModeStrip, false, ""},
+		{EDNSSubnetModeStrip, true, ""},
+	}
+	for _, c := range cases {
+		provider, err := NewDMProvider([]string{"https://dns.example/dns-query"}, &DMProviderOptions{
+			EDNSSubnet:     "64.10.0.0/20",
+			EDNSSubnetMode: c.mode,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		newMsg := func() *dns.Msg {
+			msg := new(dns.Msg)
+			msg.SetQuestion("example.com.", dns.TypeA)
+			if c.clientECS {
+				msg.SetEdns0(dns.DefaultMsgSize, false)
+				ReplaceEDNS0Subnet(msg, clientSubnet)
+			}
+			return msg
+		}
+
+		// wire format.
+		msg := newMsg()
+		if err := provider.setEDNSOptions(msg, nil); err != nil {
+			t.Fatal(err)
+		}
+		sent := ""
+		if hasEDNS0Subnet(msg) {
+			subnet := ObtainEDN0Subnet(msg)
+			sent = fmt.Sprintf("%v/%v", subnet.Address, subnet.SourceNetmask)
+		}
+		if sent != c.expected {
+			t.Errorf("mode %v, client ecs %v: expected subnet %q in message, got: %q",
+				c.mode, c.clientECS, c.expected, sent)
+		}
+
+		// url parameters.
+		if sent := provider.paramEDNSSubnet(newMsg(), nil); sent != c.expected {
+			t.Errorf("mode %v, client ecs %v: expected subnet parameter %q, got: %q",
+				c.mode, c.clientECS, c.expected, sent)
+		}
+	}
+
+	if _, err := NewDMProvider([]string{"https://dns.example/dns-query"},
+		&DMProviderOptions{EDNSSubnetMode: "bogus"}); err == nil {
+		t.Errorf("unsupported edns subnet mode should be rejected")
+	}
+}
+
+func TestEDNSPadding(t *testing.T) {
+	for _, blockSize := range []int{0, 128, 256} {
+		provider, err := NewDMProvider([]string{"https://dns.example/dns-query"}, &DMProviderOptions{
+			EDNSSubnet:  "64.10.0.0/20",
+			EDNSPadding: blockSize,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := blockSize
+		if expected == 0 {
+			expected = DefaultEDNSPadding
+		}
+		for _, name := range []string{"a.com.", "a-much-longer-name.subdomain.example.com."} {
+			msg := new(dns.Msg)
+			msg.SetQuestion(name, dns.TypeA)
+			msg.SetEdns0(dns.DefaultMsgSize, false)
+			opt := msg.IsEdns0()
+			opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "0123456789abcdef"})
+			if err := provider.setEDNSOptions(msg, nil); err != nil {
+				t.Fatal(err)
+			}
+			bytesMsg, err := msg.Pack()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(bytesMsg)%expected != 0 {
+				t.Errorf("block size %v, %v: expected length multiple of %v, got: %v",
+					blockSize, name, expected, len(bytesMsg))
+			}
+			if !hasEDNS0Subnet(msg) || len(msg.IsEdns0().Option) != 3 {
+				t.Errorf("padding should coexist with other options, got: %v", msg.IsEdns0())
+			}
+		}
+	}
+
+	provider, err := NewDMProvider([]string{"https://dns.example/dns-query"}, &DMProviderOptions{
+		EDNSSubnet:  "no",
+		EDNSPadding: -1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := new(dns.Msg)
+	msg.SetQuestion("a.com.", dns.TypeA)
+	if err := provider.setEDNSOptions(msg, nil); err != nil {
+		t.Fatal(err)
+	}
+	if msg.IsEdns0() != nil {
+		t.Errorf("padding should be disabled, got: %v", msg.IsEdns0())
+	}
+}
+
+func TestIPHashStrategy(t *testing.T) {
+	endpoints := []string{"https://a.example/dns-query", "https://b.example/dns-query", "https://c.example/dns-query"}
+	provider, err := NewDMProvider(endpoints, &DMProviderOptions{Strategy: StrategyIPHash})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chosen := make(map[string]string)
+	for i := 0; i < 100; i++ {
+		ip := net.IPv4(192, 0, 2, byte(i)).String()
+		first := provider.ipHashUpstreams(net.ParseIP(ip))[0].endpoint
+		for j := 0; j < 3; j++ {
+			if e := provider.ipHashUpstreams(net.ParseIP(ip))[0].endpoint; e != first {
+				t.Fatalf("%v should stably hit %v, got: %v", ip, first, e)
+			}
+		}
+		chosen[ip] = first
+	}
+	counts := make(map[string]int)
+	for _, e := range chosen {
+		counts[e]++
+	}
+	if len(counts) != len(endpoints) {
+		t.Errorf("clients should be distributed over all endpoints, got: %v", counts)
+	}
+
+	// clients of the unhealthy endpoint are redistributed, others stay.
+	provider.upstreams[0].failures = maxConsecutiveFailures
+	for ip, e := range chosen {
+		now := provider.ipHashUpstreams(net.ParseIP(ip))[0].endpoint
+		if e == endpoints[0] && now == endpoints[0] {
+			t.Errorf("%v should move off the unhealthy endpoint", ip)
+		}
+		if e != endpoints[0] && now != e {
+			t.Errorf("%v should stay on %v, got: %v", ip, e, now)
+		}
+	}
+}
+
+func TestWeightedRoundRobin(t *testing.T) {
+	endpoints := []string{"https://a.example/dns-query", "https://b.example/dns-query"}
+	provider, err := NewDMProvider(endpoints, &DMProviderOptions{Strategy: StrategyRoundRobin,
+		EndpointWeights: map[string]int{endpoints[0]: 3}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := make(map[string]int)
+	for i := 0; i < 400; i++ {
+		counts[provider.roundRobinUpstreams()[0].endpoint]++
+	}
+	if counts[endpoints[0]] != 300 || counts[endpoints[1]] != 100 {
+		t.Errorf("expected picks in ratio 3:1, got: %v", counts)
+	}
+
+	if _, err := NewDMProvider(endpoints, &DMProviderOptions{
+		EndpointWeights: map[string]int{"https://unknown.example/dns-query": 2}}); err == nil {
+		t.Error("weight of unknown endpoint should be rejected")
+	}
+}
+
+func TestEDNSSubnetNo(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		raw, _ := base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		req := new(dns.Msg)
+		if err := req.Unpack(raw); err != nil {
+			t.Errorf("unpack query error: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if hasEDNS0Subnet(req) {
+			t.Errorf("edns subnet should not be sent upstream: %v", req)
+		}
+		m := new(dns.Msg)
+		m.SetReply(req)
+		rr, _ := dns.NewRR(req.Question[0].Name + " 300 IN A 93.184.216.34")
+		m.Answer = append(m.Answer, rr)
+		// echoed by upstream.
+		m.SetEdns0(dns.DefaultMsgSize, false)
+		ReplaceEDNS0Subnet(m, &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24,
+			SourceScope: 24, Address: net.ParseIP("203.0.113.0").To4()})
+		bytesMsg, _ := m.Pack()
+		w.Header().Set("Content-Type", ContentType)
+		_, _ = w.Write(bytesMsg)
+	}))
+	defer ts.Close()
+
+	provider, err := NewDMProvider([]string{ts.URL}, &DMProviderOptions{EDNSSubnet: "no"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	msg.SetEdns0(dns.DefaultMsgSize, false)
+	ReplaceEDNS0Subnet(msg, &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24,
+		Address: net.ParseIP("198.51.100.0").To4()})
+	rMsg, err := provider.Query(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hasEDNS0Subnet(rMsg) {
+		t.Errorf("edns subnet should be removed from answer: %v", rMsg)
+	}
+}
+
+func TestTLSServerName(t *testing.T) {
+	cert, caFile := newTestCert(t, "sni.test")
+	serverNames := make(chan string, 1)
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		raw, _ := base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		req := new(dns.Msg)
+		if err := req.Unpack(raw); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		m := new(dns.Msg)
+		m.SetReply(req)
+		bytesMsg, _ := m.Pack()
+		w.Header().Set("Content-Type", ContentType)
+		_, _ = w.Write(bytesMsg)
+	}))
+	ts.TLS = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			select {
+			case serverNames <- hello.ServerName:
+			default:
+			}
+			return nil, nil
+		},
+	}
+	ts.StartTLS()
+	defer ts.Close()
+
+	_, port, _ := net.SplitHostPort(ts.Listener.Addr().String())
+	provider, err := NewDMProvider([]string{"https://doh.test:" + port + "/dns-query"}, &DMProviderOptions{
+		EndpointIPs:    []net.IP{net.ParseIP("127.0.0.1")},
+		CACertFilePath: caFile,
+		TLSServerName:  "sni.test",
+		EDNSSubnet:     "no",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	if _, err := provider.Query(msg); err != nil {
+		t.Fatal(err)
+	}
+	if serverName := <-serverNames; serverName != "sni.test" {
+		t.Errorf("expected SNI sni.test, got: %v", serverName)
+	}
+}
+
+func TestBootstrapEndpointIPs(t *testing.T) {
+	resolver := startPlainTestServer(t, dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		if r.Question[0].Name == "doh.test." && r.Question[0].Qtype == dns.TypeA {
+			for _, ip := range []string{"127.0.0.1", "127.0.0.2"} {
+				m.Answer = append(m.Answer, &dns.A{
+					Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+					A:   net.ParseIP(ip),
+				})
+			}
+		}
+		_ = w.WriteMsg(m)
+	}))
+	provider, err := NewDMProvider([]string{"https://doh.test/dns-query"}, &DMProviderOptions{
+		DnsResolver: resolver,
+		EDNSSubnet:  "no",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// resolved on startup.
+	deadline := time.Now().Add(time.Second)
+	for {
+		provider.bootstrap.lock.Lock()
+		host := provider.bootstrap.hosts["doh.test."]
+		resolved := host != nil && len(host.ip4s) > 0
+		provider.bootstrap.lock.Unlock()
+		if resolved {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("endpoint host should be resolved on startup")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	addrs, err := provider.endpointAddrs("doh.test:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(addrs)
+	if len(addrs) != 2 || addrs[0] != "127.0.0.1:443" || addrs[1] != "127.0.0.2:443" {
+		t.Errorf("both resolved ips should be endpoint addresses, got: %v", addrs)
+	}
+
+	// the system resolver answers names the dns resolver can't.
+	r, err := newBootstrapResolver(resolver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.lookupSystem = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		return []net.IPAddr{{IP: net.ParseIP("192.0.2.1")}}, nil
+	}
+	if ip4s, _ := r.lookup("other.test."); len(ip4s) != 1 || ip4s[0] != "192.0.2.1" {
+		t.Errorf("system resolver should be the fallback, got: %v", ip4s)
+	}
+}
+
+func TestDoHMethodPost(t *testing.T) {
+	// a large query of a name near the 255 bytes limit.
+	label := strings.Repeat("a", 63)
+	name := strings.Join([]string{label, label, label, label[:61]}, ".") + "."
+	var posts int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&posts, 1)
+		if r.Method != http.MethodPost {
+			t.Errorf("expected POST, got: %v", r.Method)
+		}
+		if ct := r.Header.Get("Content-Type"); ct != "application/dns-message" {
+			t.Errorf("unexpected Content-Type: %v", ct)
+		}
+		if accept := r.Header.Values("Accept"); len(accept) != 1 || accept[0] != "application/dns-message" {
+			t.Errorf("unexpected Accept: %v", accept)
+		}
+		if key := r.Header.Get("X-Api-Key"); key != "secret" {
+			t.Errorf("headers of options should be sent, got X-Api-Key: %v", key)
+		}
+		if r.URL.RawQuery != "" {
+			t.Errorf("no dns parameter should be sent, got: %v", r.URL.RawQuery)
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := new(dns.Msg)
+		if err := msg.Unpack(body); err != nil {
+			t.Fatalf("body should be the query in wire format: %v", err)
+		}
+		if msg.Question[0].Name != name || !dnssecOK(msg) {
+			t.Errorf("unexpected query: %v", msg)
+		}
+		rMsg := new(dns.Msg)
+		rMsg.SetReply(msg)
+		bytesMsg, _ := rMsg.Pack()
+		w.Header().Set("Content-Type", "application/dns-message")
+		_, _ = w.Write(bytesMsg)
+	}))
+	defer ts.Close()
+
+	if _, err := NewDMProvider([]string{ts.URL}, &DMProviderOptions{DoHMethod: "put"}); err == nil {
+		t.Error("unsupported method should be rejected")
+	}
+	provider, err := NewDMProvider([]string{ts.URL}, &DMProviderOptions{
+		DoHMethod: DoHMethodPost, EDNSSubnet: "no",
+		Headers: http.Header{"X-Api-Key": []string{"secret"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := new(dns.Msg)
+	msg.SetQuestion(name, dns.TypeDNSKEY)
+	msg.SetEdns0(4096, true)
+	for i := 0; i < 2; i++ {
+		if _, err := provider.Query(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadInt32(&posts); n != 2 {
+		t.Errorf("expected 2 POST requests, got: %v", n)
+	}
+}
+
+func TestDNSRR_RR(t *testing.T) {
+	tests := []struct {
+		rr       string
+		expected string
+	}{
+		{`{"name": "example.com.", "type": 1, "TTL": 300, "data": "93.184.216.34"}`,
+			"example.com.\t300\tIN\tA\t93.184.216.34"},
+		{`{"name": "example.com.", "type": 28, "TTL": 300, "data": "2606:2800:220:1:248:1893:25c8:1946"}`,
+			"example.com.\t300\tIN\tAAAA\t2606:2800:220:1:248:1893:25c8:1946"},
+		{`{"name": "www.example.com.", "type": 5, "TTL": 60, "data": "example.com."}`,
+			"www.example.com.\t60\tIN\tCNAME\texample.com."},
+		{`{"name": "www.example.com", "type": 5, "TTL": 60, "data": "example.com"}`,
+			"www.example.com.\t60\tIN\tCNAME\texample.com."},
+		{`{"name": "example.com.", "type": 15, "TTL": 3600, "data": "10 mail.example.com."}`,
+			"example.com.\t3600\tIN\tMX\t10 mail.example.com."},
+		{`{"name": "example.com.", "type": 16, "TTL": 3600, "data": "\"v=spf1 -all\""}`,
+			"example.com.\t3600\tIN\tTXT\t\"v=spf1 -all\""},
+		{`{"name": "example.com.", "type": 16, "TTL": 3600, "data": "v=spf1 include:\"x\" -all"}`,
+			"example.com.\t3600\tIN\tTXT\t\"v=spf1 include:\\\"x\\\" -all\""},
+		{`{"name": "example.com.", "type": 16, "TTL": 3600, "data": "\"part one\" \"part two\""}`,
+			"example.com.\t3600\tIN\tTXT\t\"part one\" \"part two\""},
+		{`{"name": "_sip._tcp.example.com.", "type": 33, "TTL": 600, "data": "10 5 5060 sip.example.com."}`,
+			"_sip._tcp.example.com.\t600\tIN\tSRV\t10 5 5060 sip.example.com."},
+		{`{"name": "example.com.", "type": 6, "TTL": 1800, "data": "ns.example.com. admin.example.com. 2021010101 7200 900 1209600 300"}`,
+			"example.com.\t1800\tIN\tSOA\tns.example.com. admin.example.com. 2021010101 7200 900 1209600 300"},
+		{`{"name": "example.com.", "type": 2, "TTL": 86400, "data": "a.iana-servers.net."}`,
+			"example.com.\t86400\tIN\tNS\ta.iana-servers.net."},
+		{`{"name": "34.216.184.93.in-addr.arpa.", "type": 12, "TTL": 3600, "data": "example.com."}`,
+			"34.216.184.93.in-addr.arpa.\t3600\tIN\tPTR\texample.com."},
+	}
+	for _, test := range tests {
+		var r DNSRR
+		if err := json.Unmarshal([]byte(test.rr), &r); err != nil {
+			t.Fatal(err)
+		}
+		rr, err := r.RR()
+		if err != nil {
+			t.Errorf("%v should be converted: %v", test.rr, err)
+			continue
+		}
+		if rr.String() != test.expected {
+			t.Errorf("%v should be converted to %q, got %q", test.rr, test.expected, rr.String())
+		}
+	}
+
+	long := strings.Repeat("a", 300)
+	rr, err := DNSRR{Name: "example.com.", Type: dns.TypeTXT, TTL: 60, Data: long}.RR()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if txt := rr.(*dns.TXT).Txt; len(txt) != 2 || strings.Join(txt, "") != long {
+		t.Errorf("long text should be split to strings of 255 bytes, got: %v", txt)
+	}
+	if _, err := (DNSRR{Name: "example.com.", Type: dns.TypeMX, Data: ""}).RR(); err == nil {
+		t.Error("empty data should be rejected")
+	}
+}
+
+func TestObtainDMFromJSON(t *testing.T) {
+	payload := `{"Status": 3, "TC": false, "RD": true, "RA": true, "AD": false, "CD": false,
+		"Question": [{"name": "nx.example.com.", "type": 1}],
+		"Answer": [{"name": "nx.example.com.", "type": 5, "TTL": 60, "data": "gone.example.com."}],
+		"Authority": [{"name": "example.com.", "type": 6, "TTL": 900,
+			"data": "ns.example.com. admin.example.com. 1 7200 900 1209600 300"}],
+		"Additional": [{"name": "ns.example.com.", "type": 1, "TTL": 300, "data": "192.0.2.53"}]}`
+	var json_ JSONDNSResponse
+	if err := json.Unmarshal([]byte(payload), &json_); err != nil {
+		t.Fatal(err)
+	}
+	msg := new(dns.Msg)
+	msg.SetQuestion("nx.example.com.", dns.TypeA)
+	rMsg := DMProvider{}.obtainDMFromJSON(&json_, msg)
+	if rMsg.Id != msg.Id || !rMsg.Response || rMsg.Rcode != dns.RcodeNameError {
+		t.Errorf("reply should keep the rcode of json, got: %v", rMsg)
+	}
+	if !rMsg.RecursionAvailable || rMsg.AuthenticatedData {
+		t.Errorf("RA and AD should be of json, got: %v", rMsg)
+	}
+	if len(rMsg.Answer) != 1 || len(rMsg.Ns) != 1 || len(rMsg.Extra) != 1 {
+		t.Fatalf("all sections should be converted, got: %v", rMsg)
+	}
+	if soa, ok := rMsg.Ns[0].(*dns.SOA); !ok || soa.Hdr.Ttl != 900 || soa.Minttl != 300 {
+		t.Errorf("unexpected authority: %v", rMsg.Ns[0])
+	}
+}
+
+func TestUpstreamBreaker(t *testing.T) {
+	var hitsBad, hitsGood int32
+	tsBad := newDoHTestServer(t, http.StatusInternalServerError, dns.RcodeSuccess, &hitsBad)
+	defer tsBad.Close()
+	tsGood := newDoHTestServer(t, http.StatusOK, dns.RcodeSuccess, &hitsGood)
+	defer tsGood.Close()
+
+	const cooldown = 200 * time.Millisecond
+	provider, err := NewDMProvider([]string{tsBad.URL, tsGood.URL}, &DMProviderOptions{
+		EDNSSubnet:       "no",
+		BreakerThreshold: 2,
+		BreakerCooldown:  cooldown,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := func() {
+		msg := new(dns.Msg)
+		msg.SetQuestion("breaker.example.com.", dns.TypeA)
+		if rMsg, err := provider.Query(msg); err != nil || len(rMsg.Answer) != 1 {
+			t.Fatalf("query should be answered by the healthy endpoint, got: %v, %v", rMsg, err)
+		}
+	}
+
+	query()
+	query()
+	if n := atomic.LoadInt32(&hitsBad); n != 2 {
+		t.Fatalf("failing endpoint should be tried until the threshold, hits: %v", n)
+	}
+	query()
+	query()
+	if n := atomic.LoadInt32(&hitsBad); n != 2 {
+		t.Errorf("endpoint with open breaker should be skipped, hits: %v", n)
+	}
+
+	time.Sleep(cooldown + 50*time.Millisecond)
+	query()
+	if n := atomic.LoadInt32(&hitsBad); n != 3 {
+		t.Errorf("endpoint should be probed after the cooldown, hits: %v", n)
+	}
+	// the failed probe opens the breaker again.
+	query()
+	if n := atomic.LoadInt32(&hitsBad); n != 3 {
+		t.Errorf("endpoint failed the probe should be skipped, hits: %v", n)
+	}
+	if n := atomic.LoadInt32(&hitsGood); n != 6 {
+		t.Errorf("every query should be answered by the healthy endpoint, hits: %v", n)
+	}
+}
+
+func TestDMProvider_GetIPsClosureOptions(t *testing.T) {
+	var posts int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			t.Errorf("endpoint ips should be resolved by the doh method of options, got: %v", r.Method)
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		atomic.AddInt32(&posts, 1)
+		body, _ := ioutil.ReadAll(r.Body)
+		msg := new(dns.Msg)
+		if err := msg.Unpack(body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if opt := msg.IsEdns0(); opt != nil {
+			for _, o := range opt.Option {
+				if o.Option() == dns.EDNS0SUBNET {
+					t.Errorf("endpoint ips should be resolved without client subnet, got: %v", o)
+				}
+			}
+		}
+		rMsg := new(dns.Msg)
+		rMsg.SetReply(msg)
+		if msg.Question[0].Qtype == dns.TypeA {
+			rr, _ := dns.NewRR(msg.Question[0].Name + " 300 IN A 192.0.2.1")
+			rMsg.Answer = append(rMsg.Answer, rr)
+		}
+		bytesMsg, _ := rMsg.Pack()
+		w.Header().Set("Content-Type", "application/dns-message")
+		_, _ = w.Write(bytesMsg)
+	}))
+	defer ts.Close()
+
+	provider, err := NewDMProvider([]string{ts.URL}, &DMProviderOptions{
+		DoHMethod: DoHMethodPost, EDNSSubnet: "192.0.2.0/24", EDNSSubnetMode: EDNSSubnetModeGlobal,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip4s, _ := provider.GetIPsClosure("dns.example.")()
+	if len(ip4s) != 1 || ip4s[0] != "192.0.2.1" {
+		t.Errorf("unexpected endpoint ips: %v", ip4s)
+	}
+	if n := atomic.LoadInt32(&posts); n != 2 {
+		t.Errorf("expected queries of A and AAAA, got: %v", n)
+	}
+}
+
+// countingListener counts the accepted connections.
+type countingListener struct {
+	net.Listener
+	accepted int32
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		atomic.AddInt32(&l.accepted, 1)
+	}
+	return conn, err
+}
+
+func TestDoTConnReuse(t *testing.T) {
+	cert, caFile := newTestCert(t, "dot.test")
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	counting := &countingListener{Listener: tcp}
+	server := &dns.Server{
+		Listener: tls.NewListener(counting, &tls.Config{Certificates: []tls.Certificate{cert}}),
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			m := new(dns.Msg)
+			m.SetReply(r)
+			rr, _ := dns.NewRR(r.Question[0].Name + " 300 IN A 93.184.216.34")
+			m.Answer = append(m.Answer, rr)
+			_ = w.WriteMsg(m)
+		}),
+		// idle connections are closed by the server soon.
+		IdleTimeout: func() time.Duration { return 200 * time.Millisecond },
+	}
+	go func() { _ = server.ActivateAndServe() }()
+	defer func() { _ = server.Shutdown() }()
+
+	_, port, _ := net.SplitHostPort(tcp.Addr().String())
+	provider, err := NewDMProvider([]string{"tls://dot.test:" + port}, &DMProviderOptions{
+		Protocol:       ProtocolDoT,
+		EndpointIPs:    []net.IP{net.ParseIP("127.0.0.1")},
+		CACertFilePath: caFile,
+		EDNSSubnet:     "no",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = provider.Close() }()
+
+	query := func() {
+		msg := new(dns.Msg)
+		msg.SetQuestion("example.com.", dns.TypeA)
+		rMsg, err := provider.Query(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rMsg.Answer) != 1 || rMsg.Id != msg.Id {
+			t.Fatalf("unexpected answer: %v", rMsg)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		query()
+	}
+	if n := atomic.LoadInt32(&counting.accepted); n != 1 {
+		t.Errorf("queries should share the connection, got %v connections", n)
+	}
+
+	// the connection closed by the server is replaced.
+	time.Sleep(400 * time.Millisecond)
+	query()
+	if n := atomic.LoadInt32(&counting.accepted); n != 2 {
+		t.Errorf("expected a new connection, got %v connections", n)
+	}
+}
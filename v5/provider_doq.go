@@ -0,0 +1,81 @@
+package dohProxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+
+	"github.com/miekg/dns"
+)
+
+// doqALPN is the application protocol negotiated for DNS-over-QUIC.
+const doqALPN = "doq"
+
+// DoQ error codes signaled when closing the connection or streams, RFC 9250.
+const (
+	doqNoError          = 0
+	doqRequestCancelled = 3
+)
+
+// errDoQNotSupported is returned if DoQ is requested but the binary is built
+// without tag "http3".
+var errDoQNotSupported = errors.New("DNS-over-QUIC is not supported by this build, rebuild with \"-tags http3\"")
+
+// parseDoQEndpoint accepts "quic://host[:port]" or "host[:port]", the port
+// defaults to 853.
+func parseDoQEndpoint(endpoint string) (*url.URL, error) {
+	return parseHostEndpoint(endpoint, "quic")
+}
+
+// doqQuery sends the query over a new stream of the QUIC connection to the
+// endpoint, the connection is shared by the queries.
+func (provider DMProvider) doqQuery(ctx context.Context, msg *dns.Msg, clientIP net.IP) (*dns.Msg, error) {
+	// Return fake answer (empty) if NoAAAA option is on.
+	if provider.opts.NoAAAA {
+		for _, q := range msg.Question {
+			if q.Qtype == dns.TypeAAAA {
+				msgR := new(dns.Msg)
+				msgR.SetReply(msg)
+				return msgR, nil
+			}
+		}
+	}
+
+	upstreamLog.Debugf("Dns Question Msg: \n%v", msg)
+
+	if err := provider.setEDNSOptions(msg, clientIP); err != nil {
+		return nil, err
+	}
+	// the message id must be 0 over DoQ.
+	id := msg.Id
+	msg.Id = 0
+	bytesMsg, err := msg.Pack()
+	msg.Id = id
+	if err != nil {
+		upstreamLog.Errorf("msg pack error: %v", err)
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, provider.dialer.Timeout)
+	defer cancel()
+	bytesResp, err := provider.doq.exchange(ctx, provider, bytesMsg)
+	if err != nil && ctx.Err() == context.Canceled {
+		return nil, fmt.Errorf("DoQ exchange error: %w", ctx.Err())
+	}
+	if err != nil {
+		upstreamLog.Errorf("DoQ exchange error: %v", err)
+		return nil, fmt.Errorf("DoQ exchange error: %w", err)
+	}
+
+	rMsg := new(dns.Msg)
+	if err := rMsg.Unpack(bytesResp); err != nil {
+		upstreamLog.Errorf("unpack DoQ response error: %v", err)
+		return nil, fmt.Errorf("%w: %v", errUnpackResponse, err)
+	}
+	rMsg.Id = id
+	upstreamLog.Debugf("Dns Answer Msg: \n%v", rMsg)
+
+	return rMsg, nil
+}
@@ -0,0 +1,18 @@
+//go:build !http3
+// +build !http3
+
+package dohProxy
+
+import "context"
+
+type doqConn struct{}
+
+func configDoQClient(provider *DMProvider) error {
+	return errDoQNotSupported
+}
+
+func (c *doqConn) exchange(ctx context.Context, provider DMProvider, msg []byte) ([]byte, error) {
+	return nil, errDoQNotSupported
+}
+
+func (c *doqConn) close() {}
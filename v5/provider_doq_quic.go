@@ -0,0 +1,123 @@
+//go:build http3
+// +build http3
+
+package dohProxy
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/quic-go/quic-go"
+)
+
+// doqConn holds the QUIC connection to a DoQ endpoint, it's dialed on demand
+// and re-dialed after failures.
+type doqConn struct {
+	lock    sync.Mutex
+	session quic.Connection
+}
+
+func configDoQClient(provider *DMProvider) error {
+	if provider.opts.Proxy != "" {
+		return fmt.Errorf("DNS-over-QUIC can't be used with proxy")
+	}
+	return configTLS(provider)
+}
+
+// exchange sends msg over a new stream and reads the answer, both prefixed
+// with the 2 bytes length.
+func (c *doqConn) exchange(ctx context.Context, provider DMProvider, msg []byte) ([]byte, error) {
+	session, err := c.dial(ctx, provider)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := session.OpenStreamSync(ctx)
+	if err != nil {
+		c.reset(session)
+		return nil, fmt.Errorf("open DoQ stream error: %w", err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = stream.SetDeadline(deadline)
+	}
+	// interrupt the exchange when cancelled.
+	exchanged := make(chan bool)
+	defer close(exchanged)
+	go func() {
+		select {
+		case <-ctx.Done():
+			stream.CancelRead(doqRequestCancelled)
+			stream.CancelWrite(doqRequestCancelled)
+		case <-exchanged:
+		}
+	}()
+
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+	if _, err := stream.Write(buf); err != nil {
+		return nil, err
+	}
+	// closing the sending side marks the end of the query.
+	if err := stream.Close(); err != nil {
+		return nil, err
+	}
+
+	var length [2]byte
+	if _, err := io.ReadFull(stream, length[:]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(stream, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// dial returns the QUIC connection to the endpoint, dialing if there's none or
+// it's closed.
+func (c *doqConn) dial(ctx context.Context, provider DMProvider) (quic.Connection, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.session != nil && c.session.Context().Err() == nil {
+		return c.session, nil
+	}
+	addr, err := provider.endpointAddr(provider.url.Host)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := provider.tlsConfig.Clone()
+	tlsConfig.NextProtos = []string{doqALPN}
+	upstreamLog.Debugf("dial %v over QUIC", addr)
+	session, err := quic.DialAddr(ctx, addr, tlsConfig, &quic.Config{
+		HandshakeIdleTimeout: provider.dialer.Timeout,
+		KeepAlivePeriod:      quicKeepAlivePeriod,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("dial DoQ endpoint error: %w", err)
+	}
+	c.session = session
+	return session, nil
+}
+
+// reset closes session if it's still the current one, the next query dials a
+// new connection.
+func (c *doqConn) reset(session quic.Connection) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.session == session {
+		_ = session.CloseWithError(doqNoError, "")
+		c.session = nil
+	}
+}
+
+func (c *doqConn) close() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.session != nil {
+		_ = c.session.CloseWithError(doqNoError, "")
+		c.session = nil
+	}
+}
@@ -0,0 +1,97 @@
+//go:build http3
+// +build http3
+
+package dohProxy
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// serveDoQ answers the queries on each stream with an A record, the message
+// id of queries must be 0.
+func serveDoQ(t *testing.T, listener *quic.Listener) {
+	for {
+		session, err := listener.Accept(context.Background())
+		if err != nil {
+			return
+		}
+		go func() {
+			for {
+				stream, err := session.AcceptStream(context.Background())
+				if err != nil {
+					return
+				}
+				var length [2]byte
+				if _, err := io.ReadFull(stream, length[:]); err != nil {
+					return
+				}
+				raw := make([]byte, binary.BigEndian.Uint16(length[:]))
+				if _, err := io.ReadFull(stream, raw); err != nil {
+					return
+				}
+				req := new(dns.Msg)
+				if err := req.Unpack(raw); err != nil || req.Id != 0 {
+					t.Errorf("unexpected DoQ query: %v, error: %v", req, err)
+					return
+				}
+				m := new(dns.Msg)
+				m.SetReply(req)
+				rr, _ := dns.NewRR(req.Question[0].Name + " 300 IN A 93.184.216.34")
+				m.Answer = append(m.Answer, rr)
+				bytesMsg, _ := m.Pack()
+				binary.BigEndian.PutUint16(length[:], uint16(len(bytesMsg)))
+				_, _ = stream.Write(append(length[:], bytesMsg...))
+				_ = stream.Close()
+			}
+		}()
+	}
+}
+
+func TestDoQQuery(t *testing.T) {
+	cert, caFile := newTestCert(t, "doq.test")
+	listener, err := quic.ListenAddr("127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{doqALPN},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = listener.Close() }()
+	go serveDoQ(t, listener)
+
+	port := listener.Addr().(*net.UDPAddr).Port
+	provider, err := NewDMProvider([]string{"quic://doq.test:" + strconv.Itoa(port)}, &DMProviderOptions{
+		Protocol:       ProtocolDoQ,
+		EndpointIPs:    []net.IP{net.ParseIP("127.0.0.1")},
+		CACertFilePath: caFile,
+		EDNSSubnet:     "no",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = provider.Close() }()
+
+	for i := 0; i < 2; i++ {
+		msg := new(dns.Msg)
+		msg.SetQuestion("example.com.", dns.TypeA)
+		rMsg, err := provider.Query(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rMsg.Id != msg.Id {
+			t.Errorf("message id should be restored, got: %v", rMsg.Id)
+		}
+		if a, ok := rMsg.Answer[0].(*dns.A); !ok || a.A.String() != "93.184.216.34" {
+			t.Errorf("unexpected answer: %v", rMsg.Answer[0])
+		}
+	}
+}
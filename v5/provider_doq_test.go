@@ -0,0 +1,22 @@
+package dohProxy
+
+import "testing"
+
+func TestParseDoQEndpoint(t *testing.T) {
+	cases := map[string]string{
+		"quic://dns.adguard.com":      "dns.adguard.com:853",
+		"quic://dns.adguard.com:8853": "dns.adguard.com:8853",
+		"dns.adguard.com":             "dns.adguard.com:853",
+		"tls://94.140.14.14:8853":     "94.140.14.14:853",
+	}
+	for endpoint, expected := range cases {
+		u, err := parseDoQEndpoint(endpoint)
+		if err != nil {
+			t.Errorf("parse %v error: %v", endpoint, err)
+			continue
+		}
+		if u.Host != expected || u.Scheme != "quic" {
+			t.Errorf("parse %v: expected quic://%v, got %v", endpoint, expected, u)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package dohProxy
+
+import (
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// dotConns are the idle connections to a DoT endpoint, reused by the queries
+// like the idle connections of the http transport.
+type dotConns struct {
+	lock sync.Mutex
+	// the most recently used last.
+	idle        []idleDoTConn
+	maxIdle     int
+	idleTimeout time.Duration
+	// connections are closed after each query if true.
+	disabled bool
+}
+
+type idleDoTConn struct {
+	conn  *dns.Conn
+	since time.Time
+}
+
+// newDoTConns creates the idle connections of an endpoint by MaxConns,
+// IdleTimeout and DisableKeepAlive of opts.
+func newDoTConns(opts *DMProviderOptions) *dotConns {
+	c := &dotConns{
+		maxIdle:     opts.MaxConns,
+		idleTimeout: opts.IdleTimeout,
+		disabled:    opts.DisableKeepAlive,
+	}
+	if c.maxIdle <= 0 {
+		c.maxIdle = DefaultUpstreamMaxConns
+	}
+	if c.idleTimeout <= 0 {
+		c.idleTimeout = DefaultUpstreamIdleTimeout
+	}
+	return c
+}
+
+// get returns the most recently used idle connection, nil if none; the ones
+// idle for longer than idleTimeout are closed.
+func (c *dotConns) get() *dns.Conn {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	now := time.Now()
+	for len(c.idle) > 0 {
+		last := c.idle[len(c.idle)-1]
+		c.idle = c.idle[:len(c.idle)-1]
+		if now.Sub(last.since) < c.idleTimeout {
+			return last.conn
+		}
+		_ = last.conn.Close()
+	}
+	return nil
+}
+
+// put keeps conn for reuse after a successful query, the expired ones are
+// closed first; conn is closed if keep-alive is disabled or there are maxIdle
+// connections already.
+func (c *dotConns) put(conn *dns.Conn) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	now := time.Now()
+	for len(c.idle) > 0 && now.Sub(c.idle[0].since) >= c.idleTimeout {
+		_ = c.idle[0].conn.Close()
+		c.idle = c.idle[1:]
+	}
+	if c.disabled || len(c.idle) >= c.maxIdle {
+		_ = conn.Close()
+		return
+	}
+	c.idle = append(c.idle, idleDoTConn{conn: conn, since: now})
+}
+
+// close closes the idle connections.
+func (c *dotConns) close() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, idle := range c.idle {
+		_ = idle.conn.Close()
+	}
+	c.idle = nil
+}
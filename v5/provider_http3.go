@@ -0,0 +1,78 @@
+package dohProxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// HTTP/3 isn't tried again in this duration after a failure, requests are sent
+// over the fallback transport meanwhile.
+const http3RetryDelay = 5 * time.Minute
+
+// errHTTP3NotSupported is returned if HTTP/3 is requested but the binary is
+// built without tag "http3".
+var errHTTP3NotSupported = errors.New("HTTP/3 is not supported by this build, rebuild with \"-tags http3\"")
+
+// http3Transport sends requests over HTTP/3, and over the fallback transport if
+// the endpoint can't be reached over QUIC, e.g. it doesn't offer h3.
+type http3Transport struct {
+	h3       http.RoundTripper
+	fallback http.RoundTripper
+	// unix nano time until which HTTP/3 isn't tried.
+	brokenUntil int64
+}
+
+func configHTTP3(provider *DMProvider, fallback *http.Transport) error {
+	if provider.opts.Proxy != "" {
+		return errors.New("HTTP/3 can't be used with proxy")
+	}
+	h3, err := newHTTP3RoundTripper(provider)
+	if err != nil {
+		return err
+	}
+	provider.client.Transport = &http3Transport{h3: h3, fallback: fallback}
+	return nil
+}
+
+func (t *http3Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if time.Now().UnixNano() < atomic.LoadInt64(&t.brokenUntil) {
+		return t.fallback.RoundTrip(req)
+	}
+	resp, err := t.h3.RoundTrip(req)
+	if err == nil || errors.Is(err, context.Canceled) {
+		return resp, err
+	}
+	upstreamLog.Warnf("HTTP/3 request to %v failed, fall back to HTTP/2 or HTTP/1.1 for %v: %v",
+		req.URL.Host, http3RetryDelay, err)
+	atomic.StoreInt64(&t.brokenUntil, time.Now().Add(http3RetryDelay).UnixNano())
+	if req.Body != nil {
+		// the body may be consumed by the failed request.
+		if req.GetBody == nil {
+			return nil, err
+		}
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		req = req.Clone(req.Context())
+		req.Body = body
+	}
+	return t.fallback.RoundTrip(req)
+}
+
+// CloseIdleConnections closes the idle connections of both transports, it's
+// called by http.Client.CloseIdleConnections.
+func (t *http3Transport) CloseIdleConnections() {
+	for _, rt := range []http.RoundTripper{t.h3, t.fallback} {
+		switch tr := rt.(type) {
+		case interface{ CloseIdleConnections() }:
+			tr.CloseIdleConnections()
+		case io.Closer:
+			_ = tr.Close()
+		}
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !http3
+// +build !http3
+
+package dohProxy
+
+import "net/http"
+
+func newHTTP3RoundTripper(provider *DMProvider) (http.RoundTripper, error) {
+	return nil, errHTTP3NotSupported
+}
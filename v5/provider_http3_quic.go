@@ -0,0 +1,48 @@
+//go:build http3
+// +build http3
+
+package dohProxy
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// quicKeepAlivePeriod is the interval of the keep-alive packets keeping idle
+// QUIC connections open.
+const quicKeepAlivePeriod = 15 * time.Second
+
+// newHTTP3RoundTripper creates the HTTP/3 transport, dialing the pinned
+// endpoint ips like the HTTP/2 transport.
+func newHTTP3RoundTripper(provider *DMProvider) (http.RoundTripper, error) {
+	return &http3.RoundTripper{
+		TLSClientConfig: provider.tlsConfig,
+		QuicConfig: &quic.Config{
+			HandshakeIdleTimeout: provider.dialer.Timeout,
+			KeepAlivePeriod:      quicKeepAlivePeriod,
+		},
+		Dial: func(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (quic.EarlyConnection, error) {
+			host, _, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			addr, err = provider.endpointAddr(addr)
+			if err != nil {
+				return nil, err
+			}
+			// verify the endpoint name rather than the ip dialed.
+			if tlsCfg.ServerName == "" {
+				tlsCfg = tlsCfg.Clone()
+				tlsCfg.ServerName = host
+			}
+			upstreamLog.Debugf("dial %v over QUIC", addr)
+			return quic.DialAddrEarly(ctx, addr, tlsCfg, cfg)
+		},
+	}, nil
+}
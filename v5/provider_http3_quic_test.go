@@ -0,0 +1,55 @@
+//go:build http3
+// +build http3
+
+package dohProxy
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go/http3"
+)
+
+func TestHTTP3Query(t *testing.T) {
+	cert, caFile := newTestCert(t, "doh.test")
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hits int32
+	server := &http3.Server{
+		Handler:   newDoHTestHandler(t, http.StatusOK, dns.RcodeSuccess, &hits),
+		TLSConfig: http3.ConfigureTLSConfig(&tls.Config{Certificates: []tls.Certificate{cert}}),
+	}
+	go func() { _ = server.Serve(conn) }()
+	defer func() { _ = server.Close() }()
+
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	provider, err := NewDMProvider([]string{"https://doh.test:" + strconv.Itoa(port) + "/dns-query"},
+		&DMProviderOptions{
+			HTTP3:          true,
+			EndpointIPs:    []net.IP{net.ParseIP("127.0.0.1")},
+			CACertFilePath: caFile,
+			EDNSSubnet:     "no",
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	rMsg, err := provider.Query(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a, ok := rMsg.Answer[0].(*dns.A); !ok || a.A.String() != "93.184.216.34" {
+		t.Errorf("unexpected answer: %v", rMsg.Answer[0])
+	}
+	if hits != 1 {
+		t.Errorf("query should be sent over HTTP/3, server hits: %v", hits)
+	}
+}
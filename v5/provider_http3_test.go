@@ -0,0 +1,47 @@
+package dohProxy
+
+import (
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// failingRoundTripper fails every request like an endpoint without h3.
+type failingRoundTripper struct {
+	requests int32
+}
+
+func (rt *failingRoundTripper) RoundTrip(*http.Request) (*http.Response, error) {
+	atomic.AddInt32(&rt.requests, 1)
+	return nil, errors.New("no recent network activity")
+}
+
+func TestHTTP3Fallback(t *testing.T) {
+	var hits int32
+	ts := newDoHTestServer(t, http.StatusOK, dns.RcodeSuccess, &hits)
+	defer ts.Close()
+
+	provider, err := NewDMProvider([]string{ts.URL}, &DMProviderOptions{EDNSSubnet: "no"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h3 := &failingRoundTripper{}
+	provider.client.Transport = &http3Transport{h3: h3, fallback: provider.client.Transport}
+
+	for i := 0; i < 2; i++ {
+		msg := new(dns.Msg)
+		msg.SetQuestion("example.com.", dns.TypeA)
+		if _, err := provider.Query(msg); err != nil {
+			t.Fatalf("query should fall back to HTTP/1.1: %v", err)
+		}
+	}
+	if requests := atomic.LoadInt32(&h3.requests); requests != 1 {
+		t.Errorf("HTTP/3 shouldn't be retried right after failure, requests: %v", requests)
+	}
+	if hits := atomic.LoadInt32(&hits); hits != 2 {
+		t.Errorf("expected 2 queries over fallback transport, got: %v", hits)
+	}
+}
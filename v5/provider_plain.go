@@ -0,0 +1,197 @@
+package dohProxy
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// PlainProvider queries plain DNS servers over udp or tcp; it implements the
+// Provider interface.
+type PlainProvider struct {
+	servers   []string
+	opts      *PlainProviderOptions
+	client    *dns.Client
+	tcpClient *dns.Client
+	cookies   *cookieJar
+	// port of the authorities of QnameMinimize, 53 if empty; for testing.
+	qminPort string
+}
+
+// PlainProviderOptions is a configuration object for optional PlainProvider configuration
+type PlainProviderOptions struct {
+	// "udp" (default) or "tcp", answers truncated over udp are retried over tcp.
+	Net string
+
+	// timeout of each exchange, 5 seconds if not specified.
+	Timeout time.Duration
+
+	// randomize the letter case of the query name, answers not echoing the
+	// same case are treated as failures; DNS 0x20 encoding.
+	QnameRandomize bool
+
+	// send DNS cookies and verify the cookies of answers, RFC 7873.
+	Cookies bool
+
+	// resolve iteratively from the servers taken as the root servers, sending
+	// only the next label of names to each authority; RFC 7816.
+	QnameMinimize bool
+}
+
+// errQnameMismatch is returned if the answer doesn't echo the randomized query
+// name.
+var errQnameMismatch = errors.New("query name of answer mismatched")
+
+// NewPlainProvider creates a PlainProvider, servers are like "8.8.8.8[:53]",
+// they are tried in order.
+func NewPlainProvider(servers []string, opts *PlainProviderOptions) (*PlainProvider, error) {
+	if opts == nil {
+		opts = &PlainProviderOptions{}
+	}
+	if opts.Net == "" {
+		opts.Net = "udp"
+	}
+	if opts.Net != "udp" && opts.Net != "tcp" {
+		return nil, fmt.Errorf("unsupported plain dns network: %v", opts.Net)
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = 5 * time.Second
+	}
+
+	provider := &PlainProvider{opts: opts}
+	for _, server := range servers {
+		addr, err := plainServerAddr(server)
+		if err != nil {
+			return nil, err
+		}
+		provider.servers = append(provider.servers, addr)
+	}
+	if len(provider.servers) == 0 {
+		return nil, errors.New("no plain dns server specified")
+	}
+	provider.client = &dns.Client{Net: opts.Net, Timeout: opts.Timeout}
+	provider.tcpClient = &dns.Client{Net: "tcp", Timeout: opts.Timeout}
+	if opts.Cookies {
+		jar, err := newCookieJar()
+		if err != nil {
+			return nil, err
+		}
+		provider.cookies = jar
+	}
+	return provider, nil
+}
+
+// plainServerAddr appends the default port 53 to server if it has none.
+func plainServerAddr(server string) (string, error) {
+	if _, _, err := net.SplitHostPort(server); err == nil {
+		return server, nil
+	}
+	ip := net.ParseIP(server)
+	if ip == nil {
+		return "", fmt.Errorf("invalid plain dns server: %v", server)
+	}
+	return net.JoinHostPort(ip.String(), "53"), nil
+}
+
+func (provider *PlainProvider) Query(msg *dns.Msg) (*dns.Msg, error) {
+	if len(msg.Question) == 0 {
+		upstreamLog.Debugf("no questions in resolve request.")
+		return nil, errors.New("should have question in resolve request")
+	}
+	if provider.opts.QnameMinimize {
+		startTime := time.Now()
+		rMsg, err := provider.resolveMinimized(msg, 0)
+		observeUpstream(startTime, err)
+		return rMsg, err
+	}
+
+	var err error
+	for _, server := range provider.servers {
+		startTime := time.Now()
+		var rMsg *dns.Msg
+		if provider.opts.Cookies {
+			rMsg, err = provider.exchangeWithCookie(msg, server)
+		} else {
+			rMsg, err = provider.exchangeServer(msg, server)
+		}
+		observeUpstream(startTime, err)
+		if err == nil {
+			return rMsg, nil
+		}
+		upstreamLog.Warnf("query plain dns server %v failed: %v", server, err)
+	}
+	return nil, err
+}
+
+// exchangeServer exchanges msg with server, with randomized query name if
+// QnameRandomize.
+func (provider *PlainProvider) exchangeServer(msg *dns.Msg, server string) (*dns.Msg, error) {
+	if provider.opts.QnameRandomize {
+		return provider.exchangeRandomized(msg, server)
+	}
+	return provider.exchange(msg, server)
+}
+
+func (provider *PlainProvider) exchange(msg *dns.Msg, server string) (*dns.Msg, error) {
+	rMsg, _, err := provider.client.Exchange(msg, server)
+	if err != nil {
+		return nil, fmt.Errorf("exchange with %v error: %w", server, err)
+	}
+	if rMsg.Truncated && provider.client.Net == "udp" {
+		upstreamLog.Debugf("truncated answer from %v, retry over tcp", server)
+		rMsg, _, err = provider.tcpClient.Exchange(msg, server)
+		if err != nil {
+			return nil, fmt.Errorf("exchange with %v over tcp error: %w", server, err)
+		}
+	}
+	upstreamLog.Debugf("Dns Answer Msg: \n%v", rMsg)
+	return rMsg, nil
+}
+
+// exchangeRandomized exchanges msg with the query name in randomized case, the
+// answer must echo the name bit-for-bit; the original name is restored in the
+// answer.
+func (provider *PlainProvider) exchangeRandomized(msg *dns.Msg, server string) (*dns.Msg, error) {
+	name := msg.Question[0].Name
+	randomized := randomizeCase(name)
+	qMsg := msg.Copy()
+	qMsg.Question[0].Name = randomized
+
+	rMsg, err := provider.exchange(qMsg, server)
+	if err != nil {
+		return nil, err
+	}
+	if len(rMsg.Question) == 0 || rMsg.Question[0].Name != randomized {
+		return nil, fmt.Errorf("%w: sent %v to %v", errQnameMismatch, randomized, server)
+	}
+	rMsg.Question[0].Name = name
+	for _, rrs := range [][]dns.RR{rMsg.Answer, rMsg.Ns, rMsg.Extra} {
+		for _, rr := range rrs {
+			if rr.Header().Name == randomized {
+				rr.Header().Name = name
+			}
+		}
+	}
+	return rMsg, nil
+}
+
+// randomizeCase flips the case of each letter in name randomly.
+func randomizeCase(name string) string {
+	bits := make([]byte, (len(name)+7)/8)
+	if _, err := rand.Read(bits); err != nil {
+		upstreamLog.Errorf("read random bits error: %v", err)
+		return name
+	}
+	b := []byte(strings.ToLower(name))
+	for i, c := range b {
+		if c >= 'a' && c <= 'z' && bits[i/8]&(1<<uint(i%8)) != 0 {
+			b[i] = c - 'a' + 'A'
+		}
+	}
+	return string(b)
+}
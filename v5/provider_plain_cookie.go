@@ -0,0 +1,123 @@
+package dohProxy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// length of client cookie in hex, 8 bytes.
+const clientCookieLen = 16
+
+// errBadCookie is returned if the answer has a bad or missing cookie after
+// retrying.
+var errBadCookie = errors.New("bad dns cookie")
+
+// cookieJar holds the client cookie and the cookies of servers.
+type cookieJar struct {
+	client string
+	lock   sync.Mutex
+	// server cookies in hex by server address, servers here support cookies.
+	servers map[string]string
+}
+
+func newCookieJar() (*cookieJar, error) {
+	b := make([]byte, clientCookieLen/2)
+	if _, err := rand.Read(b); err != nil {
+		return nil, fmt.Errorf("generate client cookie error: %v", err)
+	}
+	return &cookieJar{client: hex.EncodeToString(b), servers: make(map[string]string)}, nil
+}
+
+// serverCookie returns the cookie of server, and whether the server is known
+// to support cookies.
+func (j *cookieJar) serverCookie(server string) (string, bool) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	cookie, ok := j.servers[server]
+	return cookie, ok
+}
+
+func (j *cookieJar) setServerCookie(server string, cookie string) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.servers[server] = cookie
+}
+
+// exchangeWithCookie exchanges msg with the cookies of server, it's retried
+// once if the answer has a bad cookie, or none from a server supporting
+// cookies; the cookie is removed from the answer.
+func (provider *PlainProvider) exchangeWithCookie(msg *dns.Msg, server string) (*dns.Msg, error) {
+	var err error
+	for i := 0; i < 2; i++ {
+		serverCookie, supported := provider.cookies.serverCookie(server)
+		qMsg := msg.Copy()
+		setEDNS0Cookie(qMsg, provider.cookies.client+serverCookie)
+
+		var rMsg *dns.Msg
+		if rMsg, err = provider.exchangeServer(qMsg, server); err != nil {
+			return nil, err
+		}
+		cookie, ok := obtainEDNS0Cookie(rMsg)
+		switch {
+		case !ok && !supported:
+			// server not supporting cookies.
+			return rMsg, nil
+		case !ok:
+			err = fmt.Errorf("%w: no cookie from %v", errBadCookie, server)
+		case len(cookie) <= clientCookieLen || !strings.EqualFold(cookie[:clientCookieLen], provider.cookies.client):
+			err = fmt.Errorf("%w: client cookie mismatched from %v", errBadCookie, server)
+		default:
+			provider.cookies.setServerCookie(server, cookie[clientCookieLen:])
+			if rMsg.Rcode == dns.RcodeBadCookie {
+				err = fmt.Errorf("%w: BADCOOKIE from %v", errBadCookie, server)
+				break
+			}
+			removeEDNS0Cookie(rMsg)
+			return rMsg, nil
+		}
+		upstreamLog.Debugf("retry for %v", err)
+	}
+	return nil, err
+}
+
+// setEDNS0Cookie replaces the cookie option of msg with cookie in hex.
+func setEDNS0Cookie(msg *dns.Msg, cookie string) {
+	removeEDNS0Cookie(msg)
+	opt := msg.IsEdns0()
+	if opt == nil {
+		msg.SetEdns0(dns.DefaultMsgSize, false)
+		opt = msg.IsEdns0()
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: cookie})
+}
+
+func obtainEDNS0Cookie(msg *dns.Msg) (string, bool) {
+	if opt := msg.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if cookie, ok := o.(*dns.EDNS0_COOKIE); ok {
+				return cookie.Cookie, true
+			}
+		}
+	}
+	return "", false
+}
+
+func removeEDNS0Cookie(msg *dns.Msg) {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return
+	}
+	var options []dns.EDNS0
+	for _, o := range opt.Option {
+		if _, ok := o.(*dns.EDNS0_COOKIE); !ok {
+			options = append(options, o)
+		}
+	}
+	opt.Option = options
+}
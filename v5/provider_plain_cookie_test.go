@@ -0,0 +1,59 @@
+package dohProxy
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestPlainProvider_Cookies(t *testing.T) {
+	const serverCookie = "0123456789abcdef"
+	seen := make(chan string, 4)
+	var badOnce int32
+	stub := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		cookie, _ := obtainEDNS0Cookie(r)
+		seen <- cookie
+		m := new(dns.Msg)
+		m.SetReply(r)
+		if r.Question[0].Name == "bad-cookie.example.com." && atomic.CompareAndSwapInt32(&badOnce, 0, 1) {
+			m.Rcode = dns.RcodeBadCookie
+		}
+		m.SetEdns0(dns.DefaultMsgSize, false)
+		setEDNS0Cookie(m, cookie[:clientCookieLen]+serverCookie)
+		_ = w.WriteMsg(m)
+	})
+
+	provider, err := NewPlainProvider([]string{startPlainTestServer(t, stub)},
+		&PlainProviderOptions{Cookies: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := new(dns.Msg)
+	msg.SetQuestion("cookie.example.com.", dns.TypeA)
+	rMsg, err := provider.Query(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first := <-seen; len(first) != clientCookieLen {
+		t.Errorf("first query should have client cookie only, got: %v", first)
+	}
+	if _, ok := obtainEDNS0Cookie(rMsg); ok {
+		t.Errorf("cookie should be removed from answer: %v", rMsg)
+	}
+
+	if _, err := provider.Query(msg); err != nil {
+		t.Fatal(err)
+	}
+	if second := <-seen; second != provider.cookies.client+serverCookie {
+		t.Errorf("server cookie should be reused, got: %v", second)
+	}
+
+	msg.SetQuestion("bad-cookie.example.com.", dns.TypeA)
+	if rMsg, err = provider.Query(msg); err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) != 2 || rMsg.Rcode != dns.RcodeSuccess {
+		t.Errorf("BADCOOKIE should be retried once, sent %v queries, got: %v", len(seen), rMsg)
+	}
+}
@@ -0,0 +1,207 @@
+package dohProxy
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// max delegations followed when resolving a name iteratively.
+	maxQminReferrals = 16
+	// max depth of resolving the addresses of name servers without glue.
+	maxQminDepth = 4
+)
+
+// resolveMinimized resolves msg iteratively from the servers, which are taken
+// as the root servers; only the next label is sent to each authority, as an NS
+// query, until the zone of the name is found; RFC 7816. depth is the nesting of
+// resolving name servers without glue.
+func (provider *PlainProvider) resolveMinimized(msg *dns.Msg, depth int) (*dns.Msg, error) {
+	name := dns.Fqdn(msg.Question[0].Name)
+	servers := provider.servers
+	zone := "."
+	referrals := 0
+
+	labels := dns.SplitDomainName(name)
+	for i := len(labels) - 1; i >= 1; i-- {
+		child := dns.Fqdn(strings.Join(labels[i:], "."))
+		qMsg := new(dns.Msg)
+		qMsg.SetQuestion(child, dns.TypeNS)
+		qMsg.RecursionDesired = false
+		qMsg.SetEdns0(dns.DefaultMsgSize, false)
+		rMsg, err := provider.exchangeAuthorities(qMsg, servers)
+		if err != nil {
+			return nil, err
+		}
+		if rMsg.Rcode == dns.RcodeNameError {
+			// nothing exists under child, RFC 8020.
+			return minimizedNXDomain(msg, rMsg), nil
+		}
+		nsNames := delegationNames(rMsg, child)
+		if len(nsNames) == 0 {
+			// no zone cut at child, the same servers are authoritative.
+			continue
+		}
+		if referrals++; referrals > maxQminReferrals {
+			return nil, fmt.Errorf("too many referrals resolving %v", name)
+		}
+		if servers, err = provider.authorityServers(nsNames, rMsg, depth); err != nil {
+			return nil, err
+		}
+		zone = child
+		upstreamLog.Debugf("resolving %v, delegated to %v: %v", name, zone, servers)
+	}
+
+	qMsg := msg.Copy()
+	qMsg.RecursionDesired = false
+	for {
+		rMsg, err := provider.exchangeAuthorities(qMsg, servers)
+		if err != nil {
+			return nil, err
+		}
+		// the name itself may be delegated further.
+		cut, nsNames := referral(rMsg, name, zone)
+		if cut == "" {
+			rMsg.Id = msg.Id
+			rMsg.Question = append([]dns.Question(nil), msg.Question...)
+			rMsg.RecursionDesired = msg.RecursionDesired
+			rMsg.RecursionAvailable = true
+			rMsg.Authoritative = false
+			return rMsg, nil
+		}
+		if referrals++; referrals > maxQminReferrals {
+			return nil, fmt.Errorf("too many referrals resolving %v", name)
+		}
+		if servers, err = provider.authorityServers(nsNames, rMsg, depth); err != nil {
+			return nil, err
+		}
+		zone = cut
+	}
+}
+
+// exchangeAuthorities exchanges msg with the servers in order until one
+// answers with NOERROR or NXDOMAIN.
+func (provider *PlainProvider) exchangeAuthorities(msg *dns.Msg, servers []string) (*dns.Msg, error) {
+	var err error
+	for _, server := range servers {
+		var rMsg *dns.Msg
+		if provider.opts.Cookies {
+			rMsg, err = provider.exchangeWithCookie(msg, server)
+		} else {
+			rMsg, err = provider.exchangeServer(msg, server)
+		}
+		if err == nil && rMsg.Rcode != dns.RcodeSuccess && rMsg.Rcode != dns.RcodeNameError {
+			err = fmt.Errorf("%v answered %v", server, dns.RcodeToString[rMsg.Rcode])
+		}
+		if err == nil {
+			return rMsg, nil
+		}
+		upstreamLog.Debugf("query authority %v for %v failed: %v", server, msg.Question[0].Name, err)
+	}
+	return nil, err
+}
+
+// authorityServers returns the addresses of the name servers nsNames, from the
+// glue in rMsg, or resolved if there's none.
+func (provider *PlainProvider) authorityServers(nsNames []string, rMsg *dns.Msg, depth int) ([]string, error) {
+	var servers []string
+	for _, rr := range rMsg.Extra {
+		var ip net.IP
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		default:
+			continue
+		}
+		for _, nsName := range nsNames {
+			if dns.CanonicalName(rr.Header().Name) == nsName {
+				servers = append(servers, net.JoinHostPort(ip.String(), provider.authorityPort()))
+			}
+		}
+	}
+	if len(servers) > 0 {
+		return servers, nil
+	}
+	if depth >= maxQminDepth {
+		return nil, fmt.Errorf("too deep resolving name servers %v", nsNames)
+	}
+	for _, nsName := range nsNames {
+		qMsg := new(dns.Msg)
+		qMsg.SetQuestion(nsName, dns.TypeA)
+		aMsg, err := provider.resolveMinimized(qMsg, depth+1)
+		if err != nil {
+			upstreamLog.Debugf("resolve name server %v failed: %v", nsName, err)
+			continue
+		}
+		for _, rr := range aMsg.Answer {
+			if a, ok := rr.(*dns.A); ok {
+				servers = append(servers, net.JoinHostPort(a.A.String(), provider.authorityPort()))
+			}
+		}
+		if len(servers) > 0 {
+			return servers, nil
+		}
+	}
+	return nil, fmt.Errorf("no address of name servers %v", nsNames)
+}
+
+// authorityPort returns the port of authorities found by delegation, 53 unless
+// replaced for testing.
+func (provider *PlainProvider) authorityPort() string {
+	if provider.qminPort != "" {
+		return provider.qminPort
+	}
+	return "53"
+}
+
+// delegationNames returns the name servers of child in the answer or the
+// authority section of rMsg, in canonical form.
+func delegationNames(rMsg *dns.Msg, child string) []string {
+	var names []string
+	for _, rrs := range [][]dns.RR{rMsg.Answer, rMsg.Ns} {
+		for _, rr := range rrs {
+			if ns, ok := rr.(*dns.NS); ok && dns.CanonicalName(ns.Hdr.Name) == dns.CanonicalName(child) {
+				names = append(names, dns.CanonicalName(ns.Ns))
+			}
+		}
+	}
+	return names
+}
+
+// referral returns the zone cut below zone that rMsg delegates name to, with
+// the name servers; "" if rMsg isn't a referral.
+func referral(rMsg *dns.Msg, name string, zone string) (string, []string) {
+	if rMsg.Rcode != dns.RcodeSuccess || len(rMsg.Answer) > 0 || rMsg.Authoritative {
+		return "", nil
+	}
+	for _, rr := range rMsg.Ns {
+		ns, ok := rr.(*dns.NS)
+		if !ok {
+			continue
+		}
+		cut := dns.CanonicalName(ns.Hdr.Name)
+		if cut != dns.CanonicalName(zone) && dns.IsSubDomain(zone, cut) && dns.IsSubDomain(cut, name) {
+			return cut, delegationNames(rMsg, cut)
+		}
+	}
+	return "", nil
+}
+
+// minimizedNXDomain returns the NXDOMAIN answer of msg from the answer rMsg of
+// a minimized query, with its SOA for negative caching.
+func minimizedNXDomain(msg *dns.Msg, rMsg *dns.Msg) *dns.Msg {
+	nxMsg := new(dns.Msg)
+	nxMsg.SetRcode(msg, dns.RcodeNameError)
+	nxMsg.RecursionAvailable = true
+	for _, rr := range rMsg.Ns {
+		if rr.Header().Rrtype == dns.TypeSOA {
+			nxMsg.Ns = append(nxMsg.Ns, dns.Copy(rr))
+		}
+	}
+	return nxMsg
+}
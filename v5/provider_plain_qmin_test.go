@@ -0,0 +1,132 @@
+package dohProxy
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// startAuthorities starts udp dns servers with handlers on 127.0.0.1,
+// 127.0.0.2, ... and the same port, which is returned.
+func startAuthorities(t *testing.T, handlers []dns.Handler) string {
+	for attempt := 0; attempt < 10; attempt++ {
+		var pcs []net.PacketConn
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		pcs = append(pcs, pc)
+		_, port, _ := net.SplitHostPort(pc.LocalAddr().String())
+		for i := 2; i <= len(handlers); i++ {
+			if pc, err = net.ListenPacket("udp", fmt.Sprintf("127.0.0.%d:%v", i, port)); err != nil {
+				break
+			}
+			pcs = append(pcs, pc)
+		}
+		if err != nil {
+			for _, pc := range pcs {
+				_ = pc.Close()
+			}
+			continue
+		}
+		for i, pc := range pcs {
+			server := &dns.Server{Handler: handlers[i], PacketConn: pc}
+			started := make(chan bool)
+			server.NotifyStartedFunc = func() { close(started) }
+			go func() { _ = server.ActivateAndServe() }()
+			<-started
+			t.Cleanup(func() { _ = server.Shutdown() })
+		}
+		return port
+	}
+	t.Skip("no port free on all loopback addresses")
+	return ""
+}
+
+func TestPlainProvider_QnameMinimize(t *testing.T) {
+	var lock sync.Mutex
+	var queries []string
+	authority := func(server string, answer func(r *dns.Msg, m *dns.Msg)) dns.Handler {
+		return dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			lock.Lock()
+			queries = append(queries, fmt.Sprintf("%v %v %v", server, r.Question[0].Name,
+				dns.TypeToString[r.Question[0].Qtype]))
+			lock.Unlock()
+			m := new(dns.Msg)
+			m.SetReply(r)
+			answer(r, m)
+			_ = w.WriteMsg(m)
+		})
+	}
+	// snapshot of the queries sent, reset if reset.
+	sent := func(reset bool) []string {
+		lock.Lock()
+		defer lock.Unlock()
+		snapshot := append([]string(nil), queries...)
+		if reset {
+			queries = nil
+		}
+		return snapshot
+	}
+	rr := func(s string) dns.RR {
+		r, _ := dns.NewRR(s)
+		return r
+	}
+	// delegates zone to the name server at ip.
+	delegate := func(zone string, ip string) func(r *dns.Msg, m *dns.Msg) {
+		return func(r *dns.Msg, m *dns.Msg) {
+			m.Ns = []dns.RR{rr(zone + " 3600 IN NS ns." + zone)}
+			m.Extra = []dns.RR{rr("ns." + zone + " 3600 IN A " + ip)}
+		}
+	}
+	port := startAuthorities(t, []dns.Handler{
+		authority("root", delegate("com.", "127.0.0.2")),
+		authority("com", delegate("example.com.", "127.0.0.3")),
+		authority("example.com", func(r *dns.Msg, m *dns.Msg) {
+			m.Authoritative = true
+			switch q := r.Question[0]; {
+			case q.Name == "www.example.com." && q.Qtype == dns.TypeA:
+				m.Answer = []dns.RR{rr("www.example.com. 300 IN A 192.0.2.1")}
+			case strings.HasSuffix(q.Name, ".example.com."):
+				m.Rcode = dns.RcodeNameError
+				m.Ns = []dns.RR{rr("example.com. 300 IN SOA ns.example.com. admin.example.com. 1 3600 600 86400 60")}
+			}
+		}),
+	})
+
+	provider, err := NewPlainProvider([]string{"127.0.0.1:" + port}, &PlainProviderOptions{QnameMinimize: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider.qminPort = port
+	msg := new(dns.Msg)
+	msg.SetQuestion("www.example.com.", dns.TypeA)
+	rMsg, err := provider.Query(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rMsg.Answer) != 1 || rMsg.Answer[0].(*dns.A).A.String() != "192.0.2.1" || rMsg.Id != msg.Id {
+		t.Errorf("unexpected answer: %v", rMsg)
+	}
+	expected := []string{"root com. NS", "com example.com. NS", "example.com www.example.com. A"}
+	if got := sent(true); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected minimized queries %v, got: %v", expected, got)
+	}
+
+	msg.SetQuestion("a.b.missing.example.com.", dns.TypeA)
+	if rMsg, err = provider.Query(msg); err != nil {
+		t.Fatal(err)
+	}
+	if rMsg.Rcode != dns.RcodeNameError || len(rMsg.Ns) != 1 {
+		t.Errorf("expected NXDOMAIN with SOA, got: %v", rMsg)
+	}
+	got := sent(false)
+	if len(got) == 0 || got[len(got)-1] != "example.com missing.example.com. NS" {
+		t.Errorf("resolving should stop at the missing name, got: %v", got)
+	}
+}
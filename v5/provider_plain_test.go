@@ -0,0 +1,144 @@
+package dohProxy
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// newPlainTestServer starts a plain dns server answering A questions with ip.
+func newPlainTestServer(t *testing.T, network string, ip string) string {
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		rr, _ := dns.NewRR(r.Question[0].Name + " 300 IN A " + ip)
+		m.Answer = append(m.Answer, rr)
+		_ = w.WriteMsg(m)
+	})
+	server := &dns.Server{Handler: handler}
+	if network == "tcp" {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		server.Listener = l
+	} else {
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		server.PacketConn = pc
+	}
+	started := make(chan bool)
+	server.NotifyStartedFunc = func() { close(started) }
+	go func() { _ = server.ActivateAndServe() }()
+	<-started
+	t.Cleanup(func() { _ = server.Shutdown() })
+	if server.Listener != nil {
+		return server.Listener.Addr().String()
+	}
+	return server.PacketConn.LocalAddr().String()
+}
+
+func TestPlainProvider_Query(t *testing.T) {
+	for _, network := range []string{"udp", "tcp"} {
+		addr := newPlainTestServer(t, network, "10.0.0.1")
+		// the first server is unreachable.
+		provider, err := NewPlainProvider([]string{"127.0.0.1:1", addr}, &PlainProviderOptions{Net: network})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		msg := new(dns.Msg)
+		msg.SetQuestion("host.corp.local.", dns.TypeA)
+		rMsg, err := provider.Query(msg)
+		if err != nil {
+			t.Fatalf("%v: %v", network, err)
+		}
+		if a, ok := rMsg.Answer[0].(*dns.A); !ok || a.A.String() != "10.0.0.1" {
+			t.Errorf("%v: unexpected answer: %v", network, rMsg)
+		}
+	}
+}
+
+func TestPlainServerAddr(t *testing.T) {
+	cases := map[string]string{
+		"1.1.1.1":          "1.1.1.1:53",
+		"1.1.1.1:5353":     "1.1.1.1:5353",
+		"2001:db8::1":      "[2001:db8::1]:53",
+		"[2001:db8::1]:54": "[2001:db8::1]:54",
+	}
+	for server, expected := range cases {
+		if addr, err := plainServerAddr(server); err != nil || addr != expected {
+			t.Errorf("%v: expected %v, got %v, %v", server, expected, addr, err)
+		}
+	}
+	if _, err := plainServerAddr("not a server"); err == nil {
+		t.Errorf("expected error for invalid server")
+	}
+}
+
+func TestPlainProvider_QnameRandomize(t *testing.T) {
+	seen := make(chan string, 1)
+	echo := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		seen <- r.Question[0].Name
+		m := new(dns.Msg)
+		m.SetReply(r)
+		rr, _ := dns.NewRR(r.Question[0].Name + " 300 IN A 10.0.0.1")
+		m.Answer = append(m.Answer, rr)
+		_ = w.WriteMsg(m)
+	})
+	lower := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Question[0].Name = strings.ToLower(m.Question[0].Name)
+		_ = w.WriteMsg(m)
+	})
+
+	name := "randomized-case.internal.example.com."
+	provider, err := NewPlainProvider([]string{startPlainTestServer(t, echo)},
+		&PlainProviderOptions{QnameRandomize: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := new(dns.Msg)
+	msg.SetQuestion(name, dns.TypeA)
+	rMsg, err := provider.Query(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent := <-seen
+	if sent == name || !strings.EqualFold(sent, name) {
+		t.Errorf("query name should be sent in randomized case, got: %v", sent)
+	}
+	if rMsg.Question[0].Name != name || rMsg.Answer[0].Header().Name != name {
+		t.Errorf("query name should be restored in answer, got: %v", rMsg)
+	}
+
+	provider, err = NewPlainProvider([]string{startPlainTestServer(t, lower)},
+		&PlainProviderOptions{QnameRandomize: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := provider.Query(msg); !errors.Is(err, errQnameMismatch) {
+		t.Errorf("answer not echoing the case should fail, got: %v", err)
+	}
+}
+
+// startPlainTestServer starts a udp dns server with handler.
+func startPlainTestServer(t *testing.T, handler dns.Handler) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &dns.Server{Handler: handler, PacketConn: pc}
+	started := make(chan bool)
+	server.NotifyStartedFunc = func() { close(started) }
+	go func() { _ = server.ActivateAndServe() }()
+	<-started
+	t.Cleanup(func() { _ = server.Shutdown() })
+	return pc.LocalAddr().String()
+}
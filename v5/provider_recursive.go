@@ -0,0 +1,158 @@
+package dohProxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// RecursiveProvider resolves names iteratively from the root servers with
+// plain dns, without any upstream resolver; referrals are followed with
+// minimized query names as PlainProviderOptions.QnameMinimize, and CNAMEs to
+// other zones are resolved from the root too. It implements the Provider
+// interface.
+type RecursiveProvider struct {
+	plain *PlainProvider
+}
+
+// RecursiveProviderOptions is a configuration object for optional
+// RecursiveProvider configuration
+type RecursiveProviderOptions struct {
+	// the root servers as "ip[:port]", the ipv4 addresses of the root hints
+	// if empty.
+	RootServers []string
+
+	// plain dns resolver the addresses of the root servers are primed from on
+	// creating, by the ". NS" query, e.g. "8.8.8.8:53"; the root hints are
+	// kept if empty, or priming fails. Ignored if RootServers specified.
+	Bootstrap string
+
+	// timeout of each exchange, 5 seconds if not specified.
+	Timeout time.Duration
+
+	// same as those of PlainProviderOptions.
+	QnameRandomize bool
+	Cookies        bool
+}
+
+// NewRecursiveProvider creates a RecursiveProvider.
+func NewRecursiveProvider(opts *RecursiveProviderOptions) (*RecursiveProvider, error) {
+	if opts == nil {
+		opts = &RecursiveProviderOptions{}
+	}
+	roots := opts.RootServers
+	if len(roots) == 0 {
+		roots = rootHintServers()
+		if opts.Bootstrap != "" {
+			primed, err := primeRootServers(opts.Bootstrap, opts.Timeout)
+			if err != nil {
+				upstreamLog.Warnf("prime root servers from %v failed, using the root hints: %v", opts.Bootstrap, err)
+			} else {
+				roots = primed
+			}
+		}
+	}
+	plain, err := NewPlainProvider(roots, &PlainProviderOptions{
+		Timeout:        opts.Timeout,
+		QnameRandomize: opts.QnameRandomize,
+		Cookies:        opts.Cookies,
+		QnameMinimize:  true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &RecursiveProvider{plain: plain}, nil
+}
+
+// rootHintServers returns the ipv4 addresses of the root hints.
+func rootHintServers() []string {
+	servers := make([]string, 0, len(rootServers))
+	for _, server := range rootServers {
+		servers = append(servers, net.JoinHostPort(server[1], "53"))
+	}
+	return servers
+}
+
+// primeRootServers queries resolver for the root servers, their ipv4
+// addresses are returned.
+func primeRootServers(resolver string, timeout time.Duration) ([]string, error) {
+	provider, err := NewPlainProvider([]string{resolver}, &PlainProviderOptions{Timeout: timeout})
+	if err != nil {
+		return nil, err
+	}
+	msg := new(dns.Msg)
+	msg.SetQuestion(".", dns.TypeNS)
+	msg.SetEdns0(dns.DefaultMsgSize, false)
+	rMsg, err := provider.Query(msg)
+	if err != nil {
+		return nil, err
+	}
+	nsNames := make(map[string]bool)
+	for _, rr := range rMsg.Answer {
+		if ns, ok := rr.(*dns.NS); ok && ns.Hdr.Name == "." {
+			nsNames[dns.CanonicalName(ns.Ns)] = true
+		}
+	}
+	var servers []string
+	for _, rr := range rMsg.Extra {
+		if a, ok := rr.(*dns.A); ok && nsNames[dns.CanonicalName(a.Hdr.Name)] {
+			servers = append(servers, net.JoinHostPort(a.A.String(), "53"))
+		}
+	}
+	if len(servers) == 0 {
+		return nil, errors.New("no address of root servers answered")
+	}
+	return servers, nil
+}
+
+func (provider *RecursiveProvider) Query(msg *dns.Msg) (*dns.Msg, error) {
+	if len(msg.Question) == 0 {
+		return nil, errors.New("should have question in resolve request")
+	}
+	startTime := time.Now()
+	rMsg, err := provider.resolve(msg)
+	observeUpstream(startTime, err)
+	return rMsg, err
+}
+
+// resolve resolves msg from the root servers, following the CNAMEs not
+// resolved in the answer.
+func (provider *RecursiveProvider) resolve(msg *dns.Msg) (*dns.Msg, error) {
+	rMsg, err := provider.plain.resolveMinimized(msg, 0)
+	if err != nil {
+		return nil, err
+	}
+	q := msg.Question[0]
+	if q.Qtype == dns.TypeCNAME || q.Qtype == dns.TypeANY {
+		return rMsg, nil
+	}
+	name := q.Name
+	seen := map[string]bool{}
+	for {
+		target, _, ok := findCNAME(rMsg.Answer, name)
+		if !ok {
+			return rMsg, nil
+		}
+		if seen[dns.CanonicalName(target)] || len(seen) >= maxCNAMEDepth {
+			return nil, fmt.Errorf("cname chain of %v is looping or too long", q.Name)
+		}
+		seen[dns.CanonicalName(name)] = true
+		name = target
+		if _, _, ok := findCNAME(rMsg.Answer, name); ok || hasAddress(rMsg.Answer, name, q.Qtype) {
+			continue
+		}
+		// the target is in another zone.
+		qMsg := msg.Copy()
+		qMsg.Question[0].Name = name
+		next, err := provider.plain.resolveMinimized(qMsg, 0)
+		if err != nil {
+			return nil, fmt.Errorf("resolve cname %v of %v error: %v", name, q.Name, err)
+		}
+		rMsg.Rcode = next.Rcode
+		rMsg.Answer = append(rMsg.Answer, next.Answer...)
+		rMsg.Ns = next.Ns
+	}
+}
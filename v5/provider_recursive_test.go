@@ -0,0 +1,84 @@
+package dohProxy
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestRecursiveProvider_Query(t *testing.T) {
+	rr := func(s string) dns.RR {
+		r, _ := dns.NewRR(s)
+		return r
+	}
+	authority := func(answer func(q dns.Question, m *dns.Msg)) dns.Handler {
+		return dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			m := new(dns.Msg)
+			m.SetReply(r)
+			answer(r.Question[0], m)
+			_ = w.WriteMsg(m)
+		})
+	}
+	delegate := func(m *dns.Msg, zone string, ip string) {
+		m.Ns = []dns.RR{rr(zone + " 3600 IN NS ns." + zone)}
+		m.Extra = []dns.RR{rr("ns." + zone + " 3600 IN A " + ip)}
+	}
+	port := startAuthorities(t, []dns.Handler{
+		// the root.
+		authority(func(q dns.Question, m *dns.Msg) {
+			switch {
+			case strings.HasSuffix(q.Name, "com."):
+				delegate(m, "com.", "127.0.0.2")
+			case strings.HasSuffix(q.Name, "net."):
+				delegate(m, "net.", "127.0.0.4")
+			default:
+				m.Rcode = dns.RcodeNameError
+			}
+		}),
+		// the com TLD.
+		authority(func(q dns.Question, m *dns.Msg) {
+			delegate(m, "example.com.", "127.0.0.3")
+		}),
+		// example.com, the CNAME target is in another zone.
+		authority(func(q dns.Question, m *dns.Msg) {
+			m.Authoritative = true
+			if q.Name == "www.example.com." {
+				m.Answer = []dns.RR{rr("www.example.com. 300 IN CNAME edge.example.net.")}
+			}
+		}),
+		// the net TLD, authoritative for example.net too.
+		authority(func(q dns.Question, m *dns.Msg) {
+			m.Authoritative = true
+			if q.Name == "edge.example.net." && q.Qtype == dns.TypeA {
+				m.Answer = []dns.RR{rr("edge.example.net. 60 IN A 192.0.2.7")}
+			}
+		}),
+	})
+
+	provider, err := NewRecursiveProvider(&RecursiveProviderOptions{RootServers: []string{"127.0.0.1:" + port}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider.plain.qminPort = port
+	msg := new(dns.Msg)
+	msg.SetQuestion("www.example.com.", dns.TypeA)
+	rMsg, err := provider.Query(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rMsg.Rcode != dns.RcodeSuccess || len(rMsg.Answer) != 2 || !rMsg.RecursionAvailable || rMsg.Id != msg.Id {
+		t.Fatalf("unexpected answer: %v", rMsg)
+	}
+	if cname, ok := rMsg.Answer[0].(*dns.CNAME); !ok || cname.Target != "edge.example.net." {
+		t.Errorf("expected cname to edge.example.net., got: %v", rMsg.Answer[0])
+	}
+	if a, ok := rMsg.Answer[1].(*dns.A); !ok || a.A.String() != "192.0.2.7" {
+		t.Errorf("cname should be resolved from the root, got: %v", rMsg.Answer[1])
+	}
+
+	msg.SetQuestion("www.example.org.", dns.TypeA)
+	if rMsg, err = provider.Query(msg); err != nil || rMsg.Rcode != dns.RcodeNameError {
+		t.Errorf("expected NXDOMAIN from the root, got: %v, %v", rMsg, err)
+	}
+}
@@ -0,0 +1,198 @@
+package dohProxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Route maps a domain suffix to the upstreams answering the names under it.
+type Route struct {
+	// the domain, names equal to or under it are routed.
+	Suffix string
+	// "https://..." for DoH, "tls://..." for DoT, "quic://..." for DoQ,
+	// "tcp://host[:port]" or
+	// "[udp://]host[:port]" for plain DNS; all upstreams of a route must be of
+	// the same kind.
+	Upstreams []string
+}
+
+// RouteProvider picks the provider by the question name, the longest matched
+// suffix wins, names matching no route are queried by the default provider; it
+// implements the Provider interface.
+type RouteProvider struct {
+	routes          map[string]Provider
+	defaultProvider Provider
+}
+
+// LoadRoutes reads the routing file, one route per line:
+//
+//	corp.local 10.0.0.53 10.0.0.54:53
+//	vpn.corp.local tcp://10.1.0.53
+//	example.org https://doh.example.org/dns-query
+func LoadRoutes(path string) ([]Route, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open routes file %v error: %v", path, err)
+	}
+	defer func() { _ = f.Close() }()
+
+	var routes []Route
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			// Discard comments.
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("routes file %v line %v: no upstream for %v", path, lineNo, fields[0])
+		}
+		routes = append(routes, Route{Suffix: fields[0], Upstreams: fields[1:]})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read routes file %v error: %v", path, err)
+	}
+	return routes, nil
+}
+
+// NewRouteProvider creates a RouteProvider, providers of DoH, DoT and DoQ routes
+// are created with opts, except the endpoint ips.
+func NewRouteProvider(defaultProvider Provider, routes []Route, opts *DMProviderOptions) (*RouteProvider, error) {
+	provider := &RouteProvider{
+		routes:          make(map[string]Provider),
+		defaultProvider: defaultProvider,
+	}
+	for _, route := range routes {
+		suffix := dns.CanonicalName(strings.TrimPrefix(route.Suffix, "*."))
+		if _, ok := dns.IsDomainName(suffix); !ok {
+			return nil, fmt.Errorf("invalid route domain: %v", route.Suffix)
+		}
+		p, err := newRouteUpstream(route.Upstreams, opts)
+		if err != nil {
+			return nil, fmt.Errorf("route %v: %v", route.Suffix, err)
+		}
+		provider.routes[suffix] = p
+		upstreamLog.Infof("route %v to %v", suffix, route.Upstreams)
+	}
+	return provider, nil
+}
+
+func newRouteUpstream(upstreams []string, opts *DMProviderOptions) (Provider, error) {
+	scheme := routeUpstreamScheme(upstreams[0])
+	for _, upstream := range upstreams[1:] {
+		if routeUpstreamScheme(upstream) != scheme {
+			return nil, fmt.Errorf("mixed upstream kinds: %v", upstreams)
+		}
+	}
+
+	switch scheme {
+	case "https", "tls", "quic":
+		dmOpts := DMProviderOptions{}
+		if opts != nil {
+			dmOpts = *opts
+		}
+		// the endpoint ips are of the default endpoint.
+		dmOpts.EndpointIPs = nil
+		dmOpts.Protocol = ProtocolDoH
+		switch scheme {
+		case "tls":
+			dmOpts.Protocol = ProtocolDoT
+		case "quic":
+			dmOpts.Protocol = ProtocolDoQ
+		}
+		return NewDMProvider(upstreams, &dmOpts)
+	case "udp", "tcp":
+		servers := make([]string, 0, len(upstreams))
+		for _, upstream := range upstreams {
+			servers = append(servers, strings.TrimPrefix(upstream, scheme+"://"))
+		}
+		plainOpts := &PlainProviderOptions{Net: scheme}
+		if opts != nil {
+			plainOpts.QnameRandomize = opts.QnameRandomize
+			plainOpts.Cookies = opts.Cookies
+			plainOpts.QnameMinimize = opts.QnameMinimize
+		}
+		return NewPlainProvider(servers, plainOpts)
+	default:
+		return nil, fmt.Errorf("unsupported upstream: %v", upstreams[0])
+	}
+}
+
+// routeUpstreamScheme returns the scheme of upstream, "udp" if omitted.
+func routeUpstreamScheme(upstream string) string {
+	if !strings.Contains(upstream, "://") {
+		return "udp"
+	}
+	u, err := url.Parse(upstream)
+	if err != nil {
+		return ""
+	}
+	return u.Scheme
+}
+
+// Route returns the provider for name.
+func (provider *RouteProvider) Route(name string) Provider {
+	name = dns.CanonicalName(name)
+	// the name itself, then its parent domains, the longest one first.
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if p, ok := provider.routes[name[off:]]; ok {
+			return p
+		}
+	}
+	return provider.defaultProvider
+}
+
+func (provider *RouteProvider) Query(msg *dns.Msg) (*dns.Msg, error) {
+	if len(msg.Question) == 0 {
+		upstreamLog.Debugf("no questions in resolve request.")
+		return nil, fmt.Errorf("should have question in resolve request")
+	}
+	return provider.Route(msg.Question[0].Name).Query(msg)
+}
+
+// QueryClient is like Query, passing clientIP to the provider routed to.
+func (provider *RouteProvider) QueryClient(msg *dns.Msg, clientIP net.IP) (*dns.Msg, error) {
+	if len(msg.Question) == 0 {
+		upstreamLog.Debugf("no questions in resolve request.")
+		return nil, fmt.Errorf("should have question in resolve request")
+	}
+	return queryClient(provider.Route(msg.Question[0].Name), msg, clientIP)
+}
+
+// QueryContext is like QueryClient, passing ctx to the provider routed to.
+func (provider *RouteProvider) QueryContext(ctx context.Context, msg *dns.Msg, clientIP net.IP) (*dns.Msg, error) {
+	if len(msg.Question) == 0 {
+		upstreamLog.Debugf("no questions in resolve request.")
+		return nil, fmt.Errorf("should have question in resolve request")
+	}
+	return queryContext(ctx, provider.Route(msg.Question[0].Name), msg, clientIP)
+}
+
+// Close closes the providers of all routes and the default provider.
+func (provider *RouteProvider) Close() error {
+	var err error
+	closeProvider := func(p Provider) {
+		if closer, ok := p.(io.Closer); ok {
+			if e := closer.Close(); e != nil {
+				err = e
+			}
+		}
+	}
+	for _, p := range provider.routes {
+		closeProvider(p)
+	}
+	closeProvider(provider.defaultProvider)
+	return err
+}
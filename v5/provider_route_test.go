@@ -0,0 +1,76 @@
+package dohProxy
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestRouteProvider_LongestSuffix(t *testing.T) {
+	corp := &testProvider{name: "corp"}
+	vpn := &testProvider{name: "vpn"}
+	defaultProvider := &testProvider{name: "default"}
+	provider := &RouteProvider{
+		routes: map[string]Provider{
+			"corp.local.":     corp,
+			"vpn.corp.local.": vpn,
+		},
+		defaultProvider: defaultProvider,
+	}
+
+	cases := map[string]string{
+		"corp.local.":            "corp",
+		"git.corp.local.":        "corp",
+		"vpn.corp.local.":        "vpn",
+		"host.vpn.corp.local.":   "vpn",
+		"HOST.VPN.Corp.Local.":   "vpn",
+		"xvpn.corp.local.":       "corp",
+		"notcorp.local.":         "default",
+		"example.com.":           "default",
+		"corp.local.example.com": "default",
+	}
+	for name, expected := range cases {
+		msg := new(dns.Msg)
+		msg.SetQuestion(dns.Fqdn(name), dns.TypeTXT)
+		rMsg, err := provider.Query(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if txt := txtOf(rMsg); txt != expected {
+			t.Errorf("%v: expected routed to %v, got %v", name, expected, txt)
+		}
+	}
+}
+
+func TestLoadRoutes(t *testing.T) {
+	content := `# internal domains
+corp.local 10.0.0.53 10.0.0.54:53
+*.vpn.corp.local tcp://10.1.0.53
+example.org https://doh.example.org/dns-query
+`
+	routes, err := LoadRoutes(writeTestConfig(t, content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(routes) != 3 || routes[1].Suffix != "*.vpn.corp.local" || len(routes[0].Upstreams) != 2 {
+		t.Fatalf("unexpected routes: %+v", routes)
+	}
+
+	provider, err := NewRouteProvider(&testProvider{name: "default"}, routes, &DMProviderOptions{EDNSSubnet: "no"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := provider.Route("a.corp.local.").(*PlainProvider); !ok {
+		t.Errorf("corp.local should be routed to plain dns")
+	}
+	if p, ok := provider.Route("a.vpn.corp.local.").(*PlainProvider); !ok || p.opts.Net != "tcp" {
+		t.Errorf("vpn.corp.local should be routed to plain dns over tcp")
+	}
+	if _, ok := provider.Route("www.example.org.").(*DMProvider); !ok {
+		t.Errorf("example.org should be routed to DoH")
+	}
+
+	if _, err := NewRouteProvider(nil, []Route{{Suffix: "corp.local", Upstreams: []string{"10.0.0.53", "https://doh.example"}}}, nil); err == nil {
+		t.Errorf("expected error for mixed upstream kinds")
+	}
+}
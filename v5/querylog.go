@@ -0,0 +1,214 @@
+package dohProxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// QueryLogFormatText writes the entries as "key=value" pairs, the
+	// default; QueryLogFormatJSON writes json lines.
+	QueryLogFormatText = "text"
+	QueryLogFormatJSON = "json"
+
+	// entries are dropped if this many are waiting to be written.
+	queryLogBufferSize = 4096
+)
+
+// QueryLogEntry is a line in the query log.
+type QueryLogEntry struct {
+	Time     time.Time `json:"time"`
+	ClientIP string    `json:"client_ip"`
+	Name     string    `json:"qname"`
+	Type     string    `json:"qtype"`
+	Rcode    string    `json:"rcode"`
+	CacheHit bool      `json:"cache_hit"`
+	// 0 if not answered by upstream.
+	UpstreamLatency time.Duration `json:"-"`
+}
+
+type queryLogJSONEntry struct {
+	*QueryLogEntry
+	UpstreamLatencyMs float64 `json:"upstream_latency_ms"`
+}
+
+// QueryLogOptions specifies options of the query log.
+type QueryLogOptions struct {
+	// QueryLogFormatText (default) or QueryLogFormatJSON.
+	Format string
+	// the file is rotated to "<path>.1" when it exceeds MaxSize bytes, 0 means
+	// no rotation.
+	MaxSize int64
+}
+
+// QueryLog appends the entries to a file asynchronously, so logging never
+// blocks the handler.
+type QueryLog struct {
+	path    string
+	opts    *QueryLogOptions
+	file    *os.File
+	writer  *bufio.Writer
+	size    int64
+	entries chan *QueryLogEntry
+	done    sync.WaitGroup
+}
+
+// NewQueryLog opens the query log at path for appending.
+func NewQueryLog(path string, opts *QueryLogOptions) (*QueryLog, error) {
+	if opts == nil {
+		opts = &QueryLogOptions{}
+	}
+	switch opts.Format {
+	case "", QueryLogFormatText, QueryLogFormatJSON:
+	default:
+		return nil, fmt.Errorf("unsupported query log format: %v", opts.Format)
+	}
+	l := &QueryLog{path: path, opts: opts, entries: make(chan *QueryLogEntry, queryLogBufferSize)}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	l.done.Add(1)
+	go l.run()
+	return l, nil
+}
+
+// Log queues entry for writing, it's dropped if the queue is full.
+func (l *QueryLog) Log(entry *QueryLogEntry) {
+	select {
+	case l.entries <- entry:
+	default:
+		metricQueryLogDropped.Inc()
+	}
+}
+
+// Close writes the queued entries and closes the file, Log must not be called
+// after closing.
+func (l *QueryLog) Close() error {
+	close(l.entries)
+	l.done.Wait()
+	return l.file.Close()
+}
+
+func (l *QueryLog) open() error {
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("open query log %v error: %v", l.path, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return fmt.Errorf("stat query log %v error: %v", l.path, err)
+	}
+	l.file = file
+	l.writer = bufio.NewWriter(file)
+	l.size = info.Size()
+	return nil
+}
+
+func (l *QueryLog) run() {
+	defer l.done.Done()
+	for entry := range l.entries {
+		l.write(entry)
+		// flush when idle, so lines are visible without waiting for a full
+		// buffer.
+		if len(l.entries) == 0 {
+			if err := l.writer.Flush(); err != nil {
+				Log.Errorf("write query log error: %v", err)
+			}
+		}
+	}
+	if err := l.writer.Flush(); err != nil {
+		Log.Errorf("write query log error: %v", err)
+	}
+}
+
+func (l *QueryLog) write(entry *QueryLogEntry) {
+	line := l.format(entry)
+	if l.opts.MaxSize > 0 && l.size > 0 && l.size+int64(len(line)) > l.opts.MaxSize {
+		if err := l.rotate(); err != nil {
+			Log.Errorf("rotate query log error: %v", err)
+		}
+	}
+	n, err := l.writer.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		Log.Errorf("write query log error: %v", err)
+	}
+}
+
+// rotate renames the file to "<path>.1", replacing the previous one.
+func (l *QueryLog) rotate() error {
+	if err := l.writer.Flush(); err != nil {
+		return err
+	}
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(l.path, l.path+".1"); err != nil {
+		Log.Errorf("rename query log error: %v", err)
+	}
+	return l.open()
+}
+
+func (l *QueryLog) format(entry *QueryLogEntry) []byte {
+	latencyMs := float64(entry.UpstreamLatency) / float64(time.Millisecond)
+	if l.opts.Format == QueryLogFormatJSON {
+		line, err := json.Marshal(&queryLogJSONEntry{QueryLogEntry: entry, UpstreamLatencyMs: latencyMs})
+		if err != nil {
+			Log.Errorf("marshal query log entry error: %v", err)
+			return nil
+		}
+		return append(line, '\n')
+	}
+	return []byte(fmt.Sprintf("time=%v client_ip=%v qname=%v qtype=%v rcode=%v cache_hit=%v upstream_latency_ms=%.3f\n",
+		entry.Time.Format(time.RFC3339Nano), entry.ClientIP, entry.Name, entry.Type, entry.Rcode,
+		entry.CacheHit, latencyMs))
+}
+
+// queryLogWriter records the rcode of the answer for the query log.
+type queryLogWriter struct {
+	dns.ResponseWriter
+	lock    sync.Mutex
+	entry   QueryLogEntry
+	written bool
+}
+
+func newQueryLogWriter(writer dns.ResponseWriter, clientIP net.IP, msg *dns.Msg) *queryLogWriter {
+	w := &queryLogWriter{ResponseWriter: writer, entry: QueryLogEntry{Time: time.Now()}}
+	if clientIP != nil {
+		w.entry.ClientIP = clientIP.String()
+	}
+	if len(msg.Question) > 0 {
+		w.entry.Name = msg.Question[0].Name
+		w.entry.Type = dns.TypeToString[msg.Question[0].Qtype]
+	}
+	return w
+}
+
+func (w *queryLogWriter) WriteMsg(msg *dns.Msg) error {
+	w.lock.Lock()
+	w.entry.Rcode = dns.RcodeToString[msg.Rcode]
+	w.written = true
+	w.lock.Unlock()
+	return w.ResponseWriter.WriteMsg(msg)
+}
+
+// finish logs the query to l if it's answered, dropped queries aren't logged.
+func (w *queryLogWriter) finish(l *QueryLog, cacheHit bool, upstreamLatency time.Duration) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if !w.written {
+		return
+	}
+	entry := w.entry
+	entry.CacheHit = cacheHit
+	entry.UpstreamLatency = upstreamLatency
+	l.Log(&entry)
+}
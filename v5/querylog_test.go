@@ -0,0 +1,85 @@
+package dohProxy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestQueryLog_Handler(t *testing.T) {
+	for _, format := range []string{QueryLogFormatText, QueryLogFormatJSON} {
+		path := writeTestConfig(t, "")
+		queryLog, err := NewQueryLog(path, &QueryLogOptions{Format: format})
+		if err != nil {
+			t.Fatal(err)
+		}
+		handler := NewHandler(&testProvider{name: "upstream"}, &HandlerOptions{QueryLog: queryLog})
+
+		writer := newTestResponseWriter("192.0.2.1:5353")
+		msg := new(dns.Msg)
+		msg.SetQuestion("logged.example.com.", dns.TypeTXT)
+		handler.Handle(writer, msg)
+		writer.waitMsg(t, time.Second)
+		if err := queryLog.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+		if len(lines) != 1 {
+			t.Fatalf("%v: expected 1 line, got: %q", format, content)
+		}
+		if format == QueryLogFormatJSON {
+			var entry map[string]interface{}
+			if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+				t.Fatal(err)
+			}
+			if entry["client_ip"] != "192.0.2.1" || entry["qname"] != "logged.example.com." ||
+				entry["qtype"] != "TXT" || entry["rcode"] != "NOERROR" || entry["cache_hit"] != false {
+				t.Errorf("unexpected json line: %v", lines[0])
+			}
+			if _, ok := entry["upstream_latency_ms"].(float64); !ok {
+				t.Errorf("upstream latency should be logged: %v", lines[0])
+			}
+			continue
+		}
+		for _, field := range []string{"client_ip=192.0.2.1", "qname=logged.example.com.", "qtype=TXT",
+			"rcode=NOERROR", "cache_hit=false", "upstream_latency_ms="} {
+			if !strings.Contains(lines[0], field) {
+				t.Errorf("%v not found in line: %v", field, lines[0])
+			}
+		}
+	}
+}
+
+func TestQueryLog_Rotate(t *testing.T) {
+	path := writeTestConfig(t, "")
+	queryLog, err := NewQueryLog(path, &QueryLogOptions{MaxSize: 300})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		queryLog.Log(&QueryLogEntry{Time: time.Now(), ClientIP: "192.0.2.1", Name: "example.com.",
+			Type: "A", Rcode: "NOERROR"})
+	}
+	if err := queryLog.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{path, path + ".1"} {
+		info, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() == 0 || info.Size() > 300 {
+			t.Errorf("%v should be rotated under 300 bytes, got: %v", p, info.Size())
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package dohProxy
+
+import (
+	"hash/fnv"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// RateLimitActionRefuse answers the queries over the limit with REFUSED,
+	// the default; RateLimitActionDrop drops them silently.
+	RateLimitActionRefuse = "refuse"
+	RateLimitActionDrop   = "drop"
+
+	// buckets are spread over shards so clients don't contend on one lock.
+	rateLimitShards = 32
+	// buckets idle for this duration are evicted, they are full anyway.
+	rateLimitIdleTimeout = 5 * time.Minute
+)
+
+// RateLimiter limits the queries of each client ip with a token bucket.
+type RateLimiter struct {
+	rate   float64
+	burst  float64
+	shards [rateLimitShards]rateLimitShard
+	// now is replaceable for testing.
+	now func() time.Time
+}
+
+type rateLimitShard struct {
+	lock    sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens   float64
+	lastSeen time.Time
+}
+
+// NewRateLimiter creates a RateLimiter allowing rate queries per second for
+// each client, with bursts of burst queries; burst defaults to rate.
+func NewRateLimiter(rate uint32, burst uint32) *RateLimiter {
+	if burst == 0 {
+		burst = rate
+	}
+	limiter := &RateLimiter{rate: float64(rate), burst: float64(burst), now: time.Now}
+	for i := range limiter.shards {
+		limiter.shards[i].buckets = make(map[string]*tokenBucket)
+	}
+	go limiter.evict()
+	return limiter
+}
+
+// Allow reports whether the client at ip may query now, a token is taken if
+// so.
+func (l *RateLimiter) Allow(ip net.IP) bool {
+	key := string(ip.To16())
+	shard := l.shard(key)
+	now := l.now()
+
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+
+	bucket := shard.buckets[key]
+	if bucket == nil {
+		bucket = &tokenBucket{tokens: l.burst, lastSeen: now}
+		shard.buckets[key] = bucket
+	}
+	bucket.tokens += now.Sub(bucket.lastSeen).Seconds() * l.rate
+	if bucket.tokens > l.burst {
+		bucket.tokens = l.burst
+	}
+	bucket.lastSeen = now
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+func (l *RateLimiter) shard(key string) *rateLimitShard {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return &l.shards[h.Sum32()%rateLimitShards]
+}
+
+func (l *RateLimiter) evict() {
+	// infinite loop
+	for {
+		time.Sleep(rateLimitIdleTimeout)
+		l.doEvict()
+	}
+}
+
+// doEvict drops the buckets idle for rateLimitIdleTimeout.
+func (l *RateLimiter) doEvict() {
+	now := l.now()
+	evicted := 0
+	for i := range l.shards {
+		shard := &l.shards[i]
+		shard.lock.Lock()
+		for key, bucket := range shard.buckets {
+			if now.Sub(bucket.lastSeen) >= rateLimitIdleTimeout {
+				delete(shard.buckets, key)
+				evicted++
+			}
+		}
+		shard.lock.Unlock()
+	}
+	if evicted > 0 {
+		Log.Debugf("rate limiter evicted %v idle clients", evicted)
+	}
+}
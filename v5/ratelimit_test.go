@@ -0,0 +1,58 @@
+package dohProxy
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter_Allow(t *testing.T) {
+	clock := &fakeClock{t: time.Now()}
+	limiter := NewRateLimiter(10, 20)
+	limiter.now = clock.now
+	noisy := net.ParseIP("10.0.0.1")
+	quiet := net.ParseIP("10.0.0.2")
+
+	allowed := 0
+	for i := 0; i < 100; i++ {
+		if limiter.Allow(noisy) {
+			allowed++
+		}
+	}
+	if allowed != 20 {
+		t.Errorf("expected burst of 20 queries allowed, got: %v", allowed)
+	}
+	if !limiter.Allow(quiet) {
+		t.Errorf("other clients shouldn't be limited")
+	}
+
+	clock.advance(500 * time.Millisecond)
+	allowed = 0
+	for i := 0; i < 100; i++ {
+		if limiter.Allow(noisy) {
+			allowed++
+		}
+	}
+	if allowed != 5 {
+		t.Errorf("expected 5 tokens refilled in 0.5s, got: %v", allowed)
+	}
+}
+
+func TestRateLimiter_Evict(t *testing.T) {
+	clock := &fakeClock{t: time.Now()}
+	limiter := NewRateLimiter(10, 0)
+	limiter.now = clock.now
+
+	limiter.Allow(net.ParseIP("10.0.0.1"))
+	clock.advance(rateLimitIdleTimeout)
+	limiter.Allow(net.ParseIP("10.0.0.2"))
+	limiter.doEvict()
+
+	clients := 0
+	for i := range limiter.shards {
+		clients += len(limiter.shards[i].buckets)
+	}
+	if clients != 1 {
+		t.Errorf("idle client should be evicted, clients left: %v", clients)
+	}
+}
@@ -0,0 +1,77 @@
+package dohProxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// errNoAnswer is returned by Resolve if the query was dropped, e.g. refused by
+// rate limiting or not answered by upstream.
+var errNoAnswer = errors.New("no answer")
+
+// resolveRemoteAddr is the client address of Resolve, loopback over tcp, so
+// answers aren't truncated.
+var resolveRemoteAddr = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+
+// Resolve answers msg through the same pipeline as Handle, access control,
+// cache and upstream included, without a dns server, e.g. for embedding the
+// proxy; the query is from resolveRemoteAddr and msg isn't modified. It
+// returns when answered, or with the error of ctx when done.
+func (h *Handler) Resolve(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	writer := &memoryResponseWriter{remoteAddr: resolveRemoteAddr}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.Handle(writer, msg.Copy())
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if rMsg := writer.answer(); rMsg != nil {
+		return rMsg, nil
+	}
+	return nil, errNoAnswer
+}
+
+// memoryResponseWriter keeps the answer written by Handler, for answering
+// without a dns server.
+type memoryResponseWriter struct {
+	remoteAddr net.Addr
+	lock       sync.Mutex
+	msg        *dns.Msg
+}
+
+func (w *memoryResponseWriter) answer() *dns.Msg {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.msg
+}
+
+func (w *memoryResponseWriter) LocalAddr() net.Addr  { return &net.TCPAddr{} }
+func (w *memoryResponseWriter) RemoteAddr() net.Addr { return w.remoteAddr }
+
+func (w *memoryResponseWriter) WriteMsg(msg *dns.Msg) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.msg = msg.Copy()
+	return nil
+}
+
+func (w *memoryResponseWriter) Write(b []byte) (int, error) {
+	msg := new(dns.Msg)
+	if err := msg.Unpack(b); err != nil {
+		return 0, err
+	}
+	return len(b), w.WriteMsg(msg)
+}
+
+func (w *memoryResponseWriter) Close() error        { return nil }
+func (w *memoryResponseWriter) TsigStatus() error   { return nil }
+func (w *memoryResponseWriter) TsigTimersOnly(bool) {}
+func (w *memoryResponseWriter) Hijack()             {}
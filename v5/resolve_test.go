@@ -0,0 +1,55 @@
+package dohProxy
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestHandler_Resolve(t *testing.T) {
+	provider := &testProvider{name: "resolved"}
+	handler := NewHandler(provider, &HandlerOptions{Cache: true})
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeTXT)
+
+	for i := 0; i < 2; i++ {
+		rMsg, err := handler.Resolve(context.Background(), msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rMsg.Id != msg.Id || len(rMsg.Answer) != 1 || rMsg.Answer[0].(*dns.TXT).Txt[0] != "resolved" {
+			t.Errorf("unexpected answer: %v", rMsg)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&provider.queries); n != 1 {
+		t.Errorf("second query should be answered from cache, queried upstream %v times", n)
+	}
+
+	blocked := &testProvider{name: "blocked", release: make(chan bool)}
+	defer close(blocked.release)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := NewHandler(blocked, &HandlerOptions{}).Resolve(ctx, msg); err != context.DeadlineExceeded {
+		t.Errorf("Resolve should return when ctx is done, got: %v", err)
+	}
+}
+
+func BenchmarkHandler_Resolve(b *testing.B) {
+	handler := NewHandler(&testProvider{name: "resolved"}, &HandlerOptions{Cache: true})
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeTXT)
+	if _, err := handler.Resolve(context.Background(), msg); err != nil {
+		b.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := handler.Resolve(context.Background(), msg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
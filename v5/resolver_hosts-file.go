@@ -29,6 +29,10 @@ type HostsFileResolver struct {
 	// We don't support old-classful IP address notation.
 	byAddr map[string][]string
 
+	// Weights of the addresses of host names in weighted lines, see
+	// parseWeightedHostsLine; the other addresses weigh 1.
+	byNameWeights map[string]map[string]int
+
 	expire time.Time
 	path   string
 	mtime  time.Time
@@ -50,11 +54,26 @@ func (hosts *HostsFileResolver)readHosts() {
 
 	hs := make(map[string][]string)
 	is := make(map[string][]string)
+	ws := make(map[string]map[string]int)
 	var f *file
 	if f, _ = open(hp); f == nil {
 		return
 	}
 	for line, ok := f.readLine(); ok; line, ok = f.readLine() {
+		if name, addrs, weights, ok := parseWeightedHostsLine(line); ok {
+			h := []byte(name)
+			lowerASCIIBytes(h)
+			key := absDomainName(h)
+			if ws[key] == nil {
+				ws[key] = make(map[string]int)
+			}
+			for i, addr := range addrs {
+				hs[key] = append(hs[key], addr)
+				is[addr] = append(is[addr], absDomainName([]byte(name)))
+				ws[key][addr] += weights[i]
+			}
+			continue
+		}
 		if i := indexByteString(line, '#'); i >= 0 {
 			// Discard comments.
 			line = line[0:i]
@@ -81,6 +100,7 @@ func (hosts *HostsFileResolver)readHosts() {
 	hosts.path = hp
 	hosts.byName = hs
 	hosts.byAddr = is
+	hosts.byNameWeights = ws
 	hosts.mtime = mtime
 	hosts.size = size
 	f.close()
@@ -105,6 +125,25 @@ func (hosts *HostsFileResolver) LookupStaticHost(host string) []string {
 	return nil
 }
 
+// LookupStaticHostWeights looks up the weights of the addresses for the given
+// host, nil if it's not in weighted lines.
+func (hosts *HostsFileResolver) LookupStaticHostWeights(host string) map[string]int {
+	hosts.Lock()
+	defer hosts.Unlock()
+	hosts.readHosts()
+	lowerHost := []byte(host)
+	lowerASCIIBytes(lowerHost)
+	weights, ok := hosts.byNameWeights[absDomainName(lowerHost)]
+	if !ok {
+		return nil
+	}
+	weightsCp := make(map[string]int, len(weights))
+	for addr, weight := range weights {
+		weightsCp[addr] = weight
+	}
+	return weightsCp
+}
+
 // LookupStaticAddr looks up the hosts for the given address from /etc/hosts.
 func (hosts *HostsFileResolver) LookupStaticAddr(addr string) []string {
 	hosts.Lock()
@@ -0,0 +1,72 @@
+package dohProxy
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// RewriteRule replaces the addresses in From of A and AAAA answers with To.
+type RewriteRule struct {
+	From *net.IPNet
+	To   net.IP
+}
+
+// ParseRewriteRule parses the rule as "cidr=ip", e.g.
+// "203.0.113.0/24=10.0.0.5"; a single ip matches only itself. The ips must be
+// of the same family.
+func ParseRewriteRule(s string) (*RewriteRule, error) {
+	kv := strings.SplitN(s, "=", 2)
+	if len(kv) != 2 {
+		return nil, fmt.Errorf("invalid rewrite rule, expected cidr=ip: %v", s)
+	}
+	from, to := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+	if !strings.Contains(from, "/") {
+		if ip := net.ParseIP(from); ip != nil && ip.To4() != nil {
+			from += "/32"
+		} else {
+			from += "/128"
+		}
+	}
+	_, ipNet, err := net.ParseCIDR(from)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rewrite rule %v: %v", s, err)
+	}
+	ip := net.ParseIP(to)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid rewrite rule %v: bad ip %v", s, to)
+	}
+	if (ipNet.IP.To4() == nil) != (ip.To4() == nil) {
+		return nil, fmt.Errorf("invalid rewrite rule %v: ips of different families", s)
+	}
+	return &RewriteRule{From: ipNet, To: ip}, nil
+}
+
+// rewriteAnswers replaces the addresses of A and AAAA records in the answer
+// section of msg by the first matched rule, other records are left alone.
+func rewriteAnswers(msg *dns.Msg, rules []*RewriteRule) {
+	for _, rr := range msg.Answer {
+		switch r := rr.(type) {
+		case *dns.A:
+			if to := rewriteIP(r.A, rules); to != nil {
+				r.A = to.To4()
+			}
+		case *dns.AAAA:
+			if to := rewriteIP(r.AAAA, rules); to != nil {
+				r.AAAA = to.To16()
+			}
+		}
+	}
+}
+
+// rewriteIP returns the ip ip is rewritten to, nil if no rule matched.
+func rewriteIP(ip net.IP, rules []*RewriteRule) net.IP {
+	for _, rule := range rules {
+		if rule.From.Contains(ip) {
+			return rule.To
+		}
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package dohProxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestHandler_Rewrite(t *testing.T) {
+	var rules []*RewriteRule
+	for _, s := range []string{"203.0.113.0/24=10.0.0.5", "203.0.113.7=10.0.0.7", "2001:db8::/32=fd00::5"} {
+		rule, err := ParseRewriteRule(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rules = append(rules, rule)
+	}
+	handler := NewHandler(&zoneProvider{zone: map[string][]string{
+		"v4.example.com.":  {"v4.example.com. 300 IN A 203.0.113.7", "v4.example.com. 300 IN A 198.51.100.1"},
+		"v6.example.com.":  {"v6.example.com. 300 IN AAAA 2001:db8::1"},
+		"txt.example.com.": {`txt.example.com. 300 IN TXT "203.0.113.7"`},
+	}}, &HandlerOptions{RewriteRules: rules})
+
+	cases := []struct {
+		name     string
+		qtype    uint16
+		expected []string
+	}{
+		// the first matched wins, the one outside is untouched.
+		{"v4.example.com.", dns.TypeA, []string{"10.0.0.5", "198.51.100.1"}},
+		{"v6.example.com.", dns.TypeAAAA, []string{"fd00::5"}},
+		{"txt.example.com.", dns.TypeTXT, []string{"203.0.113.7"}},
+	}
+	for _, c := range cases {
+		msg := new(dns.Msg)
+		msg.SetQuestion(c.name, c.qtype)
+		writer := newTestResponseWriter("127.0.0.1:5353")
+		handler.Handle(writer, msg)
+		rMsg := writer.waitMsg(t, time.Second)
+		if len(rMsg.Answer) != len(c.expected) {
+			t.Fatalf("unexpected answer of %v: %v", c.name, rMsg)
+		}
+		for i, rr := range rMsg.Answer {
+			var got string
+			switch r := rr.(type) {
+			case *dns.A:
+				got = r.A.String()
+			case *dns.AAAA:
+				got = r.AAAA.String()
+			case *dns.TXT:
+				got = r.Txt[0]
+			}
+			if got != c.expected[i] {
+				t.Errorf("expected %v in answer of %v, got: %v", c.expected[i], c.name, rr)
+			}
+		}
+	}
+
+	for _, s := range []string{"203.0.113.0/24", "203.0.113.0/24=fd00::5", "bogus=10.0.0.5"} {
+		if _, err := ParseRewriteRule(s); err == nil {
+			t.Errorf("%v should be rejected", s)
+		}
+	}
+}
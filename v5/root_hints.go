@@ -0,0 +1,67 @@
+package dohProxy
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// RootNSResponseUpstream sends the NS queries of the root upstream.
+	RootNSResponseUpstream = "upstream"
+	// RootNSResponseLocal answers the NS queries of the root with the root
+	// hints.
+	RootNSResponseLocal = "local"
+	// RootNSResponseRefused answers the NS queries of the root with REFUSED.
+	RootNSResponseRefused = "refused"
+
+	// ttls of the root hints, as in named.root.
+	rootHintsNSTTL      = 518400
+	rootHintsAddressTTL = 3600000
+)
+
+// rootServers are the root name servers with their ipv4 and ipv6 addresses,
+// from https://www.internic.net/domain/named.root.
+var rootServers = [][3]string{
+	{"a.root-servers.net.", "198.41.0.4", "2001:503:ba3e::2:30"},
+	{"b.root-servers.net.", "170.247.170.2", "2801:1b8:10::b"},
+	{"c.root-servers.net.", "192.33.4.12", "2001:500:2::c"},
+	{"d.root-servers.net.", "199.7.91.13", "2001:500:2d::d"},
+	{"e.root-servers.net.", "192.203.230.10", "2001:500:a8::e"},
+	{"f.root-servers.net.", "192.5.5.241", "2001:500:2f::f"},
+	{"g.root-servers.net.", "192.112.36.4", "2001:500:12::d0d"},
+	{"h.root-servers.net.", "198.97.190.53", "2001:500:1::53"},
+	{"i.root-servers.net.", "192.36.148.17", "2001:7fe::53"},
+	{"j.root-servers.net.", "192.58.128.30", "2001:503:c27::2:30"},
+	{"k.root-servers.net.", "193.0.14.129", "2001:7fd::1"},
+	{"l.root-servers.net.", "199.7.83.42", "2001:500:9f::42"},
+	{"m.root-servers.net.", "202.12.27.33", "2001:dc3::35"},
+}
+
+// rootNSReply answers the NS and ANY queries of the root, which also come as
+// the empty name, by mode; nil if they're sent upstream, or for other queries.
+func rootNSReply(msg *dns.Msg, mode string) *dns.Msg {
+	q := msg.Question[0]
+	if mode == "" || mode == RootNSResponseUpstream || q.Qclass != dns.ClassINET ||
+		(q.Qtype != dns.TypeNS && q.Qtype != dns.TypeANY) || dns.Fqdn(q.Name) != "." {
+		return nil
+	}
+	rMsg := new(dns.Msg)
+	if mode == RootNSResponseRefused {
+		rMsg.SetRcode(msg, dns.RcodeRefused)
+		return rMsg
+	}
+	rMsg.SetReply(msg)
+	rMsg.RecursionAvailable = true
+	for _, server := range rootServers {
+		rMsg.Answer = append(rMsg.Answer, &dns.NS{
+			Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: rootHintsNSTTL},
+			Ns:  server[0],
+		})
+		a := genAnswerFromIP(dns.TypeA, server[0], net.ParseIP(server[1]))
+		aaaa := genAnswerFromIP(dns.TypeAAAA, server[0], net.ParseIP(server[2]))
+		a.Header().Ttl, aaaa.Header().Ttl = rootHintsAddressTTL, rootHintsAddressTTL
+		rMsg.Extra = append(rMsg.Extra, a, aaaa)
+	}
+	return rMsg
+}
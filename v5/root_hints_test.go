@@ -0,0 +1,44 @@
+package dohProxy
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestHandler_RootNSResponse(t *testing.T) {
+	query := func(handler *Handler) *dns.Msg {
+		writer := newTestResponseWriter("127.0.0.1:5353")
+		msg := new(dns.Msg)
+		msg.SetQuestion(".", dns.TypeNS)
+		handler.Handle(writer, msg)
+		return writer.waitMsg(t, time.Second)
+	}
+
+	provider := &testProvider{name: "upstream"}
+	if rMsg := query(NewHandler(provider, &HandlerOptions{RootNSResponse: RootNSResponseUpstream})); len(rMsg.Answer) != 1 {
+		t.Errorf("root NS query should be answered by upstream, got: %v", rMsg)
+	}
+	if n := atomic.LoadInt32(&provider.queries); n != 1 {
+		t.Errorf("root NS query should be sent upstream once, sent %v", n)
+	}
+
+	provider = &testProvider{name: "upstream"}
+	// the glue is truncated to fit in 512 bytes over udp.
+	rMsg := query(NewHandler(provider, &HandlerOptions{RootNSResponse: RootNSResponseLocal}))
+	if rMsg.Rcode != dns.RcodeSuccess || len(rMsg.Answer) != len(rootServers) || len(rMsg.Extra) == 0 {
+		t.Errorf("root NS query should be answered with the root hints, got: %v", rMsg)
+	} else if ns := rMsg.Answer[0].(*dns.NS); ns.Ns != "a.root-servers.net." {
+		t.Errorf("unexpected root server: %v", ns)
+	}
+
+	rMsg = query(NewHandler(provider, &HandlerOptions{RootNSResponse: RootNSResponseRefused}))
+	if rMsg.Rcode != dns.RcodeRefused || len(rMsg.Answer) != 0 {
+		t.Errorf("root NS query should be refused, got: %v", rMsg)
+	}
+	if n := atomic.LoadInt32(&provider.queries); n != 0 {
+		t.Errorf("root NS queries should not be sent upstream, sent %v", n)
+	}
+}
@@ -0,0 +1,318 @@
+package dohProxy
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// actions of RPZ rules, by the target of their CNAME records.
+const (
+	rpzNXDomain = "nxdomain"
+	rpzNoData   = "nodata"
+	rpzPassthru = "passthru"
+	// answered with the local data of the rule, e.g. a CNAME redirecting to a
+	// walled garden.
+	rpzLocalData = "local-data"
+)
+
+// rpzRule is the policy of a trigger.
+type rpzRule struct {
+	action string
+	// records of rpzLocalData, owned by the trigger.
+	rrs []dns.RR
+}
+
+// rpzIPRule is the policy of an answer ip trigger.
+type rpzIPRule struct {
+	subnet *net.IPNet
+	rule   *rpzRule
+}
+
+// RPZ is a response policy zone, draft-vixie-dnsop-dns-rpz: the queries of
+// names triggering a rule are answered by its action rather than upstream, so
+// are the answers having addresses triggering a rule.
+//
+// Supported are the qname triggers, "*." wildcards included, and the
+// rpz-ip answer ip triggers; actions are NXDOMAIN ("CNAME ."), NODATA ("CNAME
+// *."), PASSTHRU ("CNAME rpz-passthru.") and local data, e.g. "CNAME
+// garden.example.net." redirecting. Other triggers and actions are ignored.
+type RPZ struct {
+	// exact names, in canonical form.
+	names map[string]*rpzRule
+	// names of "*.example.com" triggers, matching subdomains of them.
+	wildcards map[string]*rpzRule
+	ips       []rpzIPRule
+	// SOA of the zone, in the authority section of negative answers.
+	soa dns.RR
+}
+
+// LoadRPZ reads the response policy zone file at path, in master file format;
+// triggers are relative to the origin of the zone, the owner of its SOA.
+func LoadRPZ(path string) (*RPZ, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open rpz %v error: %v", path, err)
+	}
+	defer func() { _ = f.Close() }()
+
+	var rrs []dns.RR
+	rpz := &RPZ{names: make(map[string]*rpzRule), wildcards: make(map[string]*rpzRule)}
+	zp := dns.NewZoneParser(f, ".", path)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		if rr.Header().Rrtype == dns.TypeSOA && rpz.soa == nil {
+			rpz.soa = rr
+			continue
+		}
+		rrs = append(rrs, rr)
+	}
+	if err := zp.Err(); err != nil {
+		return nil, fmt.Errorf("read rpz %v error: %v", path, err)
+	}
+	origin := "."
+	if rpz.soa != nil {
+		origin = dns.CanonicalName(rpz.soa.Header().Name)
+	}
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == dns.TypeNS {
+			continue
+		}
+		owner := dns.CanonicalName(rr.Header().Name)
+		if origin != "." {
+			if !dns.IsSubDomain(origin, owner) || owner == origin {
+				Log.Debugf("ignore rpz record out of zone %v: %v", origin, rr)
+				continue
+			}
+			owner = owner[:len(owner)-len(origin)]
+		}
+		if err := rpz.add(owner, rr); err != nil {
+			Log.Debugf("ignore rpz record %v: %v", rr, err)
+		}
+	}
+	return rpz, nil
+}
+
+// add adds rr of the trigger owner, relative to the origin and ending with a
+// dot.
+func (r *RPZ) add(owner string, rr dns.RR) error {
+	action := rpzLocalData
+	if cname, ok := rr.(*dns.CNAME); ok {
+		switch target := dns.CanonicalName(cname.Target); {
+		case target == ".":
+			action = rpzNXDomain
+		case target == "*.":
+			action = rpzNoData
+		case target == "rpz-passthru.":
+			action = rpzPassthru
+		case strings.HasPrefix(target, "rpz-"):
+			return fmt.Errorf("unsupported action %v", target)
+		}
+	}
+
+	rule, err := r.rule(owner)
+	if err != nil {
+		return err
+	}
+	if rule.action != "" && rule.action != action {
+		return fmt.Errorf("conflicting action %v of %v", action, rule.action)
+	}
+	rule.action = action
+	if action == rpzLocalData {
+		rule.rrs = append(rule.rrs, rr)
+	}
+	return nil
+}
+
+// rule returns the rule of the trigger owner, added if not yet.
+func (r *RPZ) rule(owner string) (*rpzRule, error) {
+	switch {
+	case strings.HasSuffix(owner, ".rpz-ip."):
+		subnet, err := parseRPZIP(strings.TrimSuffix(owner, ".rpz-ip."))
+		if err != nil {
+			return nil, err
+		}
+		for _, ipRule := range r.ips {
+			if ipRule.subnet.String() == subnet.String() {
+				return ipRule.rule, nil
+			}
+		}
+		rule := new(rpzRule)
+		r.ips = append(r.ips, rpzIPRule{subnet: subnet, rule: rule})
+		return rule, nil
+	case strings.HasPrefix(owner, "rpz-") || strings.Contains(owner, ".rpz-"):
+		return nil, fmt.Errorf("unsupported trigger %v", owner)
+	}
+	rules, name := r.names, owner
+	if strings.HasPrefix(owner, "*.") {
+		rules, name = r.wildcards, strings.TrimPrefix(owner, "*.")
+	}
+	if rules[name] == nil {
+		rules[name] = new(rpzRule)
+	}
+	return rules[name], nil
+}
+
+// parseRPZIP parses the subnet of an rpz-ip trigger without the suffix, the
+// prefix length then the labels of the address in reverse order, "zz" for
+// "::" of ipv6, e.g. "24.0.2.0.192" or "48.zz.db8.2001".
+func parseRPZIP(s string) (*net.IPNet, error) {
+	labels := strings.Split(strings.TrimSuffix(s, "."), ".")
+	if len(labels) < 2 {
+		return nil, fmt.Errorf("invalid rpz-ip trigger %v", s)
+	}
+	prefix, err := strconv.Atoi(labels[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid prefix length of rpz-ip trigger %v", s)
+	}
+	parts := make([]string, 0, len(labels)-1)
+	for i := len(labels) - 1; i > 0; i-- {
+		parts = append(parts, labels[i])
+	}
+	addr := strings.Join(parts, ".")
+	bits := 32
+	if len(parts) != 4 || net.ParseIP(addr).To4() == nil {
+		for i, part := range parts {
+			if part == "zz" {
+				parts[i] = ""
+			}
+		}
+		addr = strings.Join(parts, ":")
+		// "zz" at either end is "::" too.
+		if parts[0] == "" {
+			addr = ":" + addr
+		}
+		if parts[len(parts)-1] == "" {
+			addr += ":"
+		}
+		bits = 128
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil || prefix < 1 || prefix > bits {
+		return nil, fmt.Errorf("invalid rpz-ip trigger %v", s)
+	}
+	if bits == 32 {
+		ip = ip.To4()
+	}
+	mask := net.CIDRMask(prefix, bits)
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}, nil
+}
+
+// Len returns the number of triggers.
+func (r *RPZ) Len() int {
+	return len(r.names) + len(r.wildcards) + len(r.ips)
+}
+
+// matchName returns the rule triggered by the query of name, the exact one
+// before the closest wildcard; nil if none.
+func (r *RPZ) matchName(name string) *rpzRule {
+	name = dns.CanonicalName(name)
+	if rule := r.names[name]; rule != nil {
+		return rule
+	}
+	// parent domains of name, excluding name itself.
+	for off, end := dns.NextLabel(name, 0); !end; off, end = dns.NextLabel(name, off) {
+		if rule := r.wildcards[name[off:]]; rule != nil {
+			return rule
+		}
+	}
+	return nil
+}
+
+// matchAnswer returns the rule triggered by the addresses in rMsg answering
+// the query of name, the one of the longest prefix; nil if none, or name
+// triggers a rule, which takes precedence.
+func (r *RPZ) matchAnswer(name string, rMsg *dns.Msg) *rpzRule {
+	if len(r.ips) == 0 || r.matchName(name) != nil {
+		return nil
+	}
+	var matched *rpzRule
+	longest := -1
+	for _, rr := range rMsg.Answer {
+		var ip net.IP
+		switch a := rr.(type) {
+		case *dns.A:
+			ip = a.A
+		case *dns.AAAA:
+			ip = a.AAAA
+		default:
+			continue
+		}
+		for _, ipRule := range r.ips {
+			if ones, _ := ipRule.subnet.Mask.Size(); ones > longest && ipRule.subnet.Contains(ip) {
+				matched, longest = ipRule.rule, ones
+			}
+		}
+	}
+	return matched
+}
+
+// reply answers msg by the action of rule, nil for rpzPassthru; records of
+// local data are renamed to the question name.
+func (r *RPZ) reply(msg *dns.Msg, rule *rpzRule) *dns.Msg {
+	q := msg.Question[0]
+	rMsg := new(dns.Msg)
+	switch rule.action {
+	case rpzPassthru:
+		return nil
+	case rpzNXDomain:
+		rMsg.SetRcode(msg, dns.RcodeNameError)
+	case rpzNoData:
+		rMsg.SetReply(msg)
+	default:
+		rMsg.SetReply(msg)
+		for _, rr := range rule.rrs {
+			if t := rr.Header().Rrtype; t != q.Qtype && t != dns.TypeCNAME && q.Qtype != dns.TypeANY {
+				continue
+			}
+			rr = dns.Copy(rr)
+			rr.Header().Name = q.Name
+			rMsg.Answer = append(rMsg.Answer, rr)
+		}
+	}
+	if len(rMsg.Answer) == 0 && r.soa != nil {
+		rMsg.Ns = []dns.RR{dns.Copy(r.soa)}
+	}
+	rMsg.RecursionAvailable = true
+	return rMsg
+}
+
+// rpzReply answers msg by rule, a CNAME of local data is followed upstream
+// for the records of the target.
+func (h *Handler) rpzReply(msg *dns.Msg, rule *rpzRule, clientIP net.IP) *dns.Msg {
+	rMsg := h.options.RPZ.reply(msg, rule)
+	q := msg.Question[0]
+	target, _, ok := findCNAME(rMsg.Answer, q.Name)
+	if !ok || q.Qtype == dns.TypeCNAME || len(rMsg.Answer) != 1 {
+		return rMsg
+	}
+	next, err := h.queryName(msg, target, clientIP)
+	if err != nil {
+		Log.Debugf("follow rpz cname %v of %v failed: %v", target, q.Name, err)
+		return rMsg
+	}
+	rMsg.Rcode = next.Rcode
+	for _, rr := range next.Answer {
+		rMsg.Answer = append(rMsg.Answer, dns.Copy(rr))
+	}
+	return rMsg
+}
+
+// applyRPZ returns the answer resp of msg, replaced if its addresses trigger
+// a rule of RPZ.
+func (h *Handler) applyRPZ(msg *dns.Msg, resp *dns.Msg, clientIP net.IP) *dns.Msg {
+	if h.options.RPZ == nil {
+		return resp
+	}
+	rule := h.options.RPZ.matchAnswer(msg.Question[0].Name, resp)
+	if rule == nil || rule.action == rpzPassthru {
+		return resp
+	}
+	Log.Infof("rpz %v by answer ip: %v", rule.action, msg.Question[0].Name)
+	rMsg := h.rpzReply(msg, rule, clientIP)
+	rMsg.Id = resp.Id
+	return rMsg
+}
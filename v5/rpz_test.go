@@ -0,0 +1,123 @@
+package dohProxy
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const sampleRPZ = `$TTL 60
+$ORIGIN rpz.example.
+@                        SOA  localhost. root.localhost. 1 3600 600 86400 60
+                         NS   localhost.
+malware.example.com      CNAME .
+*.tracker.example.com    CNAME *.
+good.tracker.example.com CNAME rpz-passthru.
+32.10.113.0.203.rpz-ip   CNAME garden.example.net.
+24.0.113.0.203.rpz-ip    CNAME .
+48.zz.db8.2001.rpz-ip    CNAME .
+`
+
+func loadTestRPZ(t *testing.T) *RPZ {
+	rpz, err := LoadRPZ(writeTestConfig(t, sampleRPZ))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rpz.Len() != 6 {
+		t.Errorf("expected 6 triggers, got: %v", rpz.Len())
+	}
+	return rpz
+}
+
+func TestRPZ_Match(t *testing.T) {
+	rpz := loadTestRPZ(t)
+	for name, action := range map[string]string{
+		"malware.example.com.":      rpzNXDomain,
+		"Malware.Example.COM.":      rpzNXDomain,
+		"sub.malware.example.com.":  "",
+		"a.tracker.example.com.":    rpzNoData,
+		"tracker.example.com.":      "",
+		"good.tracker.example.com.": rpzPassthru,
+		"example.com.":              "",
+	} {
+		rule := rpz.matchName(name)
+		if (rule == nil && action != "") || (rule != nil && rule.action != action) {
+			t.Errorf("%v should trigger %q, got: %+v", name, action, rule)
+		}
+	}
+
+	answer := func(name string, rrs ...string) *dns.Msg {
+		msg := new(dns.Msg)
+		for _, s := range rrs {
+			rr, _ := dns.NewRR(name + " 60 IN " + s)
+			msg.Answer = append(msg.Answer, rr)
+		}
+		return msg
+	}
+	// the longest prefix wins.
+	if rule := rpz.matchAnswer("a.example.com.", answer("a.example.com.", "A 203.0.113.10")); rule == nil ||
+		rule.action != rpzLocalData {
+		t.Errorf("203.0.113.10 should be redirected, got: %+v", rule)
+	}
+	if rule := rpz.matchAnswer("a.example.com.", answer("a.example.com.", "A 203.0.113.11")); rule == nil ||
+		rule.action != rpzNXDomain {
+		t.Errorf("203.0.113.11 should trigger NXDOMAIN, got: %+v", rule)
+	}
+	if rule := rpz.matchAnswer("a.example.com.", answer("a.example.com.", "AAAA 2001:db8::1")); rule == nil {
+		t.Errorf("2001:db8::1 should trigger NXDOMAIN")
+	}
+	if rule := rpz.matchAnswer("a.example.com.", answer("a.example.com.", "A 192.0.2.1")); rule != nil {
+		t.Errorf("192.0.2.1 should trigger nothing, got: %+v", rule)
+	}
+	// qname triggers take precedence.
+	if rule := rpz.matchAnswer("good.tracker.example.com.",
+		answer("good.tracker.example.com.", "A 203.0.113.10")); rule != nil {
+		t.Errorf("passthru name should not be checked by answer ip, got: %+v", rule)
+	}
+}
+
+func TestHandler_RPZQNameNXDomain(t *testing.T) {
+	provider := &testProvider{name: "upstream"}
+	handler := NewHandler(provider, &HandlerOptions{RPZ: loadTestRPZ(t)})
+
+	writer := newTestResponseWriter("127.0.0.1:5353")
+	msg := new(dns.Msg)
+	msg.SetQuestion("malware.example.com.", dns.TypeA)
+	handler.Handle(writer, msg)
+	rMsg := writer.waitMsg(t, time.Second)
+	if rMsg.Rcode != dns.RcodeNameError || len(rMsg.Answer) != 0 {
+		t.Errorf("qname trigger should be answered with NXDOMAIN, got: %v", rMsg)
+	}
+	if len(rMsg.Ns) != 1 || rMsg.Ns[0].Header().Rrtype != dns.TypeSOA {
+		t.Errorf("NXDOMAIN should have the SOA of the zone, got: %v", rMsg.Ns)
+	}
+	if n := atomic.LoadInt32(&provider.queries); n != 0 {
+		t.Errorf("qname trigger should not be queried upstream, queried %v", n)
+	}
+}
+
+func TestHandler_RPZAnswerIPRedirect(t *testing.T) {
+	provider := &zoneProvider{zone: map[string][]string{
+		"www.example.com.":    {"www.example.com. 300 IN A 203.0.113.10"},
+		"garden.example.net.": {"garden.example.net. 300 IN A 192.0.2.80"},
+	}}
+	handler := NewHandler(provider, &HandlerOptions{RPZ: loadTestRPZ(t)})
+
+	writer := newTestResponseWriter("127.0.0.1:5353")
+	msg := new(dns.Msg)
+	msg.SetQuestion("www.example.com.", dns.TypeA)
+	handler.Handle(writer, msg)
+	rMsg := writer.waitMsg(t, time.Second)
+	if rMsg.Rcode != dns.RcodeSuccess || len(rMsg.Answer) != 2 {
+		t.Fatalf("answer ip trigger should redirect, got: %v", rMsg)
+	}
+	if cname, ok := rMsg.Answer[0].(*dns.CNAME); !ok || cname.Hdr.Name != "www.example.com." ||
+		cname.Target != "garden.example.net." {
+		t.Errorf("expected cname to garden.example.net., got: %v", rMsg.Answer[0])
+	}
+	if a, ok := rMsg.Answer[1].(*dns.A); !ok || a.A.String() != "192.0.2.80" {
+		t.Errorf("redirect should be followed, got: %v", rMsg.Answer[1])
+	}
+}
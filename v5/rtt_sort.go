@@ -0,0 +1,234 @@
+package dohProxy
+
+import (
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// DefaultRTTProbePort is the tcp port connected to for measuring rtt.
+	DefaultRTTProbePort = 443
+	// DefaultRTTProbeInterval is how often the known ips are probed again.
+	DefaultRTTProbeInterval = 5 * time.Minute
+
+	rttProbeTimeout = time.Second
+	// at most this many ips are probed, the least recently seen are
+	// discarded beyond.
+	maxRTTProbeIPs = 4096
+	// ips waiting for their first probe, more are probed by the next round.
+	rttProbeQueueSize = 256
+)
+
+// RTTProberOptions specifies options of the rtt prober.
+type RTTProberOptions struct {
+	// DefaultRTTProbePort if 0.
+	Port int
+	// DefaultRTTProbeInterval if 0; rtts older than 2 intervals are stale.
+	Interval time.Duration
+}
+
+type rttEntry struct {
+	rtt      time.Duration
+	probedAt time.Time
+	seenAt   time.Time
+	// the last probe failed, sorted after the reachable ips.
+	unreachable bool
+}
+
+// RTTProber measures the rtt of the ips in answers by tcp connecting in
+// background, and sorts the address records of answers by it.
+type RTTProber struct {
+	opts  *RTTProberOptions
+	probe func(ip string) (time.Duration, error)
+	now   func() time.Time
+
+	lock    sync.Mutex
+	entries map[string]*rttEntry
+	queue   chan string
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// NewRTTProber creates the prober and starts probing in background.
+func NewRTTProber(opts *RTTProberOptions) *RTTProber {
+	if opts == nil {
+		opts = &RTTProberOptions{}
+	}
+	port := opts.Port
+	if port == 0 {
+		port = DefaultRTTProbePort
+	}
+	return newRTTProber(opts, func(ip string) (time.Duration, error) {
+		start := time.Now()
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort(ip, strconv.Itoa(port)), rttProbeTimeout)
+		if err != nil {
+			return 0, err
+		}
+		rtt := time.Now().Sub(start)
+		_ = conn.Close()
+		return rtt, nil
+	})
+}
+
+func newRTTProber(opts *RTTProberOptions, probe func(ip string) (time.Duration, error)) *RTTProber {
+	if opts.Interval == 0 {
+		opts.Interval = DefaultRTTProbeInterval
+	}
+	p := &RTTProber{
+		opts:    opts,
+		probe:   probe,
+		now:     time.Now,
+		entries: make(map[string]*rttEntry),
+		queue:   make(chan string, rttProbeQueueSize),
+		done:    make(chan struct{}),
+	}
+	p.wg.Add(1)
+	go p.run()
+	return p
+}
+
+// Close stops probing.
+func (p *RTTProber) Close() error {
+	close(p.done)
+	p.wg.Wait()
+	return nil
+}
+
+// Sort orders the A and AAAA records of msg by rtt, the fastest first, in
+// place of the records; stale or unprobed ips are kept in original order
+// after the probed ones, and queued for probing.
+func (p *RTTProber) Sort(msg *dns.Msg) {
+	for _, t := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		var positions []int
+		var records []dns.RR
+		for i, rr := range msg.Answer {
+			if rr.Header().Rrtype == t {
+				positions = append(positions, i)
+				records = append(records, rr)
+			}
+		}
+		if len(records) < 2 {
+			continue
+		}
+		rtts := make(map[dns.RR]*rttEntry, len(records))
+		for _, rr := range records {
+			if entry := p.lookup(addressOf(rr)); entry != nil {
+				rtts[rr] = entry
+			}
+		}
+		sort.SliceStable(records, func(i, j int) bool {
+			ei, ej := rtts[records[i]], rtts[records[j]]
+			switch {
+			case ei == nil:
+				return false
+			case ej == nil:
+				return true
+			case ei.unreachable != ej.unreachable:
+				return ej.unreachable
+			}
+			return ei.rtt < ej.rtt
+		})
+		for i, pos := range positions {
+			msg.Answer[pos] = records[i]
+		}
+	}
+}
+
+func addressOf(rr dns.RR) string {
+	switch r := rr.(type) {
+	case *dns.A:
+		return r.A.String()
+	case *dns.AAAA:
+		return r.AAAA.String()
+	}
+	return ""
+}
+
+// lookup returns a copy of the fresh rtt of ip, or nil; unknown ips are queued
+// for probing.
+func (p *RTTProber) lookup(ip string) *rttEntry {
+	now := p.now()
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	entry, ok := p.entries[ip]
+	if !ok {
+		if len(p.entries) >= maxRTTProbeIPs {
+			p.evictLocked()
+		}
+		p.entries[ip] = &rttEntry{seenAt: now}
+		select {
+		case p.queue <- ip:
+		default:
+		}
+		return nil
+	}
+	entry.seenAt = now
+	if entry.probedAt.IsZero() || now.Sub(entry.probedAt) > 2*p.opts.Interval {
+		return nil
+	}
+	e := *entry
+	return &e
+}
+
+// evictLocked discards the least recently seen ip.
+func (p *RTTProber) evictLocked() {
+	var oldest string
+	var oldestAt time.Time
+	for ip, entry := range p.entries {
+		if oldest == "" || entry.seenAt.Before(oldestAt) {
+			oldest, oldestAt = ip, entry.seenAt
+		}
+	}
+	delete(p.entries, oldest)
+}
+
+func (p *RTTProber) run() {
+	defer p.wg.Done()
+	ticker := time.NewTicker(p.opts.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case ip := <-p.queue:
+			p.probeIP(ip)
+		case <-ticker.C:
+			now := p.now()
+			p.lock.Lock()
+			ips := make([]string, 0, len(p.entries))
+			for ip, entry := range p.entries {
+				// not in answers recently.
+				if now.Sub(entry.seenAt) > 2*p.opts.Interval {
+					delete(p.entries, ip)
+					continue
+				}
+				ips = append(ips, ip)
+			}
+			p.lock.Unlock()
+			for _, ip := range ips {
+				p.probeIP(ip)
+			}
+		}
+	}
+}
+
+func (p *RTTProber) probeIP(ip string) {
+	rtt, err := p.probe(ip)
+	if err != nil {
+		Log.Debugf("rtt probe %v failed: %v", ip, err)
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	entry, ok := p.entries[ip]
+	if !ok {
+		return
+	}
+	entry.rtt = rtt
+	entry.unreachable = err != nil
+	entry.probedAt = p.now()
+}
@@ -0,0 +1,66 @@
+package dohProxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestRTTProber_Sort(t *testing.T) {
+	rtts := map[string]time.Duration{"192.0.2.1": 80 * time.Millisecond, "192.0.2.2": 5 * time.Millisecond}
+	prober := newRTTProber(&RTTProberOptions{}, func(ip string) (time.Duration, error) {
+		return rtts[ip], nil
+	})
+	defer prober.Close()
+
+	newAnswer := func() *dns.Msg {
+		msg := new(dns.Msg)
+		msg.SetQuestion("www.example.com.", dns.TypeA)
+		for _, record := range []string{
+			"www.example.com. 300 IN CNAME lb.example.com.",
+			"lb.example.com. 300 IN A 192.0.2.1",
+			"lb.example.com. 300 IN A 192.0.2.2",
+		} {
+			rr, _ := dns.NewRR(record)
+			msg.Answer = append(msg.Answer, rr)
+		}
+		return msg
+	}
+
+	// unprobed ips are kept in order.
+	msg := newAnswer()
+	prober.Sort(msg)
+	if addressOf(msg.Answer[1]) != "192.0.2.1" {
+		t.Errorf("unprobed answer should be kept in order, got: %v", msg.Answer)
+	}
+	deadline := time.Now().Add(time.Second)
+	for !isProbed(prober, "192.0.2.1") || !isProbed(prober, "192.0.2.2") {
+		if time.Now().After(deadline) {
+			t.Fatal("ips should be probed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	msg = newAnswer()
+	prober.Sort(msg)
+	if msg.Answer[0].Header().Rrtype != dns.TypeCNAME ||
+		addressOf(msg.Answer[1]) != "192.0.2.2" || addressOf(msg.Answer[2]) != "192.0.2.1" {
+		t.Errorf("the faster ip should be first, got: %v", msg.Answer)
+	}
+
+	// stale rtts fall back to original order.
+	prober.now = func() time.Time { return time.Now().Add(3 * DefaultRTTProbeInterval) }
+	msg = newAnswer()
+	prober.Sort(msg)
+	if addressOf(msg.Answer[1]) != "192.0.2.1" {
+		t.Errorf("stale answer should be kept in order, got: %v", msg.Answer)
+	}
+}
+
+func isProbed(p *RTTProber, ip string) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	entry, ok := p.entries[ip]
+	return ok && !entry.probedAt.IsZero()
+}
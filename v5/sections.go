@@ -0,0 +1,80 @@
+package dohProxy
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// stripSections removes the records of the additional section except OPT if
+// additional, and of the authority section if authority; the SOA of negative
+// answers, also those of CNAME chains, is kept, it's needed for negative
+// caching, RFC 2308.
+func stripSections(msg *dns.Msg, additional bool, authority bool) {
+	if additional {
+		var extra []dns.RR
+		for _, rr := range msg.Extra {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				extra = append(extra, rr)
+			}
+		}
+		msg.Extra = extra
+	}
+	if authority {
+		var ns []dns.RR
+		if isNegativeAnswer(msg) {
+			for _, rr := range msg.Ns {
+				if rr.Header().Rrtype == dns.TypeSOA {
+					ns = append(ns, rr)
+				}
+			}
+		}
+		msg.Ns = ns
+	}
+}
+
+// minimizeAnswer removes the records of the answer section not of the
+// question type, or not owned by the names of the CNAME chain from the
+// question name; the CNAMEs of the chain, DNAMEs and the RRSIGs of the kept
+// records are kept. Answers to ANY queries are intact.
+func minimizeAnswer(msg *dns.Msg) {
+	if len(msg.Question) == 0 || msg.Question[0].Qtype == dns.TypeANY {
+		return
+	}
+	qtype := msg.Question[0].Qtype
+	chain := map[string]bool{strings.ToLower(msg.Question[0].Name): true}
+	for name := msg.Question[0].Name; len(chain) <= maxCNAMEDepth; {
+		target, _, ok := findCNAME(msg.Answer, name)
+		if !ok || chain[strings.ToLower(target)] {
+			break
+		}
+		chain[strings.ToLower(target)] = true
+		name = target
+	}
+	keep := func(rr dns.RR) bool {
+		t := rr.Header().Rrtype
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			t = sig.TypeCovered
+		}
+		inChain := chain[strings.ToLower(rr.Header().Name)]
+		return t == dns.TypeDNAME || (inChain && (t == qtype || t == dns.TypeCNAME))
+	}
+	answer := msg.Answer[:0]
+	for _, rr := range msg.Answer {
+		if keep(rr) {
+			answer = append(answer, rr)
+		}
+	}
+	msg.Answer = answer
+}
+
+// stripSections removes the additional and authority sections of the answer
+// resp as configured, and minimizes its answer section if MinimizeAnswers.
+func (h *Handler) stripSections(resp *dns.Msg) {
+	if h.options.StripAdditional || h.options.StripAuthority {
+		stripSections(resp, h.options.StripAdditional, h.options.StripAuthority)
+	}
+	if h.options.MinimizeAnswers {
+		minimizeAnswer(resp)
+	}
+}
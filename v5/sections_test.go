@@ -0,0 +1,96 @@
+package dohProxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// sectionsProvider answers with glue in the additional section, and the SOA of
+// "nxdomain.example.com." and of "alias.example.com." aliasing it.
+type sectionsProvider struct{}
+
+func (p *sectionsProvider) Query(msg *dns.Msg) (*dns.Msg, error) {
+	rMsg := new(dns.Msg)
+	rMsg.SetReply(msg)
+	rr := func(s string) dns.RR {
+		r, _ := dns.NewRR(s)
+		return r
+	}
+	switch msg.Question[0].Name {
+	case "alias.example.com.":
+		rMsg.Answer = []dns.RR{rr("alias.example.com. 300 IN CNAME nxdomain.example.com.")}
+		fallthrough
+	case "nxdomain.example.com.":
+		rMsg.Rcode = dns.RcodeNameError
+		rMsg.Ns = []dns.RR{rr("example.com. 300 IN SOA ns1.example.com. admin.example.com. 1 3600 600 86400 60")}
+		return rMsg, nil
+	}
+	rMsg.Answer = []dns.RR{rr("example.com. 300 IN NS ns1.example.com."), rr("example.com. 300 IN NS ns2.example.com.")}
+	rMsg.Ns = []dns.RR{rr("example.com. 300 IN NS ns1.example.com.")}
+	rMsg.Extra = []dns.RR{rr("ns1.example.com. 300 IN A 192.0.2.53"), rr("ns2.example.com. 300 IN A 192.0.2.54")}
+	return rMsg, nil
+}
+
+func TestHandler_StripSections(t *testing.T) {
+	handler := NewHandler(&sectionsProvider{},
+		&HandlerOptions{Cache: true, StripAdditional: true, StripAuthority: true})
+
+	for i := 0; i < 2; i++ {
+		writer := newTestResponseWriter("127.0.0.1:5353")
+		msg := new(dns.Msg)
+		msg.SetQuestion("example.com.", dns.TypeNS)
+		handler.Handle(writer, msg)
+		rMsg := writer.waitMsg(t, time.Second)
+		if len(rMsg.Answer) != 2 {
+			t.Errorf("answer section should be intact, got: %v", rMsg)
+		}
+		if len(rMsg.Ns) != 0 {
+			t.Errorf("authority should be removed, got: %v", rMsg)
+		}
+		for _, rr := range rMsg.Extra {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				t.Errorf("glue should be removed, got: %v", rMsg)
+			}
+		}
+	}
+
+	for _, name := range []string{"nxdomain.example.com.", "alias.example.com."} {
+		writer := newTestResponseWriter("127.0.0.1:5353")
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, dns.TypeA)
+		handler.Handle(writer, msg)
+		rMsg := writer.waitMsg(t, time.Second)
+		if rMsg.Rcode != dns.RcodeNameError || len(rMsg.Ns) != 1 || rMsg.Ns[0].Header().Rrtype != dns.TypeSOA {
+			t.Errorf("SOA of negative answers should be kept, got: %v", rMsg)
+		}
+	}
+}
+
+func TestHandler_MinimizeAnswers(t *testing.T) {
+	provider := &zoneProvider{zone: map[string][]string{
+		"www.example.com.": {
+			"www.example.com. 300 IN CNAME cdn.example.net.",
+			"www.example.com. 300 IN TXT \"v=spf1 -all\"",
+			"cdn.example.net. 300 IN A 192.0.2.80",
+			"other.example.net. 300 IN A 192.0.2.81",
+		},
+	}}
+	handler := NewHandler(provider, &HandlerOptions{MinimizeAnswers: true})
+
+	writer := newTestResponseWriter("127.0.0.1:5353")
+	msg := new(dns.Msg)
+	msg.SetQuestion("www.example.com.", dns.TypeA)
+	handler.Handle(writer, msg)
+	rMsg := writer.waitMsg(t, time.Second)
+	if len(rMsg.Answer) != 2 {
+		t.Fatalf("expected the cname and a records, got: %v", rMsg)
+	}
+	if cname, ok := rMsg.Answer[0].(*dns.CNAME); !ok || cname.Target != "cdn.example.net." {
+		t.Errorf("cname chain should be kept, got: %v", rMsg.Answer[0])
+	}
+	if a, ok := rMsg.Answer[1].(*dns.A); !ok || a.Hdr.Name != "cdn.example.net." {
+		t.Errorf("a record of the chain should be kept, got: %v", rMsg.Answer[1])
+	}
+}
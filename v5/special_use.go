@@ -0,0 +1,115 @@
+package dohProxy
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// SpecialUseDomainsOff sends the queries of special-use domains upstream.
+	SpecialUseDomainsOff = "off"
+	// SpecialUseDomainsLocalhost answers the queries of localhost and its
+	// subdomains with the loopback addresses, and the reverse queries of the
+	// loopback addresses with localhost, RFC 6761.
+	SpecialUseDomainsLocalhost = "localhost"
+	// SpecialUseDomainsAll answers like SpecialUseDomainsLocalhost, and the
+	// queries of invalid and the private reverse zones with NXDOMAIN, RFC 6761
+	// and RFC 6303.
+	SpecialUseDomainsAll = "all"
+
+	// ttl of the local answers, also the negative ttl of their SOA.
+	specialUseTTL = 10800
+)
+
+// the reverse names of the loopback addresses.
+var loopbackReverseNames = map[string]bool{
+	"1.0.0.127.in-addr.arpa.": true,
+	"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.ip6.arpa.": true,
+}
+
+// the zones answered with NXDOMAIN by SpecialUseDomainsAll.
+var nxSpecialUseZones = func() []string {
+	zones := []string{"invalid.", "10.in-addr.arpa.", "168.192.in-addr.arpa.", "254.169.in-addr.arpa.",
+		"d.f.ip6.arpa.", "8.e.f.ip6.arpa.", "9.e.f.ip6.arpa.", "a.e.f.ip6.arpa.", "b.e.f.ip6.arpa."}
+	for i := 16; i < 32; i++ {
+		zones = append(zones, fmt.Sprintf("%v.172.in-addr.arpa.", i))
+	}
+	return zones
+}()
+
+// specialUseReply answers the queries of special-use domains in class IN by
+// mode, so they're not leaked upstream; nil if they're sent upstream, or for
+// other queries.
+func specialUseReply(msg *dns.Msg, mode string) *dns.Msg {
+	q := msg.Question[0]
+	if mode == "" || mode == SpecialUseDomainsOff || q.Qclass != dns.ClassINET {
+		return nil
+	}
+	name := dns.CanonicalName(q.Name)
+	rMsg := new(dns.Msg)
+	switch {
+	case dns.IsSubDomain("localhost.", name):
+		rMsg.SetReply(msg)
+		if q.Qtype == dns.TypeA || q.Qtype == dns.TypeANY {
+			rMsg.Answer = append(rMsg.Answer, specialUseAnswer(dns.TypeA, q.Name, net.IPv4(127, 0, 0, 1)))
+		}
+		if q.Qtype == dns.TypeAAAA || q.Qtype == dns.TypeANY {
+			rMsg.Answer = append(rMsg.Answer, specialUseAnswer(dns.TypeAAAA, q.Name, net.IPv6loopback))
+		}
+		if len(rMsg.Answer) == 0 {
+			rMsg.Ns = []dns.RR{specialUseSOA("localhost.")}
+		}
+	case loopbackReverseNames[name]:
+		rMsg.SetReply(msg)
+		if q.Qtype == dns.TypePTR || q.Qtype == dns.TypeANY {
+			rMsg.Answer = []dns.RR{&dns.PTR{
+				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: specialUseTTL},
+				Ptr: "localhost.",
+			}}
+		} else {
+			rMsg.Ns = []dns.RR{specialUseSOA(name)}
+		}
+	default:
+		if mode != SpecialUseDomainsAll {
+			return nil
+		}
+		zone := ""
+		for _, z := range nxSpecialUseZones {
+			if dns.IsSubDomain(z, name) {
+				zone = z
+				break
+			}
+		}
+		if zone == "" {
+			return nil
+		}
+		rMsg.SetRcode(msg, dns.RcodeNameError)
+		rMsg.Ns = []dns.RR{specialUseSOA(zone)}
+	}
+	rMsg.Authoritative = true
+	rMsg.RecursionAvailable = true
+	return rMsg
+}
+
+func specialUseAnswer(t uint16, name string, ip net.IP) dns.RR {
+	rr := genAnswerFromIP(t, name, ip)
+	rr.Header().Ttl = specialUseTTL
+	return rr
+}
+
+// specialUseSOA is the SOA of the locally served zone, as suggested by RFC
+// 6303, for the negative answers to be cached.
+func specialUseSOA(zone string) dns.RR {
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: specialUseTTL},
+		Ns:      zone,
+		Mbox:    "nobody.invalid.",
+		Serial:  1,
+		Refresh: 3600,
+		Retry:   1200,
+		Expire:  604800,
+		Minttl:  specialUseTTL,
+	}
+}
@@ -0,0 +1,70 @@
+package dohProxy
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestHandler_SpecialUseDomains(t *testing.T) {
+	query := func(handler *Handler, name string, qtype uint16) *dns.Msg {
+		writer := newTestResponseWriter("127.0.0.1:5353")
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, qtype)
+		handler.Handle(writer, msg)
+		return writer.waitMsg(t, time.Second)
+	}
+
+	provider := &testProvider{name: "upstream"}
+	handler := NewHandler(provider, &HandlerOptions{SpecialUseDomains: SpecialUseDomainsLocalhost})
+	rMsg := query(handler, "localhost.", dns.TypeA)
+	if len(rMsg.Answer) != 1 || !rMsg.Answer[0].(*dns.A).A.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("localhost should be answered with 127.0.0.1, got: %v", rMsg)
+	}
+	rMsg = query(handler, "app.LocalHost.", dns.TypeAAAA)
+	if len(rMsg.Answer) != 1 || !rMsg.Answer[0].(*dns.AAAA).AAAA.Equal(net.IPv6loopback) {
+		t.Errorf("subdomain of localhost should be answered with ::1, got: %v", rMsg)
+	}
+	rMsg = query(handler, "localhost.", dns.TypeMX)
+	if rMsg.Rcode != dns.RcodeSuccess || len(rMsg.Answer) != 0 || len(rMsg.Ns) != 1 {
+		t.Errorf("other types of localhost should be answered with NODATA, got: %v", rMsg)
+	}
+	rMsg = query(handler, "1.0.0.127.in-addr.arpa.", dns.TypePTR)
+	if len(rMsg.Answer) != 1 || rMsg.Answer[0].(*dns.PTR).Ptr != "localhost." {
+		t.Errorf("reverse of 127.0.0.1 should be answered with localhost, got: %v", rMsg)
+	}
+	if rMsg = query(handler, "example.invalid.", dns.TypeA); len(rMsg.Answer) != 1 {
+		t.Errorf("invalid should be sent upstream by localhost mode, got: %v", rMsg)
+	}
+	if n := atomic.LoadInt32(&provider.queries); n != 1 {
+		t.Errorf("only the query of invalid should be sent upstream, sent %v", n)
+	}
+
+	provider = &testProvider{name: "upstream"}
+	handler = NewHandler(provider, &HandlerOptions{SpecialUseDomains: SpecialUseDomainsAll})
+	for _, name := range []string{"example.invalid.", "invalid.", "1.1.168.192.in-addr.arpa.", "5.20.172.in-addr.arpa."} {
+		rMsg = query(handler, name, dns.TypeA)
+		if rMsg.Rcode != dns.RcodeNameError || len(rMsg.Ns) != 1 {
+			t.Errorf("%v should be answered with NXDOMAIN, got: %v", name, rMsg)
+		}
+	}
+	if rMsg = query(handler, "localhost.", dns.TypeA); len(rMsg.Answer) != 1 {
+		t.Errorf("localhost should be answered locally by all mode, got: %v", rMsg)
+	}
+	if rMsg = query(handler, "5.32.172.in-addr.arpa.", dns.TypePTR); len(rMsg.Answer) != 1 {
+		t.Errorf("public reverse zone should be sent upstream, got: %v", rMsg)
+	}
+	if n := atomic.LoadInt32(&provider.queries); n != 1 {
+		t.Errorf("only the public reverse query should be sent upstream, sent %v", n)
+	}
+
+	// A and AAAA queries of localhost are still answered by the hosts file.
+	provider = &testProvider{name: "upstream"}
+	handler = NewHandler(provider, &HandlerOptions{SpecialUseDomains: SpecialUseDomainsOff})
+	if rMsg = query(handler, "1.0.0.127.in-addr.arpa.", dns.TypePTR); atomic.LoadInt32(&provider.queries) != 1 {
+		t.Errorf("reverse of 127.0.0.1 should be sent upstream when off, got: %v", rMsg)
+	}
+}
@@ -0,0 +1,223 @@
+package dohProxy
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DefaultStaticHostsTTL is the ttl of answers from static hosts if not
+// specified.
+const DefaultStaticHostsTTL = 60
+
+// StaticHosts answers A and AAAA queries from a hosts format file, names
+// mapped to multiple ips are answered round-robin, or with one ip chosen by
+// weight if mapped in weighted lines, see parseWeightedHostsLine; PTR queries
+// of the mapped ips are answered with all their names. The file is re-read on
+// changes.
+type StaticHosts struct {
+	resolver HostsFileResolver
+	ttl      uint32
+	// rotates the answers of names with multiple ips.
+	next uint32
+	// chooses the ips of weighted names, replaceable for testing.
+	rand     *rand.Rand
+	randLock sync.Mutex
+}
+
+// NewStaticHosts creates a StaticHosts of the hosts file at path, answers have
+// the ttl, DefaultStaticHostsTTL if 0.
+func NewStaticHosts(path string, ttl uint32) (*StaticHosts, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, fmt.Errorf("open static hosts %v error: %v", path, err)
+	}
+	if ttl == 0 {
+		ttl = DefaultStaticHostsTTL
+	}
+	hosts := &StaticHosts{ttl: ttl, rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+	hosts.resolver.path = path
+	return hosts, nil
+}
+
+// Lookup answers msg if it's an A or AAAA query of a mapped name, names
+// mapped to ips of the other family only are answered with NODATA; nil if the
+// name isn't mapped.
+func (hosts *StaticHosts) Lookup(msg *dns.Msg) *dns.Msg {
+	if len(msg.Question) == 0 {
+		return nil
+	}
+	q := msg.Question[0]
+	if q.Qtype == dns.TypePTR {
+		return hosts.lookupPTR(msg)
+	}
+	if q.Qtype != dns.TypeA && q.Qtype != dns.TypeAAAA {
+		return nil
+	}
+	ips := hosts.resolver.LookupStaticHost(strings.TrimSuffix(q.Name, "."))
+	if len(ips) == 0 {
+		return nil
+	}
+
+	var matched []net.IP
+	for _, ip := range ips {
+		parsed := net.ParseIP(ip)
+		if parsed == nil || (parsed.To4() != nil) != (q.Qtype == dns.TypeA) {
+			continue
+		}
+		matched = append(matched, parsed)
+	}
+
+	rMsg := new(dns.Msg)
+	rMsg.SetReply(msg)
+	rMsg.Authoritative = true
+	if len(matched) == 0 {
+		return rMsg
+	}
+	if weights := hosts.resolver.LookupStaticHostWeights(strings.TrimSuffix(q.Name, ".")); weights != nil {
+		rr := genAnswerFromIP(q.Qtype, q.Name, hosts.choose(matched, weights))
+		rr.Header().Ttl = hosts.ttl
+		rMsg.Answer = append(rMsg.Answer, rr)
+		return rMsg
+	}
+	offset := int(atomic.AddUint32(&hosts.next, 1)) % len(matched)
+	for i := range matched {
+		rr := genAnswerFromIP(q.Qtype, q.Name, matched[(offset+i)%len(matched)])
+		rr.Header().Ttl = hosts.ttl
+		rMsg.Answer = append(rMsg.Answer, rr)
+	}
+	return rMsg
+}
+
+// choose returns one of ips at random by weights, the ips not in weights weigh
+// 1.
+func (hosts *StaticHosts) choose(ips []net.IP, weights map[string]int) net.IP {
+	total := 0
+	for _, ip := range ips {
+		total += ipWeight(ip, weights)
+	}
+	hosts.randLock.Lock()
+	n := hosts.rand.Intn(total)
+	hosts.randLock.Unlock()
+	for _, ip := range ips {
+		if n -= ipWeight(ip, weights); n < 0 {
+			return ip
+		}
+	}
+	return ips[len(ips)-1]
+}
+
+func ipWeight(ip net.IP, weights map[string]int) int {
+	if weight, ok := weights[ip.String()]; ok {
+		return weight
+	}
+	return 1
+}
+
+// parseWeightedHostsLine parses the line of a name mapped to weighted ips, the
+// name first, e.g. "printer.home 10.0.0.9#3 10.0.0.10#1", the weight is 1 if
+// no "#N" suffix; ok is false for lines of other formats, e.g. hosts format.
+func parseWeightedHostsLine(line string) (name string, addrs []string, weights []int, ok bool) {
+	fields := getFields(line)
+	if len(fields) < 2 || strings.HasPrefix(fields[0], "#") || parseLiteralIP(fields[0]) != "" {
+		return "", nil, nil, false
+	}
+	for _, field := range fields[1:] {
+		if strings.HasPrefix(field, "#") {
+			// comment.
+			break
+		}
+		addr, weight := field, 1
+		if i := strings.IndexByte(field, '#'); i >= 0 {
+			w, err := strconv.Atoi(field[i+1:])
+			if err != nil || w < 1 {
+				return "", nil, nil, false
+			}
+			addr, weight = field[:i], w
+		}
+		if addr = parseLiteralIP(addr); addr == "" {
+			return "", nil, nil, false
+		}
+		addrs = append(addrs, addr)
+		weights = append(weights, weight)
+	}
+	return fields[0], addrs, weights, len(addrs) > 0
+}
+
+// lookupPTR answers the PTR query msg with the names mapped to the ip, nil if
+// the ip isn't mapped.
+func (hosts *StaticHosts) lookupPTR(msg *dns.Msg) *dns.Msg {
+	q := msg.Question[0]
+	ip := reverseNameIP(q.Name)
+	if ip == nil {
+		return nil
+	}
+	names := hosts.resolver.LookupStaticAddr(ip.String())
+	if len(names) == 0 {
+		return nil
+	}
+	rMsg := new(dns.Msg)
+	rMsg.SetReply(msg)
+	rMsg.Authoritative = true
+	seen := make(map[string]bool)
+	for _, name := range names {
+		name = dns.Fqdn(name)
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		rMsg.Answer = append(rMsg.Answer, &dns.PTR{
+			Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: hosts.ttl},
+			Ptr: name,
+		})
+	}
+	return rMsg
+}
+
+// reverseNameIP returns the ip of the reverse name under "in-addr.arpa." or
+// "ip6.arpa.", nil if name isn't the reverse name of a whole ip.
+func reverseNameIP(name string) net.IP {
+	name = strings.ToLower(dns.Fqdn(name))
+	switch {
+	case strings.HasSuffix(name, ".in-addr.arpa."):
+		labels := strings.Split(strings.TrimSuffix(name, ".in-addr.arpa."), ".")
+		if len(labels) != net.IPv4len {
+			return nil
+		}
+		for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+			labels[i], labels[j] = labels[j], labels[i]
+		}
+		return net.ParseIP(strings.Join(labels, ".")).To4()
+	case strings.HasSuffix(name, ".ip6.arpa."):
+		nibbles := strings.Split(strings.TrimSuffix(name, ".ip6.arpa."), ".")
+		if len(nibbles) != 2*net.IPv6len {
+			return nil
+		}
+		ip := make(net.IP, net.IPv6len)
+		for i, nibble := range nibbles {
+			if len(nibble) != 1 {
+				return nil
+			}
+			v := strings.IndexByte("0123456789abcdef", nibble[0])
+			if v < 0 {
+				return nil
+			}
+			// nibbles are in reverse order, the lowest first.
+			pos := len(nibbles) - 1 - i
+			if pos%2 == 0 {
+				ip[pos/2] |= byte(v) << 4
+			} else {
+				ip[pos/2] |= byte(v)
+			}
+		}
+		return ip
+	}
+	return nil
+}
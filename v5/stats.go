@@ -0,0 +1,73 @@
+package dohProxy
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// queryStats counts the queries for the /stats admin api, updated along with
+// the metrics.
+var queryStats = newStats()
+
+// Stats counts queries and upstream queries with atomic operations, reading
+// is lock-free.
+type Stats struct {
+	startTime       time.Time
+	queries         int64
+	cacheHits       int64
+	upstreamQueries int64
+	upstreamErrors  int64
+	// sum of the latency of upstream queries in nanoseconds.
+	upstreamLatency int64
+}
+
+// StatsSnapshot is the json of the /stats admin api.
+type StatsSnapshot struct {
+	Queries              int64   `json:"queries"`
+	CacheHits            int64   `json:"cache_hits"`
+	CacheHitRatio        float64 `json:"cache_hit_ratio"`
+	UpstreamQueries      int64   `json:"upstream_queries"`
+	UpstreamErrors       int64   `json:"upstream_errors"`
+	AvgUpstreamLatencyMs float64 `json:"avg_upstream_latency_ms"`
+	UptimeSeconds        float64 `json:"uptime_seconds"`
+}
+
+func newStats() *Stats {
+	return &Stats{startTime: time.Now()}
+}
+
+func (s *Stats) recordQuery() {
+	atomic.AddInt64(&s.queries, 1)
+}
+
+func (s *Stats) recordCacheHit() {
+	atomic.AddInt64(&s.cacheHits, 1)
+}
+
+func (s *Stats) recordUpstream(latency time.Duration, err error) {
+	atomic.AddInt64(&s.upstreamQueries, 1)
+	atomic.AddInt64(&s.upstreamLatency, int64(latency))
+	if err != nil {
+		atomic.AddInt64(&s.upstreamErrors, 1)
+	}
+}
+
+// Snapshot returns the current counters, the ratio and average are 0 if
+// there's nothing counted.
+func (s *Stats) Snapshot() *StatsSnapshot {
+	snapshot := &StatsSnapshot{
+		Queries:         atomic.LoadInt64(&s.queries),
+		CacheHits:       atomic.LoadInt64(&s.cacheHits),
+		UpstreamQueries: atomic.LoadInt64(&s.upstreamQueries),
+		UpstreamErrors:  atomic.LoadInt64(&s.upstreamErrors),
+		UptimeSeconds:   time.Since(s.startTime).Seconds(),
+	}
+	if snapshot.Queries > 0 {
+		snapshot.CacheHitRatio = float64(snapshot.CacheHits) / float64(snapshot.Queries)
+	}
+	if snapshot.UpstreamQueries > 0 {
+		latency := atomic.LoadInt64(&s.upstreamLatency)
+		snapshot.AvgUpstreamLatencyMs = float64(latency) / float64(snapshot.UpstreamQueries) / float64(time.Millisecond)
+	}
+	return snapshot
+}
@@ -291,7 +291,7 @@ func (stub Stub) generateMsgFromReq(r *http.Request) (*dns.Msg, error) {
 
 func (stub Stub) Run() {
 	if stub.UseCache {
-		cache = NewCache()
+		cache = NewCache(nil)
 	}
 
 	stub.addSubnetException()
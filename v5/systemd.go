@@ -0,0 +1,72 @@
+package dohProxy
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// the first file descriptor passed by systemd socket activation, after stdin,
+// stdout and stderr.
+const systemdListenFdsStart = 3
+
+// SystemdActivated tells whether sockets are passed to this process by systemd
+// socket activation.
+func SystemdActivated() bool {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	return err == nil && pid == os.Getpid() && os.Getenv("LISTEN_FDS") != ""
+}
+
+// SystemdSockets returns the stream sockets passed by systemd socket
+// activation as listeners, and the datagram sockets as packet conns, by the
+// LISTEN_FDS protocol of sd_listen_fds(3); none if not activated. The
+// environment variables are unset, so they're not inherited by children.
+func SystemdSockets() ([]net.Listener, []net.PacketConn, error) {
+	return systemdSockets(systemdListenFdsStart)
+}
+
+func systemdSockets(start int) ([]net.Listener, []net.PacketConn, error) {
+	if !SystemdActivated() {
+		return nil, nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 0 {
+		return nil, nil, fmt.Errorf("invalid LISTEN_FDS: %v", os.Getenv("LISTEN_FDS"))
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	for _, env := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		_ = os.Unsetenv(env)
+	}
+
+	var listeners []net.Listener
+	var packetConns []net.PacketConn
+	closeAll := func() {
+		for _, l := range listeners {
+			_ = l.Close()
+		}
+		for _, pc := range packetConns {
+			_ = pc.Close()
+		}
+	}
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("LISTEN_FD_%v", start+i)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		// the net functions dup the descriptor, the file is closed after.
+		f := os.NewFile(uintptr(start+i), name)
+		if l, err := net.FileListener(f); err == nil {
+			listeners = append(listeners, l)
+		} else if pc, err := net.FilePacketConn(f); err == nil {
+			packetConns = append(packetConns, pc)
+		} else {
+			_ = f.Close()
+			closeAll()
+			return nil, nil, fmt.Errorf("inherited socket %v is neither stream nor datagram: %v", name, err)
+		}
+		_ = f.Close()
+	}
+	return listeners, packetConns, nil
+}
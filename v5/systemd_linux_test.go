@@ -0,0 +1,100 @@
+//go:build linux
+// +build linux
+
+package dohProxy
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/sys/unix"
+)
+
+// inheritFd duplicates the descriptor of f to fd, as if it's passed by
+// systemd.
+func inheritFd(t *testing.T, f *os.File, fd int) {
+	defer func() { _ = f.Close() }()
+	if err := unix.Dup2(int(f.Fd()), fd); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSystemdSockets(t *testing.T) {
+	// high descriptors unlikely in use by the test process.
+	const start = 200
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	udpConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcpFile, err := tcpListener.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	udpFile, err := udpConn.(*net.UDPConn).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcpAddr, udpAddr := tcpListener.Addr().String(), udpConn.LocalAddr().String()
+	inheritFd(t, tcpFile, start)
+	inheritFd(t, udpFile, start+1)
+	_ = tcpListener.Close()
+	_ = udpConn.Close()
+
+	if SystemdActivated() {
+		t.Fatal("should not be activated without LISTEN_PID")
+	}
+	_ = os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	_ = os.Setenv("LISTEN_FDS", "2")
+	listeners, packetConns, err := systemdSockets(start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listeners) != 1 || len(packetConns) != 1 {
+		t.Fatalf("one listener and one packet conn should be inherited, got %v and %v", len(listeners), len(packetConns))
+	}
+	if os.Getenv("LISTEN_FDS") != "" || SystemdActivated() {
+		t.Error("environment variables should be unset")
+	}
+
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Answer = []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.ParseIP("192.0.2.1"),
+		}}
+		_ = w.WriteMsg(m)
+	})
+	servers := []*dns.Server{
+		{Net: "tcp", Listener: listeners[0], Handler: handler},
+		{Net: "udp", PacketConn: packetConns[0], Handler: handler},
+	}
+	for _, server := range servers {
+		started := make(chan struct{})
+		server.NotifyStartedFunc = func() { close(started) }
+		go func(server *dns.Server) { _ = server.ActivateAndServe() }(server)
+		<-started
+		defer func(server *dns.Server) { _ = server.Shutdown() }(server)
+	}
+
+	for network, addr := range map[string]string{"tcp": tcpAddr, "udp": udpAddr} {
+		msg := new(dns.Msg)
+		msg.SetQuestion("example.com.", dns.TypeA)
+		c := &dns.Client{Net: network, Timeout: time.Second}
+		rMsg, _, err := c.Exchange(msg, addr)
+		if err != nil {
+			t.Fatalf("query over %v on the inherited socket failed: %v", network, err)
+		}
+		if len(rMsg.Answer) != 1 {
+			t.Errorf("unexpected answer over %v: %v", network, rMsg)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package dohProxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// span names of query handling, the upstream and write spans are children
+	// of the query span.
+	spanNameQuery       = "dns.query"
+	spanNameCacheLookup = "cache.lookup"
+	spanNameUpstream    = "upstream.query"
+	spanNameWrite       = "response.write"
+
+	tracerName = "github.com/tinkernels/doh-proxy"
+
+	otlpTracesPath = "/v1/traces"
+)
+
+// traceparent is the W3C Trace Context propagator of the upstream span in DoH
+// requests.
+var traceparent = propagation.TraceContext{}
+
+// TracerOptions specifies options of Tracer.
+type TracerOptions struct {
+	// service.name of the exported spans, "doh-proxy" if empty.
+	ServiceName string
+}
+
+// Tracer creates the spans of query handling and exports them in batches, a
+// nil Tracer creates no-op spans, so tracing is off.
+type Tracer struct {
+	provider *sdktrace.TracerProvider
+	tracer   trace.Tracer
+}
+
+// NewTracer returns a tracer exporting the spans to exporter.
+func NewTracer(exporter sdktrace.SpanExporter, opts *TracerOptions) *Tracer {
+	if opts == nil {
+		opts = &TracerOptions{}
+	}
+	if opts.ServiceName == "" {
+		opts.ServiceName = "doh-proxy"
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(opts.ServiceName))),
+	)
+	return &Tracer{provider: provider, tracer: provider.Tracer(tracerName)}
+}
+
+// Close exports the pending spans and shuts the exporter down, no spans should
+// be ended after closing.
+func (t *Tracer) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return t.provider.Shutdown(ctx)
+}
+
+// start returns a new span, the child of the span of ctx if any, and ctx
+// carrying it; the span of ctx, a no-op one if none, if t is nil.
+func (t *Tracer) start(ctx context.Context, name string, kind trace.SpanKind) (context.Context, trace.Span) {
+	if t == nil {
+		return ctx, trace.SpanFromContext(ctx)
+	}
+	return t.tracer.Start(ctx, name, trace.WithSpanKind(kind))
+}
+
+// injectTraceparent sets the traceparent header of req to the span of its
+// context, so the DoH server can correlate.
+func injectTraceparent(req *http.Request) {
+	traceparent.Inject(req.Context(), propagation.HeaderCarrier(req.Header))
+}
+
+// setQuerySpanAttributes sets the attributes of the query span from the query
+// msg and the answered rcode, negative if not answered.
+func setQuerySpanAttributes(span trace.Span, msg *dns.Msg, rcode int, cacheHit bool) {
+	if len(msg.Question) > 0 {
+		span.SetAttributes(
+			attribute.String("dns.qname", msg.Question[0].Name),
+			attribute.String("dns.qtype", dns.TypeToString[msg.Question[0].Qtype]),
+		)
+	}
+	if rcode >= 0 {
+		span.SetAttributes(attribute.String("dns.rcode", dns.RcodeToString[rcode]))
+	}
+	span.SetAttributes(attribute.Bool("dns.cache_hit", cacheHit))
+}
+
+// rcodeWriter records the rcode of the answer for the query span.
+type rcodeWriter struct {
+	dns.ResponseWriter
+	lock  sync.Mutex
+	rcode int
+}
+
+func newRcodeWriter(writer dns.ResponseWriter) *rcodeWriter {
+	return &rcodeWriter{ResponseWriter: writer, rcode: -1}
+}
+
+func (w *rcodeWriter) WriteMsg(msg *dns.Msg) error {
+	w.lock.Lock()
+	w.rcode = msg.Rcode
+	w.lock.Unlock()
+	return w.ResponseWriter.WriteMsg(msg)
+}
+
+func (w *rcodeWriter) answeredRcode() int {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.rcode
+}
+
+// OTLPExporterOptions specifies options of the OTLP exporter.
+type OTLPExporterOptions struct {
+	// timeout of the export requests, 10 seconds if 0.
+	Timeout time.Duration
+}
+
+// NewOTLPExporter returns the OTLP/HTTP exporter to endpoint, e.g.
+// "http://localhost:4318"; "/v1/traces" is appended if it has no path.
+func NewOTLPExporter(endpoint string, opts *OTLPExporterOptions) (sdktrace.SpanExporter, error) {
+	if opts == nil {
+		opts = &OTLPExporterOptions{}
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = 10 * time.Second
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("otel endpoint should be an http or https url: %v", endpoint)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = otlpTracesPath
+	}
+	// no connection is made until the spans are exported.
+	return otlptracehttp.New(context.Background(),
+		otlptracehttp.WithEndpointURL(u.String()),
+		otlptracehttp.WithTimeout(opts.Timeout),
+	)
+}
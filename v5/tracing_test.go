@@ -0,0 +1,154 @@
+package dohProxy
+
+import (
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestHandler_Tracing(t *testing.T) {
+	traceparents := make(chan http.Header, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparents <- r.Header.Clone()
+		raw, _ := base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		req := new(dns.Msg)
+		if err := req.Unpack(raw); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		m := new(dns.Msg)
+		m.SetReply(req)
+		rr, _ := dns.NewRR(req.Question[0].Name + " 300 IN A 192.0.2.1")
+		m.Answer = append(m.Answer, rr)
+		bytesMsg, _ := m.Pack()
+		w.Header().Set("Content-Type", ContentType)
+		_, _ = w.Write(bytesMsg)
+	}))
+	defer ts.Close()
+
+	provider, err := NewDMProvider([]string{ts.URL}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exporter := tracetest.NewInMemoryExporter()
+	tracer := NewTracer(exporter, nil)
+	handler := NewHandler(provider, &HandlerOptions{Cache: true, Tracer: tracer})
+	writer := newTestResponseWriter("127.0.0.1:5353")
+	msg := new(dns.Msg)
+	msg.SetQuestion("traced.example.com.", dns.TypeA)
+	handler.Handle(writer, msg)
+	writer.waitMsg(t, time.Second)
+
+	// the query span ends after the answer is written.
+	var spans map[string]tracetest.SpanStub
+	for i := 0; i < 100; i++ {
+		if err := tracer.provider.ForceFlush(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		spans = make(map[string]tracetest.SpanStub)
+		for _, span := range exporter.GetSpans() {
+			spans[span.Name] = span
+		}
+		if _, ok := spans[spanNameQuery]; ok {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	root, ok := spans[spanNameQuery]
+	if !ok || root.Parent.IsValid() || root.SpanKind != trace.SpanKindServer {
+		t.Fatalf("expected root query span, got: %v", spans)
+	}
+	attributes := attribute.NewSet(root.Attributes...)
+	for key, expected := range map[attribute.Key]attribute.Value{
+		"dns.qname":     attribute.StringValue("traced.example.com."),
+		"dns.qtype":     attribute.StringValue("A"),
+		"dns.rcode":     attribute.StringValue("NOERROR"),
+		"dns.cache_hit": attribute.BoolValue(false),
+	} {
+		if value, _ := attributes.Value(key); value != expected {
+			t.Errorf("unexpected attribute %v of query span: %v", key, value.Emit())
+		}
+	}
+	if name := root.Resource.Set().Encoded(attribute.DefaultEncoder()); name != "service.name=doh-proxy" {
+		t.Errorf("unexpected resource of query span: %v", name)
+	}
+	for _, name := range []string{spanNameCacheLookup, spanNameUpstream, spanNameWrite} {
+		span, ok := spans[name]
+		if !ok || span.SpanContext.TraceID() != root.SpanContext.TraceID() ||
+			span.Parent.SpanID() != root.SpanContext.SpanID() {
+			t.Errorf("expected %v span as a child of query span, got: %v", name, span)
+		}
+	}
+	if upstream, ok := spans[spanNameUpstream]; ok {
+		sent := trace.SpanContextFromContext(propagation.TraceContext{}.Extract(context.Background(),
+			propagation.HeaderCarrier(<-traceparents)))
+		if sent.SpanID() != upstream.SpanContext.SpanID() || sent.TraceID() != upstream.SpanContext.TraceID() {
+			t.Errorf("traceparent of upstream span should be sent, got: %v", sent)
+		}
+	}
+}
+
+func TestOTLPExporter(t *testing.T) {
+	requests := make(chan *coltracepb.ExportTraceServiceRequest, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != otlpTracesPath {
+			t.Errorf("unexpected path: %v", r.URL.Path)
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		request := &coltracepb.ExportTraceServiceRequest{}
+		if err := proto.Unmarshal(body, request); err != nil {
+			t.Errorf("unmarshal export request error: %v", err)
+		}
+		requests <- request
+		w.Header().Set("Content-Type", "application/x-protobuf")
+	}))
+	defer ts.Close()
+
+	if _, err := NewOTLPExporter("localhost:4318", nil); err == nil {
+		t.Error("endpoint without scheme should be rejected")
+	}
+	exporter, err := NewOTLPExporter(ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracer := NewTracer(exporter, &TracerOptions{ServiceName: "test"})
+	ctx, root := tracer.start(context.Background(), spanNameQuery, trace.SpanKindServer)
+	root.SetAttributes(attribute.String("dns.qname", "example.com."))
+	_, child := tracer.start(ctx, spanNameUpstream, trace.SpanKindClient)
+	child.End()
+	root.End()
+	if err := tracer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	request := <-requests
+	resourceSpans := request.ResourceSpans[0]
+	if attribute := resourceSpans.Resource.Attributes[0]; attribute.Key != "service.name" ||
+		attribute.Value.GetStringValue() != "test" {
+		t.Errorf("unexpected resource attribute: %v", attribute)
+	}
+	spans := resourceSpans.ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans, got: %v", spans)
+	}
+	upstream, query := spans[0], spans[1]
+	if string(upstream.ParentSpanId) != string(query.SpanId) || string(upstream.TraceId) != string(query.TraceId) {
+		t.Errorf("upstream span should be a child of query span: %v", spans)
+	}
+	attribute := query.Attributes[0]
+	if attribute.Key != "dns.qname" || attribute.Value.GetStringValue() != "example.com." {
+		t.Errorf("unexpected attribute: %v", attribute)
+	}
+}
@@ -0,0 +1,147 @@
+package dohProxy
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// length of the dns message header, shorter packets are dropped by the server.
+const dnsHeaderLen = 12
+
+// errWorkersBusy is returned by reading while all workers are busy, it's
+// temporary so the server checks for shutting down and reads again.
+type errWorkersBusy struct{}
+
+func (errWorkersBusy) Error() string   { return "all udp workers busy" }
+func (errWorkersBusy) Timeout() bool   { return true }
+func (errWorkersBusy) Temporary() bool { return true }
+
+// UDPWorkers limits the udp queries a dns server handles concurrently, a
+// packet is read only when a worker is free, so bursts wait in the socket
+// receive buffer rather than piling up goroutines.
+type UDPWorkers struct {
+	slots chan struct{}
+	// response writers of the queries being handled.
+	serving sync.Map
+}
+
+// NewUDPWorkers returns n workers.
+func NewUDPWorkers(n int) *UDPWorkers {
+	return &UDPWorkers{slots: make(chan struct{}, n)}
+}
+
+// Attach makes server read and handle udp queries by the workers, it must be
+// called after the handler and the accept func of server are set.
+//
+// The worker taken for a packet is released when the handler returns, when
+// the packet is ignored, or when the server answers it by itself, like the
+// rejected and the malformed queries.
+func (w *UDPWorkers) Attach(server *dns.Server) {
+	accept := server.MsgAcceptFunc
+	if accept == nil {
+		accept = dns.DefaultMsgAcceptFunc
+	}
+	server.MsgAcceptFunc = func(dh dns.Header) dns.MsgAcceptAction {
+		action := accept(dh)
+		if action == dns.MsgIgnore {
+			w.release()
+		}
+		return action
+	}
+	handler := server.Handler
+	if handler == nil {
+		handler = dns.DefaultServeMux
+	}
+	server.Handler = dns.HandlerFunc(func(rw dns.ResponseWriter, msg *dns.Msg) {
+		w.serving.Store(rw, struct{}{})
+		defer func() {
+			w.serving.Delete(rw)
+			w.release()
+		}()
+		handler.ServeDNS(rw, msg)
+	})
+	decorateWriter := server.DecorateWriter
+	server.DecorateWriter = func(dw dns.Writer) dns.Writer {
+		rw := dw
+		if decorateWriter != nil {
+			dw = decorateWriter(dw)
+		}
+		return &workersWriter{Writer: dw, rw: rw, workers: w}
+	}
+	decorate := server.DecorateReader
+	server.DecorateReader = func(r dns.Reader) dns.Reader {
+		if decorate != nil {
+			r = decorate(r)
+		}
+		return &workersReader{Reader: r, workers: w}
+	}
+}
+
+// acquire takes a worker, waiting at most timeout.
+func (w *UDPWorkers) acquire(timeout time.Duration) bool {
+	select {
+	case w.slots <- struct{}{}:
+		return true
+	default:
+	}
+	metricUDPWorkersBusy.Inc()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case w.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func (w *UDPWorkers) release() {
+	<-w.slots
+}
+
+// workersReader reads a udp packet after taking a worker.
+type workersReader struct {
+	dns.Reader
+	workers *UDPWorkers
+}
+
+func (r *workersReader) ReadUDP(conn *net.UDPConn, timeout time.Duration) ([]byte, *dns.SessionUDP, error) {
+	if !r.workers.acquire(timeout) {
+		return nil, nil, errWorkersBusy{}
+	}
+	m, s, err := r.Reader.ReadUDP(conn, timeout)
+	if err != nil || len(m) < dnsHeaderLen {
+		r.workers.release()
+	}
+	return m, s, err
+}
+
+func (r *workersReader) ReadPacketConn(conn net.PacketConn, timeout time.Duration) ([]byte, net.Addr, error) {
+	if !r.workers.acquire(timeout) {
+		return nil, nil, errWorkersBusy{}
+	}
+	m, addr, err := r.Reader.(dns.PacketConnReader).ReadPacketConn(conn, timeout)
+	if err != nil || len(m) < dnsHeaderLen {
+		r.workers.release()
+	}
+	return m, addr, err
+}
+
+// workersWriter releases the worker of a packet answered by the server rather
+// than the handler.
+type workersWriter struct {
+	dns.Writer
+	rw      dns.Writer
+	workers *UDPWorkers
+}
+
+func (w *workersWriter) Write(b []byte) (int, error) {
+	n, err := w.Writer.Write(b)
+	if _, ok := w.workers.serving.Load(w.rw); !ok {
+		w.workers.release()
+	}
+	return n, err
+}
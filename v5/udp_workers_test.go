@@ -0,0 +1,81 @@
+package dohProxy
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestUDPWorkers(t *testing.T) {
+	release := make(chan bool)
+	handled := make(chan string, 4)
+	pc, err := ListenUDP("127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		handled <- r.Question[0].Name
+		if r.Question[0].Name == "slow.example.com." {
+			<-release
+		}
+		m := new(dns.Msg)
+		m.SetReply(r)
+		_ = w.WriteMsg(m)
+	})}
+	NewUDPWorkers(1).Attach(server)
+	go func() { _ = server.ActivateAndServe() }()
+	defer func() { _ = server.Shutdown() }()
+
+	conn, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+	send := func(name string) {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, dns.TypeA)
+		b, _ := msg.Pack()
+		if _, err := conn.Write(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// packets not passed to the handler don't hold a worker: too short, a
+	// response, two questions, a question cut off.
+	for _, b := range [][]byte{
+		{0, 1, 2},
+		{0, 1, 0x80, 0, 0, 1, 0, 0, 0, 0, 0, 0},
+		{0, 1, 0, 0, 0, 2, 0, 0, 0, 0, 0, 0},
+		{0, 1, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 5, 'a'},
+	} {
+		if _, err := conn.Write(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	send("slow.example.com.")
+	select {
+	case name := <-handled:
+		if name != "slow.example.com." {
+			t.Fatalf("unexpected query handled: %v", name)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("query should be handled by the free worker")
+	}
+	send("fast.example.com.")
+	select {
+	case name := <-handled:
+		t.Fatalf("%v should wait for the busy worker", name)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	select {
+	case name := <-handled:
+		if name != "fast.example.com." {
+			t.Errorf("unexpected query handled: %v", name)
+		}
+	case <-time.After(time.Second):
+		t.Error("query should be handled once the worker is free")
+	}
+}
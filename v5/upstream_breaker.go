@@ -0,0 +1,107 @@
+package dohProxy
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// DefaultUpstreamBreakerCooldown is how long the circuit breaker of an
+// endpoint stays open if not specified.
+const DefaultUpstreamBreakerCooldown = 30 * time.Second
+
+// upstreamBreaker is the circuit breaker of an endpoint: it opens after the
+// threshold of consecutive failures, the endpoint is skipped until the
+// cooldown elapses, then one query probes it; the breaker closes if the probe
+// succeeds, or opens again.
+type upstreamBreaker struct {
+	// unix nano the cooldown ends, 0 if closed.
+	openUntil int64
+	// a query is probing the half open endpoint.
+	probing int32
+}
+
+// allow tells whether the endpoint can be queried at now, true for one query
+// once the cooldown elapsed.
+func (b *upstreamBreaker) allow(now time.Time) bool {
+	openUntil := atomic.LoadInt64(&b.openUntil)
+	if openUntil == 0 {
+		return true
+	}
+	if now.UnixNano() < openUntil {
+		return false
+	}
+	return atomic.CompareAndSwapInt32(&b.probing, 0, 1)
+}
+
+// open opens the breaker for cooldown from now, it's reported whether it was
+// closed.
+func (b *upstreamBreaker) open(now time.Time, cooldown time.Duration) bool {
+	wasClosed := atomic.SwapInt64(&b.openUntil, now.Add(cooldown).UnixNano()) == 0
+	atomic.StoreInt32(&b.probing, 0)
+	return wasClosed
+}
+
+// close closes the breaker, it's reported whether it was open.
+func (b *upstreamBreaker) close() bool {
+	if atomic.LoadInt64(&b.openUntil) == 0 {
+		return false
+	}
+	atomic.StoreInt32(&b.probing, 0)
+	return atomic.SwapInt64(&b.openUntil, 0) != 0
+}
+
+// abort lets another query probe, the probing one was cancelled without a
+// result.
+func (b *upstreamBreaker) abort() {
+	atomic.StoreInt32(&b.probing, 0)
+}
+
+// breakerAllows tells whether u can be queried at now by its breaker, it must
+// be queried then.
+func (provider DMProvider) breakerAllows(u *upstream, now time.Time) bool {
+	return provider.opts.BreakerThreshold <= 0 || u.breaker.allow(now)
+}
+
+// allowedUpstreams returns the endpoints of upstreams whose breakers allow
+// querying, in order, they must all be queried; all of them if none does, so
+// queries aren't failed without trying.
+func (provider DMProvider) allowedUpstreams(upstreams []*upstream) []*upstream {
+	if provider.opts.BreakerThreshold <= 0 {
+		return upstreams
+	}
+	now := time.Now()
+	allowed := make([]*upstream, 0, len(upstreams))
+	for _, u := range upstreams {
+		if provider.breakerAllows(u, now) {
+			allowed = append(allowed, u)
+		}
+	}
+	if len(allowed) == 0 {
+		return upstreams
+	}
+	return allowed
+}
+
+// observeBreaker updates the breaker of u by the result of a query, failures
+// is the consecutive failures after it.
+func (provider DMProvider) observeBreaker(u *upstream, failures int32) {
+	if provider.opts.BreakerThreshold <= 0 {
+		return
+	}
+	if failures == 0 {
+		if u.breaker.close() {
+			upstreamLog.Infof("endpoint %v recovered, circuit closed", u.endpoint)
+		}
+		return
+	}
+	if int(failures) < provider.opts.BreakerThreshold {
+		return
+	}
+	cooldown := provider.opts.BreakerCooldown
+	if cooldown <= 0 {
+		cooldown = DefaultUpstreamBreakerCooldown
+	}
+	if u.breaker.open(time.Now(), cooldown) {
+		upstreamLog.Warnf("endpoint %v failed %v times, circuit open for %v", u.endpoint, failures, cooldown)
+	}
+}
@@ -0,0 +1,148 @@
+package dohProxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// UpstreamGroupOptionCode is the EDNS0 local option of queries tagging the
+// upstream group, the data is the group name, e.g. "gaming".
+const UpstreamGroupOptionCode = 65001
+
+// ParseUpstreamGroup parses the upstream group as name=url1,url2, e.g.
+// "gaming=https://dns.example.com/dns-query,https://dns.example.net/dns-query".
+func ParseUpstreamGroup(s string) (string, []string, error) {
+	i := strings.IndexByte(s, '=')
+	if i < 0 {
+		return "", nil, fmt.Errorf("upstream group should be name=url1,url2: %v", s)
+	}
+	name := strings.TrimSpace(s[:i])
+	if name == "" {
+		return "", nil, fmt.Errorf("no name of upstream group: %v", s)
+	}
+	var upstreams []string
+	for _, upstream := range strings.Split(s[i+1:], ",") {
+		if upstream = strings.TrimSpace(upstream); upstream != "" {
+			upstreams = append(upstreams, upstream)
+		}
+	}
+	if len(upstreams) == 0 {
+		return "", nil, fmt.Errorf("no upstream of group %v", name)
+	}
+	return name, upstreams, nil
+}
+
+// upstreamGroupTag returns the upstream group tagged by msg, "" if none.
+func upstreamGroupTag(msg *dns.Msg) string {
+	if opt := msg.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if local, ok := o.(*dns.EDNS0_LOCAL); ok && local.Code == UpstreamGroupOptionCode {
+				return string(local.Data)
+			}
+		}
+	}
+	return ""
+}
+
+// setUpstreamGroupTag replaces the upstream group tag of msg with tag, it's
+// removed if tag is "".
+func setUpstreamGroupTag(msg *dns.Msg, tag string) {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		if tag == "" {
+			return
+		}
+		msg.SetEdns0(dns.DefaultMsgSize, false)
+		opt = msg.IsEdns0()
+	}
+	var options []dns.EDNS0
+	for _, o := range opt.Option {
+		if local, ok := o.(*dns.EDNS0_LOCAL); !ok || local.Code != UpstreamGroupOptionCode {
+			options = append(options, o)
+		}
+	}
+	if tag != "" {
+		options = append(options, &dns.EDNS0_LOCAL{Code: UpstreamGroupOptionCode, Data: []byte(tag)})
+	}
+	opt.Option = options
+}
+
+// GroupProvider picks the provider by the upstream group tagged by the query,
+// untagged queries and groups not found are queried by the default provider;
+// the tag isn't sent upstream. It implements the Provider interface.
+type GroupProvider struct {
+	groups          map[string]Provider
+	defaultProvider Provider
+}
+
+// NewGroupProvider creates a GroupProvider of groups, mapping the names to the
+// upstreams, which are like those of routes; providers of DoH, DoT and DoQ
+// groups are created with opts, except the endpoint ips.
+func NewGroupProvider(defaultProvider Provider, groups map[string][]string, opts *DMProviderOptions) (*GroupProvider, error) {
+	provider := &GroupProvider{
+		groups:          make(map[string]Provider),
+		defaultProvider: defaultProvider,
+	}
+	for name, upstreams := range groups {
+		p, err := newRouteUpstream(upstreams, opts)
+		if err != nil {
+			return nil, fmt.Errorf("upstream group %v: %v", name, err)
+		}
+		provider.groups[name] = p
+		upstreamLog.Infof("upstream group %v: %v", name, upstreams)
+	}
+	return provider, nil
+}
+
+// Group returns the provider for msg, and msg without the tag.
+func (provider *GroupProvider) Group(msg *dns.Msg) (Provider, *dns.Msg) {
+	tag := upstreamGroupTag(msg)
+	if tag == "" {
+		return provider.defaultProvider, msg
+	}
+	msg = msg.Copy()
+	setUpstreamGroupTag(msg, "")
+	if p, ok := provider.groups[tag]; ok {
+		return p, msg
+	}
+	return provider.defaultProvider, msg
+}
+
+func (provider *GroupProvider) Query(msg *dns.Msg) (*dns.Msg, error) {
+	p, msg := provider.Group(msg)
+	return p.Query(msg)
+}
+
+// QueryClient is like Query, passing clientIP to the provider of the group.
+func (provider *GroupProvider) QueryClient(msg *dns.Msg, clientIP net.IP) (*dns.Msg, error) {
+	p, msg := provider.Group(msg)
+	return queryClient(p, msg, clientIP)
+}
+
+// QueryContext is like QueryClient, passing ctx to the provider of the group.
+func (provider *GroupProvider) QueryContext(ctx context.Context, msg *dns.Msg, clientIP net.IP) (*dns.Msg, error) {
+	p, msg := provider.Group(msg)
+	return queryContext(ctx, p, msg, clientIP)
+}
+
+// Close closes the providers of all groups and the default provider.
+func (provider *GroupProvider) Close() error {
+	var err error
+	closeProvider := func(p Provider) {
+		if closer, ok := p.(io.Closer); ok {
+			if e := closer.Close(); e != nil {
+				err = e
+			}
+		}
+	}
+	for _, p := range provider.groups {
+		closeProvider(p)
+	}
+	closeProvider(provider.defaultProvider)
+	return err
+}
@@ -0,0 +1,98 @@
+package dohProxy
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// startGroupTestServer starts a plain dns server answering A queries with ip,
+// the queries received are sent to seen.
+func startGroupTestServer(t *testing.T, ip string, seen chan<- *dns.Msg) string {
+	return startPlainTestServer(t, dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		seen <- r
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Answer = []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+			A:   net.ParseIP(ip),
+		}}
+		_ = w.WriteMsg(m)
+	}))
+}
+
+func TestParseUpstreamGroup(t *testing.T) {
+	name, upstreams, err := ParseUpstreamGroup("gaming=https://a.example/dns-query, https://b.example/dns-query")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "gaming" || len(upstreams) != 2 || upstreams[1] != "https://b.example/dns-query" {
+		t.Errorf("unexpected group %v: %v", name, upstreams)
+	}
+	for _, s := range []string{"gaming", "=https://a.example/dns-query", "gaming="} {
+		if _, _, err := ParseUpstreamGroup(s); err == nil {
+			t.Errorf("%q should be invalid", s)
+		}
+	}
+}
+
+func TestHandler_UpstreamGroup(t *testing.T) {
+	defaultSeen := make(chan *dns.Msg, 8)
+	gamingSeen := make(chan *dns.Msg, 8)
+	defaultProvider, err := NewPlainProvider([]string{startGroupTestServer(t, "192.0.2.1", defaultSeen)}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider, err := NewGroupProvider(defaultProvider,
+		map[string][]string{"gaming": {"udp://" + startGroupTestServer(t, "192.0.2.2", gamingSeen)}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = provider.Close() }()
+	handler := NewHandler(provider, &HandlerOptions{Cache: true, UpstreamGroups: map[string]bool{"gaming": true}})
+
+	query := func(tag string) *dns.Msg {
+		writer := newTestResponseWriter("127.0.0.1:5353")
+		msg := new(dns.Msg)
+		msg.SetQuestion("example.com.", dns.TypeA)
+		if tag != "" {
+			setUpstreamGroupTag(msg, tag)
+		}
+		handler.Handle(writer, msg)
+		rMsg := writer.waitMsg(t, time.Second)
+		time.Sleep(20 * time.Millisecond)
+		if len(rMsg.Answer) != 1 {
+			t.Fatalf("unexpected answer: %v", rMsg)
+		}
+		return rMsg
+	}
+
+	if rMsg := query("gaming"); !rMsg.Answer[0].(*dns.A).A.Equal(net.ParseIP("192.0.2.2")) {
+		t.Errorf("gaming query should be answered by the gaming group, got: %v", rMsg)
+	}
+	if len(gamingSeen) != 1 || len(defaultSeen) != 0 {
+		t.Fatalf("gaming query should be sent to the gaming group only, sent %v and %v",
+			len(gamingSeen), len(defaultSeen))
+	}
+	if tag := upstreamGroupTag(<-gamingSeen); tag != "" {
+		t.Errorf("tag should not be sent upstream, got: %v", tag)
+	}
+
+	for _, tag := range []string{"", "unknown"} {
+		if rMsg := query(tag); !rMsg.Answer[0].(*dns.A).A.Equal(net.ParseIP("192.0.2.1")) {
+			t.Errorf("query tagged %q should be answered by default, got: %v", tag, rMsg)
+		}
+	}
+	if len(defaultSeen) != 1 {
+		t.Errorf("untagged and unknown tagged queries should share the default cache, sent %v", len(defaultSeen))
+	}
+
+	if rMsg := query("gaming"); !rMsg.Answer[0].(*dns.A).A.Equal(net.ParseIP("192.0.2.2")) {
+		t.Errorf("cached gaming answer should be of the gaming group, got: %v", rMsg)
+	}
+	if len(gamingSeen) != 0 {
+		t.Errorf("gaming answer should be cached, sent %v", len(gamingSeen))
+	}
+}
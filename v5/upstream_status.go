@@ -0,0 +1,121 @@
+package dohProxy
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// UpstreamStatus is the state of an endpoint, as served by GET /upstreams.
+type UpstreamStatus struct {
+	Endpoint string `json:"endpoint"`
+	// false if failed consecutively too many times, or the circuit is open.
+	Healthy             bool  `json:"healthy"`
+	ConsecutiveFailures int32 `json:"consecutive_failures"`
+	// "closed", "open" or "half-open", "disabled" without BreakerThreshold.
+	Breaker string `json:"breaker"`
+	// nil if never succeeded.
+	LastSuccess *time.Time `json:"last_success"`
+	// of the last successful query.
+	LatencyMs float64 `json:"latency_ms"`
+}
+
+// UpstreamStatuser is implemented by providers reporting the state of their
+// endpoints.
+type UpstreamStatuser interface {
+	UpstreamStatuses() []UpstreamStatus
+}
+
+// observeSuccess records a successful query of u taking latency.
+func (u *upstream) observeSuccess(now time.Time, latency time.Duration) {
+	atomic.StoreInt64(&u.lastSuccess, now.UnixNano())
+	atomic.StoreInt64(&u.latency, int64(latency))
+}
+
+// state returns the state of the breaker at now.
+func (b *upstreamBreaker) state(now time.Time) string {
+	openUntil := atomic.LoadInt64(&b.openUntil)
+	switch {
+	case openUntil == 0:
+		return "closed"
+	case now.UnixNano() < openUntil:
+		return "open"
+	default:
+		return "half-open"
+	}
+}
+
+// UpstreamStatuses returns the state of the endpoints in configured order.
+func (provider DMProvider) UpstreamStatuses() []UpstreamStatus {
+	now := time.Now()
+	statuses := make([]UpstreamStatus, 0, len(provider.upstreams))
+	for _, u := range provider.upstreams {
+		status := UpstreamStatus{
+			Endpoint:            u.endpoint,
+			ConsecutiveFailures: atomic.LoadInt32(&u.failures),
+			Breaker:             "disabled",
+			LatencyMs:           float64(atomic.LoadInt64(&u.latency)) / float64(time.Millisecond),
+		}
+		if provider.opts.BreakerThreshold > 0 {
+			status.Breaker = u.breaker.state(now)
+		}
+		status.Healthy = status.ConsecutiveFailures < maxConsecutiveFailures && status.Breaker != "open"
+		if lastSuccess := atomic.LoadInt64(&u.lastSuccess); lastSuccess != 0 {
+			t := time.Unix(0, lastSuccess)
+			status.LastSuccess = &t
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// UpstreamStatuses returns the state of the endpoints of the default provider
+// and the routes, each endpoint once.
+func (provider *RouteProvider) UpstreamStatuses() []UpstreamStatus {
+	return collectUpstreamStatuses(provider.defaultProvider, provider.routes)
+}
+
+// UpstreamStatuses returns the state of the endpoints of the default provider
+// and the groups, each endpoint once.
+func (provider *GroupProvider) UpstreamStatuses() []UpstreamStatus {
+	return collectUpstreamStatuses(provider.defaultProvider, provider.groups)
+}
+
+// UpstreamStatuses returns the state of the endpoints of the validated
+// provider.
+func (provider *DNSSECProvider) UpstreamStatuses() []UpstreamStatus {
+	return upstreamStatuses(provider.provider)
+}
+
+// upstreamStatuses returns the state of the endpoints of provider, nil if it
+// doesn't report them.
+func upstreamStatuses(provider Provider) []UpstreamStatus {
+	if p, ok := provider.(UpstreamStatuser); ok {
+		return p.UpstreamStatuses()
+	}
+	return nil
+}
+
+// collectUpstreamStatuses returns the states of defaultProvider and providers
+// by name, a shared endpoint is reported once.
+func collectUpstreamStatuses(defaultProvider Provider, providers map[string]Provider) []UpstreamStatus {
+	statuses := upstreamStatuses(defaultProvider)
+	names := make([]string, 0, len(providers))
+	for name := range providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	seen := make(map[string]bool)
+	for _, status := range statuses {
+		seen[status.Endpoint] = true
+	}
+	for _, name := range names {
+		for _, status := range upstreamStatuses(providers[name]) {
+			if !seen[status.Endpoint] {
+				seen[status.Endpoint] = true
+				statuses = append(statuses, status)
+			}
+		}
+	}
+	return statuses
+}
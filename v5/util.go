@@ -26,7 +26,7 @@ func NewLogger()*logrus.Logger{
 	defaultTextFormatter := logrus.TextFormatter{}
 	_, _ = defaultTextFormatter.Format(&logrus.Entry{Logger: logrus.New()})
 	isColoredLog := defaultTextFormatter.IsColored()
-	log.SetFormatter(&zt_formatter.ZtFormatter{
+	log.SetFormatter(&componentLevelFormatter{Formatter: &zt_formatter.ZtFormatter{
 		CallerPrettyfier: func(f *runtime.Frame) (string, string) {
 			filename := path.Base(f.File)
 			return fmt.Sprintf("%s()", f.Function), fmt.Sprintf("%s:%d", filename, f.Line)
@@ -36,7 +36,7 @@ func NewLogger()*logrus.Logger{
 			NoColors: !isColoredLog,
 			NoFieldsColors: !isColoredLog,
 		},
-	})
+	}})
 	return log
 }
 func GenerateUrlSafeString(n int) string {
@@ -67,6 +67,35 @@ func CSVtoIPs(csv string) (ips []net.IP, err error) {
 	return
 }
 
+// CSVtoIPNets parses the comma separated CIDRs, single ips are taken as /32 or
+// /128 networks.
+func CSVtoIPNets(csv string) (ipNets []*net.IPNet, err error) {
+	for _, r := range strings.Split(csv, ",") {
+		r = strings.TrimSpace(r)
+		if r == "" {
+			continue
+		}
+		if !strings.Contains(r, "/") {
+			ip := net.ParseIP(r)
+			if ip == nil {
+				return ipNets, fmt.Errorf("unable to parse IP from string %s", r)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			ipNets = append(ipNets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(r)
+		if err != nil {
+			return ipNets, fmt.Errorf("unable to parse CIDR from string %s", r)
+		}
+		ipNets = append(ipNets, ipNet)
+	}
+	return
+}
+
 type KeyValue map[string][]string
 
 func (k KeyValue) Set(kv string) error {
@@ -85,6 +114,36 @@ func (k KeyValue) Set(kv string) error {
 	return nil
 }
 
+// Reset removes all keys in place, so the flag holding k keeps working.
+func (k KeyValue) Reset() {
+	for key := range k {
+		delete(k, key)
+	}
+}
+
+// UnmarshalYAML accepts both a single value and a list of values per key,
+// values are merged into the existing map in place.
+func (k *KeyValue) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var raw map[string]interface{}
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+	if *k == nil {
+		*k = make(KeyValue)
+	}
+	for key, v := range raw {
+		switch vs := v.(type) {
+		case []interface{}:
+			for _, v := range vs {
+				(*k)[key] = append((*k)[key], fmt.Sprintf("%v", v))
+			}
+		default:
+			(*k)[key] = append((*k)[key], fmt.Sprintf("%v", vs))
+		}
+	}
+	return nil
+}
+
 func (k KeyValue) String() string {
 	var s []string
 	for k, vs := range k {
@@ -96,6 +155,39 @@ func (k KeyValue) String() string {
 	return strings.Join(s, " ")
 }
 
+// StringList is a flag value which can be specified multiple times.
+type StringList []string
+
+func (l *StringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// Reset removes all values, so values on command line replace the ones in
+// config file.
+func (l *StringList) Reset() {
+	*l = (*l)[:0]
+}
+
+// UnmarshalYAML accepts both a single value and a list of values.
+func (l *StringList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var vs []string
+	if err := unmarshal(&vs); err == nil {
+		*l = vs
+		return nil
+	}
+	var v string
+	if err := unmarshal(&v); err != nil {
+		return err
+	}
+	*l = StringList{v}
+	return nil
+}
+
+func (l StringList) String() string {
+	return strings.Join(l, ",")
+}
+
 func IsLocalListen(addr string) bool {
 	localNets := []string{
 		"127.0.0.1",
@@ -130,6 +222,59 @@ func ObtainEDN0Subnet(msg *dns.Msg) (edns0Subnet dns.EDNS0_SUBNET) {
 	return dns.EDNS0_SUBNET{}
 }
 
+// rotateAddressRecords rotates the A and AAAA records in the answer section of
+// msg by n positions, records of each type stay in the positions they took.
+func rotateAddressRecords(msg *dns.Msg, n uint32) {
+	for _, t := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		var positions []int
+		var records []dns.RR
+		for i, rr := range msg.Answer {
+			if rr.Header().Rrtype == t {
+				positions = append(positions, i)
+				records = append(records, rr)
+			}
+		}
+		if len(records) < 2 {
+			continue
+		}
+		offset := int(n % uint32(len(records)))
+		for i, pos := range positions {
+			msg.Answer[pos] = records[(i+offset)%len(records)]
+		}
+	}
+}
+
+// hasEDNS0Subnet reports whether msg carries an edns0-client-subnet option.
+func hasEDNS0Subnet(msg *dns.Msg) bool {
+	return ObtainEDN0Subnet(msg).Code == dns.EDNS0SUBNET
+}
+
+// RemoveEDNS0Subnet removes the edns0-client-subnet option from msg.
+func RemoveEDNS0Subnet(msg *dns.Msg) {
+	edns0 := msg.IsEdns0()
+	if edns0 == nil {
+		return
+	}
+	var options []dns.EDNS0
+	for _, o := range edns0.Option {
+		if _, ok := o.(*dns.EDNS0_SUBNET); !ok {
+			options = append(options, o)
+		}
+	}
+	edns0.Option = options
+}
+
+// answerEDNS0Subnet returns subnet of the client for the answer msg, with the
+// scope prefix length of the edns0-client-subnet in msg, RFC 7871 section 7.2.2;
+// the source prefix length if msg has none, so the answer is kept to the subnet.
+func answerEDNS0Subnet(msg *dns.Msg, subnet dns.EDNS0_SUBNET) dns.EDNS0_SUBNET {
+	subnet.SourceScope = subnet.SourceNetmask
+	if answered := ObtainEDN0Subnet(msg); answered.Code == dns.EDNS0SUBNET {
+		subnet.SourceScope = answered.SourceScope
+	}
+	return subnet
+}
+
 func ReplaceEDNS0Subnet(msg *dns.Msg, subnet *dns.EDNS0_SUBNET) {
 	var edns0 = msg.IsEdns0()
 	if edns0 != nil {
@@ -193,3 +193,25 @@ func track(s string, startTime time.Time) {
 	endTime := time.Now()
 	fmt.Printf("End %v took: %v\n", s, endTime.Sub(startTime))
 }
+
+func TestCSVtoIPNets(t *testing.T) {
+	ipNets, err := CSVtoIPNets("10.0.0.0/8, 192.168.1.1,2001:db8::/32,::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"10.0.0.0/8", "192.168.1.1/32", "2001:db8::/32", "::1/128"}
+	if len(ipNets) != len(expected) {
+		t.Fatalf("expected %v, got: %v", expected, ipNets)
+	}
+	for i, ipNet := range ipNets {
+		if ipNet.String() != expected[i] {
+			t.Errorf("expected %v, got: %v", expected[i], ipNet)
+		}
+	}
+	if _, err := CSVtoIPNets("10.0.0.0/33"); err == nil {
+		t.Errorf("expected error for invalid CIDR")
+	}
+	if ipNets, err := CSVtoIPNets(""); err != nil || len(ipNets) != 0 {
+		t.Errorf("expected no networks, got: %v, %v", ipNets, err)
+	}
+}